@@ -2,34 +2,219 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/ingemar0720/voucher-pool/codegen"
+	"github.com/ingemar0720/voucher-pool/codepool"
+	"github.com/ingemar0720/voucher-pool/config"
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/ingemar0720/voucher-pool/logging"
+	"github.com/ingemar0720/voucher-pool/metrics"
 	voucher "github.com/ingemar0720/voucher-pool/service"
+	"github.com/ingemar0720/voucher-pool/tracing"
+	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 )
 
 func main() {
+	configFile := flag.String("config", os.Getenv(config.EnvFile), "YAML config file, the environment overrides its settings")
+	inMemory := flag.Bool("memory", false, "run with an in-memory store seeded with 10 customers instead of postgres")
+	flag.Parse()
 	fmt.Println("hellow voucher service")
-	db, err := voucher.New()
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal(errors.Wrapf(err, "fail to load config"))
+	}
+	if *inMemory {
+		cfg.Features.MemoryStore = true
+	}
+	logger, err := logging.New(os.Stdout, cfg.Log)
 	if err != nil {
-		log.Fatal(errors.Wrapf(err, "fail to init a DB instance"))
+		log.Fatal(errors.Wrapf(err, "fail to init the logger"))
 	}
+	lg := logger.For(context.Background())
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	srv := voucher.VoucherSrv{DB: db, Ctx: ctx}
+	m := metrics.New()
+	tracer, err := tracing.New(ctx, cfg.Tracing)
+	if err != nil {
+		lg.Fatal().Err(err).Msg("fail to init the tracer")
+	}
+	var store dbmodel.VoucherStore
+	var db *sqlx.DB
+	if cfg.Features.MemoryStore {
+		store = dbmodel.NewMemoryStore()
+		seeder := voucher.VoucherSrv{Store: store, Ctx: ctx}
+		for i := 0; i < 10; i++ {
+			if _, err := seeder.RegisterCustomer(ctx, fmt.Sprintf("customer %v", i), fmt.Sprintf("customer%v@gmail.com", i)); err != nil {
+				lg.Fatal().Err(err).Msg("fail to seed customers")
+			}
+		}
+	} else {
+		db, err = voucher.New(cfg.DB)
+		if err != nil {
+			lg.Fatal().Err(err).Msg("fail to init a DB instance")
+		}
+		pg := dbmodel.NewPostgresStore(db)
+		// the span of the operation is started first, the other hooks run within it
+		pg.Use(tracer.QueryHook())
+		pg.Use(m.QueryHook())
+		pg.Use(logger.QueryHook())
+		m.RegisterDB(db.DB, "voucher")
+		store = pg
+	}
+
+	gen, err := codegen.New(cfg.CodeGen)
+	if err != nil {
+		lg.Fatal().Err(err).Msg("fail to init the code generator")
+	}
+	// background goroutines stop when ctx is cancelled, the DB pool is closed once they are done
+	var background sync.WaitGroup
+	var codeGen codegen.CodeGenerator = gen
+	if cfg.Features.CodePool {
+		// pre-generate codes in the background, the pool stops refilling when ctx is cancelled
+		pool, err := codepool.New(gen, cfg.CodePool)
+		if err != nil {
+			lg.Fatal().Err(err).Msg("fail to init the code pool")
+		}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			if err := pool.Run(ctx); err != nil && err != context.Canceled {
+				lg.Error().Err(err).Msg("code pool stopped")
+			}
+		}()
+		m.RegisterCodePool(pool.Stats)
+		codeGen = pool
+	}
+
+	srv := voucher.VoucherSrv{
+		Store:            store,
+		Ctx:              ctx,
+		CodeGen:          codeGen,
+		CodeAttempts:     cfg.Vouchers.CodeAttempts,
+		BulkBatchSize:    cfg.Vouchers.BulkBatchSize,
+		ReservationTTL:   cfg.Vouchers.ReservationTTL,
+		IdempotencyTTL:   cfg.Vouchers.IdempotencyTTL,
+		IdempotencyLease: cfg.Vouchers.IdempotencyLease,
+		ReadinessTimeout: cfg.HTTP.ReadinessTimeout,
+		Metrics:          m,
+		Log:              logger,
+	}
+	if cfg.Features.Sweeper {
+		interval := cfg.Vouchers.SweepInterval
+		if interval == 0 {
+			interval = voucher.DefaultSweepInterval
+		}
+		// release expired reservations in the background
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			if err := srv.RunReservationSweeper(ctx, interval); err != nil && err != context.Canceled {
+				lg.Error().Err(err).Msg("reservation sweeper stopped")
+			}
+		}()
+	}
+	idempotent := func(next http.Handler) http.Handler { return next }
+	if cfg.Features.Idempotency {
+		idempotent = srv.Idempotent
+	}
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
-	r.Use(middleware.Timeout(60 * time.Second))
-	r.Use(middleware.Logger)
-	r.Post("/vouchers/validate", srv.ValidateHanlder)
-	r.Post("/vouchers/generate", srv.GenerateHanlder)
+	r.Use(tracer.Middleware)
+	r.Use(m.Middleware)
+	r.Use(logger.Middleware)
+	r.Use(middleware.Recoverer)
+	r.Use(middleware.Timeout(cfg.HTTP.RequestTimeout))
+	r.With(idempotent).Post("/vouchers/validate", srv.ValidateHanlder)
+	r.Post("/vouchers/quote", srv.QuoteHandler)
+	r.Post("/vouchers/redeem", srv.RedeemCodesHandler)
+	r.Post("/vouchers/reserve", srv.ReserveHandler)
+	r.Post("/vouchers/confirm", srv.ConfirmHandler)
+	r.Post("/vouchers/release", srv.ReleaseHandler)
+	r.Post("/vouchers/reverse", srv.ReverseHandler)
+	r.Get("/vouchers/{code}/redemptions", srv.GetRedemptionsHandler)
+	r.With(idempotent).Post("/vouchers/generate", srv.GenerateHanlder)
+	r.Post("/vouchers/generate/bulk", srv.BulkGenerateHandler)
+	r.Get("/vouchers/generate/bulk/{jobID}", srv.GetBulkJobHandler)
 	r.Get("/vouchers", srv.GetValidVouchers)
-	log.Fatal(http.ListenAndServe(":5000", r))
+	r.Post("/customers", srv.CreateCustomerHandler)
+	r.Get("/customers", srv.ListCustomersHandler)
+	r.Get("/customers/{id}", srv.GetCustomerHandler)
+	r.Put("/customers/{id}", srv.UpdateCustomerHandler)
+	r.Delete("/customers/{id}", srv.DeleteCustomerHandler)
+	r.Get("/customers/{id}/export", srv.ExportCustomerHandler)
+	r.Post("/customers/{id}/erase", srv.EraseCustomerHandler)
+	r.Post("/offers", srv.CreateOfferHandler)
+	r.Get("/offers", srv.ListOffersHandler)
+	r.Get("/offers/{id}", srv.GetOfferHandler)
+	r.Put("/offers/{id}", srv.UpdateOfferHandler)
+	r.Delete("/offers/{id}", srv.ArchiveOfferHandler)
+	r.Get("/offers/{id}/versions", srv.GetOfferHistoryHandler)
+	r.Get("/healthz", srv.HealthzHandler)
+	r.Get("/readyz", srv.ReadyzHandler)
+	r.Handle("/metrics", m.Handler())
+	server := &http.Server{
+		Addr:         cfg.HTTP.Addr,
+		Handler:      r,
+		ReadTimeout:  cfg.HTTP.ReadTimeout,
+		WriteTimeout: cfg.HTTP.WriteTimeout,
+		IdleTimeout:  cfg.HTTP.IdleTimeout,
+	}
+	lg.Info().Str("addr", cfg.HTTP.Addr).Msg("voucher service started")
+	if err := serve(server, cfg.HTTP.ShutdownTimeout, lg); err != nil {
+		lg.Error().Err(err).Msg("voucher service failed")
+	}
+	cancel()
+	background.Wait()
+	srv.WaitBulkJobs()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+	if err := tracer.Shutdown(shutdownCtx); err != nil {
+		lg.Error().Err(err).Msg("fail to export the remaining spans")
+	}
+	cancelShutdown()
+	if db != nil {
+		if err := db.Close(); err != nil {
+			lg.Error().Err(err).Msg("fail to close the DB pool")
+		}
+	}
+	lg.Info().Msg("voucher service stopped")
+}
+
+// serve runs server until SIGINT or SIGTERM, then stops accepting connections and waits up to timeout for the
+// in-flight requests to finish
+func serve(server *http.Server, timeout time.Duration, lg *zerolog.Logger) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		return errors.Wrapf(err, "fail to serve")
+	case sig := <-stop:
+		lg.Info().Str("signal", sig.String()).Msg("draining requests")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return errors.Wrapf(err, "fail to drain requests")
+	}
+	return nil
 }
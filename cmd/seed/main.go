@@ -1,28 +1,33 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"os"
 
+	"github.com/ingemar0720/voucher-pool/config"
+	"github.com/ingemar0720/voucher-pool/dbmodel"
 	voucher "github.com/ingemar0720/voucher-pool/service"
 	"github.com/pkg/errors"
 )
 
 func main() {
-	db, err := voucher.New()
+	cfg, err := config.Load(os.Getenv(config.EnvFile))
 	if err != nil {
-		log.Fatal(errors.Wrapf(err, "fail to init a DB instance"))
+		log.Fatal(errors.Wrapf(err, "fail to load config"))
 	}
-	tx, err := db.Beginx()
+	db, err := voucher.New(cfg.DB)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(errors.Wrapf(err, "fail to init a DB instance"))
 	}
+	// customers are registered through the service so they are validated and normalized like the ones of the API
+	srv := voucher.VoucherSrv{Store: dbmodel.NewPostgresStore(db), Ctx: context.Background()}
+	// customers seeded by a previous run are kept, so the go service can depend on the seed completing
 	for i := 0; i < 10; i++ {
-		_, err = tx.Exec("INSERT INTO customers (name, email) VALUES ($1, $2)", fmt.Sprintf("customer %v", i), fmt.Sprintf("customer%v@gmail.com", i))
-		if err != nil {
-			tx.Rollback()
+		_, err = srv.RegisterCustomer(srv.Ctx, fmt.Sprintf("customer %v", i), fmt.Sprintf("customer%v@gmail.com", i))
+		if err != nil && !errors.Is(err, dbmodel.ErrCustomerConflict) {
 			log.Fatal(err)
 		}
 	}
-	tx.Commit()
 }
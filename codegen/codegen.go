@@ -0,0 +1,159 @@
+package codegen
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Letters is the alphabet of the codes generated so far, lower and upper case ASCII letters
+	Letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	// Unambiguous is upper case letters and digits without the ones easily mixed up when read or typed, 0/O and 1/I
+	Unambiguous = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+// DefaultConfig generates 8 letters codes
+var DefaultConfig = Config{Length: 8, Alphabet: Letters}
+
+// CodeGenerator generates voucher codes
+type CodeGenerator interface {
+	Generate() (string, error)
+}
+
+// Config describes the format of the codes, e.g. {Length: 8, Alphabet: Unambiguous, Prefix: "KOI-", GroupSize: 4, CheckDigit: true}
+// generates codes like KOI-XM4K-PQ7T-A
+type Config struct {
+	// number of random characters, the check digit is not counted
+	Length   int    `yaml:"length"`
+	Alphabet string `yaml:"alphabet"`
+	Prefix   string `yaml:"prefix"`
+	Suffix   string `yaml:"suffix"`
+	// insert a dash after every GroupSize characters of the random part, 0 disables grouping
+	GroupSize int `yaml:"group_size"`
+	// append a Luhn mod N check character computed over the random part
+	CheckDigit bool `yaml:"check_digit"`
+}
+
+// Generator is a CodeGenerator backed by crypto/rand, it is safe for concurrent use
+type Generator struct {
+	cfg Config
+	max *big.Int
+}
+
+func New(cfg Config) (*Generator, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &Generator{cfg: cfg, max: big.NewInt(int64(len(cfg.Alphabet)))}, nil
+}
+
+// Validate returns why codes cannot be generated with cfg, nil if they can
+func (cfg Config) Validate() error {
+	if cfg.Length <= 0 {
+		return errors.Errorf("code length shall be positive, got %v", cfg.Length)
+	}
+	if len(cfg.Alphabet) < 2 {
+		return errors.Errorf("code alphabet shall have at least 2 characters, got %q", cfg.Alphabet)
+	}
+	seen := map[rune]bool{}
+	for _, c := range cfg.Alphabet {
+		if c > 127 || c == '-' {
+			return errors.Errorf("code alphabet shall only have ASCII characters other than '-', got %q", c)
+		}
+		if seen[c] {
+			return errors.Errorf("code alphabet shall not repeat characters, got %q twice", c)
+		}
+		seen[c] = true
+	}
+	// Luhn mod N only detects every single character typo when N is even
+	if cfg.CheckDigit && len(cfg.Alphabet)%2 != 0 {
+		return errors.Errorf("check digit requires an alphabet of even size, got %v characters", len(cfg.Alphabet))
+	}
+	if cfg.GroupSize < 0 {
+		return errors.Errorf("code group size shall not be negative, got %v", cfg.GroupSize)
+	}
+	return nil
+}
+
+// MustNew is like New but panics on invalid config
+func MustNew(cfg Config) *Generator {
+	g, err := New(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+func (g *Generator) Generate() (string, error) {
+	b := make([]byte, g.cfg.Length, g.cfg.Length+1)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, g.max)
+		if err != nil {
+			return "", errors.Wrapf(err, "fail to read random number")
+		}
+		b[i] = g.cfg.Alphabet[n.Int64()]
+	}
+	if g.cfg.CheckDigit {
+		b = append(b, checkCharacter(g.cfg.Alphabet, b))
+	}
+	return g.cfg.Prefix + group(b, g.cfg.GroupSize) + g.cfg.Suffix, nil
+}
+
+// Verify reports whether code has the format of the config, including a valid check character if enabled
+func (g *Generator) Verify(code string) bool {
+	if !strings.HasPrefix(code, g.cfg.Prefix) || !strings.HasSuffix(code, g.cfg.Suffix) || len(code) < len(g.cfg.Prefix)+len(g.cfg.Suffix) {
+		return false
+	}
+	body := code[len(g.cfg.Prefix) : len(code)-len(g.cfg.Suffix)]
+	want := g.cfg.Length
+	if g.cfg.CheckDigit {
+		want++
+	}
+	b := []byte(strings.Replace(body, "-", "", -1))
+	if len(b) != want || group(b, g.cfg.GroupSize) != body {
+		return false
+	}
+	for _, c := range b {
+		if strings.IndexByte(g.cfg.Alphabet, c) < 0 {
+			return false
+		}
+	}
+	if g.cfg.CheckDigit {
+		return checkCharacter(g.cfg.Alphabet, b[:len(b)-1]) == b[len(b)-1]
+	}
+	return true
+}
+
+func group(b []byte, size int) string {
+	if size <= 0 || len(b) <= size {
+		return string(b)
+	}
+	var sb strings.Builder
+	for i, c := range b {
+		if i > 0 && i%size == 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// checkCharacter computes the Luhn mod N check character of b, https://en.wikipedia.org/wiki/Luhn_mod_N_algorithm
+func checkCharacter(alphabet string, b []byte) byte {
+	n := len(alphabet)
+	factor := 2
+	sum := 0
+	for i := len(b) - 1; i >= 0; i-- {
+		addend := factor * strings.IndexByte(alphabet, b[i])
+		if factor == 2 {
+			factor = 1
+		} else {
+			factor = 2
+		}
+		sum += addend/n + addend%n
+	}
+	return alphabet[(n-sum%n)%n]
+}
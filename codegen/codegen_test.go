@@ -0,0 +1,109 @@
+package codegen
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "default config", cfg: DefaultConfig},
+		{name: "zero length", cfg: Config{Alphabet: Letters}, wantErr: true},
+		{name: "single character alphabet", cfg: Config{Length: 8, Alphabet: "a"}, wantErr: true},
+		{name: "repeated character", cfg: Config{Length: 8, Alphabet: "abca"}, wantErr: true},
+		{name: "dash in alphabet", cfg: Config{Length: 8, Alphabet: "ab-"}, wantErr: true},
+		{name: "check digit with odd alphabet", cfg: Config{Length: 8, Alphabet: "abc", CheckDigit: true}, wantErr: true},
+		{name: "negative group size", cfg: Config{Length: 8, Alphabet: Letters, GroupSize: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg)
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantLen int
+	}{
+		{name: "default config", cfg: DefaultConfig, wantLen: 8},
+		{name: "prefix and suffix", cfg: Config{Length: 6, Alphabet: Unambiguous, Prefix: "KOI-", Suffix: "-21"}, wantLen: 13},
+		{name: "grouping", cfg: Config{Length: 12, Alphabet: Unambiguous, GroupSize: 4}, wantLen: 14},
+		{name: "check digit", cfg: Config{Length: 8, Alphabet: Unambiguous, CheckDigit: true}, wantLen: 9},
+		{name: "everything", cfg: Config{Length: 8, Alphabet: Unambiguous, Prefix: "KOI-", GroupSize: 3, CheckDigit: true}, wantLen: 4 + 9 + 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := MustNew(tt.cfg)
+			for i := 0; i < 100; i++ {
+				code, err := g.Generate()
+				require.Nil(t, err)
+				assert.Len(t, code, tt.wantLen)
+				assert.True(t, strings.HasPrefix(code, tt.cfg.Prefix))
+				assert.True(t, strings.HasSuffix(code, tt.cfg.Suffix))
+				body := strings.TrimSuffix(strings.TrimPrefix(code, tt.cfg.Prefix), tt.cfg.Suffix)
+				for _, c := range strings.Replace(body, "-", "", -1) {
+					assert.Contains(t, tt.cfg.Alphabet, string(c))
+				}
+				assert.True(t, g.Verify(code), code)
+			}
+		})
+	}
+}
+
+func TestVerifyCheckDigit(t *testing.T) {
+	g := MustNew(Config{Length: 8, Alphabet: Unambiguous, GroupSize: 3, CheckDigit: true})
+	code, err := g.Generate()
+	require.Nil(t, err)
+	assert.True(t, g.Verify(code))
+
+	// any single substituted character shall be detected
+	for i := range code {
+		if code[i] == '-' {
+			continue
+		}
+		for _, c := range []byte(Unambiguous) {
+			if c == code[i] {
+				continue
+			}
+			typo := code[:i] + string(c) + code[i+1:]
+			assert.False(t, g.Verify(typo), typo)
+		}
+	}
+	assert.False(t, g.Verify(strings.Replace(code, "-", "", -1)))
+	assert.False(t, g.Verify(code[1:]))
+}
+
+func TestGenerateConcurrently(t *testing.T) {
+	g := MustNew(DefaultConfig)
+	const workers, perWorker = 8, 500
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seen := map[string]bool{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				code, err := g.Generate()
+				assert.Nil(t, err)
+				mu.Lock()
+				seen[code] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, seen, workers*perWorker)
+}
@@ -0,0 +1,154 @@
+package codepool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ingemar0720/voucher-pool/codegen"
+	"github.com/pkg/errors"
+)
+
+// DefaultConfig keeps up to 1000 codes and refills when less than 250 are left
+var DefaultConfig = Config{Size: 1000, LowWater: 250}
+
+type Config struct {
+	// number of codes kept in the pool
+	Size int `yaml:"size"`
+	// the pool is refilled to Size when it holds less than LowWater codes
+	LowWater int `yaml:"low_water"`
+}
+
+// Validate returns why a pool cannot be run with cfg, nil if it can
+func (cfg Config) Validate() error {
+	if cfg.Size <= 0 {
+		return errors.Errorf("code pool size shall be positive, got %v", cfg.Size)
+	}
+	if cfg.LowWater < 0 || cfg.LowWater >= cfg.Size {
+		return errors.Errorf("code pool low water mark shall be in [0, %v), got %v", cfg.Size, cfg.LowWater)
+	}
+	return nil
+}
+
+// Stats is a snapshot of the pool metrics
+type Stats struct {
+	Depth    int `json:"depth"`
+	Size     int `json:"size"`
+	LowWater int `json:"low_water"`
+	// codes handed out from the pool
+	Served uint64 `json:"served"`
+	// codes generated on demand because the pool was empty
+	Misses uint64 `json:"misses"`
+	// codes generated by the refill goroutine
+	Generated uint64 `json:"generated"`
+	// generated codes dropped because they were already in the pool
+	Duplicates uint64 `json:"duplicates"`
+}
+
+// Pool keeps a buffer of pre-generated unique codes, it implements codegen.CodeGenerator so it can replace
+// the generator of the service. Codes are generated in the goroutine of Run, when the pool is drained
+// Generate falls back to generate the code on demand.
+type Pool struct {
+	gen    codegen.CodeGenerator
+	cfg    Config
+	codes  chan string
+	refill chan struct{}
+
+	mu     sync.Mutex
+	pooled map[string]struct{}
+
+	served     uint64
+	misses     uint64
+	generated  uint64
+	duplicates uint64
+}
+
+func New(gen codegen.CodeGenerator, cfg Config) (*Pool, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &Pool{
+		gen:    gen,
+		cfg:    cfg,
+		codes:  make(chan string, cfg.Size),
+		refill: make(chan struct{}, 1),
+		pooled: make(map[string]struct{}, cfg.Size),
+	}, nil
+}
+
+// Run fills the pool and refills it whenever it drops below the low water mark, until ctx is done.
+// It shall be called once, usually in its own goroutine.
+func (p *Pool) Run(ctx context.Context) error {
+	for {
+		if err := p.fill(ctx); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.refill:
+		}
+	}
+}
+
+func (p *Pool) fill(ctx context.Context) error {
+	for len(p.codes) < p.cfg.Size {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		code, err := p.gen.Generate()
+		if err != nil {
+			return errors.Wrapf(err, "fail to refill code pool")
+		}
+		atomic.AddUint64(&p.generated, 1)
+		p.mu.Lock()
+		if _, ok := p.pooled[code]; ok {
+			p.mu.Unlock()
+			atomic.AddUint64(&p.duplicates, 1)
+			continue
+		}
+		p.pooled[code] = struct{}{}
+		p.mu.Unlock()
+		// only Run sends to codes, so the buffer cannot be full here
+		p.codes <- code
+	}
+	return nil
+}
+
+// Generate hands out a code of the pool, or generates one if the pool is empty
+func (p *Pool) Generate() (string, error) {
+	select {
+	case code := <-p.codes:
+		p.mu.Lock()
+		delete(p.pooled, code)
+		p.mu.Unlock()
+		atomic.AddUint64(&p.served, 1)
+		if len(p.codes) < p.cfg.LowWater {
+			p.signalRefill()
+		}
+		return code, nil
+	default:
+		atomic.AddUint64(&p.misses, 1)
+		p.signalRefill()
+		return p.gen.Generate()
+	}
+}
+
+func (p *Pool) signalRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Pool) Stats() Stats {
+	return Stats{
+		Depth:      len(p.codes),
+		Size:       p.cfg.Size,
+		LowWater:   p.cfg.LowWater,
+		Served:     atomic.LoadUint64(&p.served),
+		Misses:     atomic.LoadUint64(&p.misses),
+		Generated:  atomic.LoadUint64(&p.generated),
+		Duplicates: atomic.LoadUint64(&p.duplicates),
+	}
+}
@@ -0,0 +1,145 @@
+package codepool
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/codegen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// counterCodeGen generates code-1, code-2, ...
+type counterCodeGen struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (g *counterCodeGen) Generate() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.n++
+	return fmt.Sprintf("code-%v", g.n), nil
+}
+
+// repeatCodeGen generates the same code every other call
+type repeatCodeGen struct {
+	counterCodeGen
+	calls int
+}
+
+func (g *repeatCodeGen) Generate() (string, error) {
+	g.calls++
+	if g.calls%2 == 0 {
+		return "code-1", nil
+	}
+	return g.counterCodeGen.Generate()
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(&counterCodeGen{}, Config{Size: 0})
+	assert.NotNil(t, err)
+	_, err = New(&counterCodeGen{}, Config{Size: 10, LowWater: 10})
+	assert.NotNil(t, err)
+	_, err = New(&counterCodeGen{}, Config{Size: 10, LowWater: -1})
+	assert.NotNil(t, err)
+	_, err = New(&counterCodeGen{}, DefaultConfig)
+	assert.Nil(t, err)
+}
+
+func waitForDepth(t *testing.T, p *Pool, depth int) {
+	assert.Eventually(t, func() bool { return p.Stats().Depth == depth }, time.Second, time.Millisecond)
+}
+
+func TestRunFillsAndRefills(t *testing.T) {
+	p, err := New(&counterCodeGen{}, Config{Size: 10, LowWater: 5})
+	require.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+	waitForDepth(t, p, 10)
+
+	// draining down to the low water mark does not refill
+	for i := 0; i < 5; i++ {
+		_, err := p.Generate()
+		assert.Nil(t, err)
+	}
+	assert.EqualValues(t, 5, p.Stats().Depth)
+	// dropping below it does
+	_, err = p.Generate()
+	assert.Nil(t, err)
+	waitForDepth(t, p, 10)
+
+	stats := p.Stats()
+	assert.EqualValues(t, 6, stats.Served)
+	assert.EqualValues(t, 16, stats.Generated)
+	assert.EqualValues(t, 0, stats.Misses)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Run did not return after cancel")
+	}
+}
+
+func TestGenerateFallsBackWhenEmpty(t *testing.T) {
+	p, err := New(&counterCodeGen{}, Config{Size: 10, LowWater: 5})
+	require.Nil(t, err)
+	code, err := p.Generate()
+	assert.Nil(t, err)
+	assert.Equal(t, "code-1", code)
+	assert.EqualValues(t, 1, p.Stats().Misses)
+}
+
+func TestPoolCodesAreUnique(t *testing.T) {
+	p, err := New(&repeatCodeGen{}, Config{Size: 10, LowWater: 5})
+	require.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+	waitForDepth(t, p, 10)
+	assert.NotZero(t, p.Stats().Duplicates)
+
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		code, err := p.Generate()
+		require.Nil(t, err)
+		assert.False(t, seen[code], code)
+		seen[code] = true
+	}
+}
+
+func TestGenerateConcurrently(t *testing.T) {
+	p, err := New(codegen.MustNew(codegen.DefaultConfig), Config{Size: 100, LowWater: 50})
+	require.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+
+	const workers, perWorker = 8, 200
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seen := map[string]bool{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				code, err := p.Generate()
+				assert.Nil(t, err)
+				mu.Lock()
+				seen[code] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, seen, workers*perWorker)
+	stats := p.Stats()
+	assert.EqualValues(t, workers*perWorker, stats.Served+stats.Misses)
+}
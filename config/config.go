@@ -0,0 +1,277 @@
+// Package config loads the settings of the voucher service from an optional YAML file and the environment, so the
+// same binary runs in docker-compose, CI and production.
+package config
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/codegen"
+	"github.com/ingemar0720/voucher-pool/codepool"
+	"github.com/ingemar0720/voucher-pool/logging"
+	"github.com/ingemar0720/voucher-pool/tracing"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EnvFile names the YAML file Load reads if no path is given
+	EnvFile = "VOUCHER_CONFIG"
+	// EnvTestDSN is the database of the integration tests
+	EnvTestDSN = "VOUCHER_TEST_DB_DSN"
+	// the database started by docker-compose
+	defaultDSN     = "postgres://user:mysecretpassword@db:5432/postgres?sslmode=disable"
+	defaultTestDSN = "postgres://user:mysecretpassword@db:5432/postgres_test?sslmode=disable"
+)
+
+// Config of the voucher service. Durations are written like 60s or 15m, in the file and in the environment.
+type Config struct {
+	DB       DB              `yaml:"db"`
+	HTTP     HTTP            `yaml:"http"`
+	Vouchers Vouchers        `yaml:"vouchers"`
+	CodeGen  codegen.Config  `yaml:"codegen"`
+	CodePool codepool.Config `yaml:"codepool"`
+	Features Features        `yaml:"features"`
+	Log      logging.Config  `yaml:"log"`
+	Tracing  tracing.Config  `yaml:"tracing"`
+}
+
+type DB struct {
+	DSN string `yaml:"dsn"`
+	// 0 does not limit the open connections
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+}
+
+type HTTP struct {
+	Addr string `yaml:"addr"`
+	// RequestTimeout cancels the context of a request running longer
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	ReadTimeout    time.Duration `yaml:"read_timeout"`
+	// WriteTimeout shall leave a request RequestTimeout to respond, 0 disables it
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout is how long in-flight requests are waited for on SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// ReadinessTimeout bounds the dependency checks of /readyz
+	ReadinessTimeout time.Duration `yaml:"readiness_timeout"`
+}
+
+// Vouchers tunes the voucher service, 0 keeps the default of VoucherSrv
+type Vouchers struct {
+	ReservationTTL time.Duration `yaml:"reservation_ttl"`
+	IdempotencyTTL time.Duration `yaml:"idempotency_ttl"`
+	// IdempotencyLease shall be longer than the request timeout
+	IdempotencyLease time.Duration `yaml:"idempotency_lease"`
+	SweepInterval    time.Duration `yaml:"sweep_interval"`
+	CodeAttempts     int           `yaml:"code_attempts"`
+	BulkBatchSize    int           `yaml:"bulk_batch_size"`
+}
+
+// Features switch parts of the service on and off
+type Features struct {
+	// keep everything in memory instead of postgres, seeded with 10 customers
+	MemoryStore bool `yaml:"memory_store"`
+	// pre-generate codes in the background instead of per request
+	CodePool bool `yaml:"code_pool"`
+	// honour the Idempotency-Key header on generate and validate
+	Idempotency bool `yaml:"idempotency"`
+	// release expired reservations and idempotency keys in the background
+	Sweeper bool `yaml:"sweeper"`
+}
+
+// Default is the config of docker-compose, Load starts from it
+func Default() Config {
+	return Config{
+		DB: DB{
+			DSN:             defaultDSN,
+			MaxOpenConns:    20,
+			MaxIdleConns:    10,
+			ConnMaxLifetime: 30 * time.Minute,
+		},
+		HTTP: HTTP{
+			Addr:             ":5000",
+			RequestTimeout:   60 * time.Second,
+			ReadTimeout:      15 * time.Second,
+			WriteTimeout:     75 * time.Second,
+			IdleTimeout:      2 * time.Minute,
+			ShutdownTimeout:  30 * time.Second,
+			ReadinessTimeout: 2 * time.Second,
+		},
+		CodeGen:  codegen.DefaultConfig,
+		CodePool: codepool.DefaultConfig,
+		Features: Features{CodePool: true, Idempotency: true, Sweeper: true},
+		Log:      logging.DefaultConfig,
+		Tracing:  tracing.DefaultConfig,
+	}
+}
+
+// Load returns the defaults overridden by the YAML file at path, if path is not empty, and then by the environment
+// variables listed in envVars. The result is validated.
+func Load(path string) (Config, error) {
+	return load(path, os.LookupEnv)
+}
+
+func load(path string, lookupEnv func(string) (string, bool)) (Config, error) {
+	cfg := Default()
+	if path != "" {
+		if err := cfg.readFile(path); err != nil {
+			return Config{}, err
+		}
+	}
+	for _, v := range cfg.envVars() {
+		value, ok := lookupEnv(v.name)
+		if !ok {
+			continue
+		}
+		if err := v.set(value); err != nil {
+			return Config{}, errors.Wrapf(err, "invalid %v", v.name)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// readFile overrides the settings given in the file, unknown settings are rejected to catch typos
+func (cfg *Config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "fail to open config file")
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return errors.Wrapf(err, "fail to read config file %v", path)
+	}
+	return nil
+}
+
+// Validate returns the first setting the service cannot run with, nil if there is none
+func (cfg Config) Validate() error {
+	if cfg.DB.DSN == "" && !cfg.Features.MemoryStore {
+		return errors.New("db dsn shall be given unless the memory store is used")
+	}
+	if cfg.DB.MaxOpenConns < 0 || cfg.DB.MaxIdleConns < 0 || cfg.DB.ConnMaxLifetime < 0 {
+		return errors.New("db pool settings shall not be negative")
+	}
+	if cfg.DB.MaxOpenConns > 0 && cfg.DB.MaxIdleConns > cfg.DB.MaxOpenConns {
+		return errors.Errorf("db max idle conns shall be at most max open conns %v, got %v", cfg.DB.MaxOpenConns, cfg.DB.MaxIdleConns)
+	}
+	if cfg.HTTP.Addr == "" {
+		return errors.New("http addr shall be given")
+	}
+	if cfg.HTTP.RequestTimeout <= 0 {
+		return errors.Errorf("http request timeout shall be positive, got %v", cfg.HTTP.RequestTimeout)
+	}
+	if cfg.HTTP.ShutdownTimeout <= 0 {
+		return errors.Errorf("http shutdown timeout shall be positive, got %v", cfg.HTTP.ShutdownTimeout)
+	}
+	if cfg.HTTP.ReadTimeout < 0 || cfg.HTTP.WriteTimeout < 0 || cfg.HTTP.IdleTimeout < 0 || cfg.HTTP.ReadinessTimeout < 0 {
+		return errors.New("http timeouts shall not be negative")
+	}
+	if cfg.HTTP.WriteTimeout > 0 && cfg.HTTP.WriteTimeout <= cfg.HTTP.RequestTimeout {
+		return errors.Errorf("http write timeout shall be longer than the request timeout %v, got %v", cfg.HTTP.RequestTimeout, cfg.HTTP.WriteTimeout)
+	}
+	v := cfg.Vouchers
+	if v.ReservationTTL < 0 || v.IdempotencyTTL < 0 || v.IdempotencyLease < 0 || v.SweepInterval < 0 || v.CodeAttempts < 0 || v.BulkBatchSize < 0 {
+		return errors.New("voucher settings shall not be negative")
+	}
+	if v.IdempotencyLease > 0 && v.IdempotencyLease <= cfg.HTTP.RequestTimeout {
+		return errors.Errorf("idempotency lease shall be longer than the request timeout %v, got %v", cfg.HTTP.RequestTimeout, v.IdempotencyLease)
+	}
+	if err := cfg.CodeGen.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid codegen config")
+	}
+	if cfg.Features.CodePool {
+		if err := cfg.CodePool.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid codepool config")
+		}
+	}
+	if err := cfg.Log.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid log config")
+	}
+	if err := cfg.Tracing.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid tracing config")
+	}
+	return nil
+}
+
+// TestDSN is the database of the integration tests, EnvTestDSN if it is set
+func TestDSN() string {
+	if dsn := os.Getenv(EnvTestDSN); dsn != "" {
+		return dsn
+	}
+	return defaultTestDSN
+}
+
+// envVar overrides the setting at p, one of *string, *int, *bool, *float64 and *time.Duration
+type envVar struct {
+	name string
+	p    interface{}
+}
+
+// envVars lists the environment variables of the settings of cfg
+func (cfg *Config) envVars() []envVar {
+	return []envVar{
+		{"VOUCHER_DB_DSN", &cfg.DB.DSN},
+		{"VOUCHER_DB_MAX_OPEN_CONNS", &cfg.DB.MaxOpenConns},
+		{"VOUCHER_DB_MAX_IDLE_CONNS", &cfg.DB.MaxIdleConns},
+		{"VOUCHER_DB_CONN_MAX_LIFETIME", &cfg.DB.ConnMaxLifetime},
+		{"VOUCHER_HTTP_ADDR", &cfg.HTTP.Addr},
+		{"VOUCHER_HTTP_REQUEST_TIMEOUT", &cfg.HTTP.RequestTimeout},
+		{"VOUCHER_HTTP_READ_TIMEOUT", &cfg.HTTP.ReadTimeout},
+		{"VOUCHER_HTTP_WRITE_TIMEOUT", &cfg.HTTP.WriteTimeout},
+		{"VOUCHER_HTTP_IDLE_TIMEOUT", &cfg.HTTP.IdleTimeout},
+		{"VOUCHER_HTTP_SHUTDOWN_TIMEOUT", &cfg.HTTP.ShutdownTimeout},
+		{"VOUCHER_HTTP_READINESS_TIMEOUT", &cfg.HTTP.ReadinessTimeout},
+		{"VOUCHER_RESERVATION_TTL", &cfg.Vouchers.ReservationTTL},
+		{"VOUCHER_IDEMPOTENCY_TTL", &cfg.Vouchers.IdempotencyTTL},
+		{"VOUCHER_IDEMPOTENCY_LEASE", &cfg.Vouchers.IdempotencyLease},
+		{"VOUCHER_SWEEP_INTERVAL", &cfg.Vouchers.SweepInterval},
+		{"VOUCHER_CODE_ATTEMPTS", &cfg.Vouchers.CodeAttempts},
+		{"VOUCHER_BULK_BATCH_SIZE", &cfg.Vouchers.BulkBatchSize},
+		{"VOUCHER_CODEGEN_LENGTH", &cfg.CodeGen.Length},
+		{"VOUCHER_CODEGEN_ALPHABET", &cfg.CodeGen.Alphabet},
+		{"VOUCHER_CODEGEN_PREFIX", &cfg.CodeGen.Prefix},
+		{"VOUCHER_CODEGEN_SUFFIX", &cfg.CodeGen.Suffix},
+		{"VOUCHER_CODEGEN_GROUP_SIZE", &cfg.CodeGen.GroupSize},
+		{"VOUCHER_CODEGEN_CHECK_DIGIT", &cfg.CodeGen.CheckDigit},
+		{"VOUCHER_CODEPOOL_SIZE", &cfg.CodePool.Size},
+		{"VOUCHER_CODEPOOL_LOW_WATER", &cfg.CodePool.LowWater},
+		{"VOUCHER_FEATURE_MEMORY_STORE", &cfg.Features.MemoryStore},
+		{"VOUCHER_FEATURE_CODE_POOL", &cfg.Features.CodePool},
+		{"VOUCHER_FEATURE_IDEMPOTENCY", &cfg.Features.Idempotency},
+		{"VOUCHER_FEATURE_SWEEPER", &cfg.Features.Sweeper},
+		{"VOUCHER_LOG_LEVEL", &cfg.Log.Level},
+		{"VOUCHER_LOG_REDACT", &cfg.Log.Redact},
+		{"VOUCHER_TRACING_EXPORTER", &cfg.Tracing.Exporter},
+		{"VOUCHER_TRACING_ENDPOINT", &cfg.Tracing.Endpoint},
+		{"VOUCHER_TRACING_INSECURE", &cfg.Tracing.Insecure},
+		{"VOUCHER_TRACING_SAMPLE_RATIO", &cfg.Tracing.SampleRatio},
+	}
+}
+
+func (v envVar) set(value string) error {
+	var err error
+	switch p := v.p.(type) {
+	case *string:
+		*p = value
+	case *int:
+		*p, err = strconv.Atoi(value)
+	case *bool:
+		*p, err = strconv.ParseBool(value)
+	case *float64:
+		*p, err = strconv.ParseFloat(value, 64)
+	case *time.Duration:
+		*p, err = time.ParseDuration(value)
+	default:
+		err = errors.Errorf("unsupported setting type %T", v.p)
+	}
+	return err
+}
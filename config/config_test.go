@@ -0,0 +1,130 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/codegen"
+	"github.com/ingemar0720/voucher-pool/logging"
+	"github.com/ingemar0720/voucher-pool/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.yaml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func TestLoad(t *testing.T) {
+	cfg, err := load("", env(nil))
+	require.Nil(t, err)
+	assert.Equal(t, Default(), cfg)
+
+	path := writeFile(t, `
+db:
+  dsn: postgres://file
+  max_open_conns: 5
+  max_idle_conns: 5
+http:
+  addr: ":8080"
+  request_timeout: 10s
+  write_timeout: 15s
+vouchers:
+  reservation_ttl: 5m
+codegen:
+  length: 12
+  alphabet: ABCDEFGHJKLMNPQRSTUVWXYZ23456789
+  group_size: 4
+  check_digit: true
+features:
+  idempotency: false
+log:
+  level: debug
+`)
+	cfg, err = load(path, env(map[string]string{
+		"VOUCHER_DB_DSN":               "postgres://env",
+		"VOUCHER_HTTP_REQUEST_TIMEOUT": "12s",
+		"VOUCHER_CODEGEN_PREFIX":       "KOI-",
+		"VOUCHER_FEATURE_MEMORY_STORE": "true",
+		"VOUCHER_LOG_REDACT":           "false",
+		"VOUCHER_TRACING_EXPORTER":     "otlp",
+		"VOUCHER_TRACING_SAMPLE_RATIO": "0.25",
+	}))
+	require.Nil(t, err)
+	// the environment wins over the file, the file over the defaults
+	assert.Equal(t, "postgres://env", cfg.DB.DSN)
+	assert.Equal(t, 5, cfg.DB.MaxOpenConns)
+	assert.Equal(t, 30*time.Minute, cfg.DB.ConnMaxLifetime)
+	assert.Equal(t, ":8080", cfg.HTTP.Addr)
+	assert.Equal(t, 12*time.Second, cfg.HTTP.RequestTimeout)
+	assert.Equal(t, 5*time.Minute, cfg.Vouchers.ReservationTTL)
+	assert.Equal(t, codegen.Config{Length: 12, Alphabet: codegen.Unambiguous, Prefix: "KOI-", GroupSize: 4, CheckDigit: true}, cfg.CodeGen)
+	assert.Equal(t, Features{MemoryStore: true, CodePool: true, Idempotency: false, Sweeper: true}, cfg.Features)
+	assert.Equal(t, logging.Config{Level: "debug", Redact: false}, cfg.Log)
+	assert.Equal(t, tracing.Config{Exporter: tracing.ExporterOTLP, SampleRatio: 0.25}, cfg.Tracing)
+
+	_, err = load(writeFile(t, "db:\n  dns: postgres://typo\n"), env(nil))
+	assert.NotNil(t, err)
+	_, err = load(filepath.Join(os.TempDir(), "missing.yaml"), env(nil))
+	assert.NotNil(t, err)
+	_, err = load("", env(map[string]string{"VOUCHER_HTTP_IDLE_TIMEOUT": "60"}))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid VOUCHER_HTTP_IDLE_TIMEOUT")
+	_, err = load("", env(map[string]string{"VOUCHER_DB_MAX_OPEN_CONNS": "many"}))
+	assert.NotNil(t, err)
+	// an empty file keeps the defaults
+	cfg, err = load(writeFile(t, ""), env(nil))
+	require.Nil(t, err)
+	assert.Equal(t, Default(), cfg)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(cfg *Config)
+		wantErr bool
+	}{
+		{name: "default config", change: func(cfg *Config) {}},
+		{name: "no dsn", change: func(cfg *Config) { cfg.DB.DSN = "" }, wantErr: true},
+		{name: "no dsn with memory store", change: func(cfg *Config) { cfg.DB.DSN = ""; cfg.Features.MemoryStore = true }},
+		{name: "more idle than open conns", change: func(cfg *Config) { cfg.DB.MaxIdleConns = 30 }, wantErr: true},
+		{name: "idle conns without limit of open conns", change: func(cfg *Config) { cfg.DB.MaxOpenConns = 0; cfg.DB.MaxIdleConns = 30 }},
+		{name: "negative pool size", change: func(cfg *Config) { cfg.DB.MaxOpenConns = -1 }, wantErr: true},
+		{name: "no addr", change: func(cfg *Config) { cfg.HTTP.Addr = "" }, wantErr: true},
+		{name: "no request timeout", change: func(cfg *Config) { cfg.HTTP.RequestTimeout = 0 }, wantErr: true},
+		{name: "no shutdown timeout", change: func(cfg *Config) { cfg.HTTP.ShutdownTimeout = 0 }, wantErr: true},
+		{name: "write timeout before request timeout", change: func(cfg *Config) { cfg.HTTP.WriteTimeout = 30 * time.Second }, wantErr: true},
+		{name: "no write timeout", change: func(cfg *Config) { cfg.HTTP.WriteTimeout = 0 }},
+		{name: "idempotency lease before request timeout", change: func(cfg *Config) { cfg.Vouchers.IdempotencyLease = 30 * time.Second }, wantErr: true},
+		{name: "negative idempotency lease", change: func(cfg *Config) { cfg.Vouchers.IdempotencyLease = -time.Second }, wantErr: true},
+		{name: "negative reservation ttl", change: func(cfg *Config) { cfg.Vouchers.ReservationTTL = -time.Second }, wantErr: true},
+		{name: "invalid codegen", change: func(cfg *Config) { cfg.CodeGen.Alphabet = "a" }, wantErr: true},
+		{name: "invalid codepool", change: func(cfg *Config) { cfg.CodePool.LowWater = cfg.CodePool.Size }, wantErr: true},
+		{name: "invalid codepool not used", change: func(cfg *Config) { cfg.CodePool.Size = 0; cfg.Features.CodePool = false }},
+		{name: "unknown log level", change: func(cfg *Config) { cfg.Log.Level = "verbose" }, wantErr: true},
+		{name: "unknown exporter", change: func(cfg *Config) { cfg.Tracing.Exporter = "jaeger" }, wantErr: true},
+		{name: "sample ratio above 1", change: func(cfg *Config) { cfg.Tracing.SampleRatio = 2 }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.change(&cfg)
+			assert.Equal(t, tt.wantErr, cfg.Validate() != nil)
+		})
+	}
+}
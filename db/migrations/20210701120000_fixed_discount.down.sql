@@ -0,0 +1,7 @@
+DELETE FROM vouchers WHERE special_offer_id IN (SELECT id FROM special_offers WHERE discount_type='fixed');
+DELETE FROM special_offers WHERE discount_type='fixed';
+ALTER TABLE special_offers DROP CONSTRAINT IF EXISTS special_offers_discount_type;
+ALTER TABLE special_offers DROP COLUMN IF EXISTS currency;
+ALTER TABLE special_offers DROP COLUMN IF EXISTS amount_minor;
+ALTER TABLE special_offers DROP COLUMN IF EXISTS discount_type;
+ALTER TABLE special_offers ALTER COLUMN discount SET NOT NULL;
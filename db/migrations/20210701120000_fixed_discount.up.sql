@@ -0,0 +1,10 @@
+ALTER TABLE special_offers ALTER COLUMN discount DROP NOT NULL;
+ALTER TABLE special_offers ADD COLUMN discount_type TEXT NOT NULL DEFAULT 'percentage';
+ALTER TABLE special_offers ADD COLUMN amount_minor BIGINT;
+ALTER TABLE special_offers ADD COLUMN currency CHAR(3);
+
+-- percentage discounts are kept in discount, fixed amount discounts in amount_minor of the ISO 4217 currency
+ALTER TABLE special_offers ADD CONSTRAINT special_offers_discount_type CHECK (
+  (discount_type='percentage' AND discount IS NOT NULL AND amount_minor IS NULL AND currency IS NULL) OR
+  (discount_type='fixed' AND discount IS NULL AND amount_minor>0 AND currency ~ '^[A-Z]{3}$')
+);
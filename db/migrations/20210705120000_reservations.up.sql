@@ -0,0 +1,13 @@
+-- a voucher is held by at most one reservation, rows are deleted on confirm, release or expiry
+CREATE TABLE IF NOT EXISTS reservations(
+  id TEXT PRIMARY KEY,
+  voucher_id INTEGER NOT NULL,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  CONSTRAINT reservations_voucher_id
+        FOREIGN KEY (voucher_id)
+        REFERENCES vouchers(id)
+);
+
+CREATE UNIQUE INDEX idx_reservation_voucher_id_key on reservations(voucher_id);
+CREATE INDEX idx_reservation_expires_at on reservations(expires_at);
@@ -0,0 +1,26 @@
+-- every redemption of a voucher, reversed redemptions are kept with who reversed them, when and why.
+-- vouchers.used_at is the time of the redemption not reversed, NULL if there is none
+CREATE TABLE IF NOT EXISTS redemptions(
+  id SERIAL PRIMARY KEY,
+  voucher_id INTEGER NOT NULL,
+  customer_id INTEGER NOT NULL,
+  redeemed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  reversed_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+  reversed_by TEXT DEFAULT NULL,
+  reversal_reason TEXT DEFAULT NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  CONSTRAINT redemptions_voucher_id
+        FOREIGN KEY (voucher_id)
+        REFERENCES vouchers(id),
+  CONSTRAINT redemptions_customer_id
+        FOREIGN KEY (customer_id)
+        REFERENCES customers(id),
+  CONSTRAINT redemptions_reversal CHECK ((reversed_at IS NULL) = (reversed_by IS NULL))
+);
+
+CREATE INDEX idx_redemption_voucher_id on redemptions(voucher_id);
+-- a single-use voucher has at most one redemption not reversed
+CREATE UNIQUE INDEX idx_redemption_active_voucher_id on redemptions(voucher_id) WHERE reversed_at IS NULL;
+
+INSERT INTO redemptions (voucher_id, customer_id, redeemed_at)
+  SELECT id, customer_id, used_at FROM vouchers WHERE used_at IS NOT NULL;
@@ -0,0 +1,17 @@
+-- vouchers redeemed more than once keep only their first redemption not reversed
+DELETE FROM reservations WHERE id NOT IN (SELECT DISTINCT ON (voucher_id) id FROM reservations ORDER BY voucher_id, created_at);
+DROP INDEX IF EXISTS idx_reservation_voucher_id;
+CREATE UNIQUE INDEX idx_reservation_voucher_id_key on reservations(voucher_id);
+ALTER TABLE reservations DROP COLUMN IF EXISTS customer_id;
+
+UPDATE redemptions SET reversed_at=CURRENT_TIMESTAMP, reversed_by='migration', reversal_reason='single-use vouchers'
+  WHERE reversed_at IS NULL AND id NOT IN (SELECT min(id) FROM redemptions WHERE reversed_at IS NULL GROUP BY voucher_id);
+DROP INDEX IF EXISTS idx_redemption_active_voucher_customer;
+CREATE UNIQUE INDEX idx_redemption_active_voucher_id on redemptions(voucher_id) WHERE reversed_at IS NULL;
+
+UPDATE vouchers vo SET used_at=r.redeemed_at FROM redemptions r WHERE r.voucher_id=vo.id AND r.reversed_at IS NULL AND vo.used_at IS NULL;
+ALTER TABLE vouchers
+  DROP CONSTRAINT IF EXISTS vouchers_redemption_limits,
+  DROP COLUMN IF EXISTS max_redemptions,
+  DROP COLUMN IF EXISTS max_per_customer,
+  DROP COLUMN IF EXISTS redemption_count;
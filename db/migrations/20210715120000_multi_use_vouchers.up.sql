@@ -0,0 +1,27 @@
+-- a voucher can be redeemed max_redemptions times in total and max_per_customer times by one customer (no limit if NULL).
+-- redemption_count is the number of redemptions not reversed, used_at is set once it reaches max_redemptions
+ALTER TABLE vouchers
+  ADD COLUMN max_redemptions INTEGER NOT NULL DEFAULT 1,
+  ADD COLUMN max_per_customer INTEGER DEFAULT NULL,
+  ADD COLUMN redemption_count INTEGER NOT NULL DEFAULT 0;
+
+UPDATE vouchers SET redemption_count=1 WHERE used_at IS NOT NULL;
+
+ALTER TABLE vouchers ADD CONSTRAINT vouchers_redemption_limits CHECK (
+  max_redemptions > 0
+  AND (max_per_customer IS NULL OR max_per_customer > 0)
+  AND redemption_count BETWEEN 0 AND max_redemptions
+  AND ((used_at IS NOT NULL) = (redemption_count = max_redemptions))
+);
+
+DROP INDEX IF EXISTS idx_redemption_active_voucher_id;
+CREATE INDEX idx_redemption_active_voucher_customer on redemptions(voucher_id, customer_id) WHERE reversed_at IS NULL;
+
+-- a voucher can be held by as many reservations as it has uses left
+ALTER TABLE reservations ADD COLUMN customer_id INTEGER;
+UPDATE reservations r SET customer_id=vo.customer_id FROM vouchers vo WHERE vo.id=r.voucher_id;
+ALTER TABLE reservations
+  ALTER COLUMN customer_id SET NOT NULL,
+  ADD CONSTRAINT reservations_customer_id FOREIGN KEY (customer_id) REFERENCES customers(id);
+DROP INDEX IF EXISTS idx_reservation_voucher_id_key;
+CREATE INDEX idx_reservation_voucher_id on reservations(voucher_id);
@@ -0,0 +1,10 @@
+-- unassigned vouchers cannot be kept without a customer
+DELETE FROM reservations WHERE voucher_id IN (SELECT id FROM vouchers WHERE customer_id IS NULL);
+DELETE FROM redemptions WHERE voucher_id IN (SELECT id FROM vouchers WHERE customer_id IS NULL);
+DELETE FROM vouchers WHERE customer_id IS NULL;
+
+DROP INDEX IF EXISTS idx_voucher_customer_id;
+ALTER TABLE vouchers
+  DROP CONSTRAINT IF EXISTS vouchers_assignment,
+  DROP COLUMN IF EXISTS assignment,
+  ALTER COLUMN customer_id SET NOT NULL;
@@ -0,0 +1,14 @@
+-- assignment tells who can redeem a voucher: only the customer of customer_id, any customer (public),
+-- or the first customer who redeems or reserves it (claim). Unassigned vouchers have no customer_id,
+-- the customer is recorded in redemptions and reservations
+ALTER TABLE vouchers
+  ADD COLUMN assignment TEXT NOT NULL DEFAULT 'customer',
+  ALTER COLUMN customer_id DROP DEFAULT,
+  ALTER COLUMN customer_id DROP NOT NULL;
+
+ALTER TABLE vouchers ADD CONSTRAINT vouchers_assignment CHECK (
+  assignment IN ('customer', 'public', 'claim')
+  AND ((assignment = 'customer') = (customer_id IS NOT NULL))
+);
+
+CREATE INDEX idx_voucher_customer_id on vouchers(customer_id);
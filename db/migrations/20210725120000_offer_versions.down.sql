@@ -0,0 +1,13 @@
+-- vouchers of superseded versions get the discount of the current version
+UPDATE vouchers vo SET special_offer_id=cur.id FROM special_offers so
+  INNER JOIN special_offers cur ON cur.name=so.name AND cur.superseded_at IS NULL
+  WHERE vo.special_offer_id=so.id AND so.superseded_at IS NOT NULL;
+DELETE FROM special_offers WHERE superseded_at IS NOT NULL;
+
+DROP INDEX IF EXISTS idx_special_offer_current_name;
+ALTER TABLE special_offers
+  DROP CONSTRAINT IF EXISTS special_offers_name_version,
+  DROP COLUMN IF EXISTS version,
+  DROP COLUMN IF EXISTS active,
+  DROP COLUMN IF EXISTS superseded_at,
+  ADD CONSTRAINT special_offers_name_key UNIQUE (name);
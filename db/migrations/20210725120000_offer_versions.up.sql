@@ -0,0 +1,10 @@
+-- a row of special_offers is a version of the offer, a new discount makes a new version and vouchers keep the
+-- version they are issued with. The current version of an offer is the one not superseded.
+ALTER TABLE special_offers DROP CONSTRAINT IF EXISTS special_offers_name_key;
+ALTER TABLE special_offers
+  ADD COLUMN version INTEGER NOT NULL DEFAULT 1,
+  ADD COLUMN active BOOLEAN NOT NULL DEFAULT TRUE,
+  ADD COLUMN superseded_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+  ADD CONSTRAINT special_offers_name_version UNIQUE (name, version);
+
+CREATE UNIQUE INDEX idx_special_offer_current_name on special_offers(name) WHERE superseded_at IS NULL;
@@ -0,0 +1,15 @@
+ALTER TABLE special_offers ADD COLUMN active BOOLEAN NOT NULL DEFAULT TRUE;
+UPDATE special_offers so SET active=(o.active AND o.archived_at IS NULL) FROM offers o WHERE o.id=so.offer_id;
+
+DROP INDEX IF EXISTS idx_special_offer_current_offer_id;
+ALTER TABLE special_offers
+  DROP CONSTRAINT IF EXISTS special_offers_offer_id_version,
+  DROP CONSTRAINT IF EXISTS special_offers_offer_id,
+  DROP COLUMN IF EXISTS offer_id;
+
+-- versions are numbered by name again, a renamed offer continues the versions of its new name
+UPDATE special_offers so SET version=renumbered.version FROM
+  (SELECT id, row_number() OVER (PARTITION BY name ORDER BY id) AS version FROM special_offers) renumbered
+  WHERE renumbered.id=so.id;
+ALTER TABLE special_offers ADD CONSTRAINT special_offers_name_version UNIQUE (name, version);
+DROP TABLE IF EXISTS offers;
@@ -0,0 +1,30 @@
+-- an offer keeps its id over its versions, the state of the offer is kept in offers and the terms of every
+-- version in special_offers
+CREATE TABLE IF NOT EXISTS offers (
+  id SERIAL PRIMARY KEY,
+  description TEXT NOT NULL DEFAULT '',
+  starts_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+  ends_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+  active BOOLEAN NOT NULL DEFAULT TRUE,
+  archived_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  CONSTRAINT offers_window CHECK (starts_at IS NULL OR ends_at IS NULL OR starts_at < ends_at)
+);
+
+-- the versions of the same name are one offer, it gets the id of its first version
+INSERT INTO offers (id, active, created_at)
+  SELECT first.id, cur.active, first.created_at FROM special_offers cur
+  INNER JOIN special_offers first ON first.name=cur.name AND first.version=1
+  WHERE cur.superseded_at IS NULL;
+SELECT setval(pg_get_serial_sequence('offers', 'id'), COALESCE((SELECT max(id) FROM offers), 0) + 1, false);
+
+ALTER TABLE special_offers ADD COLUMN offer_id INTEGER;
+UPDATE special_offers so SET offer_id=first.id FROM special_offers first WHERE first.name=so.name AND first.version=1;
+ALTER TABLE special_offers
+  ALTER COLUMN offer_id SET NOT NULL,
+  ADD CONSTRAINT special_offers_offer_id FOREIGN KEY (offer_id) REFERENCES offers(id),
+  ADD CONSTRAINT special_offers_offer_id_version UNIQUE (offer_id, version),
+  DROP CONSTRAINT IF EXISTS special_offers_name_version,
+  DROP COLUMN IF EXISTS active;
+CREATE UNIQUE INDEX idx_special_offer_current_offer_id on special_offers(offer_id) WHERE superseded_at IS NULL;
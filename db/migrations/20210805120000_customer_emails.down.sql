@@ -0,0 +1 @@
+ALTER TABLE customers DROP CONSTRAINT IF EXISTS customers_email_normalized;
@@ -0,0 +1,16 @@
+-- emails are looked up case-insensitively, they are stored trimmed and in lower case.
+-- customers whose emails differ only in case shall be merged before, the migration stops and lists them otherwise.
+DO $$
+DECLARE
+    duplicates text;
+BEGIN
+    SELECT string_agg(format('%s (ids %s)', email, ids), ', ') INTO duplicates FROM (
+        SELECT lower(btrim(email)) AS email, string_agg(id::text, ', ' ORDER BY id) AS ids
+        FROM customers GROUP BY lower(btrim(email)) HAVING count(*) > 1
+    ) d;
+    IF duplicates IS NOT NULL THEN
+        RAISE EXCEPTION 'customers share emails differing only in case or spaces, merge them before migrating: %', duplicates;
+    END IF;
+END $$;
+UPDATE customers SET email=lower(btrim(email)) WHERE email<>lower(btrim(email));
+ALTER TABLE customers ADD CONSTRAINT customers_email_normalized CHECK (email=lower(btrim(email)));
@@ -0,0 +1,2 @@
+-- erased customers keep their row for the vouchers and redemptions referring to them, name and email are anonymized
+ALTER TABLE customers ADD COLUMN erased_at TIMESTAMP WITH TIME ZONE DEFAULT NULL;
@@ -0,0 +1 @@
+ALTER TABLE offers DROP COLUMN IF EXISTS rules;
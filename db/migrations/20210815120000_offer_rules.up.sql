@@ -0,0 +1,2 @@
+-- eligibility rules of the offer as a JSON array, see package rules, evaluated against the order on validate and quote
+ALTER TABLE offers ADD COLUMN rules JSONB NOT NULL DEFAULT '[]';
@@ -0,0 +1,5 @@
+ALTER TABLE offers
+  DROP CONSTRAINT IF EXISTS offers_max_total_discount,
+  DROP COLUMN IF EXISTS max_total_discount,
+  DROP COLUMN IF EXISTS stack_group,
+  DROP COLUMN IF EXISTS exclusive;
@@ -0,0 +1,6 @@
+-- stacking policy of the offer, how its vouchers combine with other codes redeemed for the same order
+ALTER TABLE offers
+  ADD COLUMN exclusive BOOLEAN NOT NULL DEFAULT FALSE,
+  ADD COLUMN stack_group TEXT NOT NULL DEFAULT '',
+  ADD COLUMN max_total_discount NUMERIC(5,2) DEFAULT NULL,
+  ADD CONSTRAINT offers_max_total_discount CHECK (max_total_discount > 0 AND max_total_discount <= 100);
@@ -0,0 +1,14 @@
+-- responses of requests sent with an Idempotency-Key header, replayed to retries of the same request until expires_at.
+-- status and body are NULL while the first request is in progress.
+CREATE TABLE IF NOT EXISTS idempotency_keys(
+  scope TEXT NOT NULL,
+  key TEXT NOT NULL,
+  fingerprint TEXT NOT NULL,
+  status INTEGER DEFAULT NULL,
+  body BYTEA DEFAULT NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX idx_idempotency_keys_expires_at on idempotency_keys(expires_at);
@@ -0,0 +1,32 @@
+package dbmodel
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Assignment tells who can redeem a voucher
+type Assignment string
+
+const (
+	// AssignmentCustomer vouchers can only be redeemed by the customer they are generated for
+	AssignmentCustomer Assignment = "customer"
+	// AssignmentPublic vouchers can be redeemed by any customer, up to the limits of the voucher
+	AssignmentPublic Assignment = "public"
+	// AssignmentClaim vouchers belong to the first customer who redeems or reserves them
+	AssignmentClaim Assignment = "claim"
+)
+
+// Validate returns an error unless the assignment is one of the known ones
+func (a Assignment) Validate() error {
+	switch a {
+	case AssignmentCustomer, AssignmentPublic, AssignmentClaim:
+		return nil
+	default:
+		return errors.Errorf("unknown assignment %q", string(a))
+	}
+}
+
+// unassigned tells if the voucher has no customer_id, the customer is known only at redemption
+func (a Assignment) unassigned() bool {
+	return a == AssignmentPublic || a == AssignmentClaim
+}
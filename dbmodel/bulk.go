@@ -0,0 +1,155 @@
+package dbmodel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// postgres binds at most 65535 parameters per statement, insertVoucherRows binds 6 per voucher
+const maxVoucherRows = 65535 / 6
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// CustomerFilter selects customers for bulk operations, the zero value selects all customers
+type CustomerFilter struct {
+	// domain of the email, e.g. gmail.com
+	EmailDomain string
+}
+
+// GetCustomerIDsByEmails returns the ids of the customers keyed by normalized email, unknown emails are left out
+func GetCustomerIDsByEmails(ctx context.Context, emails []string, db *sqlx.DB) (map[string]uint64, error) {
+	normalized := make([]string, len(emails))
+	for i, email := range emails {
+		normalized[i] = NormalizeEmail(email)
+	}
+	rows, err := db.QueryContext(ctx, "SELECT id, email FROM customers WHERE email = ANY($1) AND erased_at IS NULL", pq.Array(normalized))
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to query customers by emails")
+	}
+	defer rows.Close()
+	ids := make(map[string]uint64, len(emails))
+	for rows.Next() {
+		var id uint64
+		var email string
+		if err := rows.Scan(&id, &email); err != nil {
+			return nil, errors.Wrapf(err, "fail to query customers by emails")
+		}
+		ids[email] = id
+	}
+	return ids, rows.Err()
+}
+
+// ListCustomerEmails returns the emails of the customers matching filter in the order they signed up, erased customers are left out
+func ListCustomerEmails(ctx context.Context, filter CustomerFilter, db *sqlx.DB) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT email FROM customers WHERE erased_at IS NULL AND ($1='' OR lower(email) LIKE '%@' || lower($1) ESCAPE '\') ORDER BY id`, escapeLike(filter.EmailDomain))
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to query customers")
+	}
+	defer rows.Close()
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, errors.Wrapf(err, "fail to query customers")
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+// InsertVouchers resolves the special offer and inserts the vouchers of it, all with the same limits, with one multi-row INSERT in a transaction.
+// Code, CustomerID and ExpiryDate of the vouchers shall be set. Vouchers whose code already exists are skipped
+// and their codes returned, so the caller can retry them with fresh codes.
+func InsertVouchers(ctx context.Context, offer OfferRef, limits Limits, vouchers []DBModelVoucher, db *sqlx.DB) ([]string, error) {
+	if len(vouchers) == 0 {
+		return nil, nil
+	}
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to begin insert of vouchers")
+	}
+	conflicts, err := insertVouchers(ctx, offer, limits, vouchers, tx)
+	if err != nil {
+		if err1 := tx.Rollback(); err1 != nil {
+			return nil, errors.Wrapf(err1, "fail to rollback insert to voucher table, insert error %v", err)
+		}
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "fail to commit insert of vouchers")
+	}
+	return conflicts, nil
+}
+
+func insertVouchers(ctx context.Context, ref OfferRef, limits Limits, vouchers []DBModelVoucher, tx *sqlx.Tx) ([]string, error) {
+	offer, err := resolveOffer(ctx, ref, tx)
+	if err != nil {
+		return nil, err
+	}
+	// a code repeated within the batch conflicts with its first occurrence
+	var conflicts []string
+	batch := make(map[string]bool, len(vouchers))
+	unique := make([]DBModelVoucher, 0, len(vouchers))
+	for _, v := range vouchers {
+		if batch[v.Code] {
+			conflicts = append(conflicts, v.Code)
+			continue
+		}
+		batch[v.Code] = true
+		unique = append(unique, v)
+	}
+	inserted := make(map[string]bool, len(unique))
+	for start := 0; start < len(unique); start += maxVoucherRows {
+		end := start + maxVoucherRows
+		if end > len(unique) {
+			end = len(unique)
+		}
+		if err := insertVoucherRows(ctx, offer.ID, limits, unique[start:end], inserted, tx); err != nil {
+			return nil, err
+		}
+	}
+	for code := range batch {
+		if !inserted[code] {
+			conflicts = append(conflicts, code)
+		}
+	}
+	return conflicts, nil
+}
+
+// insertVoucherRows inserts the vouchers with one multi-row INSERT, at most maxVoucherRows of them, and adds the codes
+// inserted to inserted
+func insertVoucherRows(ctx context.Context, offerID uint64, limits Limits, vouchers []DBModelVoucher, inserted map[string]bool, tx *sqlx.Tx) error {
+	values := make([]string, 0, len(vouchers))
+	args := make([]interface{}, 0, 6*len(vouchers))
+	for i, v := range vouchers {
+		values = append(values, fmt.Sprintf("($%v, $%v, $%v, $%v, $%v, $%v)", 6*i+1, 6*i+2, 6*i+3, 6*i+4, 6*i+5, 6*i+6))
+		args = append(args, v.Code, v.CustomerID, offerID, v.ExpiryDate, limits.maxRedemptions(), limits.maxPerCustomer())
+	}
+	rows, err := tx.QueryContext(ctx, "INSERT INTO vouchers (code, customer_id, special_offer_id, expired_at, max_redemptions, max_per_customer) VALUES "+strings.Join(values, ", ")+
+		" ON CONFLICT (code) DO NOTHING RETURNING code", args...)
+	if err != nil {
+		return errors.Wrapf(err, "fail to insert to voucher table")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return errors.Wrapf(err, "fail to insert to voucher table")
+		}
+		inserted[code] = true
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrapf(err, "fail to insert to voucher table")
+	}
+	return nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern, so s matches itself only
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
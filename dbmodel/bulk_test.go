@@ -0,0 +1,111 @@
+package dbmodel
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsertVouchers(t *testing.T) {
+	expiry := time.Date(2021, time.June, 1, 0, 0, 0, 0, time.Local)
+	vouchers := []DBModelVoucher{
+		{Code: "abcd", CustomerID: 1, ExpiryDate: expiry},
+		{Code: "efgh", CustomerID: 2, ExpiryDate: expiry},
+		{Code: "abcd", CustomerID: 3, ExpiryDate: expiry},
+	}
+	tests := []struct {
+		name          string
+		insertErr     bool
+		inserted      []string
+		wantConflicts []string
+	}{
+		{
+			name:          "insert all unique codes",
+			inserted:      []string{"abcd", "efgh"},
+			wantConflicts: []string{"abcd"},
+		},
+		{
+			name:          "skip existing codes",
+			inserted:      []string{"efgh"},
+			wantConflicts: []string{"abcd", "abcd"},
+		},
+		{
+			name:      "insert error",
+			insertErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := setupSQLMock(t)
+			defer db.Close()
+			mock.ExpectBegin()
+			expectNewOffer(mock, "summer", "15.00", 7)
+			// the repeated code is not sent to postgres
+			insert := mock.ExpectQuery(`INSERT INTO vouchers \(code, customer_id, special_offer_id, expired_at, max_redemptions, max_per_customer\) VALUES \(\$1, \$2, \$3, \$4, \$5, \$6\), \(\$7, \$8, \$9, \$10, \$11, \$12\) ON CONFLICT \(code\) DO NOTHING RETURNING code`).
+				WithArgs("abcd", 1, 7, expiry, 10, nil, "efgh", 2, 7, expiry, 10, nil)
+			if tt.insertErr {
+				insert.WillReturnError(errors.New("error"))
+				mock.ExpectRollback()
+			} else {
+				rows := sqlmock.NewRows([]string{"code"})
+				for _, code := range tt.inserted {
+					rows.AddRow(code)
+				}
+				insert.WillReturnRows(rows)
+				mock.ExpectCommit()
+			}
+
+			conflicts, err := InsertVouchers(context.Background(), OfferRef{Name: "summer", Discount: PercentageDiscount(1500)}, Limits{MaxRedemptions: 10}, vouchers, sqlx.NewDb(db, "sqlmock"))
+			assert.Equal(t, tt.insertErr, err != nil)
+			assert.ElementsMatch(t, tt.wantConflicts, conflicts)
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestInsertVouchersChunked(t *testing.T) {
+	db, mock := setupSQLMock(t)
+	defer db.Close()
+	expiry := time.Date(2021, time.June, 1, 0, 0, 0, 0, time.Local)
+	vouchers := make([]DBModelVoucher, maxVoucherRows+1)
+	inserted := sqlmock.NewRows([]string{"code"})
+	for i := range vouchers {
+		vouchers[i] = DBModelVoucher{Code: fmt.Sprintf("code%v", i), CustomerID: 1, ExpiryDate: expiry}
+		if i < maxVoucherRows {
+			inserted.AddRow(vouchers[i].Code)
+		}
+	}
+	mock.ExpectBegin()
+	expectNewOffer(mock, "summer", "15.00", 7)
+	// the rows beyond the parameter limit of postgres go into a second INSERT
+	mock.ExpectQuery(`INSERT INTO vouchers (.+) VALUES (.+) ON CONFLICT \(code\) DO NOTHING RETURNING code`).WillReturnRows(inserted)
+	mock.ExpectQuery(`INSERT INTO vouchers \(code, customer_id, special_offer_id, expired_at, max_redemptions, max_per_customer\) VALUES \(\$1, \$2, \$3, \$4, \$5, \$6\) ON CONFLICT`).
+		WithArgs(vouchers[maxVoucherRows].Code, 1, 7, expiry, 1, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"code"}))
+	mock.ExpectCommit()
+
+	conflicts, err := InsertVouchers(context.Background(), OfferRef{Name: "summer", Discount: PercentageDiscount(1500)}, Limits{}, vouchers, sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{vouchers[maxVoucherRows].Code}, conflicts)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestListCustomerEmails(t *testing.T) {
+	db, mock := setupSQLMock(t)
+	defer db.Close()
+	// the wildcards of the domain match themselves only
+	mock.ExpectQuery("SELECT email FROM customers WHERE (.+) ESCAPE (.+) ORDER BY id").WithArgs(`gmail\_com\%`).
+		WillReturnRows(sqlmock.NewRows([]string{"email"}))
+	emails, err := ListCustomerEmails(context.Background(), CustomerFilter{EmailDomain: "gmail_com%"}, sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+	assert.Empty(t, emails)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	assert.Equal(t, `a\\b\%c\_d`, escapeLike(`a\b%c_d`))
+}
@@ -0,0 +1,228 @@
+package dbmodel
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+type DBModelCustomer struct {
+	ID        uint64    `json:"id" db:"id"`
+	Name      string    `json:"name" db:"name"`
+	Email     string    `json:"email" db:"email"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	// ErasedAt is set once the personal data of the customer is erased
+	ErasedAt sql.NullTime `json:"erased_at" db:"erased_at"`
+}
+
+// CustomerVoucher is a voucher of the customer with the version of the offer it was issued with
+type CustomerVoucher struct {
+	DBModelVoucher
+	Offer DBModelSpecialOffer `db:"offer"`
+}
+
+// CustomerExport is everything held about a customer, the vouchers assigned to it and all its redemptions
+// including the ones of public and claim vouchers
+type CustomerExport struct {
+	Customer    DBModelCustomer
+	Vouchers    []CustomerVoucher
+	Redemptions []DBModelRedemption
+}
+
+// ErasedEmailDomain is the domain of the emails erased customers are given, no customer can sign up with it
+const ErasedEmailDomain = "erased.invalid"
+
+// erasedEmail is unique per customer as emails shall be
+func erasedEmail(id uint64) string {
+	return fmt.Sprintf("erased-%v@%v", id, ErasedEmailDomain)
+}
+
+// NormalizeEmail returns the email as it is stored, emails are case-insensitive and looked up normalized
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+const customerColumns = "id, name, email, created_at, updated_at, erased_at"
+
+// CreateCustomer inserts the customer with the normalized email, it fails with ErrCustomerConflict if the email is taken
+func CreateCustomer(ctx context.Context, name, email string, db *sqlx.DB) (uint64, error) {
+	var customerID uint64
+	email = NormalizeEmail(email)
+	err := db.QueryRowxContext(ctx, "INSERT INTO customers (name, email) VALUES ($1, $2) RETURNING id", name, email).Scan(&customerID)
+	if err != nil {
+		if isViolation(err, pqUniqueViolation) {
+			return 0, errors.Wrapf(ErrCustomerConflict, "fail to insert customer with email %v, %v", email, err)
+		}
+		return 0, errors.Wrapf(err, "fail to insert customer with email %v", email)
+	}
+	return customerID, nil
+}
+
+func GetCustomer(ctx context.Context, id uint64, db *sqlx.DB) (DBModelCustomer, error) {
+	c := DBModelCustomer{}
+	err := db.GetContext(ctx, &c, "SELECT "+customerColumns+" FROM customers WHERE id=$1", id)
+	if err == sql.ErrNoRows {
+		return DBModelCustomer{}, errors.Wrapf(ErrCustomerNotFound, "customer %v", id)
+	}
+	if err != nil {
+		return DBModelCustomer{}, errors.Wrapf(err, "fail to query customer %v", id)
+	}
+	return c, nil
+}
+
+// ListCustomers returns up to limit customers matching filter with an id bigger than afterID, in the order of their ids
+func ListCustomers(ctx context.Context, filter CustomerFilter, afterID uint64, limit int, db *sqlx.DB) ([]DBModelCustomer, error) {
+	customers := []DBModelCustomer{}
+	err := db.SelectContext(ctx, &customers, "SELECT "+customerColumns+` FROM customers
+										WHERE id>$1 AND ($2='' OR email LIKE '%@' || lower($2) ESCAPE '\') ORDER BY id LIMIT $3`, afterID, escapeLike(filter.EmailDomain), limit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to query customers")
+	}
+	return customers, nil
+}
+
+// UpdateCustomer changes the name and the email of the customer, it fails with ErrCustomerConflict if the email is taken
+// by another customer and with ErrCustomerErased if the customer is erased
+func UpdateCustomer(ctx context.Context, id uint64, name, email string, db *sqlx.DB) (DBModelCustomer, error) {
+	c := DBModelCustomer{}
+	email = NormalizeEmail(email)
+	err := db.GetContext(ctx, &c, "UPDATE customers SET name=$1, email=$2, updated_at=$3 WHERE id=$4 AND erased_at IS NULL RETURNING "+customerColumns,
+		name, email, time.Now(), id)
+	if err == sql.ErrNoRows {
+		var erased bool
+		err = db.GetContext(ctx, &erased, "SELECT erased_at IS NOT NULL FROM customers WHERE id=$1", id)
+		if err == sql.ErrNoRows {
+			return DBModelCustomer{}, errors.Wrapf(ErrCustomerNotFound, "customer %v", id)
+		}
+		if err != nil {
+			return DBModelCustomer{}, errors.Wrapf(err, "fail to query customer %v", id)
+		}
+		return DBModelCustomer{}, errors.Wrapf(ErrCustomerErased, "customer %v", id)
+	}
+	if err != nil {
+		if isViolation(err, pqUniqueViolation) {
+			return DBModelCustomer{}, errors.Wrapf(ErrCustomerConflict, "fail to update customer %v, %v", id, err)
+		}
+		return DBModelCustomer{}, errors.Wrapf(err, "fail to update customer %v", id)
+	}
+	return c, nil
+}
+
+// DeleteCustomer deletes the customer, it fails with ErrCustomerInUse if vouchers, redemptions or reservations refer to it
+func DeleteCustomer(ctx context.Context, id uint64, db *sqlx.DB) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM customers WHERE id=$1", id)
+	if err != nil {
+		if isViolation(err, pqForeignKeyViolation) {
+			return errors.Wrapf(ErrCustomerInUse, "fail to delete customer %v, %v", id, err)
+		}
+		return errors.Wrapf(err, "fail to delete customer %v", id)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "fail to delete customer %v", id)
+	}
+	if affected != 1 {
+		return errors.Wrapf(ErrCustomerNotFound, "customer %v", id)
+	}
+	return nil
+}
+
+// ExportCustomer returns everything held about the customer
+func ExportCustomer(ctx context.Context, id uint64, db *sqlx.DB) (CustomerExport, error) {
+	c, err := GetCustomer(ctx, id, db)
+	if err != nil {
+		return CustomerExport{}, err
+	}
+	export := CustomerExport{Customer: c, Vouchers: []CustomerVoucher{}, Redemptions: []DBModelRedemption{}}
+	err = db.SelectContext(ctx, &export.Vouchers, `SELECT vo.code, vo.customer_id, vo.special_offer_id, vo.expired_at, vo.used_at, vo.max_redemptions,
+										vo.max_per_customer, vo.redemption_count, vo.assignment,
+										so.id "offer.id", so.offer_id "offer.offer_id", so.name "offer.name", so.version "offer.version",
+										so.discount_type "offer.discount_type", so.discount "offer.discount", so.amount_minor "offer.amount_minor",
+										so.currency "offer.currency", so.created_at "offer.created_at", so.superseded_at "offer.superseded_at"
+										FROM vouchers vo INNER JOIN special_offers so ON so.id=vo.special_offer_id
+										WHERE vo.customer_id=$1 ORDER BY vo.id`, id)
+	if err != nil {
+		return CustomerExport{}, errors.Wrapf(err, "fail to query vouchers of customer %v", id)
+	}
+	err = db.SelectContext(ctx, &export.Redemptions, redemptionQuery+" WHERE r.customer_id=$1 ORDER BY r.id", id)
+	if err != nil {
+		return CustomerExport{}, errors.Wrapf(err, "fail to query redemptions of customer %v", id)
+	}
+	return export, nil
+}
+
+// EraseCustomer anonymizes the name and the email of the customer and releases its reservations. Its vouchers and
+// redemptions are kept for financial reporting, vouchers not redeemed yet cannot be redeemed any more as no email
+// leads to the customer. Erasing an erased customer returns it unchanged.
+func EraseCustomer(ctx context.Context, id uint64, db *sqlx.DB) (DBModelCustomer, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return DBModelCustomer{}, errors.Wrapf(err, "fail to begin erasure of customer %v", id)
+	}
+	c, err := eraseCustomer(ctx, id, tx)
+	if err != nil {
+		if err1 := tx.Rollback(); err1 != nil {
+			return DBModelCustomer{}, errors.Wrapf(err1, "fail to rollback erasure of customer %v, error %v", id, err)
+		}
+		return DBModelCustomer{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return DBModelCustomer{}, errors.Wrapf(err, "fail to commit erasure of customer %v", id)
+	}
+	return c, nil
+}
+
+func eraseCustomer(ctx context.Context, id uint64, tx *sqlx.Tx) (DBModelCustomer, error) {
+	c := DBModelCustomer{}
+	err := tx.GetContext(ctx, &c, "SELECT "+customerColumns+" FROM customers WHERE id=$1 FOR UPDATE", id)
+	if err == sql.ErrNoRows {
+		return DBModelCustomer{}, errors.Wrapf(ErrCustomerNotFound, "customer %v", id)
+	}
+	if err != nil {
+		return DBModelCustomer{}, errors.Wrapf(err, "fail to lock customer %v", id)
+	}
+	if c.ErasedAt.Valid {
+		return c, nil
+	}
+	now := time.Now()
+	err = tx.GetContext(ctx, &c, "UPDATE customers SET name='', email=$1, erased_at=$2, updated_at=$2 WHERE id=$3 RETURNING "+customerColumns,
+		erasedEmail(id), now, id)
+	if err != nil {
+		return DBModelCustomer{}, errors.Wrapf(err, "fail to erase customer %v", id)
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM reservations WHERE customer_id=$1", id)
+	if err != nil {
+		return DBModelCustomer{}, errors.Wrapf(err, "fail to release reservations of customer %v", id)
+	}
+	return c, nil
+}
+
+func GetCustomerIDByEmail(ctx context.Context, email string, db *sqlx.DB) (uint64, error) {
+	return findCustomerID(ctx, email, db)
+}
+
+func findCustomerID(ctx context.Context, email string, q sqlx.QueryerContext) (uint64, error) {
+	email = NormalizeEmail(email)
+	rows, err := q.QueryContext(ctx, "SELECT id FROM customers WHERE email=$1 AND erased_at IS NULL", email)
+	if err != nil {
+		return 0, errors.Wrapf(err, "fail to find customer with email %v", email)
+	}
+	var customerID uint64
+	if rows.Next() {
+		err := rows.Scan(&customerID)
+		if err != nil {
+			return 0, errors.Wrapf(err, "fail to query discount from table special_offers")
+		}
+	}
+	rows.Close()
+	if customerID == 0 {
+		return 0, errors.Wrapf(ErrCustomerNotFound, "email %v", email)
+	}
+	return customerID, nil
+}
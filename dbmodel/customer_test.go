@@ -0,0 +1,153 @@
+package dbmodel
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateCustomer(t *testing.T) {
+	tests := []struct {
+		name      string
+		insertErr error
+		wantErr   error
+	}{
+		{
+			name: "email is normalized",
+		},
+		{
+			name:      "email already exists",
+			insertErr: &pq.Error{Code: pqUniqueViolation, Constraint: "customers_email_key"},
+			wantErr:   ErrCustomerConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := setupSQLMock(t)
+			defer db.Close()
+			insert := mock.ExpectQuery(`INSERT INTO customers \(name, email\) VALUES \(\$1, \$2\) RETURNING id`).
+				WithArgs("customer 0", "customer0@gmail.com")
+			if tt.insertErr != nil {
+				insert.WillReturnError(tt.insertErr)
+			} else {
+				insert.WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			}
+
+			id, err := CreateCustomer(context.Background(), "customer 0", " Customer0@Gmail.COM ", sqlx.NewDb(db, "sqlmock"))
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+			} else {
+				assert.Nil(t, err)
+				assert.EqualValues(t, 1, id)
+			}
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDeleteCustomer(t *testing.T) {
+	tests := []struct {
+		name     string
+		affected int64
+		execErr  error
+		wantErr  error
+	}{
+		{
+			name:     "deleted",
+			affected: 1,
+		},
+		{
+			name:    "not found",
+			wantErr: ErrCustomerNotFound,
+		},
+		{
+			name:    "customer has vouchers",
+			execErr: &pq.Error{Code: pqForeignKeyViolation, Constraint: "vouchers_customer_id_fkey"},
+			wantErr: ErrCustomerInUse,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := setupSQLMock(t)
+			defer db.Close()
+			exec := mock.ExpectExec(`DELETE FROM customers WHERE id=\$1`).WithArgs(1)
+			if tt.execErr != nil {
+				exec.WillReturnError(tt.execErr)
+			} else {
+				exec.WillReturnResult(sqlmock.NewResult(0, tt.affected))
+			}
+
+			err := DeleteCustomer(context.Background(), 1, sqlx.NewDb(db, "sqlmock"))
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestEraseCustomer(t *testing.T) {
+	columns := []string{"id", "name", "email", "created_at", "updated_at", "erased_at"}
+	now := time.Now()
+	tests := []struct {
+		name     string
+		erasedAt sql.NullTime
+		notFound bool
+		wantErr  error
+	}{
+		{
+			name: "erase customer",
+		},
+		{
+			name:     "already erased",
+			erasedAt: sql.NullTime{Time: now, Valid: true},
+		},
+		{
+			name:     "not found",
+			notFound: true,
+			wantErr:  ErrCustomerNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := setupSQLMock(t)
+			defer db.Close()
+			mock.ExpectBegin()
+			lock := mock.ExpectQuery(`SELECT id, name, email, created_at, updated_at, erased_at FROM customers WHERE id=\$1 FOR UPDATE`).WithArgs(1)
+			switch {
+			case tt.notFound:
+				lock.WillReturnRows(sqlmock.NewRows(columns))
+				mock.ExpectRollback()
+			case tt.erasedAt.Valid:
+				lock.WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "", "erased-1@erased.invalid", now, now, tt.erasedAt))
+				mock.ExpectCommit()
+			default:
+				lock.WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "customer 0", "customer0@gmail.com", now, now, nil))
+				mock.ExpectQuery(`UPDATE customers SET name='', email=\$1, erased_at=\$2, updated_at=\$2 WHERE id=\$3 RETURNING`).
+					WithArgs("erased-1@erased.invalid", sqlmock.AnyArg(), 1).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "", "erased-1@erased.invalid", now, now, now))
+				mock.ExpectExec(`DELETE FROM reservations WHERE customer_id=\$1`).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}
+
+			c, err := EraseCustomer(context.Background(), 1, sqlx.NewDb(db, "sqlmock"))
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, "erased-1@erased.invalid", c.Email)
+				assert.True(t, c.ErasedAt.Valid)
+			}
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
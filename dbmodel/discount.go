@@ -0,0 +1,108 @@
+package dbmodel
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/ingemar0720/voucher-pool/money"
+	"github.com/pkg/errors"
+)
+
+type DiscountType string
+
+const (
+	DiscountPercentage DiscountType = "percentage"
+	DiscountFixed      DiscountType = "fixed"
+)
+
+// Discount of a special offer. Value is in hundredths of a percent for percentage discounts,
+// and in minor units of Currency for fixed amount discounts, e.g. 3850 is 38.50% and 1000 with EUR is 10.00 EUR.
+type Discount struct {
+	Type     DiscountType
+	Value    int64
+	Currency string
+}
+
+func PercentageDiscount(basisPoints int64) Discount {
+	return Discount{Type: DiscountPercentage, Value: basisPoints}
+}
+
+func FixedDiscount(minor int64, currency string) Discount {
+	return Discount{Type: DiscountFixed, Value: minor, Currency: currency}
+}
+
+// Validate checks the discount satisfies the constraints of table special_offers
+func (d Discount) Validate() error {
+	switch d.Type {
+	case DiscountPercentage:
+		if d.Value <= 0 || d.Value > 100*100 || d.Currency != "" {
+			return errors.Errorf("percentage discount shall be in (0, 100.00] without currency, got %v", d)
+		}
+	case DiscountFixed:
+		if _, err := money.LookupCurrency(d.Currency); err != nil {
+			return err
+		}
+		if d.Value <= 0 {
+			return errors.Errorf("fixed discount shall be positive, got %v", d)
+		}
+	default:
+		return errors.Errorf("unknown discount type %q", d.Type)
+	}
+	return nil
+}
+
+// Scale is the number of fraction digits of Value
+func (d Discount) Scale() int {
+	if d.Type == DiscountFixed {
+		c, err := money.LookupCurrency(d.Currency)
+		if err == nil {
+			return c.Exponent
+		}
+	}
+	return money.PercentScale
+}
+
+// Decimal formats Value as an exact decimal, e.g. "38.50" or "10.00"
+func (d Discount) Decimal() string {
+	return money.FormatDecimal(d.Value, d.Scale())
+}
+
+func (d Discount) String() string {
+	if d.Type == DiscountFixed {
+		return fmt.Sprintf("%v %v", d.Decimal(), d.Currency)
+	}
+	return d.Decimal() + "%"
+}
+
+// newSpecialOffer returns the row of table special_offers, percentage discounts are kept in column discount
+// and fixed amount discounts in columns amount_minor and currency
+func newSpecialOffer(name string, d Discount) DBModelSpecialOffer {
+	if d.Type == DiscountFixed {
+		return DBModelSpecialOffer{
+			Name:         name,
+			DiscountType: string(d.Type),
+			AmountMinor:  sql.NullInt64{Int64: d.Value, Valid: true},
+			Currency:     sql.NullString{String: d.Currency, Valid: true},
+		}
+	}
+	return DBModelSpecialOffer{
+		Name:         name,
+		DiscountType: string(DiscountPercentage),
+		Discount:     sql.NullString{String: d.Decimal(), Valid: true},
+	}
+}
+
+// Terms returns the discount of the offer
+func (o DBModelSpecialOffer) Terms() (Discount, error) {
+	if DiscountType(o.DiscountType) == DiscountFixed {
+		if !o.AmountMinor.Valid || !o.Currency.Valid {
+			return Discount{}, errors.New("fixed discount without amount or currency")
+		}
+		return FixedDiscount(o.AmountMinor.Int64, o.Currency.String), nil
+	}
+	basisPoints, err := money.ParseDecimal(o.Discount.String, money.PercentScale)
+	if err != nil {
+		return Discount{}, errors.Wrapf(err, "fail to parse percentage discount")
+	}
+	return PercentageDiscount(basisPoints), nil
+}
@@ -0,0 +1,41 @@
+package dbmodel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscountValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		given   Discount
+		wantErr bool
+	}{
+		{name: "percentage", given: PercentageDiscount(3850)},
+		{name: "100 percent", given: PercentageDiscount(10000)},
+		{name: "over 100 percent", given: PercentageDiscount(10001), wantErr: true},
+		{name: "zero percent", given: PercentageDiscount(0), wantErr: true},
+		{name: "percentage with currency", given: Discount{Type: DiscountPercentage, Value: 1000, Currency: "EUR"}, wantErr: true},
+		{name: "fixed amount", given: FixedDiscount(1000, "EUR")},
+		{name: "fixed amount without currency", given: FixedDiscount(1000, ""), wantErr: true},
+		{name: "negative fixed amount", given: FixedDiscount(-1, "EUR"), wantErr: true},
+		{name: "unknown type", given: Discount{Type: "bogo", Value: 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantErr, tt.given.Validate() != nil)
+		})
+	}
+}
+
+func TestSpecialOfferTerms(t *testing.T) {
+	for _, d := range []Discount{PercentageDiscount(3850), FixedDiscount(1000, "EUR"), FixedDiscount(500, "JPY")} {
+		got, err := newSpecialOffer("offer", d).Terms()
+		assert.Nil(t, err)
+		assert.Equal(t, d, got)
+	}
+	assert.Equal(t, "38.50%", PercentageDiscount(3850).String())
+	assert.Equal(t, "10.00 EUR", FixedDiscount(1000, "EUR").String())
+	assert.Equal(t, "500 JPY", FixedDiscount(500, "JPY").String())
+}
@@ -0,0 +1,58 @@
+package dbmodel
+
+import (
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// errors returned by the stores, callers shall check them with errors.Is as they are usually wrapped
+var (
+	ErrVoucherNotFound  = errors.New("voucher not found")
+	ErrVoucherNotOwned  = errors.New("voucher belongs to another customer")
+	ErrVoucherExpired   = errors.New("voucher expired")
+	ErrVoucherRedeemed  = errors.New("this voucher has been redeemed")
+	ErrCustomerNotFound = errors.New("customer not found")
+	// another customer has the email
+	ErrCustomerConflict = errors.New("customer email already exists")
+	// customers with vouchers, redemptions or reservations cannot be deleted
+	ErrCustomerInUse = errors.New("customer has vouchers or redemptions")
+	// the personal data of the customer is erased, it cannot be changed any more
+	ErrCustomerErased = errors.New("customer is erased")
+	// the name of the offer is taken or the offer changed meanwhile
+	ErrOfferConflict = errors.New("special offer conflicts with its constraints")
+	// the spec or the discount of the offer does not validate
+	ErrInvalidOffer  = errors.New("special offer is invalid")
+	ErrOfferNotFound = errors.New("special offer not found")
+	// no voucher can be issued or redeemed for a deactivated or archived offer
+	ErrOfferInactive = errors.New("special offer is deactivated")
+	// the vouchers of the offer cannot be redeemed before the offer starts
+	ErrOfferNotStarted = errors.New("special offer has not started yet")
+	ErrOfferEnded      = errors.New("special offer has ended")
+	// archived offers cannot be changed any more
+	ErrOfferArchived = errors.New("special offer is archived")
+	ErrCodeConflict  = errors.New("voucher code already exists")
+	// the voucher is held by a reservation not expired yet
+	ErrVoucherReserved     = errors.New("voucher is reserved")
+	ErrReservationNotFound = errors.New("reservation not found")
+	ErrReservationExpired  = errors.New("reservation expired")
+	ErrVoucherNotRedeemed  = errors.New("voucher has not been redeemed")
+	// the customer has redeemed the voucher as many times as its limit per customer
+	ErrCustomerLimitReached = errors.New("customer has reached the redemption limit of this voucher")
+	// the vouchers redeemed together for an order break the stacking policy of their offers
+	ErrStackingConflict = errors.New("vouchers cannot be combined")
+	// the vouchers of offers with a stacking policy are only redeemed together with the other codes of their order, so
+	// the policy applies to them
+	ErrStackingPolicy = errors.New("vouchers of offers with a stacking policy shall be redeemed with the redeem API")
+)
+
+// postgres error codes, https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	pqForeignKeyViolation pq.ErrorCode = "23503"
+	pqUniqueViolation     pq.ErrorCode = "23505"
+	pqCheckViolation      pq.ErrorCode = "23514"
+)
+
+func isViolation(err error, code pq.ErrorCode) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == code
+}
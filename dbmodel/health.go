@@ -0,0 +1,51 @@
+package dbmodel
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// SchemaVersion is the latest migration of db/migrations the code is written against, bump it with every migration
+const SchemaVersion = "20210825120000"
+
+// the table dbmigrate records the applied migrations in, by the timestamp prefix of their file names
+const migrationsTable = "dbmigrate_versions"
+
+// HealthChecker is implemented by the stores backed by a database, it tells whether the store can serve requests
+type HealthChecker interface {
+	Ping(ctx context.Context) error
+	// return the latest migration applied to the database, empty if none
+	MigrationVersion(ctx context.Context) (string, error)
+	// return the connection pool statistics
+	Stats() sql.DBStats
+}
+
+var _ HealthChecker = (*PostgresStore)(nil)
+
+// MigrationVersion returns the latest migration applied to the database, empty if none
+func MigrationVersion(ctx context.Context, db *sqlx.DB) (string, error) {
+	var version sql.NullString
+	err := db.GetContext(ctx, &version, "SELECT MAX(version) FROM "+migrationsTable)
+	if err != nil {
+		return "", errors.Wrapf(err, "fail to query migration version")
+	}
+	return version.String, nil
+}
+
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	if err := s.DB.PingContext(ctx); err != nil {
+		return errors.Wrapf(err, "fail to ping db")
+	}
+	return nil
+}
+
+func (s *PostgresStore) MigrationVersion(ctx context.Context) (string, error) {
+	return MigrationVersion(ctx, s.DB)
+}
+
+func (s *PostgresStore) Stats() sql.DBStats {
+	return s.DB.Stats()
+}
@@ -0,0 +1,42 @@
+package dbmodel
+
+import (
+	"context"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// SchemaVersion shall be bumped with every migration, readiness fails otherwise
+func TestSchemaVersion(t *testing.T) {
+	files, err := ioutil.ReadDir("../db/migrations")
+	require.Nil(t, err)
+	var versions []string
+	for _, f := range files {
+		versions = append(versions, strings.SplitN(f.Name(), "_", 2)[0])
+	}
+	sort.Strings(versions)
+	require.NotEmpty(t, versions)
+	assert.Equal(t, versions[len(versions)-1], SchemaVersion)
+}
+
+func TestMigrationVersion(t *testing.T) {
+	db, mock := setupSQLMock(t)
+	defer db.Close()
+	mock.ExpectQuery("SELECT MAX\\(version\\) FROM dbmigrate_versions").WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(SchemaVersion))
+	mock.ExpectQuery("SELECT MAX\\(version\\) FROM dbmigrate_versions").WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(nil))
+
+	version, err := MigrationVersion(context.Background(), sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+	assert.Equal(t, SchemaVersion, version)
+	version, err = MigrationVersion(context.Background(), sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+	assert.Empty(t, version)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,87 @@
+package dbmodel
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// DBModelIdempotencyKey is a request sent with an idempotency key and its response, the scope is the endpoint the key
+// is used for. Status is not valid while the first request with the key is in progress.
+type DBModelIdempotencyKey struct {
+	Scope       string        `json:"scope" db:"scope"`
+	Key         string        `json:"key" db:"key"`
+	Fingerprint string        `json:"fingerprint" db:"fingerprint"`
+	Status      sql.NullInt64 `json:"status" db:"status"`
+	Body        []byte        `json:"body" db:"body"`
+	CreatedAt   time.Time     `json:"created_at" db:"created_at"`
+	ExpiresAt   time.Time     `json:"expires_at" db:"expires_at"`
+}
+
+const idempotencyKeyColumns = "scope, key, fingerprint, status, body, created_at, expires_at"
+
+// ClaimIdempotencyKey records the key for the request of fingerprint until expiresAt and returns true, or returns the
+// record of the key and false if another request has it. A key expired at now is taken over, so a key whose request
+// never saved a response, e.g. as the service crashed, is free again once its claim expires.
+func ClaimIdempotencyKey(ctx context.Context, scope, key, fingerprint string, now, expiresAt time.Time, db *sqlx.DB) (DBModelIdempotencyKey, bool, error) {
+	k := DBModelIdempotencyKey{}
+	err := db.GetContext(ctx, &k, `INSERT INTO idempotency_keys (scope, key, fingerprint, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)
+										ON CONFLICT (scope, key) DO UPDATE SET fingerprint=EXCLUDED.fingerprint, status=NULL, body=NULL,
+										created_at=EXCLUDED.created_at, expires_at=EXCLUDED.expires_at
+										WHERE idempotency_keys.expires_at<=EXCLUDED.created_at RETURNING `+idempotencyKeyColumns,
+		scope, key, fingerprint, now, expiresAt)
+	if err == nil {
+		return k, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return DBModelIdempotencyKey{}, false, errors.Wrapf(err, "fail to claim idempotency key %v", key)
+	}
+	// the key is taken and not expired
+	err = db.GetContext(ctx, &k, "SELECT "+idempotencyKeyColumns+" FROM idempotency_keys WHERE scope=$1 AND key=$2", scope, key)
+	if err == sql.ErrNoRows {
+		return DBModelIdempotencyKey{}, false, errors.Errorf("fail to claim idempotency key %v, it was deleted meanwhile", key)
+	}
+	if err != nil {
+		return DBModelIdempotencyKey{}, false, errors.Wrapf(err, "fail to query idempotency key %v", key)
+	}
+	return k, false, nil
+}
+
+// SaveIdempotentResponse records the response of the request which claimed the key, it is replayed to the retries
+// until expiresAt. The key was claimed for the time the request may run only. The claim is told by its fingerprint and
+// createdAt, a request which outlived its claim does not overwrite the claim of a retry.
+func SaveIdempotentResponse(ctx context.Context, scope, key, fingerprint string, createdAt time.Time, status int, body []byte, expiresAt time.Time, db *sqlx.DB) error {
+	_, err := db.ExecContext(ctx, "UPDATE idempotency_keys SET status=$1, body=$2, expires_at=$3 WHERE scope=$4 AND key=$5 AND fingerprint=$6 AND created_at=$7",
+		status, body, expiresAt, scope, key, fingerprint, createdAt)
+	if err != nil {
+		return errors.Wrapf(err, "fail to save response of idempotency key %v", key)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey deletes the key claimed by a request without a response to replay, so a retry runs again.
+// Like SaveIdempotentResponse, only the claim of fingerprint and createdAt is deleted.
+func ReleaseIdempotencyKey(ctx context.Context, scope, key, fingerprint string, createdAt time.Time, db *sqlx.DB) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE scope=$1 AND key=$2 AND fingerprint=$3 AND created_at=$4",
+		scope, key, fingerprint, createdAt)
+	if err != nil {
+		return errors.Wrapf(err, "fail to delete idempotency key %v", key)
+	}
+	return nil
+}
+
+// DeleteExpiredIdempotencyKeys deletes the keys expired at now and returns how many were deleted
+func DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time, db *sqlx.DB) (int64, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at<=$1", now)
+	if err != nil {
+		return 0, errors.Wrapf(err, "fail to delete expired idempotency keys")
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrapf(err, "fail to delete expired idempotency keys")
+	}
+	return affected, nil
+}
@@ -0,0 +1,74 @@
+package dbmodel
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimIdempotencyKey(t *testing.T) {
+	db, mock := setupSQLMock(t)
+	defer db.Close()
+	columns := []string{"scope", "key", "fingerprint", "status", "body", "created_at", "expires_at"}
+	now := time.Now()
+	expiresAt := now.Add(time.Hour)
+	for _, tt := range []struct {
+		name        string
+		givenTaken  bool
+		want        DBModelIdempotencyKey
+		wantClaimed bool
+	}{
+		{
+			name:        "claim key",
+			want:        DBModelIdempotencyKey{Scope: "scope", Key: "key", Fingerprint: "f1", CreatedAt: now, ExpiresAt: expiresAt},
+			wantClaimed: true,
+		},
+		{
+			name:       "key taken",
+			givenTaken: true,
+			want: DBModelIdempotencyKey{Scope: "scope", Key: "key", Fingerprint: "f0", Status: sql.NullInt64{Int64: 201, Valid: true},
+				Body: []byte(`{}`), CreatedAt: now, ExpiresAt: expiresAt},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			claim := mock.ExpectQuery("INSERT INTO idempotency_keys (.+) ON CONFLICT (.+) WHERE idempotency_keys.expires_at<=EXCLUDED.created_at RETURNING (.+)").
+				WithArgs("scope", "key", "f1", now, expiresAt)
+			if tt.givenTaken {
+				claim.WillReturnError(sql.ErrNoRows)
+				mock.ExpectQuery("SELECT (.+) FROM idempotency_keys WHERE scope=(.+) AND key=(.+)").WithArgs("scope", "key").
+					WillReturnRows(sqlmock.NewRows(columns).AddRow("scope", "key", "f0", 201, []byte(`{}`), now, expiresAt))
+			} else {
+				claim.WillReturnRows(sqlmock.NewRows(columns).AddRow("scope", "key", "f1", nil, nil, now, expiresAt))
+			}
+
+			got, claimed, err := ClaimIdempotencyKey(context.Background(), "scope", "key", "f1", now, expiresAt, sqlx.NewDb(db, "sqlmock"))
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantClaimed, claimed)
+			assert.Equal(t, tt.want, got)
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSaveAndReleaseIdempotencyKey(t *testing.T) {
+	db, mock := setupSQLMock(t)
+	defer db.Close()
+	createdAt := time.Now()
+	expiresAt := createdAt.Add(time.Hour)
+	sqlxDB := sqlx.NewDb(db, "sqlmock")
+
+	// only the claim of the request is updated or deleted, a retry may have taken the key over meanwhile
+	mock.ExpectExec("UPDATE idempotency_keys SET (.+) WHERE scope=(.+) AND key=(.+) AND fingerprint=(.+) AND created_at=(.+)").
+		WithArgs(201, []byte(`{}`), expiresAt, "scope", "key", "f1", createdAt).WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.Nil(t, SaveIdempotentResponse(context.Background(), "scope", "key", "f1", createdAt, 201, []byte(`{}`), expiresAt, sqlxDB))
+
+	mock.ExpectExec("DELETE FROM idempotency_keys WHERE scope=(.+) AND key=(.+) AND fingerprint=(.+) AND created_at=(.+)").
+		WithArgs("scope", "key", "f1", createdAt).WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.Nil(t, ReleaseIdempotencyKey(context.Background(), "scope", "key", "f1", createdAt, sqlxDB))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,89 @@
+package dbmodel
+
+import (
+	"database/sql"
+
+	"github.com/ingemar0720/voucher-pool/rules"
+)
+
+// Limits of the redemptions of a voucher, the zero value is a single-use voucher
+type Limits struct {
+	// MaxRedemptions is how many times the voucher can be redeemed in total, 1 if 0
+	MaxRedemptions int
+	// MaxPerCustomer is how many times one customer can redeem the voucher, no limit but MaxRedemptions if 0
+	MaxPerCustomer int
+}
+
+func (l Limits) maxRedemptions() int {
+	if l.MaxRedemptions <= 0 {
+		return 1
+	}
+	return l.MaxRedemptions
+}
+
+func (l Limits) maxPerCustomer() sql.NullInt64 {
+	if l.MaxPerCustomer <= 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(l.MaxPerCustomer), Valid: true}
+}
+
+// RedeemResult is the discount of a voucher and how many more times the customer can redeem it
+type RedeemResult struct {
+	// OfferID is the offer the voucher is issued for
+	OfferID       uint64
+	Discount      Discount
+	RemainingUses int
+	// Rules are the eligibility rules of the offer, the caller evaluates them against the order
+	Rules rules.Set
+	// Stacking is the stacking policy of the offer
+	Stacking Stacking
+}
+
+// voucherUsage counts the redemptions and reservations of a voucher, in total and by one customer.
+// Reservations not expired yet count like redemptions, they hold a use of the voucher.
+type voucherUsage struct {
+	maxRedemptions int
+	maxPerCustomer sql.NullInt64
+	// claim vouchers belong to the customer who holds a redemption or reservation of them
+	claim            bool
+	heldByOthers     int
+	redemptions      int
+	reserved         int
+	customerRedeemed int
+	customerReserved int
+}
+
+// check returns why the customer cannot take another use of the voucher, or nil if they can
+func (u voucherUsage) check() error {
+	if u.claim && u.heldByOthers > 0 {
+		return ErrVoucherNotOwned
+	}
+	if u.redemptions >= u.maxRedemptions {
+		return ErrVoucherRedeemed
+	}
+	if u.maxPerCustomer.Valid && int64(u.customerRedeemed) >= u.maxPerCustomer.Int64 {
+		return ErrCustomerLimitReached
+	}
+	if u.redemptions+u.reserved >= u.maxRedemptions {
+		return ErrVoucherReserved
+	}
+	if u.maxPerCustomer.Valid && int64(u.customerRedeemed+u.customerReserved) >= u.maxPerCustomer.Int64 {
+		return ErrVoucherReserved
+	}
+	return nil
+}
+
+// remaining returns how many more times the customer can redeem the voucher
+func (u voucherUsage) remaining() int {
+	remaining := u.maxRedemptions - u.redemptions - u.reserved
+	if u.maxPerCustomer.Valid {
+		if byCustomer := int(u.maxPerCustomer.Int64) - u.customerRedeemed - u.customerReserved; byCustomer < remaining {
+			remaining = byCustomer
+		}
+	}
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
@@ -0,0 +1,1034 @@
+package dbmodel
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/rules"
+	"github.com/pkg/errors"
+)
+
+type memoryCustomer struct {
+	ID        uint64
+	Name      string
+	Email     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	ErasedAt  sql.NullTime
+}
+
+func (c *memoryCustomer) row() DBModelCustomer {
+	return DBModelCustomer{ID: c.ID, Name: c.Name, Email: c.Email, CreatedAt: c.CreatedAt, UpdatedAt: c.UpdatedAt, ErasedAt: c.ErasedAt}
+}
+
+// memoryOffer is a version of an offer, a row of table special_offers
+type memoryOffer struct {
+	ID           uint64
+	OfferID      uint64
+	Name         string
+	Version      int
+	Discount     Discount
+	CreatedAt    time.Time
+	SupersededAt sql.NullTime
+}
+
+// row returns the offer as a row of table special_offers
+func (o *memoryOffer) row() DBModelSpecialOffer {
+	row := newSpecialOffer(o.Name, o.Discount)
+	row.ID = o.ID
+	row.OfferID = o.OfferID
+	row.Version = o.Version
+	row.CreatedAt = o.CreatedAt
+	row.SupersededAt = o.SupersededAt
+	return row
+}
+
+// memoryOfferState is a row of table offers
+type memoryOfferState struct {
+	ID          uint64
+	Description string
+	StartsAt    sql.NullTime
+	EndsAt      sql.NullTime
+	Active      bool
+	ArchivedAt  sql.NullTime
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Rules       rules.Set
+	Stacking    Stacking
+	// the id of the current version
+	CurrentID uint64
+}
+
+func (o *memoryOfferState) state() offerState {
+	return offerState{active: o.Active, archivedAt: o.ArchivedAt, startsAt: o.StartsAt, endsAt: o.EndsAt, rules: o.Rules, stacking: o.Stacking}
+}
+
+type memoryVoucher struct {
+	ID uint64
+	DBModelVoucher
+}
+
+type memoryRedemption struct {
+	DBModelRedemption
+	CustomerID uint64
+}
+
+type memoryReservation struct {
+	ID         string
+	Code       string
+	CustomerID uint64
+	ExpiresAt  time.Time
+}
+
+// MemoryStore implements VoucherStore in process memory, it is safe for concurrent use.
+// It mirrors the constraints of the postgres schema and is meant for tests and local demos.
+type MemoryStore struct {
+	mu              sync.Mutex
+	customers       map[uint64]*memoryCustomer
+	customerByEmail map[string]uint64
+	offers          map[uint64]*memoryOffer
+	offerStates     map[uint64]*memoryOfferState
+	// the id of the current version of the offer
+	offerByName  map[string]uint64
+	vouchers     map[string]*memoryVoucher
+	reservations map[string]*memoryReservation
+	idempotency  map[idempotencyScopeKey]*DBModelIdempotencyKey
+	// in the order of their ids
+	redemptions []*memoryRedemption
+	// sequences of the ids, one per table like postgres SERIAL
+	lastCustomerID   uint64
+	lastOfferStateID uint64
+	lastOfferID      uint64
+	lastVoucherID    uint64
+	lastRedemptionID uint64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		customers:       map[uint64]*memoryCustomer{},
+		customerByEmail: map[string]uint64{},
+		offers:          map[uint64]*memoryOffer{},
+		offerStates:     map[uint64]*memoryOfferState{},
+		offerByName:     map[string]uint64{},
+		vouchers:        map[string]*memoryVoucher{},
+		reservations:    map[string]*memoryReservation{},
+		idempotency:     map[idempotencyScopeKey]*DBModelIdempotencyKey{},
+	}
+}
+
+func nextID(seq *uint64) uint64 {
+	*seq++
+	return *seq
+}
+
+func (s *MemoryStore) CreateCustomer(ctx context.Context, name, email string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	email = NormalizeEmail(email)
+	if _, ok := s.customerByEmail[email]; ok {
+		return 0, errors.Wrapf(ErrCustomerConflict, "fail to insert customer with email %v", email)
+	}
+	now := time.Now()
+	c := &memoryCustomer{ID: nextID(&s.lastCustomerID), Name: name, Email: email, CreatedAt: now, UpdatedAt: now}
+	s.customers[c.ID] = c
+	s.customerByEmail[email] = c.ID
+	return c.ID, nil
+}
+
+func (s *MemoryStore) GetCustomer(ctx context.Context, id uint64) (DBModelCustomer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.customers[id]
+	if !ok {
+		return DBModelCustomer{}, errors.Wrapf(ErrCustomerNotFound, "customer %v", id)
+	}
+	return c.row(), nil
+}
+
+func (s *MemoryStore) ListCustomers(ctx context.Context, filter CustomerFilter, afterID uint64, limit int) ([]DBModelCustomer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	customers := []DBModelCustomer{}
+	for _, c := range s.customers {
+		if c.ID > afterID && s.matchCustomer(c, filter) {
+			customers = append(customers, c.row())
+		}
+	}
+	sort.Slice(customers, func(i, j int) bool { return customers[i].ID < customers[j].ID })
+	if len(customers) > limit {
+		customers = customers[:limit]
+	}
+	return customers, nil
+}
+
+func (s *MemoryStore) UpdateCustomer(ctx context.Context, id uint64, name, email string) (DBModelCustomer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.customers[id]
+	if !ok {
+		return DBModelCustomer{}, errors.Wrapf(ErrCustomerNotFound, "customer %v", id)
+	}
+	if c.ErasedAt.Valid {
+		return DBModelCustomer{}, errors.Wrapf(ErrCustomerErased, "customer %v", id)
+	}
+	email = NormalizeEmail(email)
+	if other, ok := s.customerByEmail[email]; ok && other != id {
+		return DBModelCustomer{}, errors.Wrapf(ErrCustomerConflict, "fail to update customer %v", id)
+	}
+	delete(s.customerByEmail, c.Email)
+	c.Name = name
+	c.Email = email
+	c.UpdatedAt = time.Now()
+	s.customerByEmail[email] = id
+	return c.row(), nil
+}
+
+// DeleteCustomer deletes the customer, like the foreign keys of postgres it fails if vouchers, redemptions or
+// reservations refer to it
+func (s *MemoryStore) DeleteCustomer(ctx context.Context, id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.customers[id]
+	if !ok {
+		return errors.Wrapf(ErrCustomerNotFound, "customer %v", id)
+	}
+	for _, v := range s.vouchers {
+		if v.CustomerID == id {
+			return errors.Wrapf(ErrCustomerInUse, "fail to delete customer %v", id)
+		}
+	}
+	for _, r := range s.redemptions {
+		if r.CustomerID == id {
+			return errors.Wrapf(ErrCustomerInUse, "fail to delete customer %v", id)
+		}
+	}
+	for _, r := range s.reservations {
+		if r.CustomerID == id {
+			return errors.Wrapf(ErrCustomerInUse, "fail to delete customer %v", id)
+		}
+	}
+	delete(s.customerByEmail, c.Email)
+	delete(s.customers, id)
+	return nil
+}
+
+func (s *MemoryStore) ExportCustomer(ctx context.Context, id uint64) (CustomerExport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.customers[id]
+	if !ok {
+		return CustomerExport{}, errors.Wrapf(ErrCustomerNotFound, "customer %v", id)
+	}
+	export := CustomerExport{Customer: c.row(), Vouchers: []CustomerVoucher{}, Redemptions: []DBModelRedemption{}}
+	vouchers := []*memoryVoucher{}
+	for _, v := range s.vouchers {
+		if v.CustomerID == id {
+			vouchers = append(vouchers, v)
+		}
+	}
+	sort.Slice(vouchers, func(i, j int) bool { return vouchers[i].ID < vouchers[j].ID })
+	for _, v := range vouchers {
+		export.Vouchers = append(export.Vouchers, CustomerVoucher{DBModelVoucher: v.DBModelVoucher, Offer: s.offers[v.SpecialOfferID].row()})
+	}
+	for _, r := range s.redemptions {
+		if r.CustomerID == id {
+			export.Redemptions = append(export.Redemptions, s.redemption(r))
+		}
+	}
+	return export, nil
+}
+
+// EraseCustomer anonymizes the customer like the postgres store, the erased email stays taken by the customer
+func (s *MemoryStore) EraseCustomer(ctx context.Context, id uint64) (DBModelCustomer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.customers[id]
+	if !ok {
+		return DBModelCustomer{}, errors.Wrapf(ErrCustomerNotFound, "customer %v", id)
+	}
+	if c.ErasedAt.Valid {
+		return c.row(), nil
+	}
+	now := time.Now()
+	delete(s.customerByEmail, c.Email)
+	c.Name = ""
+	c.Email = erasedEmail(id)
+	c.ErasedAt = sql.NullTime{Time: now, Valid: true}
+	c.UpdatedAt = now
+	s.customerByEmail[c.Email] = id
+	for reservationID, r := range s.reservations {
+		if r.CustomerID == id {
+			delete(s.reservations, reservationID)
+		}
+	}
+	return c.row(), nil
+}
+
+// matchCustomer assumes s.mu is held
+func (s *MemoryStore) matchCustomer(c *memoryCustomer, filter CustomerFilter) bool {
+	return filter.EmailDomain == "" || strings.HasSuffix(c.Email, "@"+strings.ToLower(filter.EmailDomain))
+}
+
+func (s *MemoryStore) GetCustomerIDByEmail(ctx context.Context, email string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.customerID(email)
+}
+
+func (s *MemoryStore) customerID(email string) (uint64, error) {
+	email = NormalizeEmail(email)
+	customerID, ok := s.customerByEmail[email]
+	if !ok || s.customers[customerID].ErasedAt.Valid {
+		return 0, errors.Wrapf(ErrCustomerNotFound, "email %v", email)
+	}
+	return customerID, nil
+}
+
+func (s *MemoryStore) CreateOffer(ctx context.Context, spec OfferSpec) (DBModelOffer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := spec.Validate(); err != nil {
+		return DBModelOffer{}, errors.Wrapf(ErrInvalidOffer, "%v", err)
+	}
+	if _, ok := s.offerByName[spec.Name]; ok {
+		return DBModelOffer{}, errors.Wrapf(ErrOfferConflict, "offer name %v is taken", spec.Name)
+	}
+	now := time.Now()
+	o := &memoryOfferState{
+		ID:          nextID(&s.lastOfferStateID),
+		Description: spec.Description,
+		StartsAt:    spec.StartsAt,
+		EndsAt:      spec.EndsAt,
+		Active:      spec.Active,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Rules:       spec.Rules.Copy(),
+		Stacking:    spec.Stacking,
+	}
+	s.offerStates[o.ID] = o
+	s.insertOfferVersion(o, 1, spec.Name, spec.Discount)
+	return s.offer(o), nil
+}
+
+func (s *MemoryStore) GetOffer(ctx context.Context, id uint64) (DBModelOffer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.offerStates[id]
+	if !ok {
+		return DBModelOffer{}, errors.Wrapf(ErrOfferNotFound, "offer %v", id)
+	}
+	return s.offer(o), nil
+}
+
+func (s *MemoryStore) ListOffers(ctx context.Context, filter OfferFilter) ([]DBModelOffer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states := make([]*memoryOfferState, 0, len(s.offerStates))
+	for _, o := range s.offerStates {
+		if o.ID > filter.AfterID && (filter.Archived || !o.ArchivedAt.Valid) {
+			states = append(states, o)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	offers := []DBModelOffer{}
+	for _, o := range states {
+		if len(offers) == filter.Limit {
+			break
+		}
+		offers = append(offers, s.offer(o))
+	}
+	return offers, nil
+}
+
+func (s *MemoryStore) UpdateOffer(ctx context.Context, id uint64, spec OfferSpec) (DBModelOffer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := spec.Validate(); err != nil {
+		return DBModelOffer{}, errors.Wrapf(ErrInvalidOffer, "%v", err)
+	}
+	o, ok := s.offerStates[id]
+	if !ok {
+		return DBModelOffer{}, errors.Wrapf(ErrOfferNotFound, "offer %v", id)
+	}
+	if o.ArchivedAt.Valid {
+		return DBModelOffer{}, errors.Wrapf(ErrOfferArchived, "offer %v", id)
+	}
+	current := s.offers[o.CurrentID]
+	if current.Name != spec.Name {
+		if _, ok := s.offerByName[spec.Name]; ok {
+			return DBModelOffer{}, errors.Wrapf(ErrOfferConflict, "offer name %v is taken", spec.Name)
+		}
+	}
+	if current.Name != spec.Name || current.Discount != spec.Discount {
+		s.supersedeOfferVersion(o, spec.Name, spec.Discount)
+	}
+	o.Description = spec.Description
+	o.StartsAt = spec.StartsAt
+	o.EndsAt = spec.EndsAt
+	o.Active = spec.Active
+	o.Rules = spec.Rules.Copy()
+	o.Stacking = spec.Stacking
+	o.UpdatedAt = time.Now()
+	return s.offer(o), nil
+}
+
+func (s *MemoryStore) ArchiveOffer(ctx context.Context, id uint64) (DBModelOffer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.offerStates[id]
+	if !ok {
+		return DBModelOffer{}, errors.Wrapf(ErrOfferNotFound, "offer %v", id)
+	}
+	now := time.Now()
+	if !o.ArchivedAt.Valid {
+		o.ArchivedAt = sql.NullTime{Time: now, Valid: true}
+	}
+	o.UpdatedAt = now
+	return s.offer(o), nil
+}
+
+func (s *MemoryStore) GetOfferHistory(ctx context.Context, id uint64) ([]DBModelSpecialOffer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var offers []DBModelSpecialOffer
+	for _, o := range s.offers {
+		if o.OfferID == id {
+			offers = append(offers, o.row())
+		}
+	}
+	if len(offers) == 0 {
+		return nil, errors.Wrapf(ErrOfferNotFound, "offer %v", id)
+	}
+	sort.Slice(offers, func(i, j int) bool { return offers[i].Version < offers[j].Version })
+	return offers, nil
+}
+
+// offer assumes s.mu is held
+func (s *MemoryStore) offer(o *memoryOfferState) DBModelOffer {
+	return DBModelOffer{
+		ID:               o.ID,
+		Description:      o.Description,
+		StartsAt:         o.StartsAt,
+		EndsAt:           o.EndsAt,
+		Active:           o.Active,
+		ArchivedAt:       o.ArchivedAt,
+		CreatedAt:        o.CreatedAt,
+		UpdatedAt:        o.UpdatedAt,
+		Rules:            o.Rules.Copy(),
+		Exclusive:        o.Stacking.Exclusive,
+		StackGroup:       o.Stacking.Group,
+		MaxTotalDiscount: o.Stacking.maxTotalDiscount(),
+		Current:          s.offers[o.CurrentID].row(),
+	}
+}
+
+// offerState assumes s.mu is held, it returns the state of the offer of the voucher
+func (s *MemoryStore) offerState(v *memoryVoucher) offerState {
+	return s.offerStates[s.offers[v.SpecialOfferID].OfferID].state()
+}
+
+// resolveOffer assumes s.mu is held, it is the same as the postgres resolveOffer
+func (s *MemoryStore) resolveOffer(ref OfferRef) (*memoryOffer, error) {
+	if ref.ID == 0 {
+		return s.reviseSpecialOffer(ref.Name, ref.Discount)
+	}
+	o, ok := s.offerStates[ref.ID]
+	if !ok {
+		return nil, errors.Wrapf(ErrOfferNotFound, "offer %v", ref.ID)
+	}
+	if err := o.state().checkIssue(time.Now()); err != nil {
+		return nil, errors.Wrapf(err, "offer %v", ref.ID)
+	}
+	return s.offers[o.CurrentID], nil
+}
+
+// reviseSpecialOffer assumes s.mu is held, it is the same as the postgres reviseSpecialOffer
+func (s *MemoryStore) reviseSpecialOffer(name string, discount Discount) (*memoryOffer, error) {
+	if err := discount.Validate(); err != nil {
+		return nil, errors.Wrapf(ErrInvalidOffer, "%v", err)
+	}
+	currentID, ok := s.offerByName[name]
+	if !ok {
+		now := time.Now()
+		o := &memoryOfferState{ID: nextID(&s.lastOfferStateID), Active: true, CreatedAt: now, UpdatedAt: now}
+		s.offerStates[o.ID] = o
+		return s.insertOfferVersion(o, 1, name, discount), nil
+	}
+	current := s.offers[currentID]
+	o := s.offerStates[current.OfferID]
+	if err := o.state().checkIssue(time.Now()); err != nil {
+		return nil, errors.Wrapf(err, "offer %v", name)
+	}
+	if current.Discount == discount {
+		return current, nil
+	}
+	return s.supersedeOfferVersion(o, name, discount), nil
+}
+
+// supersedeOfferVersion assumes s.mu is held
+func (s *MemoryStore) supersedeOfferVersion(o *memoryOfferState, name string, discount Discount) *memoryOffer {
+	current := s.offers[o.CurrentID]
+	current.SupersededAt = sql.NullTime{Time: time.Now(), Valid: true}
+	delete(s.offerByName, current.Name)
+	return s.insertOfferVersion(o, current.Version+1, name, discount)
+}
+
+// insertOfferVersion assumes s.mu is held, the version becomes the current one of the offer
+func (s *MemoryStore) insertOfferVersion(o *memoryOfferState, version int, name string, discount Discount) *memoryOffer {
+	v := &memoryOffer{
+		ID:        nextID(&s.lastOfferID),
+		OfferID:   o.ID,
+		Name:      name,
+		Version:   version,
+		Discount:  discount,
+		CreatedAt: time.Now(),
+	}
+	s.offers[v.ID] = v
+	s.offerByName[name] = v.ID
+	o.CurrentID = v.ID
+	return v
+}
+
+func (s *MemoryStore) GenerateVoucher(ctx context.Context, email, code string, offer OfferRef, expiry time.Time, limits Limits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	customerID, err := s.customerID(email)
+	if err != nil {
+		return err
+	}
+	return s.insertVoucher(offer, DBModelVoucher{
+		Code:           code,
+		CustomerID:     customerID,
+		ExpiryDate:     expiry,
+		MaxRedemptions: limits.maxRedemptions(),
+		MaxPerCustomer: limits.maxPerCustomer(),
+		Assignment:     AssignmentCustomer,
+	})
+}
+
+func (s *MemoryStore) GenerateUnassignedVoucher(ctx context.Context, assignment Assignment, code string, offer OfferRef, expiry time.Time, limits Limits) error {
+	if !assignment.unassigned() {
+		return errors.Errorf("fail to generate voucher, %q is not an unassigned voucher", string(assignment))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insertVoucher(offer, DBModelVoucher{
+		Code:           code,
+		ExpiryDate:     expiry,
+		MaxRedemptions: limits.maxRedemptions(),
+		MaxPerCustomer: limits.maxPerCustomer(),
+		Assignment:     assignment,
+	})
+}
+
+// insertVoucher assumes s.mu is held
+func (s *MemoryStore) insertVoucher(ref OfferRef, v DBModelVoucher) error {
+	if _, ok := s.vouchers[v.Code]; ok {
+		return errors.Wrapf(ErrCodeConflict, "fail to insert to voucher table, code %v", v.Code)
+	}
+	offer, err := s.resolveOffer(ref)
+	if err != nil {
+		return err
+	}
+	v.SpecialOfferID = offer.ID
+	s.vouchers[v.Code] = &memoryVoucher{ID: nextID(&s.lastVoucherID), DBModelVoucher: v}
+	return nil
+}
+
+func (s *MemoryStore) GetVouchers(ctx context.Context, email string) ([]string, []string, []int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	customerID, err := s.customerID(email)
+	if err != nil {
+		return []string{}, []string{}, []int{}, err
+	}
+	var valid []*memoryVoucher
+	for _, v := range s.vouchers {
+		if (v.CustomerID == customerID || s.claimedBy(v, customerID)) && !v.UsedDate.Valid {
+			valid = append(valid, v)
+		}
+	}
+	sortVouchers(valid)
+	now := time.Now()
+	var codes []string
+	var names []string
+	var remaining []int
+	for _, v := range valid {
+		u := s.usage(v, customerID, now)
+		if u.remaining() == 0 || s.offerState(v).check(now) != nil {
+			continue
+		}
+		codes = append(codes, v.Code)
+		names = append(names, s.offers[v.SpecialOfferID].Name)
+		remaining = append(remaining, u.remaining())
+	}
+	return codes, names, remaining, nil
+}
+
+// claimedBy assumes s.mu is held
+func (s *MemoryStore) claimedBy(v *memoryVoucher, customerID uint64) bool {
+	if v.Assignment != AssignmentClaim {
+		return false
+	}
+	for _, r := range s.redemptions {
+		if r.Code == v.Code && r.CustomerID == customerID && !r.ReversedAt.Valid {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) RedeemVoucher(ctx context.Context, email, code string, order rules.Order) (RedeemResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.vouchers[code]
+	if !ok {
+		return RedeemResult{}, ErrVoucherNotFound
+	}
+	if err := checkAlone(s.offerState(v).stacking); err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "voucher %v", code)
+	}
+	now := time.Now()
+	if err := checkVoucher(email, s.owner(v), v.ExpiryDate, v.UsedDate, s.offerState(v), now); err != nil {
+		return RedeemResult{}, err
+	}
+	customerID, err := s.redeemerID(v, email)
+	if err != nil {
+		return RedeemResult{}, err
+	}
+	u := s.usage(v, customerID, now)
+	if err := u.check(); err != nil {
+		return RedeemResult{}, err
+	}
+	if err := s.offerState(v).rules.Evaluate(order, now); err != nil {
+		return RedeemResult{}, err
+	}
+	s.markRedeemed(v, customerID, now)
+	u.redemptions++
+	u.customerRedeemed++
+	return s.result(v, u), nil
+}
+
+// RedeemVouchers checks all the vouchers and their combination before it redeems any of them, the same as the
+// postgres RedeemVouchers
+func (s *MemoryStore) RedeemVouchers(ctx context.Context, email string, codes []string, order rules.Order, check func([]RedeemResult) error) ([]RedeemResult, error) {
+	if err := checkCodes(codes); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vouchers := make([]*memoryVoucher, len(codes))
+	policies := make([]Stacking, len(codes))
+	for i, code := range codes {
+		v, ok := s.vouchers[code]
+		if !ok {
+			return nil, errors.Wrapf(ErrVoucherNotFound, "voucher %v", code)
+		}
+		vouchers[i] = v
+		policies[i] = s.offerState(v).stacking
+	}
+	if err := checkStacking(codes, policies); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	customerIDs := make([]uint64, len(codes))
+	usages := make([]voucherUsage, len(codes))
+	for i, v := range vouchers {
+		if err := checkVoucher(email, s.owner(v), v.ExpiryDate, v.UsedDate, s.offerState(v), now); err != nil {
+			return nil, errors.Wrapf(err, "voucher %v", v.Code)
+		}
+		customerID, err := s.redeemerID(v, email)
+		if err != nil {
+			return nil, errors.Wrapf(err, "voucher %v", v.Code)
+		}
+		u := s.usage(v, customerID, now)
+		if err := u.check(); err != nil {
+			return nil, errors.Wrapf(err, "voucher %v", v.Code)
+		}
+		if err := s.offerState(v).rules.Evaluate(order, now); err != nil {
+			return nil, errors.Wrapf(err, "voucher %v", v.Code)
+		}
+		customerIDs[i], usages[i] = customerID, u
+	}
+	results := make([]RedeemResult, len(codes))
+	for i, v := range vouchers {
+		usages[i].redemptions++
+		usages[i].customerRedeemed++
+		results[i] = s.result(v, usages[i])
+	}
+	if check != nil {
+		if err := check(results); err != nil {
+			return nil, err
+		}
+	}
+	for i, v := range vouchers {
+		s.markRedeemed(v, customerIDs[i], now)
+	}
+	return results, nil
+}
+
+// result assumes s.mu is held, it is the same as voucherState.result
+func (s *MemoryStore) result(v *memoryVoucher, u voucherUsage) RedeemResult {
+	state := s.offerState(v)
+	offer := s.offers[v.SpecialOfferID]
+	return RedeemResult{OfferID: offer.OfferID, Discount: offer.Discount, RemainingUses: u.remaining(), Rules: state.rules, Stacking: state.stacking}
+}
+
+// markRedeemed assumes s.mu is held and the voucher has a use left
+func (s *MemoryStore) markRedeemed(v *memoryVoucher, customerID uint64, now time.Time) {
+	v.RedemptionCount++
+	if v.RedemptionCount >= v.MaxRedemptions {
+		v.UsedDate = sql.NullTime{Valid: true, Time: now}
+	}
+	s.redemptions = append(s.redemptions, &memoryRedemption{
+		DBModelRedemption: DBModelRedemption{ID: nextID(&s.lastRedemptionID), Code: v.Code, RedeemedAt: now},
+		CustomerID:        customerID,
+	})
+}
+
+// owner assumes s.mu is held, it is not valid for vouchers not assigned to a customer
+func (s *MemoryStore) owner(v *memoryVoucher) sql.NullString {
+	if v.CustomerID == 0 {
+		return sql.NullString{}
+	}
+	return sql.NullString{Valid: true, String: s.customers[v.CustomerID].Email}
+}
+
+// redeemerID assumes s.mu is held and checkVoucher has checked the owner of assigned vouchers
+func (s *MemoryStore) redeemerID(v *memoryVoucher, email string) (uint64, error) {
+	if v.CustomerID != 0 {
+		return v.CustomerID, nil
+	}
+	return s.customerID(email)
+}
+
+// usage assumes s.mu is held
+func (s *MemoryStore) usage(v *memoryVoucher, customerID uint64, now time.Time) voucherUsage {
+	u := voucherUsage{
+		maxRedemptions: v.MaxRedemptions,
+		maxPerCustomer: v.MaxPerCustomer,
+		claim:          v.Assignment == AssignmentClaim,
+		redemptions:    v.RedemptionCount,
+	}
+	for _, r := range s.redemptions {
+		if r.Code != v.Code || r.ReversedAt.Valid {
+			continue
+		}
+		if r.CustomerID == customerID {
+			u.customerRedeemed++
+		} else {
+			u.heldByOthers++
+		}
+	}
+	for _, r := range s.reservations {
+		if r.Code != v.Code || !r.ExpiresAt.After(now) {
+			continue
+		}
+		u.reserved++
+		if r.CustomerID == customerID {
+			u.customerReserved++
+		} else {
+			u.heldByOthers++
+		}
+	}
+	return u
+}
+
+// deleteReservation assumes s.mu is held
+func (s *MemoryStore) deleteReservation(r *memoryReservation) {
+	delete(s.reservations, r.ID)
+}
+
+func (s *MemoryStore) ReserveVoucher(ctx context.Context, email, code, reservationID string, expiresAt time.Time, order rules.Order) (RedeemResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.vouchers[code]
+	if !ok {
+		return RedeemResult{}, ErrVoucherNotFound
+	}
+	if err := checkAlone(s.offerState(v).stacking); err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "voucher %v", code)
+	}
+	now := time.Now()
+	if err := checkVoucher(email, s.owner(v), v.ExpiryDate, v.UsedDate, s.offerState(v), now); err != nil {
+		return RedeemResult{}, err
+	}
+	for _, r := range s.reservations {
+		if r.Code == code && !r.ExpiresAt.After(now) {
+			s.deleteReservation(r)
+		}
+	}
+	customerID, err := s.redeemerID(v, email)
+	if err != nil {
+		return RedeemResult{}, err
+	}
+	u := s.usage(v, customerID, now)
+	if err := u.check(); err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "voucher %v", code)
+	}
+	if err := s.offerState(v).rules.Evaluate(order, now); err != nil {
+		return RedeemResult{}, err
+	}
+	if _, ok := s.reservations[reservationID]; ok {
+		return RedeemResult{}, errors.Errorf("fail to insert into table reservations, id %v already exists", reservationID)
+	}
+	s.reservations[reservationID] = &memoryReservation{ID: reservationID, Code: code, CustomerID: customerID, ExpiresAt: expiresAt}
+	u.reserved++
+	u.customerReserved++
+	return s.result(v, u), nil
+}
+
+func (s *MemoryStore) ConfirmReservation(ctx context.Context, reservationID string) (RedeemResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.reservations[reservationID]
+	if !ok {
+		return RedeemResult{}, ErrReservationNotFound
+	}
+	now := time.Now()
+	if !r.ExpiresAt.After(now) {
+		return RedeemResult{}, ErrReservationExpired
+	}
+	v := s.vouchers[r.Code]
+	// the offer may have been deactivated or ended since the reservation
+	if err := s.offerState(v).check(now); err != nil {
+		return RedeemResult{}, err
+	}
+	s.deleteReservation(r)
+	u := s.usage(v, r.CustomerID, now)
+	if err := u.check(); err != nil {
+		return RedeemResult{}, err
+	}
+	s.markRedeemed(v, r.CustomerID, now)
+	u.redemptions++
+	u.customerRedeemed++
+	return s.result(v, u), nil
+}
+
+func (s *MemoryStore) ReleaseReservation(ctx context.Context, reservationID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.reservations[reservationID]
+	if !ok {
+		return ErrReservationNotFound
+	}
+	s.deleteReservation(r)
+	return nil
+}
+
+func (s *MemoryStore) ReleaseExpiredReservations(ctx context.Context, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var released int64
+	for _, r := range s.reservations {
+		if !r.ExpiresAt.After(now) {
+			s.deleteReservation(r)
+			released++
+		}
+	}
+	return released, nil
+}
+
+func (s *MemoryStore) QuoteVoucher(ctx context.Context, email, code string) (RedeemResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.vouchers[code]
+	if !ok {
+		return RedeemResult{}, ErrVoucherNotFound
+	}
+	now := time.Now()
+	if err := checkVoucher(email, s.owner(v), v.ExpiryDate, v.UsedDate, s.offerState(v), now); err != nil {
+		return RedeemResult{}, err
+	}
+	customerID, err := s.redeemerID(v, email)
+	if err != nil {
+		return RedeemResult{}, err
+	}
+	u := s.usage(v, customerID, now)
+	u.reserved, u.customerReserved = 0, 0
+	if err := u.check(); err != nil {
+		return RedeemResult{}, err
+	}
+	return s.result(v, u), nil
+}
+
+func (s *MemoryStore) ReverseRedemption(ctx context.Context, code string, reversal Reversal) (DBModelRedemption, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.vouchers[code]
+	if !ok {
+		return DBModelRedemption{}, ErrVoucherNotFound
+	}
+	if v.RedemptionCount == 0 {
+		return DBModelRedemption{}, ErrVoucherNotRedeemed
+	}
+	now := time.Now()
+	if reversal.UnexpiredOnly && !v.ExpiryDate.After(now) {
+		return DBModelRedemption{}, ErrVoucherExpired
+	}
+	// the latest redemption not reversed yet, unless another one is asked for
+	for i := len(s.redemptions) - 1; i >= 0; i-- {
+		r := s.redemptions[i]
+		if r.Code != code || r.ReversedAt.Valid || (reversal.RedemptionID != 0 && r.ID != reversal.RedemptionID) {
+			continue
+		}
+		r.ReversedAt = sql.NullTime{Valid: true, Time: now}
+		r.ReversedBy = sql.NullString{Valid: true, String: reversal.By}
+		r.ReversalReason = sql.NullString{Valid: true, String: reversal.Reason}
+		v.RedemptionCount--
+		v.UsedDate = sql.NullTime{}
+		return s.redemption(r), nil
+	}
+	return DBModelRedemption{}, ErrVoucherNotRedeemed
+}
+
+// redemption assumes s.mu is held
+func (s *MemoryStore) redemption(r *memoryRedemption) DBModelRedemption {
+	redemption := r.DBModelRedemption
+	redemption.Email = s.customers[r.CustomerID].Email
+	return redemption
+}
+
+func (s *MemoryStore) GetRedemptions(ctx context.Context, code string) ([]DBModelRedemption, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.vouchers[code]; !ok {
+		return nil, ErrVoucherNotFound
+	}
+	redemptions := []DBModelRedemption{}
+	for _, r := range s.redemptions {
+		if r.Code == code {
+			redemptions = append(redemptions, s.redemption(r))
+		}
+	}
+	return redemptions, nil
+}
+
+func (s *MemoryStore) GetCustomerIDsByEmails(ctx context.Context, emails []string) (map[string]uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make(map[string]uint64, len(emails))
+	for _, email := range emails {
+		email = NormalizeEmail(email)
+		if id, ok := s.customerByEmail[email]; ok && !s.customers[id].ErasedAt.Valid {
+			ids[email] = id
+		}
+	}
+	return ids, nil
+}
+
+func (s *MemoryStore) ListCustomerEmails(ctx context.Context, filter CustomerFilter) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	customers := make([]*memoryCustomer, 0, len(s.customers))
+	for _, c := range s.customers {
+		if !c.ErasedAt.Valid && s.matchCustomer(c, filter) {
+			customers = append(customers, c)
+		}
+	}
+	sort.Slice(customers, func(i, j int) bool { return customers[i].ID < customers[j].ID })
+	var emails []string
+	for _, c := range customers {
+		emails = append(emails, c.Email)
+	}
+	return emails, nil
+}
+
+func (s *MemoryStore) InsertVouchers(ctx context.Context, ref OfferRef, limits Limits, vouchers []DBModelVoucher) ([]string, error) {
+	if len(vouchers) == 0 {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range vouchers {
+		if _, ok := s.customers[v.CustomerID]; !ok {
+			return nil, errors.Wrapf(ErrCustomerNotFound, "fail to insert to voucher table, customer id %v", v.CustomerID)
+		}
+	}
+	offer, err := s.resolveOffer(ref)
+	if err != nil {
+		return nil, err
+	}
+	var conflicts []string
+	for _, v := range vouchers {
+		if _, ok := s.vouchers[v.Code]; ok {
+			conflicts = append(conflicts, v.Code)
+			continue
+		}
+		v.SpecialOfferID = offer.ID
+		v.UsedDate = sql.NullTime{}
+		v.MaxRedemptions = limits.maxRedemptions()
+		v.MaxPerCustomer = limits.maxPerCustomer()
+		v.RedemptionCount = 0
+		v.Assignment = AssignmentCustomer
+		s.vouchers[v.Code] = &memoryVoucher{ID: nextID(&s.lastVoucherID), DBModelVoucher: v}
+	}
+	return conflicts, nil
+}
+
+// sort vouchers by insertion order, the same order postgres store returns them
+func sortVouchers(vouchers []*memoryVoucher) {
+	sort.Slice(vouchers, func(i, j int) bool { return vouchers[i].ID < vouchers[j].ID })
+}
+
+type idempotencyScopeKey struct {
+	scope string
+	key   string
+}
+
+// claimedBy tells if k is still the claim of the request of fingerprint made at createdAt
+func (k *DBModelIdempotencyKey) claimedBy(fingerprint string, createdAt time.Time) bool {
+	return k.Fingerprint == fingerprint && k.CreatedAt.Equal(createdAt)
+}
+
+func (s *MemoryStore) ClaimIdempotencyKey(ctx context.Context, scope, key, fingerprint string, now, expiresAt time.Time) (DBModelIdempotencyKey, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sk := idempotencyScopeKey{scope: scope, key: key}
+	if k, ok := s.idempotency[sk]; ok && k.ExpiresAt.After(now) {
+		existing := *k
+		existing.Body = append([]byte(nil), k.Body...)
+		return existing, false, nil
+	}
+	k := &DBModelIdempotencyKey{Scope: scope, Key: key, Fingerprint: fingerprint, CreatedAt: now, ExpiresAt: expiresAt}
+	s.idempotency[sk] = k
+	return *k, true, nil
+}
+
+func (s *MemoryStore) SaveIdempotentResponse(ctx context.Context, scope, key, fingerprint string, createdAt time.Time, status int, body []byte, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if k, ok := s.idempotency[idempotencyScopeKey{scope: scope, key: key}]; ok && k.claimedBy(fingerprint, createdAt) {
+		k.Status = sql.NullInt64{Int64: int64(status), Valid: true}
+		k.Body = append([]byte(nil), body...)
+		k.ExpiresAt = expiresAt
+	}
+	return nil
+}
+
+func (s *MemoryStore) ReleaseIdempotencyKey(ctx context.Context, scope, key, fingerprint string, createdAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sk := idempotencyScopeKey{scope: scope, key: key}
+	if k, ok := s.idempotency[sk]; ok && k.claimedBy(fingerprint, createdAt) {
+		delete(s.idempotency, sk)
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted int64
+	for sk, k := range s.idempotency {
+		if !k.ExpiresAt.After(now) {
+			delete(s.idempotency, sk)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
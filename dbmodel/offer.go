@@ -0,0 +1,447 @@
+package dbmodel
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/rules"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// DBModelOffer is a special offer with its current version. The state of the offer applies to all its vouchers,
+// the discount of a voucher is the one of the version it was issued with.
+type DBModelOffer struct {
+	ID          uint64       `json:"id" db:"id"`
+	Description string       `json:"description" db:"description"`
+	StartsAt    sql.NullTime `json:"starts_at" db:"starts_at"`
+	EndsAt      sql.NullTime `json:"ends_at" db:"ends_at"`
+	Active      bool         `json:"active" db:"active"`
+	ArchivedAt  sql.NullTime `json:"archived_at" db:"archived_at"`
+	CreatedAt   time.Time    `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at" db:"updated_at"`
+	// Rules are the eligibility rules an order shall meet to redeem the vouchers of the offer
+	Rules rules.Set `json:"rules" db:"rules"`
+	// Exclusive, StackGroup and MaxTotalDiscount are the stacking policy of the offer, see Stacking
+	Exclusive        bool           `json:"exclusive" db:"exclusive"`
+	StackGroup       string         `json:"stack_group" db:"stack_group"`
+	MaxTotalDiscount sql.NullString `json:"max_total_discount" db:"max_total_discount"`
+	// Current is the version vouchers are issued with
+	Current DBModelSpecialOffer `json:"current" db:"current"`
+}
+
+// OfferSpec is what an offer is created or updated with, a change of Name or Discount makes a new version
+type OfferSpec struct {
+	Name        string
+	Description string
+	Discount    Discount
+	// StartsAt and EndsAt are the window the vouchers of the offer can be redeemed in, open if not valid
+	StartsAt sql.NullTime
+	EndsAt   sql.NullTime
+	Active   bool
+	Rules    rules.Set
+	Stacking Stacking
+}
+
+// Validate checks the spec satisfies the constraints of tables offers and special_offers
+func (s OfferSpec) Validate() error {
+	if strings.TrimSpace(s.Name) == "" {
+		return errors.New("offer name shall not be empty")
+	}
+	if s.StartsAt.Valid && s.EndsAt.Valid && !s.StartsAt.Time.Before(s.EndsAt.Time) {
+		return errors.New("offer shall start before it ends")
+	}
+	if err := s.Rules.Validate(); err != nil {
+		return err
+	}
+	if err := s.Stacking.Validate(); err != nil {
+		return err
+	}
+	return s.Discount.Validate()
+}
+
+// OfferRef is the offer vouchers are issued for, the offer of ID if it is set. Otherwise it is the offer of Name,
+// created if it does not exist yet and revised if its discount differs from Discount.
+type OfferRef struct {
+	ID       uint64
+	Name     string
+	Discount Discount
+}
+
+// OfferFilter pages through the offers in the order of their ids
+type OfferFilter struct {
+	// AfterID is the id of the last offer of the previous page, 0 for the first page
+	AfterID uint64
+	Limit   int
+	// Archived includes the archived offers
+	Archived bool
+}
+
+// offerState is the state of the offer of a voucher, checked when the voucher is issued and redeemed
+type offerState struct {
+	active     bool
+	archivedAt sql.NullTime
+	startsAt   sql.NullTime
+	endsAt     sql.NullTime
+	// the rules are evaluated against the order by the caller, the store does not know the order
+	rules rules.Set
+	// the stacking policy is checked when vouchers are redeemed together
+	stacking Stacking
+}
+
+// check returns why the vouchers of the offer cannot be redeemed at now, or nil if they can
+func (o offerState) check(now time.Time) error {
+	if err := o.checkIssue(now); err != nil {
+		return err
+	}
+	if o.startsAt.Valid && now.Before(o.startsAt.Time) {
+		return ErrOfferNotStarted
+	}
+	return nil
+}
+
+// checkIssue returns why no voucher of the offer can be issued at now, vouchers can be issued before the offer starts
+func (o offerState) checkIssue(now time.Time) error {
+	if !o.active || o.archivedAt.Valid {
+		return ErrOfferInactive
+	}
+	if o.endsAt.Valid && !o.endsAt.Time.After(now) {
+		return ErrOfferEnded
+	}
+	return nil
+}
+
+const (
+	offerColumns = `id, offer_id, name, version, discount_type, discount, amount_minor, currency, created_at, superseded_at`
+	offerQuery   = `SELECT o.id, o.description, o.starts_at, o.ends_at, o.active, o.archived_at, o.created_at, o.updated_at, o.rules,
+										o.exclusive, o.stack_group, o.max_total_discount,
+										so.id "current.id", so.offer_id "current.offer_id", so.name "current.name", so.version "current.version",
+										so.discount_type "current.discount_type", so.discount "current.discount", so.amount_minor "current.amount_minor",
+										so.currency "current.currency", so.created_at "current.created_at", so.superseded_at "current.superseded_at"
+										FROM offers o INNER JOIN special_offers so ON so.offer_id=o.id AND so.superseded_at IS NULL`
+)
+
+// CreateOffer creates the offer with its first version, the name shall not be used by another offer
+func CreateOffer(ctx context.Context, spec OfferSpec, db *sqlx.DB) (DBModelOffer, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return DBModelOffer{}, errors.Wrapf(err, "fail to begin creation of offer")
+	}
+	offer, err := createOffer(ctx, spec, tx)
+	if err != nil {
+		if err1 := tx.Rollback(); err1 != nil {
+			return DBModelOffer{}, errors.Wrapf(err1, "fail to rollback creation of offer, error %v", err)
+		}
+		return DBModelOffer{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return DBModelOffer{}, errors.Wrapf(err, "fail to commit creation of offer")
+	}
+	return offer, nil
+}
+
+func GetOffer(ctx context.Context, id uint64, db *sqlx.DB) (DBModelOffer, error) {
+	return getOffer(ctx, id, db)
+}
+
+// ListOffers returns a page of the offers
+func ListOffers(ctx context.Context, filter OfferFilter, db *sqlx.DB) ([]DBModelOffer, error) {
+	offers := []DBModelOffer{}
+	err := db.SelectContext(ctx, &offers, offerQuery+" WHERE o.id>$1 AND ($2 OR o.archived_at IS NULL) ORDER BY o.id LIMIT $3",
+		filter.AfterID, filter.Archived, filter.Limit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to query offers")
+	}
+	return offers, nil
+}
+
+// UpdateOffer replaces the offer with spec, a new version is made if the name or the discount changes.
+// Archived offers cannot be updated.
+func UpdateOffer(ctx context.Context, id uint64, spec OfferSpec, db *sqlx.DB) (DBModelOffer, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return DBModelOffer{}, errors.Wrapf(err, "fail to begin update of offer")
+	}
+	offer, err := updateOffer(ctx, id, spec, tx)
+	if err != nil {
+		if err1 := tx.Rollback(); err1 != nil {
+			return DBModelOffer{}, errors.Wrapf(err1, "fail to rollback update of offer, error %v", err)
+		}
+		return DBModelOffer{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return DBModelOffer{}, errors.Wrapf(err, "fail to commit update of offer")
+	}
+	return offer, nil
+}
+
+// ArchiveOffer archives the offer, no voucher of it can be issued or redeemed any more
+func ArchiveOffer(ctx context.Context, id uint64, db *sqlx.DB) (DBModelOffer, error) {
+	res, err := db.ExecContext(ctx, "UPDATE offers SET archived_at=COALESCE(archived_at, $1), updated_at=$1 WHERE id=$2", time.Now(), id)
+	if err != nil {
+		return DBModelOffer{}, errors.Wrapf(err, "fail to archive offer %v", id)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return DBModelOffer{}, errors.Wrapf(err, "fail to archive offer %v", id)
+	}
+	if affected != 1 {
+		return DBModelOffer{}, errors.Wrapf(ErrOfferNotFound, "offer %v", id)
+	}
+	return getOffer(ctx, id, db)
+}
+
+// GetOfferHistory returns the versions of the offer, the oldest first
+func GetOfferHistory(ctx context.Context, id uint64, db *sqlx.DB) ([]DBModelSpecialOffer, error) {
+	offers := []DBModelSpecialOffer{}
+	err := db.SelectContext(ctx, &offers, "SELECT "+offerColumns+" FROM special_offers WHERE offer_id=$1 ORDER BY version", id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to query versions of offer %v", id)
+	}
+	if len(offers) == 0 {
+		return nil, errors.Wrapf(ErrOfferNotFound, "offer %v", id)
+	}
+	return offers, nil
+}
+
+func getOffer(ctx context.Context, id uint64, q sqlx.QueryerContext) (DBModelOffer, error) {
+	offer := DBModelOffer{}
+	err := sqlx.GetContext(ctx, q, &offer, offerQuery+" WHERE o.id=$1", id)
+	if err == sql.ErrNoRows {
+		return DBModelOffer{}, errors.Wrapf(ErrOfferNotFound, "offer %v", id)
+	}
+	if err != nil {
+		return DBModelOffer{}, errors.Wrapf(err, "fail to query offer %v", id)
+	}
+	return offer, nil
+}
+
+func createOffer(ctx context.Context, spec OfferSpec, tx *sqlx.Tx) (DBModelOffer, error) {
+	if err := spec.Validate(); err != nil {
+		return DBModelOffer{}, errors.Wrapf(ErrInvalidOffer, "%v", err)
+	}
+	if err := lockOfferName(ctx, spec.Name, tx); err != nil {
+		return DBModelOffer{}, err
+	}
+	_, err := findCurrentOffer(ctx, spec.Name, tx)
+	if err == nil {
+		return DBModelOffer{}, errors.Wrapf(ErrOfferConflict, "offer name %v is taken", spec.Name)
+	}
+	if !errors.Is(err, ErrOfferNotFound) {
+		return DBModelOffer{}, err
+	}
+	var id uint64
+	err = tx.QueryRowxContext(ctx, `INSERT INTO offers (description, starts_at, ends_at, active, rules, exclusive, stack_group, max_total_discount)
+										VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		spec.Description, spec.StartsAt, spec.EndsAt, spec.Active, spec.Rules, spec.Stacking.Exclusive, spec.Stacking.Group, spec.Stacking.maxTotalDiscount()).Scan(&id)
+	if err != nil {
+		return DBModelOffer{}, errors.Wrapf(err, "fail to insert into table offers")
+	}
+	if _, err := insertOfferVersion(ctx, id, 1, spec.Name, spec.Discount, tx); err != nil {
+		return DBModelOffer{}, err
+	}
+	return getOffer(ctx, id, tx)
+}
+
+func updateOffer(ctx context.Context, id uint64, spec OfferSpec, tx *sqlx.Tx) (DBModelOffer, error) {
+	if err := spec.Validate(); err != nil {
+		return DBModelOffer{}, errors.Wrapf(ErrInvalidOffer, "%v", err)
+	}
+	// the new name is locked before the offer, in the same order as reviseSpecialOffer
+	if err := lockOfferName(ctx, spec.Name, tx); err != nil {
+		return DBModelOffer{}, err
+	}
+	state, err := lockOffer(ctx, id, true, tx)
+	if err != nil {
+		return DBModelOffer{}, err
+	}
+	if state.archivedAt.Valid {
+		return DBModelOffer{}, errors.Wrapf(ErrOfferArchived, "offer %v", id)
+	}
+	current, err := findCurrentVersion(ctx, id, tx)
+	if err != nil {
+		return DBModelOffer{}, err
+	}
+	if current.Name != spec.Name {
+		if _, err := findCurrentOffer(ctx, spec.Name, tx); err == nil {
+			return DBModelOffer{}, errors.Wrapf(ErrOfferConflict, "offer name %v is taken", spec.Name)
+		} else if !errors.Is(err, ErrOfferNotFound) {
+			return DBModelOffer{}, err
+		}
+	}
+	terms, err := current.Terms()
+	if err != nil {
+		return DBModelOffer{}, err
+	}
+	if current.Name != spec.Name || terms != spec.Discount {
+		if _, err := supersedeOfferVersion(ctx, current, spec.Name, spec.Discount, tx); err != nil {
+			return DBModelOffer{}, err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE offers SET description=$1, starts_at=$2, ends_at=$3, active=$4, rules=$5,
+										exclusive=$6, stack_group=$7, max_total_discount=$8, updated_at=$9 WHERE id=$10`,
+		spec.Description, spec.StartsAt, spec.EndsAt, spec.Active, spec.Rules,
+		spec.Stacking.Exclusive, spec.Stacking.Group, spec.Stacking.maxTotalDiscount(), time.Now(), id)
+	if err != nil {
+		if isViolation(err, pqCheckViolation) {
+			return DBModelOffer{}, errors.Wrapf(ErrOfferConflict, "fail to update offer %v, %v", id, err)
+		}
+		return DBModelOffer{}, errors.Wrapf(err, "fail to update offer %v", id)
+	}
+	return getOffer(ctx, id, tx)
+}
+
+// resolveOffer returns the version of the offer vouchers are issued with, it fails if no voucher of the offer
+// can be issued
+func resolveOffer(ctx context.Context, ref OfferRef, tx *sqlx.Tx) (DBModelSpecialOffer, error) {
+	if ref.ID == 0 {
+		return reviseSpecialOffer(ctx, ref.Name, ref.Discount, tx)
+	}
+	// the offer is not changed until the vouchers are issued
+	state, err := lockOffer(ctx, ref.ID, false, tx)
+	if err != nil {
+		return DBModelSpecialOffer{}, err
+	}
+	if err := state.checkIssue(time.Now()); err != nil {
+		return DBModelSpecialOffer{}, errors.Wrapf(err, "offer %v", ref.ID)
+	}
+	return findCurrentVersion(ctx, ref.ID, tx)
+}
+
+// reviseSpecialOffer returns the current version of the offer of name with the discount. The offer is created if
+// missing, a new version is made if the discount differs.
+func reviseSpecialOffer(ctx context.Context, name string, discount Discount, tx *sqlx.Tx) (DBModelSpecialOffer, error) {
+	if err := discount.Validate(); err != nil {
+		return DBModelSpecialOffer{}, errors.Wrapf(ErrInvalidOffer, "%v", err)
+	}
+	if err := lockOfferName(ctx, name, tx); err != nil {
+		return DBModelSpecialOffer{}, err
+	}
+	current, err := findCurrentOffer(ctx, name, tx)
+	if errors.Is(err, ErrOfferNotFound) {
+		var id uint64
+		err = tx.QueryRowxContext(ctx, "INSERT INTO offers DEFAULT VALUES RETURNING id").Scan(&id)
+		if err != nil {
+			return DBModelSpecialOffer{}, errors.Wrapf(err, "fail to insert into table offers")
+		}
+		return insertOfferVersion(ctx, id, 1, name, discount, tx)
+	}
+	if err != nil {
+		return DBModelSpecialOffer{}, err
+	}
+	state, err := lockOffer(ctx, current.OfferID, true, tx)
+	if err != nil {
+		return DBModelSpecialOffer{}, err
+	}
+	if err := state.checkIssue(time.Now()); err != nil {
+		return DBModelSpecialOffer{}, errors.Wrapf(err, "offer %v", name)
+	}
+	// read again, the offer may have been updated before it was locked
+	current, err = findCurrentVersion(ctx, current.OfferID, tx)
+	if err != nil {
+		return DBModelSpecialOffer{}, err
+	}
+	if current.Name != name {
+		return DBModelSpecialOffer{}, errors.Wrapf(ErrOfferConflict, "offer %v was renamed to %v", name, current.Name)
+	}
+	terms, err := current.Terms()
+	if err != nil {
+		return DBModelSpecialOffer{}, err
+	}
+	if terms == discount {
+		return current, nil
+	}
+	return supersedeOfferVersion(ctx, current, name, discount, tx)
+}
+
+// supersedeOfferVersion makes a new version of the offer of current with name and discount
+func supersedeOfferVersion(ctx context.Context, current DBModelSpecialOffer, name string, discount Discount, tx *sqlx.Tx) (DBModelSpecialOffer, error) {
+	// only one version of the offer is current
+	_, err := tx.ExecContext(ctx, "UPDATE special_offers SET superseded_at=$1, updated_at=$1 WHERE id=$2", time.Now(), current.ID)
+	if err != nil {
+		return DBModelSpecialOffer{}, errors.Wrapf(err, "fail to supersede version %v of special offer %v", current.Version, current.Name)
+	}
+	return insertOfferVersion(ctx, current.OfferID, current.Version+1, name, discount, tx)
+}
+
+func insertOfferVersion(ctx context.Context, offerID uint64, version int, name string, discount Discount, tx *sqlx.Tx) (DBModelSpecialOffer, error) {
+	offer := newSpecialOffer(name, discount)
+	offer.OfferID = offerID
+	offer.Version = version
+	rows, err := sqlx.NamedQueryContext(ctx, tx, `INSERT INTO special_offers (offer_id, name, version, discount_type, discount, amount_minor, currency)
+										VALUES (:offer_id, :name, :version, :discount_type, :discount, :amount_minor, :currency)
+										RETURNING `+offerColumns, offer)
+	if err == nil {
+		if rows.Next() {
+			err = rows.StructScan(&offer)
+		} else if err = rows.Err(); err == nil {
+			err = errors.New("no row returned")
+		}
+		rows.Close()
+	}
+	if err != nil {
+		if isViolation(err, pqCheckViolation) || isViolation(err, pqUniqueViolation) {
+			return DBModelSpecialOffer{}, errors.Wrapf(ErrOfferConflict, "fail to insert into table special_offers, %v", err)
+		}
+		return DBModelSpecialOffer{}, errors.Wrapf(err, "fail to insert into table special_offers")
+	}
+	return offer, nil
+}
+
+// lockOfferName serializes the changes of the offer of name until the end of the transaction. A row lock would not
+// do as the offer may not exist yet, so the lock is taken on the name.
+func lockOfferName(ctx context.Context, name string, tx *sqlx.Tx) error {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", name)
+	if err != nil {
+		return errors.Wrapf(err, "fail to lock special offer %v", name)
+	}
+	return nil
+}
+
+// lockOffer locks the row of the offer until the end of the transaction and returns its state, forUpdate is set to
+// change the offer and not set to issue vouchers of it
+func lockOffer(ctx context.Context, id uint64, forUpdate bool, tx *sqlx.Tx) (offerState, error) {
+	query := "SELECT active, archived_at, starts_at, ends_at FROM offers WHERE id=$1"
+	if forUpdate {
+		query += " FOR UPDATE"
+	} else {
+		query += " FOR SHARE"
+	}
+	var o offerState
+	err := tx.QueryRowxContext(ctx, query, id).Scan(&o.active, &o.archivedAt, &o.startsAt, &o.endsAt)
+	if err == sql.ErrNoRows {
+		return offerState{}, errors.Wrapf(ErrOfferNotFound, "offer %v", id)
+	}
+	if err != nil {
+		return offerState{}, errors.Wrapf(err, "fail to lock offer %v", id)
+	}
+	return o, nil
+}
+
+// findCurrentOffer returns the current version of the offer of name
+func findCurrentOffer(ctx context.Context, name string, q sqlx.QueryerContext) (DBModelSpecialOffer, error) {
+	offer := DBModelSpecialOffer{}
+	err := sqlx.GetContext(ctx, q, &offer, "SELECT "+offerColumns+" FROM special_offers WHERE name=$1 AND superseded_at IS NULL", name)
+	if err == sql.ErrNoRows {
+		return DBModelSpecialOffer{}, errors.Wrapf(ErrOfferNotFound, "offer %v", name)
+	}
+	if err != nil {
+		return DBModelSpecialOffer{}, errors.Wrapf(err, "fail to query special offer %v", name)
+	}
+	return offer, nil
+}
+
+// findCurrentVersion returns the current version of the offer of id
+func findCurrentVersion(ctx context.Context, id uint64, q sqlx.QueryerContext) (DBModelSpecialOffer, error) {
+	offer := DBModelSpecialOffer{}
+	err := sqlx.GetContext(ctx, q, &offer, "SELECT "+offerColumns+" FROM special_offers WHERE offer_id=$1 AND superseded_at IS NULL", id)
+	if err == sql.ErrNoRows {
+		return DBModelSpecialOffer{}, errors.Wrapf(ErrOfferNotFound, "offer %v", id)
+	}
+	if err != nil {
+		return DBModelSpecialOffer{}, errors.Wrapf(err, "fail to query special offer %v", id)
+	}
+	return offer, nil
+}
@@ -0,0 +1,267 @@
+package dbmodel
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	offerLockQuery      = "SELECT pg_advisory_xact_lock\\(hashtext\\((.+)\\)\\)"
+	currentOfferQuery   = "SELECT (.+) FROM special_offers WHERE name=(.+) AND superseded_at IS NULL"
+	currentVersionQuery = "SELECT (.+) FROM special_offers WHERE offer_id=(.+) AND superseded_at IS NULL"
+	offerStateColumns   = []string{"active", "archived_at", "starts_at", "ends_at"}
+	offerRowColumns     = []string{"id", "offer_id", "name", "version", "discount_type", "discount", "amount_minor", "currency", "created_at", "superseded_at"}
+	// columns of offerQuery
+	offerColumnNames = []string{"id", "description", "starts_at", "ends_at", "active", "archived_at", "created_at", "updated_at", "rules",
+		"exclusive", "stack_group", "max_total_discount",
+		"current.id", "current.offer_id", "current.name", "current.version", "current.discount_type", "current.discount",
+		"current.amount_minor", "current.currency", "current.created_at", "current.superseded_at"}
+)
+
+// expectNewOffer expects the revision of a percentage offer not existing yet, the offer and its first version get id
+func expectNewOffer(mock sqlmock.Sqlmock, name, discount string, id int) {
+	mock.ExpectExec(offerLockQuery).WithArgs(name).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(currentOfferQuery).WithArgs(name).WillReturnRows(sqlmock.NewRows(offerRowColumns))
+	mock.ExpectQuery("INSERT INTO offers DEFAULT VALUES RETURNING id").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id))
+	mock.ExpectQuery("INSERT INTO special_offers (.+) VALUES (.+) RETURNING (.+)").WithArgs(id, name, 1, "percentage", discount, nil, nil).
+		WillReturnRows(sqlmock.NewRows(offerRowColumns).AddRow(id, id, name, 1, "percentage", discount, nil, nil, time.Now(), nil))
+}
+
+func TestOfferStateCheck(t *testing.T) {
+	now := time.Now()
+	past := sql.NullTime{Time: now.Add(-time.Hour), Valid: true}
+	future := sql.NullTime{Time: now.Add(time.Hour), Valid: true}
+	for _, tt := range []struct {
+		name         string
+		given        offerState
+		wantErr      error
+		wantIssueErr error
+	}{
+		{name: "open window", given: offerState{active: true}},
+		{name: "within window", given: offerState{active: true, startsAt: past, endsAt: future}},
+		{name: "deactivated", given: offerState{}, wantErr: ErrOfferInactive, wantIssueErr: ErrOfferInactive},
+		{name: "archived", given: offerState{active: true, archivedAt: past}, wantErr: ErrOfferInactive, wantIssueErr: ErrOfferInactive},
+		// vouchers can be issued ahead of the offer
+		{name: "not started", given: offerState{active: true, startsAt: future}, wantErr: ErrOfferNotStarted},
+		{name: "ended", given: offerState{active: true, endsAt: past}, wantErr: ErrOfferEnded, wantIssueErr: ErrOfferEnded},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantErr, tt.given.check(now))
+			assert.Equal(t, tt.wantIssueErr, tt.given.checkIssue(now))
+		})
+	}
+}
+
+func TestReviseSpecialOffer(t *testing.T) {
+	db, mock := setupSQLMock(t)
+	defer db.Close()
+	for _, tt := range []struct {
+		name       string
+		givenState offerState
+		// discount of the current version
+		givenDiscount string
+		// name of the current version once the offer is locked
+		givenLockedName string
+		// 4 is the id of the current version, 5 of the new one
+		wantID  uint64
+		wantErr error
+	}{
+		{name: "keep current version", givenState: offerState{active: true}, givenDiscount: "20.00", wantID: 4},
+		{name: "new version of another discount", givenState: offerState{active: true}, givenDiscount: "30.00", wantID: 5},
+		{name: "offer deactivated", givenDiscount: "20.00", wantErr: ErrOfferInactive},
+		{name: "offer ended", givenState: offerState{active: true, endsAt: sql.NullTime{Time: time.Now().Add(-time.Hour), Valid: true}}, givenDiscount: "20.00", wantErr: ErrOfferEnded},
+		{name: "offer renamed meanwhile", givenState: offerState{active: true}, givenDiscount: "20.00", givenLockedName: "CARP", wantErr: ErrOfferConflict},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mock.ExpectBegin()
+			mock.ExpectExec(offerLockQuery).WithArgs("KOI").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(currentOfferQuery).WithArgs("KOI").
+				WillReturnRows(sqlmock.NewRows(offerRowColumns).AddRow(4, 9, "KOI", 2, "percentage", tt.givenDiscount, nil, nil, time.Now(), nil))
+			s := tt.givenState
+			mock.ExpectQuery("SELECT active, archived_at, starts_at, ends_at FROM offers WHERE id=(.+) FOR UPDATE").WithArgs(9).
+				WillReturnRows(sqlmock.NewRows(offerStateColumns).AddRow(s.active, s.archivedAt, s.startsAt, s.endsAt))
+			if s.checkIssue(time.Now()) == nil {
+				lockedName := "KOI"
+				if tt.givenLockedName != "" {
+					lockedName = tt.givenLockedName
+				}
+				mock.ExpectQuery(currentVersionQuery).WithArgs(9).
+					WillReturnRows(sqlmock.NewRows(offerRowColumns).AddRow(4, 9, lockedName, 2, "percentage", tt.givenDiscount, nil, nil, time.Now(), nil))
+			}
+			if tt.wantID == 5 {
+				mock.ExpectExec("UPDATE special_offers SET superseded_at=(.+) WHERE id=(.+)").WithArgs(sqlmock.AnyArg(), 4).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("INSERT INTO special_offers (.+) VALUES (.+) RETURNING (.+)").WithArgs(9, "KOI", 3, "percentage", "20.00", nil, nil).
+					WillReturnRows(sqlmock.NewRows(offerRowColumns).AddRow(5, 9, "KOI", 3, "percentage", "20.00", nil, nil, time.Now(), nil))
+			}
+			if tt.wantErr != nil {
+				mock.ExpectRollback()
+			} else {
+				mock.ExpectCommit()
+			}
+
+			tx, err := sqlx.NewDb(db, "sqlmock").Beginx()
+			require.Nil(t, err)
+			got, err := reviseSpecialOffer(context.Background(), "KOI", PercentageDiscount(2000), tx)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+				assert.Nil(t, tx.Rollback())
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tt.wantID, got.ID)
+				assert.Nil(t, tx.Commit())
+			}
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestGenerateVoucherOfOfferID(t *testing.T) {
+	db, mock := setupSQLMock(t)
+	defer db.Close()
+	expiry := time.Now().Add(24 * time.Hour)
+	for _, tt := range []struct {
+		name     string
+		notFound bool
+		given    offerState
+		wantErr  error
+	}{
+		{name: "issue voucher", given: offerState{active: true}},
+		{name: "issue voucher ahead of offer", given: offerState{active: true, startsAt: sql.NullTime{Time: time.Now().Add(time.Hour), Valid: true}}},
+		{name: "offer archived", given: offerState{active: true, archivedAt: sql.NullTime{Time: time.Now(), Valid: true}}, wantErr: ErrOfferInactive},
+		{name: "offer ended", given: offerState{active: true, endsAt: sql.NullTime{Time: time.Now(), Valid: true}}, wantErr: ErrOfferEnded},
+		{name: "offer not found", notFound: true, wantErr: ErrOfferNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mock.ExpectBegin()
+			rows := sqlmock.NewRows(offerStateColumns)
+			if !tt.notFound {
+				rows.AddRow(tt.given.active, tt.given.archivedAt, tt.given.startsAt, tt.given.endsAt)
+			}
+			// the offer is shared with other issuers, not with updates
+			mock.ExpectQuery("SELECT active, archived_at, starts_at, ends_at FROM offers WHERE id=(.+) FOR SHARE").WithArgs(9).WillReturnRows(rows)
+			if tt.wantErr != nil {
+				mock.ExpectRollback()
+			} else {
+				mock.ExpectQuery(currentVersionQuery).WithArgs(9).
+					WillReturnRows(sqlmock.NewRows(offerRowColumns).AddRow(4, 9, "KOI", 2, "percentage", "20.00", nil, nil, time.Now(), nil))
+				mock.ExpectExec("INSERT INTO vouchers (.+) VALUES (.+)").WithArgs("abcd", 0, 4, expiry, sqlmock.AnyArg(), 10, nil, "public").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			}
+
+			err := GenerateUnassignedVoucher(context.Background(), AssignmentPublic, "abcd", OfferRef{ID: 9}, expiry, Limits{MaxRedemptions: 10}, sqlx.NewDb(db, "sqlmock"))
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCreateOffer(t *testing.T) {
+	db, mock := setupSQLMock(t)
+	defer db.Close()
+	startsAt := sql.NullTime{Time: time.Date(2021, time.August, 1, 0, 0, 0, 0, time.UTC), Valid: true}
+	spec := OfferSpec{Name: "summer", Description: "summer sale", Discount: FixedDiscount(500, "EUR"), StartsAt: startsAt, Active: true}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(offerLockQuery).WithArgs("summer").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(currentOfferQuery).WithArgs("summer").WillReturnRows(sqlmock.NewRows(offerRowColumns))
+	mock.ExpectQuery("INSERT INTO offers (.+) VALUES (.+) RETURNING id").WithArgs("summer sale", startsAt, sql.NullTime{}, true, []byte("[]"), false, "", nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectQuery("INSERT INTO special_offers (.+) VALUES (.+) RETURNING (.+)").WithArgs(3, "summer", 1, "fixed", nil, 500, "EUR").
+		WillReturnRows(sqlmock.NewRows(offerRowColumns).AddRow(8, 3, "summer", 1, "fixed", nil, 500, "EUR", time.Now(), nil))
+	mock.ExpectQuery("SELECT (.+) FROM offers o INNER JOIN special_offers so ON (.+) WHERE o.id=(.+)").WithArgs(3).
+		WillReturnRows(sqlmock.NewRows(offerColumnNames).AddRow(3, "summer sale", startsAt.Time, nil, true, nil, time.Now(), time.Now(), "[]", false, "", nil,
+			8, 3, "summer", 1, "fixed", nil, 500, "EUR", time.Now(), nil))
+	mock.ExpectCommit()
+	got, err := CreateOffer(context.Background(), spec, sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 3, got.ID)
+	assert.Equal(t, startsAt, got.StartsAt)
+	assert.Equal(t, "summer", got.Current.Name)
+	terms, err := got.Current.Terms()
+	assert.Nil(t, err)
+	assert.Equal(t, FixedDiscount(500, "EUR"), terms)
+
+	// the name of the current version of another offer is taken
+	mock.ExpectBegin()
+	mock.ExpectExec(offerLockQuery).WithArgs("summer").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(currentOfferQuery).WithArgs("summer").
+		WillReturnRows(sqlmock.NewRows(offerRowColumns).AddRow(8, 3, "summer", 1, "fixed", nil, 500, "EUR", time.Now(), nil))
+	mock.ExpectRollback()
+	_, err = CreateOffer(context.Background(), spec, sqlx.NewDb(db, "sqlmock"))
+	assert.True(t, errors.Is(err, ErrOfferConflict))
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// an invalid spec is rejected before any query
+	spec.Name = ""
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	_, err = CreateOffer(context.Background(), spec, sqlx.NewDb(db, "sqlmock"))
+	assert.True(t, errors.Is(err, ErrInvalidOffer))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateOffer(t *testing.T) {
+	db, mock := setupSQLMock(t)
+	defer db.Close()
+	spec := OfferSpec{Name: "autumn", Discount: PercentageDiscount(2000), Active: false}
+	lockQuery := "SELECT active, archived_at, starts_at, ends_at FROM offers WHERE id=(.+) FOR UPDATE"
+
+	// renaming makes a new version, the discount is kept
+	mock.ExpectBegin()
+	mock.ExpectExec(offerLockQuery).WithArgs("autumn").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(lockQuery).WithArgs(3).WillReturnRows(sqlmock.NewRows(offerStateColumns).AddRow(true, nil, nil, nil))
+	mock.ExpectQuery(currentVersionQuery).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows(offerRowColumns).AddRow(8, 3, "summer", 1, "percentage", "20.00", nil, nil, time.Now(), nil))
+	mock.ExpectQuery(currentOfferQuery).WithArgs("autumn").WillReturnRows(sqlmock.NewRows(offerRowColumns))
+	mock.ExpectExec("UPDATE special_offers SET superseded_at=(.+) WHERE id=(.+)").WithArgs(sqlmock.AnyArg(), 8).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO special_offers (.+) VALUES (.+) RETURNING (.+)").WithArgs(3, "autumn", 2, "percentage", "20.00", nil, nil).
+		WillReturnRows(sqlmock.NewRows(offerRowColumns).AddRow(9, 3, "autumn", 2, "percentage", "20.00", nil, nil, time.Now(), nil))
+	mock.ExpectExec("UPDATE offers SET (.+) WHERE id=(.+)").WithArgs("", sql.NullTime{}, sql.NullTime{}, false, []byte("[]"), false, "", nil, sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT (.+) FROM offers o INNER JOIN special_offers so ON (.+) WHERE o.id=(.+)").WithArgs(3).
+		WillReturnRows(sqlmock.NewRows(offerColumnNames).AddRow(3, "", nil, nil, false, nil, time.Now(), time.Now(), "[]", false, "", nil,
+			9, 3, "autumn", 2, "percentage", "20.00", nil, nil, time.Now(), nil))
+	mock.ExpectCommit()
+	got, err := UpdateOffer(context.Background(), 3, spec, sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+	assert.False(t, got.Active)
+	assert.Equal(t, 2, got.Current.Version)
+
+	// archived offers cannot be changed
+	mock.ExpectBegin()
+	mock.ExpectExec(offerLockQuery).WithArgs("autumn").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(lockQuery).WithArgs(3).WillReturnRows(sqlmock.NewRows(offerStateColumns).AddRow(true, time.Now(), nil, nil))
+	mock.ExpectRollback()
+	_, err = UpdateOffer(context.Background(), 3, spec, sqlx.NewDb(db, "sqlmock"))
+	assert.True(t, errors.Is(err, ErrOfferArchived))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestListOffers(t *testing.T) {
+	db, mock := setupSQLMock(t)
+	defer db.Close()
+	mock.ExpectQuery("SELECT (.+) FROM offers o INNER JOIN special_offers so ON (.+) WHERE o.id>(.+) AND (.+) ORDER BY o.id LIMIT (.+)").WithArgs(2, false, 10).
+		WillReturnRows(sqlmock.NewRows(offerColumnNames).AddRow(3, "", nil, nil, true, nil, time.Now(), time.Now(), "[]", false, "", nil,
+			9, 3, "autumn", 2, "percentage", "20.00", nil, nil, time.Now(), nil))
+	got, err := ListOffers(context.Background(), OfferFilter{AfterID: 2, Limit: 10}, sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, "autumn", got[0].Current.Name)
+	}
+
+	mock.ExpectExec("UPDATE offers SET archived_at=(.+) WHERE id=(.+)").WithArgs(sqlmock.AnyArg(), 4).WillReturnResult(sqlmock.NewResult(0, 0))
+	_, err = ArchiveOffer(context.Background(), 4, sqlx.NewDb(db, "sqlmock"))
+	assert.True(t, errors.Is(err, ErrOfferNotFound))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,111 @@
+package dbmodel
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// DBModelRedemption is a redemption of the voucher Code by the customer of Email, ReversedAt is set once it is reversed
+type DBModelRedemption struct {
+	ID             uint64         `json:"id" db:"id"`
+	Code           string         `json:"code" db:"code"`
+	Email          string         `json:"email" db:"email"`
+	RedeemedAt     time.Time      `json:"redeemed_at" db:"redeemed_at"`
+	ReversedAt     sql.NullTime   `json:"reversed_at" db:"reversed_at"`
+	ReversedBy     sql.NullString `json:"reversed_by" db:"reversed_by"`
+	ReversalReason sql.NullString `json:"reversal_reason" db:"reversal_reason"`
+}
+
+// Reversal tells who reverses a redemption and why
+type Reversal struct {
+	By     string
+	Reason string
+	// UnexpiredOnly refuses to reverse redemptions of expired vouchers with ErrVoucherExpired
+	UnexpiredOnly bool
+	// RedemptionID is the redemption to reverse, the latest one not reversed yet if 0
+	RedemptionID uint64
+}
+
+const redemptionQuery = `SELECT r.id, vo.code, cus.email, r.redeemed_at, r.reversed_at, r.reversed_by, r.reversal_reason FROM redemptions r
+										INNER JOIN vouchers vo ON vo.id=r.voucher_id
+										INNER JOIN customers cus ON cus.id=r.customer_id`
+
+// ReverseRedemption reverses a redemption of the voucher not reversed yet, so the use of the voucher can be redeemed again.
+// The redemption is kept with the reversal.
+func ReverseRedemption(ctx context.Context, code string, reversal Reversal, db *sqlx.DB) (DBModelRedemption, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return DBModelRedemption{}, errors.Wrapf(err, "fail to begin reversal of redemption")
+	}
+	redemption, err := reverseRedemption(ctx, code, reversal, tx)
+	if err != nil {
+		if err1 := tx.Rollback(); err1 != nil {
+			return DBModelRedemption{}, errors.Wrapf(err1, "fail to rollback reversal of redemption, error %v", err)
+		}
+		return DBModelRedemption{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return DBModelRedemption{}, errors.Wrapf(err, "fail to commit reversal of redemption")
+	}
+	return redemption, nil
+}
+
+func reverseRedemption(ctx context.Context, code string, reversal Reversal, tx *sqlx.Tx) (DBModelRedemption, error) {
+	v, err := findVoucher(ctx, code, true, tx)
+	if err != nil {
+		return DBModelRedemption{}, err
+	}
+	if v.redemptionCount == 0 {
+		return DBModelRedemption{}, ErrVoucherNotRedeemed
+	}
+	now := time.Now()
+	if reversal.UnexpiredOnly && !v.expiredAt.After(now) {
+		return DBModelRedemption{}, ErrVoucherExpired
+	}
+	var redemptionID uint64
+	err = tx.QueryRowxContext(ctx, `UPDATE redemptions SET reversed_at=$1, reversed_by=$2, reversal_reason=$3
+										WHERE id=(SELECT id FROM redemptions WHERE voucher_id=$4 AND reversed_at IS NULL AND ($5=0 OR id=$5) ORDER BY id DESC LIMIT 1)
+										RETURNING id`,
+		now, reversal.By, reversal.Reason, v.id, reversal.RedemptionID).Scan(&redemptionID)
+	if err == sql.ErrNoRows {
+		return DBModelRedemption{}, ErrVoucherNotRedeemed
+	}
+	if err != nil {
+		return DBModelRedemption{}, errors.Wrapf(err, "fail to reverse redemption of voucher %v", code)
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE vouchers SET redemption_count=redemption_count-1, used_at=NULL, updated_at=$1 WHERE id=$2", now, v.id)
+	if err != nil {
+		return DBModelRedemption{}, errors.Wrapf(err, "fail to clear date of usage")
+	}
+	redemption := DBModelRedemption{}
+	err = tx.GetContext(ctx, &redemption, redemptionQuery+" WHERE r.id=$1", redemptionID)
+	if err != nil {
+		return DBModelRedemption{}, errors.Wrapf(err, "fail to query redemption %v", redemptionID)
+	}
+	return redemption, nil
+}
+
+// GetRedemptions returns the redemptions of the voucher, reversed or not, in the order they happened
+func GetRedemptions(ctx context.Context, code string, db *sqlx.DB) ([]DBModelRedemption, error) {
+	redemptions := []DBModelRedemption{}
+	err := db.SelectContext(ctx, &redemptions, redemptionQuery+" WHERE vo.code=$1 ORDER BY r.id", code)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to query redemptions of voucher %v", code)
+	}
+	if len(redemptions) > 0 {
+		return redemptions, nil
+	}
+	var exists bool
+	err = db.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM vouchers WHERE code=$1)", code)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to query voucher %v", code)
+	}
+	if !exists {
+		return nil, ErrVoucherNotFound
+	}
+	return redemptions, nil
+}
@@ -0,0 +1,68 @@
+package dbmodel
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseRedemption(t *testing.T) {
+	db, mock := setupSQLMock(t)
+	defer db.Close()
+	lockQuery := "SELECT (.+) FROM vouchers vo (.+) WHERE vo.code=(.+) FOR UPDATE OF vo"
+	reversal := Reversal{By: "support", Reason: "order refunded", UnexpiredOnly: true}
+	usedAt := time.Now().Add(-time.Hour)
+	for _, tt := range []struct {
+		name        string
+		givenExpiry time.Time
+		givenUsedAt interface{}
+		givenCount  int
+		noneActive  bool
+		wantErr     error
+	}{
+		{name: "reverse redemption", givenExpiry: time.Now().Add(time.Hour), givenUsedAt: usedAt, givenCount: 2},
+		{name: "reverse redemption of voucher with uses left", givenExpiry: time.Now().Add(time.Hour), givenCount: 1},
+		{name: "voucher not redeemed", givenExpiry: time.Now().Add(time.Hour), wantErr: ErrVoucherNotRedeemed},
+		{name: "voucher expired", givenExpiry: time.Now().Add(-time.Minute), givenUsedAt: usedAt, givenCount: 2, wantErr: ErrVoucherExpired},
+		{name: "no redemption recorded", givenExpiry: time.Now().Add(time.Hour), givenUsedAt: usedAt, givenCount: 2, noneActive: true, wantErr: ErrVoucherNotRedeemed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mock.ExpectBegin()
+			mock.ExpectQuery(lockQuery).WithArgs("code").
+				WillReturnRows(sqlmock.NewRows(voucherColumns).AddRow(1, 2, "test@gmail.com", "customer", tt.givenExpiry, tt.givenUsedAt, 2, nil, tt.givenCount, "percentage", "10.00", nil, nil, true, nil, nil, nil, "[]", false, "", nil, 3))
+			if tt.wantErr == nil || tt.noneActive {
+				rows := sqlmock.NewRows([]string{"id"})
+				if !tt.noneActive {
+					rows.AddRow(3)
+				}
+				mock.ExpectQuery("UPDATE redemptions SET (.+) WHERE id=\\(SELECT id FROM redemptions WHERE voucher_id=(.+) AND reversed_at IS NULL (.+)\\) RETURNING id").
+					WithArgs(sqlmock.AnyArg(), "support", "order refunded", 1, 0).WillReturnRows(rows)
+			}
+			if tt.wantErr == nil {
+				mock.ExpectExec("UPDATE vouchers SET redemption_count=redemption_count-1, used_at=NULL, (.+) WHERE id=(.+)").WithArgs(sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT (.+) FROM redemptions r (.+) WHERE r.id=(.+)").WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "code", "email", "redeemed_at", "reversed_at", "reversed_by", "reversal_reason"}).
+						AddRow(3, "code", "test@gmail.com", usedAt, time.Now(), "support", "order refunded"))
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			got, err := ReverseRedemption(context.Background(), "code", reversal, sqlx.NewDb(db, "sqlmock"))
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+			} else {
+				assert.Nil(t, err)
+				assert.EqualValues(t, 3, got.ID)
+				assert.Equal(t, sql.NullString{String: "support", Valid: true}, got.ReversedBy)
+			}
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package dbmodel
+
+import (
+	"context"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/rules"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// ReserveVoucher runs the checks of RedeemVoucher, the rules included, and holds a use of the voucher for the customer
+// until expiresAt, meanwhile the use cannot be redeemed or reserved by others. Expired reservations of the voucher are
+// released first.
+func ReserveVoucher(ctx context.Context, email, code, reservationID string, expiresAt time.Time, order rules.Order, db *sqlx.DB) (RedeemResult, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "fail to begin reservation of voucher")
+	}
+	result, err := reserveVoucher(ctx, email, code, reservationID, expiresAt, order, tx)
+	if err != nil {
+		if err1 := tx.Rollback(); err1 != nil {
+			return RedeemResult{}, errors.Wrapf(err1, "fail to rollback reservation of voucher, error %v", err)
+		}
+		return RedeemResult{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "fail to commit reservation of voucher")
+	}
+	return result, nil
+}
+
+func reserveVoucher(ctx context.Context, email, code, reservationID string, expiresAt time.Time, order rules.Order, tx *sqlx.Tx) (RedeemResult, error) {
+	v, err := findVoucher(ctx, code, true, tx)
+	if err != nil {
+		return RedeemResult{}, err
+	}
+	if err := checkAlone(v.offer.stacking); err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "voucher %v", code)
+	}
+	now := time.Now()
+	if err := checkVoucher(email, v.owner, v.expiredAt, v.usedAt, v.offer, now); err != nil {
+		return RedeemResult{}, err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM reservations WHERE voucher_id=$1 AND expires_at<=$2", v.id, now)
+	if err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "fail to release expired reservation of voucher %v", code)
+	}
+	customerID, err := v.customerID(ctx, email, tx)
+	if err != nil {
+		return RedeemResult{}, err
+	}
+	usage, err := loadUsage(ctx, v, customerID, now, tx)
+	if err != nil {
+		return RedeemResult{}, err
+	}
+	if err := usage.check(); err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "voucher %v", code)
+	}
+	if err := v.offer.rules.Evaluate(order, now); err != nil {
+		return RedeemResult{}, err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO reservations (id, voucher_id, customer_id, expires_at) VALUES ($1, $2, $3, $4)",
+		reservationID, v.id, customerID, expiresAt)
+	if err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "fail to insert into table reservations")
+	}
+	usage.reserved++
+	usage.customerReserved++
+	return v.result(usage), nil
+}
+
+// ConfirmReservation redeems the use of the voucher held by the reservation and deletes the reservation
+func ConfirmReservation(ctx context.Context, reservationID string, db *sqlx.DB) (RedeemResult, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "fail to begin confirmation of reservation")
+	}
+	result, err := confirmReservation(ctx, reservationID, tx)
+	if err != nil {
+		if err1 := tx.Rollback(); err1 != nil {
+			return RedeemResult{}, errors.Wrapf(err1, "fail to rollback confirmation of reservation, error %v", err)
+		}
+		return RedeemResult{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "fail to commit confirmation of reservation")
+	}
+	return result, nil
+}
+
+func confirmReservation(ctx context.Context, reservationID string, tx *sqlx.Tx) (RedeemResult, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT vo.code, r.customer_id, r.expires_at FROM reservations r INNER JOIN vouchers vo ON vo.id=r.voucher_id WHERE r.id=$1", reservationID)
+	if err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "fail to query reservation %v", reservationID)
+	}
+	var (
+		code       string
+		customerID uint64
+		expiresAt  time.Time
+		found      bool
+	)
+	if rows.Next() {
+		found = true
+		err = rows.Scan(&code, &customerID, &expiresAt)
+	}
+	rows.Close()
+	if err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "fail to query reservation %v", reservationID)
+	}
+	if !found {
+		return RedeemResult{}, ErrReservationNotFound
+	}
+	now := time.Now()
+	if !expiresAt.After(now) {
+		return RedeemResult{}, ErrReservationExpired
+	}
+	// lock the voucher before the reservation, in the same order as ReserveVoucher
+	v, err := findVoucher(ctx, code, true, tx)
+	if err != nil {
+		return RedeemResult{}, err
+	}
+	// the offer may have been deactivated or ended since the reservation
+	if err := v.offer.check(now); err != nil {
+		return RedeemResult{}, err
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM reservations WHERE id=$1 AND expires_at>$2", reservationID, now)
+	if err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "fail to delete reservation %v", reservationID)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "fail to delete reservation %v", reservationID)
+	}
+	// released or reaped after it was read
+	if affected != 1 {
+		return RedeemResult{}, ErrReservationNotFound
+	}
+	// the use held by the reservation is free again now, and no one else can take it before the commit
+	usage, err := loadUsage(ctx, v, customerID, now, tx)
+	if err != nil {
+		return RedeemResult{}, err
+	}
+	if err := usage.check(); err != nil {
+		return RedeemResult{}, err
+	}
+	if err := markRedeemed(ctx, v, customerID, now, tx); err != nil {
+		return RedeemResult{}, err
+	}
+	usage.redemptions++
+	usage.customerRedeemed++
+	return v.result(usage), nil
+}
+
+// ReleaseReservation deletes the reservation, so the use of the voucher it held is available again
+func ReleaseReservation(ctx context.Context, reservationID string, db *sqlx.DB) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM reservations WHERE id=$1", reservationID)
+	if err != nil {
+		return errors.Wrapf(err, "fail to delete reservation %v", reservationID)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "fail to delete reservation %v", reservationID)
+	}
+	if affected == 0 {
+		return ErrReservationNotFound
+	}
+	return nil
+}
+
+// ReleaseExpiredReservations deletes the reservations expired at now and returns how many were deleted
+func ReleaseExpiredReservations(ctx context.Context, now time.Time, db *sqlx.DB) (int64, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM reservations WHERE expires_at<=$1", now)
+	if err != nil {
+		return 0, errors.Wrapf(err, "fail to delete expired reservations")
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrapf(err, "fail to delete expired reservations")
+	}
+	return affected, nil
+}
@@ -0,0 +1,108 @@
+package dbmodel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/ingemar0720/voucher-pool/rules"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReserveVoucher(t *testing.T) {
+	db, mock := setupSQLMock(t)
+	defer db.Close()
+	expiresAt := time.Now().Add(time.Minute)
+	lockQuery := "SELECT (.+) FROM vouchers vo (.+) WHERE vo.code=(.+) FOR UPDATE OF vo"
+	for _, tt := range []struct {
+		name       string
+		givenMax   int
+		givenUsage []int
+		want       RedeemResult
+		wantErr    error
+	}{
+		{name: "reserve voucher", givenMax: 1, givenUsage: []int{0, 0, 0}, want: RedeemResult{OfferID: 3, Discount: PercentageDiscount(1000), Rules: rules.Set{}}},
+		{name: "voucher reserved", givenMax: 1, givenUsage: []int{0, 1, 0}, wantErr: ErrVoucherReserved},
+		{name: "reserve a use of multi-use voucher", givenMax: 3, givenUsage: []int{0, 1, 0}, want: RedeemResult{OfferID: 3, Discount: PercentageDiscount(1000), RemainingUses: 1, Rules: rules.Set{}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mock.ExpectBegin()
+			mock.ExpectQuery(lockQuery).WithArgs("code").
+				WillReturnRows(sqlmock.NewRows(voucherColumns).AddRow(1, 2, "test@gmail.com", "customer", time.Now().Add(time.Hour), nil, tt.givenMax, nil, 0, "percentage", "10.00", nil, nil, true, nil, nil, nil, "[]", false, "", nil, 3))
+			mock.ExpectExec("DELETE FROM reservations WHERE voucher_id=(.+) AND expires_at<=(.+)").WithArgs(1, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(usageQuery).WithArgs(1, 2, sqlmock.AnyArg()).
+				WillReturnRows(sqlmock.NewRows(usageColumns).AddRow(tt.givenUsage[0], tt.givenUsage[1], tt.givenUsage[2], 0))
+			if tt.wantErr != nil {
+				mock.ExpectRollback()
+			} else {
+				mock.ExpectExec("INSERT INTO reservations (.+)").WithArgs("reservation", 1, 2, expiresAt).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}
+
+			got, err := ReserveVoucher(context.Background(), "test@gmail.com", "code", "reservation", expiresAt, rules.Order{}, sqlx.NewDb(db, "sqlmock"))
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestConfirmReservation(t *testing.T) {
+	db, mock := setupSQLMock(t)
+	defer db.Close()
+	for _, tt := range []struct {
+		name      string
+		expiresAt time.Time
+		notFound  bool
+		raceLost  bool
+		wantErr   error
+	}{
+		{name: "confirm reservation", expiresAt: time.Now().Add(time.Minute)},
+		{name: "reservation not found", notFound: true, wantErr: ErrReservationNotFound},
+		{name: "reservation expired", expiresAt: time.Now().Add(-time.Minute), wantErr: ErrReservationExpired},
+		{name: "reservation released meanwhile", expiresAt: time.Now().Add(time.Minute), raceLost: true, wantErr: ErrReservationNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mock.ExpectBegin()
+			rows := sqlmock.NewRows([]string{"code", "customer_id", "expires_at"})
+			if !tt.notFound {
+				rows.AddRow("code", 3, tt.expiresAt)
+			}
+			mock.ExpectQuery("SELECT vo.code, r.customer_id, r.expires_at FROM reservations r (.+) WHERE r.id=(.+)").WithArgs("reservation").WillReturnRows(rows)
+			if !tt.notFound && tt.expiresAt.After(time.Now()) {
+				mock.ExpectQuery("SELECT (.+) FROM vouchers vo (.+) FOR UPDATE OF vo").WithArgs("code").
+					WillReturnRows(sqlmock.NewRows(voucherColumns).AddRow(1, 2, "test@gmail.com", "customer", time.Now().Add(time.Hour), nil, 2, nil, 0, "fixed", nil, 500, "USD", true, nil, nil, nil, "[]", false, "", nil, 3))
+				if tt.raceLost {
+					mock.ExpectExec("DELETE FROM reservations WHERE id=(.+)").WithArgs("reservation", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+				} else {
+					mock.ExpectExec("DELETE FROM reservations WHERE id=(.+)").WithArgs("reservation", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+					// the use is redeemed by the customer of the reservation
+					mock.ExpectQuery(usageQuery).WithArgs(1, 3, sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows(usageColumns).AddRow(0, 0, 0, 0))
+					mock.ExpectExec("UPDATE vouchers SET (.+) WHERE id=(.+) AND redemption_count<max_redemptions").WithArgs(sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectExec("INSERT INTO redemptions (.+)").WithArgs(1, 3, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+			}
+			if tt.wantErr != nil {
+				mock.ExpectRollback()
+			} else {
+				mock.ExpectCommit()
+			}
+
+			got, err := ConfirmReservation(context.Background(), "reservation", sqlx.NewDb(db, "sqlmock"))
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, RedeemResult{OfferID: 3, Discount: FixedDiscount(500, "USD"), RemainingUses: 1, Rules: rules.Set{}}, got)
+			}
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package dbmodel
+
+import (
+	"database/sql"
+	"sort"
+
+	"github.com/ingemar0720/voucher-pool/money"
+	"github.com/pkg/errors"
+)
+
+// Stacking is the policy of an offer on redeeming its vouchers together with other codes for the same order
+type Stacking struct {
+	// Exclusive vouchers cannot be combined with any other code
+	Exclusive bool
+	// Group, codes are combined only with codes of offers of the same group. The offers without a group are one group.
+	Group string
+	// MaxTotalDiscount caps the total discount of every combination with the vouchers of the offer, in basis points
+	// of the amount of the order like PercentageDiscount. There is no cap if 0.
+	MaxTotalDiscount int64
+}
+
+// Validate checks the policy satisfies the constraints of table offers
+func (s Stacking) Validate() error {
+	if s.MaxTotalDiscount < 0 || s.MaxTotalDiscount > 100*100 {
+		return errors.Errorf("max total discount shall be in (0, 100.00] or 0 for no cap, got %v", money.FormatDecimal(s.MaxTotalDiscount, money.PercentScale))
+	}
+	return nil
+}
+
+// maxTotalDiscount returns the cap as kept in column max_total_discount, NULL if there is none
+func (s Stacking) maxTotalDiscount() sql.NullString {
+	if s.MaxTotalDiscount == 0 {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: money.FormatDecimal(s.MaxTotalDiscount, money.PercentScale), Valid: true}
+}
+
+// parseStacking returns the policy of the columns exclusive, stack_group and max_total_discount of table offers
+func parseStacking(exclusive bool, group string, maxTotalDiscount sql.NullString) (Stacking, error) {
+	s := Stacking{Exclusive: exclusive, Group: group}
+	if maxTotalDiscount.Valid {
+		max, err := money.ParseDecimal(maxTotalDiscount.String, money.PercentScale)
+		if err != nil {
+			return Stacking{}, errors.Wrapf(err, "fail to parse max total discount")
+		}
+		s.MaxTotalDiscount = max
+	}
+	return s, nil
+}
+
+// Stacking returns the stacking policy of the offer
+func (o DBModelOffer) Stacking() (Stacking, error) {
+	return parseStacking(o.Exclusive, o.StackGroup, o.MaxTotalDiscount)
+}
+
+// checkAlone returns ErrStackingPolicy if a voucher of an offer with policy s is redeemed or reserved by itself, as
+// the other codes of its order are not known then. Only the offers without a policy combine freely.
+func checkAlone(s Stacking) error {
+	if s != (Stacking{}) {
+		return ErrStackingPolicy
+	}
+	return nil
+}
+
+// checkCodes returns an error if a code is given twice, a voucher is redeemed once per order
+func checkCodes(codes []string) error {
+	if len(codes) == 0 {
+		return errors.New("no voucher code given")
+	}
+	seen := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		if seen[code] {
+			return errors.Wrapf(ErrStackingConflict, "code %v is given twice", code)
+		}
+		seen[code] = true
+	}
+	return nil
+}
+
+// sortedCodes returns the codes in the order the vouchers are locked in, so concurrent combinations do not deadlock
+func sortedCodes(codes []string) []string {
+	sorted := append([]string(nil), codes...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// checkStacking returns ErrStackingConflict if the vouchers of codes cannot be combined, policies are the stacking
+// policies of their offers. A single code is never in conflict.
+func checkStacking(codes []string, policies []Stacking) error {
+	if len(codes) < 2 {
+		return nil
+	}
+	for i, p := range policies {
+		if p.Exclusive {
+			return errors.Wrapf(ErrStackingConflict, "voucher %v is exclusive", codes[i])
+		}
+		if p.Group != policies[0].Group {
+			return errors.Wrapf(ErrStackingConflict, "vouchers %v and %v are of different stack groups", codes[0], codes[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package dbmodel
+
+import (
+	"context"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/rules"
+	"github.com/jmoiron/sqlx"
+)
+
+// VoucherStore is the storage used by the voucher service, it covers customers, special offers, vouchers and redemptions
+type VoucherStore interface {
+	CreateCustomer(ctx context.Context, name, email string) (uint64, error)
+	GetCustomerIDByEmail(ctx context.Context, email string) (uint64, error)
+	GetCustomer(ctx context.Context, id uint64) (DBModelCustomer, error)
+	ListCustomers(ctx context.Context, filter CustomerFilter, afterID uint64, limit int) ([]DBModelCustomer, error)
+	UpdateCustomer(ctx context.Context, id uint64, name, email string) (DBModelCustomer, error)
+	DeleteCustomer(ctx context.Context, id uint64) error
+	// return everything held about the customer
+	ExportCustomer(ctx context.Context, id uint64) (CustomerExport, error)
+	// anonymize the personal data of the customer, its vouchers and redemptions are kept
+	EraseCustomer(ctx context.Context, id uint64) (DBModelCustomer, error)
+	CreateOffer(ctx context.Context, spec OfferSpec) (DBModelOffer, error)
+	GetOffer(ctx context.Context, id uint64) (DBModelOffer, error)
+	ListOffers(ctx context.Context, filter OfferFilter) ([]DBModelOffer, error)
+	// replace the offer with spec, a new version is made if the name or the discount changes, the vouchers issued
+	// before keep their version
+	UpdateOffer(ctx context.Context, id uint64, spec OfferSpec) (DBModelOffer, error)
+	// archive the offer, its vouchers cannot be issued or redeemed any more
+	ArchiveOffer(ctx context.Context, id uint64) (DBModelOffer, error)
+	// return the versions of the offer, the oldest first
+	GetOfferHistory(ctx context.Context, id uint64) ([]DBModelSpecialOffer, error)
+	GenerateVoucher(ctx context.Context, email, code string, offer OfferRef, expiry time.Time, limits Limits) error
+	// generate a public or claim voucher, not bound to a customer
+	GenerateUnassignedVoucher(ctx context.Context, assignment Assignment, code string, offer OfferRef, expiry time.Time, limits Limits) error
+	// return codes, offer names and remaining uses of the vouchers assigned to or claimed by the customer, which
+	// the customer can still redeem
+	GetVouchers(ctx context.Context, email string) ([]string, []string, []int, error)
+	RedeemVoucher(ctx context.Context, email, code string, order rules.Order) (RedeemResult, error)
+	// redeem the vouchers of codes together for one order, all of them or none, the combination shall satisfy the
+	// stacking policies of their offers or it fails with ErrStackingConflict. check is called with the results before
+	// they are committed, none is redeemed if it fails.
+	RedeemVouchers(ctx context.Context, email string, codes []string, order rules.Order, check func([]RedeemResult) error) ([]RedeemResult, error)
+	// run the checks of RedeemVoucher without redeeming the voucher
+	QuoteVoucher(ctx context.Context, email, code string) (RedeemResult, error)
+	// hold a use of the voucher until expiresAt, RedeemVoucher and ReserveVoucher fail with ErrVoucherReserved
+	// meanwhile if no other use is left
+	ReserveVoucher(ctx context.Context, email, code, reservationID string, expiresAt time.Time, order rules.Order) (RedeemResult, error)
+	ConfirmReservation(ctx context.Context, reservationID string) (RedeemResult, error)
+	ReleaseReservation(ctx context.Context, reservationID string) error
+	// release the reservations expired at now, return the number of them
+	ReleaseExpiredReservations(ctx context.Context, now time.Time) (int64, error)
+	// reverse a redemption of the voucher not reversed yet, so its use can be redeemed again
+	ReverseRedemption(ctx context.Context, code string, reversal Reversal) (DBModelRedemption, error)
+	GetRedemptions(ctx context.Context, code string) ([]DBModelRedemption, error)
+	GetCustomerIDsByEmails(ctx context.Context, emails []string) (map[string]uint64, error)
+	ListCustomerEmails(ctx context.Context, filter CustomerFilter) ([]string, error)
+	// insert the vouchers in one transaction, return codes skipped because they already exist
+	InsertVouchers(ctx context.Context, offer OfferRef, limits Limits, vouchers []DBModelVoucher) ([]string, error)
+	// record the key of scope for the request of fingerprint until expiresAt and return true, or return the record of
+	// the key and false if another request has it and it is not expired at now
+	ClaimIdempotencyKey(ctx context.Context, scope, key, fingerprint string, now, expiresAt time.Time) (DBModelIdempotencyKey, bool, error)
+	// save or delete the key claimed with fingerprint at createdAt, a key claimed since by another request is kept
+	SaveIdempotentResponse(ctx context.Context, scope, key, fingerprint string, createdAt time.Time, status int, body []byte, expiresAt time.Time) error
+	ReleaseIdempotencyKey(ctx context.Context, scope, key, fingerprint string, createdAt time.Time) error
+	// delete the idempotency keys expired at now, return the number of them
+	DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) (int64, error)
+}
+
+var (
+	_ VoucherStore = (*PostgresStore)(nil)
+	_ VoucherStore = (*MemoryStore)(nil)
+)
+
+// QueryHook is called before every operation of PostgresStore with its name, like RedeemVoucher. The operation runs
+// with the returned context, the returned func is called with its error once it is done.
+type QueryHook func(ctx context.Context, op string) (context.Context, func(err error))
+
+// PostgresStore implements VoucherStore on top of postgres
+type PostgresStore struct {
+	DB    *sqlx.DB
+	hooks []QueryHook
+}
+
+func NewPostgresStore(db *sqlx.DB) *PostgresStore {
+	return &PostgresStore{DB: db}
+}
+
+// Use adds the hook to the operations of the store, the hooks shall be added before the store is used
+func (s *PostgresStore) Use(hook QueryHook) {
+	s.hooks = append(s.hooks, hook)
+}
+
+// track runs the hooks for the operation op, the returned func ends them in reverse order and returns err
+func (s *PostgresStore) track(ctx context.Context, op string) (context.Context, func(err error) error) {
+	dones := make([]func(error), len(s.hooks))
+	for i, hook := range s.hooks {
+		ctx, dones[i] = hook(ctx, op)
+	}
+	return ctx, func(err error) error {
+		for i := len(dones) - 1; i >= 0; i-- {
+			dones[i](err)
+		}
+		return err
+	}
+}
+
+func (s *PostgresStore) CreateCustomer(ctx context.Context, name, email string) (uint64, error) {
+	ctx, done := s.track(ctx, "CreateCustomer")
+	res, err := CreateCustomer(ctx, name, email, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) GetCustomerIDByEmail(ctx context.Context, email string) (uint64, error) {
+	ctx, done := s.track(ctx, "GetCustomerIDByEmail")
+	res, err := GetCustomerIDByEmail(ctx, email, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) GetCustomer(ctx context.Context, id uint64) (DBModelCustomer, error) {
+	ctx, done := s.track(ctx, "GetCustomer")
+	res, err := GetCustomer(ctx, id, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) ListCustomers(ctx context.Context, filter CustomerFilter, afterID uint64, limit int) ([]DBModelCustomer, error) {
+	ctx, done := s.track(ctx, "ListCustomers")
+	res, err := ListCustomers(ctx, filter, afterID, limit, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) UpdateCustomer(ctx context.Context, id uint64, name, email string) (DBModelCustomer, error) {
+	ctx, done := s.track(ctx, "UpdateCustomer")
+	res, err := UpdateCustomer(ctx, id, name, email, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) DeleteCustomer(ctx context.Context, id uint64) error {
+	ctx, done := s.track(ctx, "DeleteCustomer")
+	return done(DeleteCustomer(ctx, id, s.DB))
+}
+
+func (s *PostgresStore) ExportCustomer(ctx context.Context, id uint64) (CustomerExport, error) {
+	ctx, done := s.track(ctx, "ExportCustomer")
+	res, err := ExportCustomer(ctx, id, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) EraseCustomer(ctx context.Context, id uint64) (DBModelCustomer, error) {
+	ctx, done := s.track(ctx, "EraseCustomer")
+	res, err := EraseCustomer(ctx, id, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) CreateOffer(ctx context.Context, spec OfferSpec) (DBModelOffer, error) {
+	ctx, done := s.track(ctx, "CreateOffer")
+	res, err := CreateOffer(ctx, spec, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) GetOffer(ctx context.Context, id uint64) (DBModelOffer, error) {
+	ctx, done := s.track(ctx, "GetOffer")
+	res, err := GetOffer(ctx, id, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) ListOffers(ctx context.Context, filter OfferFilter) ([]DBModelOffer, error) {
+	ctx, done := s.track(ctx, "ListOffers")
+	res, err := ListOffers(ctx, filter, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) UpdateOffer(ctx context.Context, id uint64, spec OfferSpec) (DBModelOffer, error) {
+	ctx, done := s.track(ctx, "UpdateOffer")
+	res, err := UpdateOffer(ctx, id, spec, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) ArchiveOffer(ctx context.Context, id uint64) (DBModelOffer, error) {
+	ctx, done := s.track(ctx, "ArchiveOffer")
+	res, err := ArchiveOffer(ctx, id, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) GetOfferHistory(ctx context.Context, id uint64) ([]DBModelSpecialOffer, error) {
+	ctx, done := s.track(ctx, "GetOfferHistory")
+	res, err := GetOfferHistory(ctx, id, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) GenerateVoucher(ctx context.Context, email, code string, offer OfferRef, expiry time.Time, limits Limits) error {
+	ctx, done := s.track(ctx, "GenerateVoucher")
+	return done(GenerateVoucher(ctx, email, code, offer, expiry, limits, s.DB))
+}
+
+func (s *PostgresStore) GenerateUnassignedVoucher(ctx context.Context, assignment Assignment, code string, offer OfferRef, expiry time.Time, limits Limits) error {
+	ctx, done := s.track(ctx, "GenerateUnassignedVoucher")
+	return done(GenerateUnassignedVoucher(ctx, assignment, code, offer, expiry, limits, s.DB))
+}
+
+func (s *PostgresStore) GetVouchers(ctx context.Context, email string) ([]string, []string, []int, error) {
+	ctx, done := s.track(ctx, "GetVouchers")
+	codes, names, remaining, err := GetVouchers(ctx, email, s.DB)
+	return codes, names, remaining, done(err)
+}
+
+func (s *PostgresStore) RedeemVoucher(ctx context.Context, email, code string, order rules.Order) (RedeemResult, error) {
+	ctx, done := s.track(ctx, "RedeemVoucher")
+	res, err := RedeemVoucher(ctx, email, code, order, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) RedeemVouchers(ctx context.Context, email string, codes []string, order rules.Order, check func([]RedeemResult) error) ([]RedeemResult, error) {
+	ctx, done := s.track(ctx, "RedeemVouchers")
+	res, err := RedeemVouchers(ctx, email, codes, order, check, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) QuoteVoucher(ctx context.Context, email, code string) (RedeemResult, error) {
+	ctx, done := s.track(ctx, "QuoteVoucher")
+	res, err := QuoteVoucher(ctx, email, code, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) ReserveVoucher(ctx context.Context, email, code, reservationID string, expiresAt time.Time, order rules.Order) (RedeemResult, error) {
+	ctx, done := s.track(ctx, "ReserveVoucher")
+	res, err := ReserveVoucher(ctx, email, code, reservationID, expiresAt, order, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) ConfirmReservation(ctx context.Context, reservationID string) (RedeemResult, error) {
+	ctx, done := s.track(ctx, "ConfirmReservation")
+	res, err := ConfirmReservation(ctx, reservationID, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) ReleaseReservation(ctx context.Context, reservationID string) error {
+	ctx, done := s.track(ctx, "ReleaseReservation")
+	return done(ReleaseReservation(ctx, reservationID, s.DB))
+}
+
+func (s *PostgresStore) ReleaseExpiredReservations(ctx context.Context, now time.Time) (int64, error) {
+	ctx, done := s.track(ctx, "ReleaseExpiredReservations")
+	res, err := ReleaseExpiredReservations(ctx, now, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) ReverseRedemption(ctx context.Context, code string, reversal Reversal) (DBModelRedemption, error) {
+	ctx, done := s.track(ctx, "ReverseRedemption")
+	res, err := ReverseRedemption(ctx, code, reversal, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) GetRedemptions(ctx context.Context, code string) ([]DBModelRedemption, error) {
+	ctx, done := s.track(ctx, "GetRedemptions")
+	res, err := GetRedemptions(ctx, code, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) GetCustomerIDsByEmails(ctx context.Context, emails []string) (map[string]uint64, error) {
+	ctx, done := s.track(ctx, "GetCustomerIDsByEmails")
+	res, err := GetCustomerIDsByEmails(ctx, emails, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) ListCustomerEmails(ctx context.Context, filter CustomerFilter) ([]string, error) {
+	ctx, done := s.track(ctx, "ListCustomerEmails")
+	res, err := ListCustomerEmails(ctx, filter, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) InsertVouchers(ctx context.Context, offer OfferRef, limits Limits, vouchers []DBModelVoucher) ([]string, error) {
+	ctx, done := s.track(ctx, "InsertVouchers")
+	res, err := InsertVouchers(ctx, offer, limits, vouchers, s.DB)
+	return res, done(err)
+}
+
+func (s *PostgresStore) ClaimIdempotencyKey(ctx context.Context, scope, key, fingerprint string, now, expiresAt time.Time) (DBModelIdempotencyKey, bool, error) {
+	ctx, done := s.track(ctx, "ClaimIdempotencyKey")
+	k, claimed, err := ClaimIdempotencyKey(ctx, scope, key, fingerprint, now, expiresAt, s.DB)
+	return k, claimed, done(err)
+}
+
+func (s *PostgresStore) SaveIdempotentResponse(ctx context.Context, scope, key, fingerprint string, createdAt time.Time, status int, body []byte, expiresAt time.Time) error {
+	ctx, done := s.track(ctx, "SaveIdempotentResponse")
+	return done(SaveIdempotentResponse(ctx, scope, key, fingerprint, createdAt, status, body, expiresAt, s.DB))
+}
+
+func (s *PostgresStore) ReleaseIdempotencyKey(ctx context.Context, scope, key, fingerprint string, createdAt time.Time) error {
+	ctx, done := s.track(ctx, "ReleaseIdempotencyKey")
+	return done(ReleaseIdempotencyKey(ctx, scope, key, fingerprint, createdAt, s.DB))
+}
+
+func (s *PostgresStore) DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) (int64, error) {
+	ctx, done := s.track(ctx, "DeleteExpiredIdempotencyKeys")
+	res, err := DeleteExpiredIdempotencyKeys(ctx, now, s.DB)
+	return res, done(err)
+}
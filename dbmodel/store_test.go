@@ -0,0 +1,936 @@
+package dbmodel
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/ingemar0720/voucher-pool/config"
+	"github.com/ingemar0720/voucher-pool/rules"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testVoucherStore(t, func(t *testing.T) VoucherStore {
+		return NewMemoryStore()
+	})
+}
+
+func TestPostgresStoreHooks(t *testing.T) {
+	db, mock := setupSQLMock(t)
+	defer db.Close()
+	mock.ExpectExec("DELETE FROM idempotency_keys").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM idempotency_keys").WillReturnError(errors.New("db down"))
+
+	store := NewPostgresStore(sqlx.NewDb(db, "sqlmock"))
+	var calls []string
+	for _, name := range []string{"outer", "inner"} {
+		name := name
+		store.Use(func(ctx context.Context, op string) (context.Context, func(error)) {
+			calls = append(calls, name+" start "+op)
+			return ctx, func(err error) { calls = append(calls, fmt.Sprintf("%v done %v", name, err != nil)) }
+		})
+	}
+	n, err := store.DeleteExpiredIdempotencyKeys(context.Background(), time.Now())
+	assert.Nil(t, err)
+	assert.EqualValues(t, 2, n)
+	_, err = store.DeleteExpiredIdempotencyKeys(context.Background(), time.Now())
+	assert.NotNil(t, err)
+	// the hooks end in reverse order and see the error of the operation
+	assert.Equal(t, []string{
+		"outer start DeleteExpiredIdempotencyKeys", "inner start DeleteExpiredIdempotencyKeys", "inner done false", "outer done false",
+		"outer start DeleteExpiredIdempotencyKeys", "inner start DeleteExpiredIdempotencyKeys", "inner done true", "outer done true",
+	}, calls)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+// run the same conformance suite against the test database, skip when it is not reachable
+func TestPostgresStore(t *testing.T) {
+	db, err := sqlx.Connect("postgres", config.TestDSN())
+	if err != nil {
+		t.Skipf("test DB not reachable: %v", err)
+	}
+	defer db.Close()
+	testVoucherStore(t, func(t *testing.T) VoucherStore {
+		_, err := db.Exec("TRUNCATE TABLE customers, offers, special_offers, vouchers, idempotency_keys RESTART IDENTITY CASCADE")
+		require.Nil(t, err)
+		return NewPostgresStore(db)
+	})
+}
+
+// testVoucherStore is the conformance suite every VoucherStore implementation shall pass,
+// newStore shall return an empty store
+func testVoucherStore(t *testing.T, newStore func(t *testing.T) VoucherStore) {
+	ctx := context.Background()
+	tomorrow := time.Now().Add(24 * time.Hour)
+	yesterday := time.Now().Add(-24 * time.Hour)
+
+	t.Run("customers", func(t *testing.T) {
+		s := newStore(t)
+		id, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		assert.Nil(t, err)
+		assert.NotZero(t, id)
+		_, err = s.CreateCustomer(ctx, "customer 0", "Customer0@Gmail.com")
+		assert.True(t, errors.Is(err, ErrCustomerConflict))
+
+		got, err := s.GetCustomerIDByEmail(ctx, "customer0@gmail.com")
+		assert.Nil(t, err)
+		assert.EqualValues(t, id, got)
+		got, err = s.GetCustomerIDByEmail(ctx, " CUSTOMER0@gmail.com")
+		assert.Nil(t, err)
+		assert.EqualValues(t, id, got)
+		_, err = s.GetCustomerIDByEmail(ctx, "unknown@gmail.com")
+		assert.True(t, errors.Is(err, ErrCustomerNotFound))
+	})
+
+	t.Run("manage customers", func(t *testing.T) {
+		s := newStore(t)
+		id0, err := s.CreateCustomer(ctx, "customer 0", "Customer0@gmail.com")
+		require.Nil(t, err)
+		id1, err := s.CreateCustomer(ctx, "customer 1", "customer1@yahoo.com")
+		require.Nil(t, err)
+		id2, err := s.CreateCustomer(ctx, "customer 2", "customer2@gmail.com")
+		require.Nil(t, err)
+
+		c, err := s.GetCustomer(ctx, id0)
+		require.Nil(t, err)
+		assert.Equal(t, "customer0@gmail.com", c.Email)
+		_, err = s.GetCustomer(ctx, id2+1)
+		assert.True(t, errors.Is(err, ErrCustomerNotFound))
+
+		customers, err := s.ListCustomers(ctx, CustomerFilter{}, id0, 1)
+		require.Nil(t, err)
+		require.Len(t, customers, 1)
+		assert.EqualValues(t, id1, customers[0].ID)
+		customers, err = s.ListCustomers(ctx, CustomerFilter{EmailDomain: "Gmail.com"}, 0, 10)
+		require.Nil(t, err)
+		require.Len(t, customers, 2)
+		assert.EqualValues(t, id0, customers[0].ID)
+		assert.EqualValues(t, id2, customers[1].ID)
+
+		c, err = s.UpdateCustomer(ctx, id1, "customer one", "Customer1@gmail.com")
+		require.Nil(t, err)
+		assert.Equal(t, "customer one", c.Name)
+		assert.Equal(t, "customer1@gmail.com", c.Email)
+		got, err := s.GetCustomerIDByEmail(ctx, "customer1@gmail.com")
+		require.Nil(t, err)
+		assert.EqualValues(t, id1, got)
+		_, err = s.GetCustomerIDByEmail(ctx, "customer1@yahoo.com")
+		assert.True(t, errors.Is(err, ErrCustomerNotFound))
+		_, err = s.UpdateCustomer(ctx, id1, "customer one", "customer0@gmail.com")
+		assert.True(t, errors.Is(err, ErrCustomerConflict))
+		_, err = s.UpdateCustomer(ctx, id2+1, "nobody", "nobody@gmail.com")
+		assert.True(t, errors.Is(err, ErrCustomerNotFound))
+
+		// customers with vouchers are kept
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "abc", OfferRef{Name: "KOI", Discount: PercentageDiscount(2000)}, tomorrow, Limits{}))
+		assert.True(t, errors.Is(s.DeleteCustomer(ctx, id0), ErrCustomerInUse))
+		require.Nil(t, s.DeleteCustomer(ctx, id2))
+		assert.True(t, errors.Is(s.DeleteCustomer(ctx, id2), ErrCustomerNotFound))
+		_, err = s.GetCustomerIDByEmail(ctx, "customer2@gmail.com")
+		assert.True(t, errors.Is(err, ErrCustomerNotFound))
+	})
+
+	t.Run("export and erase customer", func(t *testing.T) {
+		s := newStore(t)
+		id0, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		require.Nil(t, err)
+		_, err = s.CreateCustomer(ctx, "customer 1", "customer1@gmail.com")
+		require.Nil(t, err)
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "used", OfferRef{Name: "KOI", Discount: PercentageDiscount(2000)}, tomorrow, Limits{}))
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "unused", OfferRef{Name: "KOI", Discount: PercentageDiscount(2000)}, tomorrow, Limits{}))
+		require.Nil(t, s.GenerateUnassignedVoucher(ctx, AssignmentPublic, "PUBLIC", OfferRef{Name: "summer", Discount: PercentageDiscount(1000)}, tomorrow, Limits{MaxRedemptions: 10}))
+		require.Nil(t, s.GenerateUnassignedVoucher(ctx, AssignmentClaim, "CLAIM", OfferRef{Name: "summer", Discount: PercentageDiscount(1000)}, tomorrow, Limits{}))
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "used", rules.Order{})
+		require.Nil(t, err)
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "PUBLIC", rules.Order{})
+		require.Nil(t, err)
+		_, err = s.ReserveVoucher(ctx, "customer0@gmail.com", "CLAIM", "claim", tomorrow, rules.Order{})
+		require.Nil(t, err)
+
+		export, err := s.ExportCustomer(ctx, id0)
+		require.Nil(t, err)
+		assert.Equal(t, "customer0@gmail.com", export.Customer.Email)
+		require.Len(t, export.Vouchers, 2)
+		assert.Equal(t, "used", export.Vouchers[0].Code)
+		assert.Equal(t, "KOI", export.Vouchers[0].Offer.Name)
+		assert.Equal(t, "unused", export.Vouchers[1].Code)
+		require.Len(t, export.Redemptions, 2)
+		assert.Equal(t, "used", export.Redemptions[0].Code)
+		assert.Equal(t, "PUBLIC", export.Redemptions[1].Code)
+		_, err = s.ExportCustomer(ctx, id0+10)
+		assert.True(t, errors.Is(err, ErrCustomerNotFound))
+
+		erased, err := s.EraseCustomer(ctx, id0)
+		require.Nil(t, err)
+		assert.True(t, erased.ErasedAt.Valid)
+		assert.Empty(t, erased.Name)
+		assert.NotContains(t, erased.Email, "customer0")
+		again, err := s.EraseCustomer(ctx, id0)
+		require.Nil(t, err)
+		assert.Equal(t, erased.Email, again.Email)
+		assert.True(t, erased.ErasedAt.Time.Equal(again.ErasedAt.Time))
+		_, err = s.EraseCustomer(ctx, id0+10)
+		assert.True(t, errors.Is(err, ErrCustomerNotFound))
+
+		// vouchers and redemptions are kept, the email does not lead to the customer any more
+		export, err = s.ExportCustomer(ctx, id0)
+		require.Nil(t, err)
+		assert.Len(t, export.Vouchers, 2)
+		require.Len(t, export.Redemptions, 2)
+		assert.Equal(t, erased.Email, export.Redemptions[0].Email)
+		_, err = s.GetCustomerIDByEmail(ctx, "customer0@gmail.com")
+		assert.True(t, errors.Is(err, ErrCustomerNotFound))
+		_, err = s.GetCustomerIDByEmail(ctx, erased.Email)
+		assert.True(t, errors.Is(err, ErrCustomerNotFound))
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "unused", rules.Order{})
+		assert.True(t, errors.Is(err, ErrVoucherNotOwned))
+		_, err = s.UpdateCustomer(ctx, id0, "customer 0", "customer0@gmail.com")
+		assert.True(t, errors.Is(err, ErrCustomerErased))
+		emails, err := s.ListCustomerEmails(ctx, CustomerFilter{})
+		require.Nil(t, err)
+		assert.Equal(t, []string{"customer1@gmail.com"}, emails)
+		// the reservation of the erased customer is released, the claim voucher can be claimed by others
+		_, err = s.RedeemVoucher(ctx, "customer1@gmail.com", "CLAIM", rules.Order{})
+		assert.Nil(t, err)
+		// the email can sign up again as a new customer
+		_, err = s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		assert.Nil(t, err)
+	})
+
+	t.Run("special offers", func(t *testing.T) {
+		s := newStore(t)
+		_, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		require.Nil(t, err)
+		generate := func(code, name string, discount Discount) error {
+			return s.GenerateVoucher(ctx, "customer0@gmail.com", code, OfferRef{Name: name, Discount: discount}, tomorrow, Limits{})
+		}
+		// the same discount keeps the version
+		assert.Nil(t, generate("k1", "KOI", PercentageDiscount(2000)))
+		assert.Nil(t, generate("k2", "KOI", PercentageDiscount(2000)))
+		offers, err := s.ListOffers(ctx, OfferFilter{Limit: 10})
+		require.Nil(t, err)
+		require.Len(t, offers, 1)
+		assert.Equal(t, 1, offers[0].Current.Version)
+		assert.True(t, errors.Is(generate("a1", "apple_store", PercentageDiscount(10100)), ErrInvalidOffer))
+		assert.Nil(t, generate("t1", "ten_off", FixedDiscount(1000, "EUR")))
+		assert.True(t, errors.Is(generate("t2", "ten_off", FixedDiscount(1000, "XXX")), ErrInvalidOffer))
+	})
+
+	t.Run("special offer versions", func(t *testing.T) {
+		s := newStore(t)
+		_, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		require.Nil(t, err)
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "v1", OfferRef{Name: "KOI", Discount: PercentageDiscount(2000)}, tomorrow, Limits{}))
+		// a new discount does not change the vouchers issued before
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "v2", OfferRef{Name: "KOI", Discount: PercentageDiscount(3000)}, tomorrow, Limits{}))
+		offers, err := s.ListOffers(ctx, OfferFilter{Limit: 10})
+		require.Nil(t, err)
+		require.Len(t, offers, 1)
+		id := offers[0].ID
+		assert.Equal(t, 2, offers[0].Current.Version)
+		assert.True(t, offers[0].Active)
+
+		updated, err := s.UpdateOffer(ctx, id, OfferSpec{Name: "KOI", Description: "koi pond", Discount: FixedDiscount(500, "EUR"), Active: true})
+		require.Nil(t, err)
+		assert.Equal(t, 3, updated.Current.Version)
+		assert.Equal(t, "koi pond", updated.Description)
+		// a change of the description only keeps the version
+		updated, err = s.UpdateOffer(ctx, id, OfferSpec{Name: "KOI", Discount: FixedDiscount(500, "EUR"), Active: true})
+		require.Nil(t, err)
+		assert.Equal(t, 3, updated.Current.Version)
+		for code, want := range map[string]Discount{"v1": PercentageDiscount(2000), "v2": PercentageDiscount(3000)} {
+			result, err := s.QuoteVoucher(ctx, "customer0@gmail.com", code)
+			require.Nil(t, err)
+			assert.Equal(t, want, result.Discount)
+		}
+		_, err = s.UpdateOffer(ctx, id+100, OfferSpec{Name: "KOI", Discount: PercentageDiscount(1000), Active: true})
+		assert.True(t, errors.Is(err, ErrOfferNotFound))
+
+		// neither issued nor redeemed while the offer is deactivated
+		deactivated, err := s.UpdateOffer(ctx, id, OfferSpec{Name: "KOI", Discount: FixedDiscount(500, "EUR")})
+		require.Nil(t, err)
+		assert.False(t, deactivated.Active)
+		err = s.GenerateVoucher(ctx, "customer0@gmail.com", "v3", OfferRef{ID: id}, tomorrow, Limits{})
+		assert.True(t, errors.Is(err, ErrOfferInactive))
+		err = s.GenerateVoucher(ctx, "customer0@gmail.com", "v3", OfferRef{Name: "KOI", Discount: FixedDiscount(500, "EUR")}, tomorrow, Limits{})
+		assert.True(t, errors.Is(err, ErrOfferInactive))
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "v1", rules.Order{})
+		assert.True(t, errors.Is(err, ErrOfferInactive))
+		codes, _, _, err := s.GetVouchers(ctx, "customer0@gmail.com")
+		assert.Nil(t, err)
+		assert.Empty(t, codes)
+
+		// renaming makes a new version, the old name is free again
+		renamed, err := s.UpdateOffer(ctx, id, OfferSpec{Name: "CARP", Discount: FixedDiscount(500, "EUR"), Active: true})
+		require.Nil(t, err)
+		assert.Equal(t, 4, renamed.Current.Version)
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "v1", rules.Order{})
+		assert.Nil(t, err)
+		history, err := s.GetOfferHistory(ctx, id)
+		require.Nil(t, err)
+		if assert.Len(t, history, 4) {
+			for i, o := range history {
+				assert.Equal(t, i+1, o.Version)
+				assert.Equal(t, id, o.OfferID)
+				assert.Equal(t, i == 3, !o.SupersededAt.Valid)
+			}
+			assert.Equal(t, sql.NullString{String: "20.00", Valid: true}, history[0].Discount)
+			assert.Equal(t, "CARP", history[3].Name)
+		}
+		_, err = s.GetOfferHistory(ctx, id+100)
+		assert.True(t, errors.Is(err, ErrOfferNotFound))
+		other, err := s.CreateOffer(ctx, OfferSpec{Name: "KOI", Discount: PercentageDiscount(1000), Active: true})
+		require.Nil(t, err)
+		assert.NotEqual(t, id, other.ID)
+		_, err = s.UpdateOffer(ctx, other.ID, OfferSpec{Name: "CARP", Discount: PercentageDiscount(1000), Active: true})
+		assert.True(t, errors.Is(err, ErrOfferConflict))
+	})
+
+	t.Run("offer windows and archive", func(t *testing.T) {
+		s := newStore(t)
+		_, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		require.Nil(t, err)
+		_, err = s.CreateOffer(ctx, OfferSpec{Name: "summer", Discount: PercentageDiscount(1000), StartsAt: sql.NullTime{Time: tomorrow, Valid: true}, EndsAt: sql.NullTime{Time: yesterday, Valid: true}})
+		assert.True(t, errors.Is(err, ErrInvalidOffer))
+		_, err = s.CreateOffer(ctx, OfferSpec{Name: "", Discount: PercentageDiscount(1000)})
+		assert.True(t, errors.Is(err, ErrInvalidOffer))
+
+		// vouchers are issued ahead of the offer and redeemed once it starts
+		upcoming, err := s.CreateOffer(ctx, OfferSpec{Name: "summer", Description: "summer sale", Discount: PercentageDiscount(1000), StartsAt: sql.NullTime{Time: tomorrow, Valid: true}, Active: true})
+		require.Nil(t, err)
+		assert.Equal(t, "summer sale", upcoming.Description)
+		assert.Equal(t, 1, upcoming.Current.Version)
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "early", OfferRef{ID: upcoming.ID}, tomorrow.Add(time.Hour), Limits{}))
+		_, err = s.QuoteVoucher(ctx, "customer0@gmail.com", "early")
+		assert.True(t, errors.Is(err, ErrOfferNotStarted))
+		_, err = s.UpdateOffer(ctx, upcoming.ID, OfferSpec{Name: "summer", Discount: PercentageDiscount(1000), StartsAt: sql.NullTime{Time: yesterday, Valid: true}, Active: true})
+		require.Nil(t, err)
+		_, err = s.QuoteVoucher(ctx, "customer0@gmail.com", "early")
+		assert.Nil(t, err)
+
+		ended, err := s.UpdateOffer(ctx, upcoming.ID, OfferSpec{Name: "summer", Discount: PercentageDiscount(1000), EndsAt: sql.NullTime{Time: time.Now().Add(-time.Minute), Valid: true}, Active: true})
+		require.Nil(t, err)
+		err = s.GenerateVoucher(ctx, "customer0@gmail.com", "late", OfferRef{ID: ended.ID}, tomorrow, Limits{})
+		assert.True(t, errors.Is(err, ErrOfferEnded))
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "early", rules.Order{})
+		assert.True(t, errors.Is(err, ErrOfferEnded))
+		err = s.GenerateVoucher(ctx, "customer0@gmail.com", "late", OfferRef{ID: ended.ID + 100}, tomorrow, Limits{})
+		assert.True(t, errors.Is(err, ErrOfferNotFound))
+
+		// archived offers are left out of the list unless asked for, and cannot be changed any more
+		second, err := s.CreateOffer(ctx, OfferSpec{Name: "winter", Discount: PercentageDiscount(1000), Active: true})
+		require.Nil(t, err)
+		third, err := s.CreateOffer(ctx, OfferSpec{Name: "spring", Discount: PercentageDiscount(1000), Active: true})
+		require.Nil(t, err)
+		archived, err := s.ArchiveOffer(ctx, upcoming.ID)
+		require.Nil(t, err)
+		assert.True(t, archived.ArchivedAt.Valid)
+		_, err = s.ArchiveOffer(ctx, upcoming.ID+100)
+		assert.True(t, errors.Is(err, ErrOfferNotFound))
+		_, err = s.UpdateOffer(ctx, upcoming.ID, OfferSpec{Name: "summer", Discount: PercentageDiscount(1000), Active: true})
+		assert.True(t, errors.Is(err, ErrOfferArchived))
+		_, err = s.QuoteVoucher(ctx, "customer0@gmail.com", "early")
+		assert.True(t, errors.Is(err, ErrOfferInactive))
+
+		page, err := s.ListOffers(ctx, OfferFilter{Limit: 1})
+		require.Nil(t, err)
+		if assert.Len(t, page, 1) {
+			assert.Equal(t, second.ID, page[0].ID)
+		}
+		page, err = s.ListOffers(ctx, OfferFilter{AfterID: second.ID, Limit: 10})
+		require.Nil(t, err)
+		if assert.Len(t, page, 1) {
+			assert.Equal(t, third.ID, page[0].ID)
+		}
+		page, err = s.ListOffers(ctx, OfferFilter{Limit: 10, Archived: true})
+		require.Nil(t, err)
+		assert.Len(t, page, 3)
+		got, err := s.GetOffer(ctx, third.ID)
+		require.Nil(t, err)
+		assert.Equal(t, "spring", got.Current.Name)
+		_, err = s.GetOffer(ctx, third.ID+100)
+		assert.True(t, errors.Is(err, ErrOfferNotFound))
+	})
+
+	t.Run("offer rules", func(t *testing.T) {
+		s := newStore(t)
+		_, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		require.Nil(t, err)
+		_, err = s.CreateOffer(ctx, OfferSpec{Name: "tea", Discount: PercentageDiscount(1000), Rules: rules.Set{{Type: rules.TypeSKU}}, Active: true})
+		assert.NotNil(t, err)
+
+		given := rules.Set{{Type: rules.TypeMinAmount, Amount: "20", Currency: "EUR"}, {Type: rules.TypeChannel, Channels: []string{"web"}}}
+		offer, err := s.CreateOffer(ctx, OfferSpec{Name: "tea", Discount: PercentageDiscount(1000), Rules: given, Active: true})
+		require.Nil(t, err)
+		assert.Equal(t, given, offer.Rules)
+		// the store keeps its own copy of the rules
+		given[1].Channels[0] = "app"
+		got, err := s.GetOffer(ctx, offer.ID)
+		require.Nil(t, err)
+		assert.Equal(t, []string{"web"}, got.Rules[1].Channels)
+
+		// the rules of the offer are returned with a quote, redemptions and reservations evaluate them with the voucher
+		// locked and fail for an order not meeting them
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "tea", OfferRef{ID: offer.ID}, tomorrow, Limits{}))
+		result, err := s.QuoteVoucher(ctx, "customer0@gmail.com", "tea")
+		require.Nil(t, err)
+		assert.Len(t, result.Rules, 2)
+		var failure *rules.Failure
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "tea", rules.Order{Currency: "EUR", Amount: 2500, Channel: "app"})
+		require.True(t, errors.As(err, &failure))
+		assert.Equal(t, 1, failure.Index)
+		_, err = s.ReserveVoucher(ctx, "customer0@gmail.com", "tea", "r1", tomorrow, rules.Order{Currency: "EUR", Amount: 1000, Channel: "web"})
+		require.True(t, errors.As(err, &failure))
+		assert.Equal(t, 0, failure.Index)
+		_, err = s.RedeemVouchers(ctx, "customer0@gmail.com", []string{"tea"}, rules.Order{}, nil)
+		assert.True(t, errors.As(err, &failure))
+		redemptions, err := s.GetRedemptions(ctx, "tea")
+		require.Nil(t, err)
+		assert.Len(t, redemptions, 0)
+
+		updated, err := s.UpdateOffer(ctx, offer.ID, OfferSpec{Name: "tea", Discount: PercentageDiscount(1000), Active: true})
+		require.Nil(t, err)
+		assert.Equal(t, rules.Set{}, updated.Rules)
+		result, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "tea", rules.Order{})
+		require.Nil(t, err)
+		assert.Equal(t, rules.Set{}, result.Rules)
+	})
+
+	t.Run("redeem vouchers together", func(t *testing.T) {
+		s := newStore(t)
+		_, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		require.Nil(t, err)
+		_, err = s.CreateOffer(ctx, OfferSpec{Name: "capped", Discount: PercentageDiscount(1000), Stacking: Stacking{MaxTotalDiscount: 100*100 + 1}, Active: true})
+		assert.True(t, errors.Is(err, ErrInvalidOffer))
+		tea, err := s.CreateOffer(ctx, OfferSpec{Name: "tea", Discount: PercentageDiscount(1000), Stacking: Stacking{Group: "drinks", MaxTotalDiscount: 2500}, Active: true})
+		require.Nil(t, err)
+		stacking, err := tea.Stacking()
+		require.Nil(t, err)
+		assert.Equal(t, Stacking{Group: "drinks", MaxTotalDiscount: 2500}, stacking)
+		coffee, err := s.CreateOffer(ctx, OfferSpec{Name: "coffee", Discount: FixedDiscount(500, "EUR"), Stacking: Stacking{Group: "drinks"}, Active: true})
+		require.Nil(t, err)
+		cake, err := s.CreateOffer(ctx, OfferSpec{Name: "cake", Discount: FixedDiscount(300, "EUR"), Active: true})
+		require.Nil(t, err)
+		vip, err := s.CreateOffer(ctx, OfferSpec{Name: "vip", Discount: PercentageDiscount(5000), Stacking: Stacking{Exclusive: true, Group: "drinks"}, Active: true})
+		require.Nil(t, err)
+		for code, offer := range map[string]uint64{"tea": tea.ID, "coffee": coffee.ID, "cake": cake.ID, "vip": vip.ID} {
+			require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", code, OfferRef{ID: offer}, tomorrow, Limits{}))
+		}
+
+		// nothing is redeemed if the combination or any voucher fails
+		_, err = s.RedeemVouchers(ctx, "customer0@gmail.com", []string{"tea", "cake"}, rules.Order{}, nil)
+		assert.True(t, errors.Is(err, ErrStackingConflict))
+		_, err = s.RedeemVouchers(ctx, "customer0@gmail.com", []string{"tea", "vip"}, rules.Order{}, nil)
+		assert.True(t, errors.Is(err, ErrStackingConflict))
+		_, err = s.RedeemVouchers(ctx, "customer0@gmail.com", []string{"tea", "tea"}, rules.Order{}, nil)
+		assert.True(t, errors.Is(err, ErrStackingConflict))
+		_, err = s.RedeemVouchers(ctx, "customer0@gmail.com", []string{"tea", "unknown"}, rules.Order{}, nil)
+		assert.True(t, errors.Is(err, ErrVoucherNotFound))
+		_, err = s.RedeemVouchers(ctx, "customer1@gmail.com", []string{"tea", "coffee"}, rules.Order{}, nil)
+		assert.True(t, errors.Is(err, ErrVoucherNotOwned))
+
+		// the vouchers of offers with a policy are only redeemed with the codes of their order
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "vip", rules.Order{})
+		assert.True(t, errors.Is(err, ErrStackingPolicy))
+		_, err = s.ReserveVoucher(ctx, "customer0@gmail.com", "tea", "r1", tomorrow, rules.Order{})
+		assert.True(t, errors.Is(err, ErrStackingPolicy))
+
+		// nothing is redeemed if the check of the results fails
+		failed := errors.New("check failed")
+		_, err = s.RedeemVouchers(ctx, "customer0@gmail.com", []string{"coffee", "tea"}, rules.Order{}, func(results []RedeemResult) error {
+			assert.Len(t, results, 2)
+			return failed
+		})
+		assert.True(t, errors.Is(err, failed))
+		for _, code := range []string{"coffee", "tea"} {
+			redemptions, err := s.GetRedemptions(ctx, code)
+			require.Nil(t, err)
+			assert.Len(t, redemptions, 0)
+		}
+
+		// a single exclusive voucher is redeemed alone
+		results, err := s.RedeemVouchers(ctx, "customer0@gmail.com", []string{"vip"}, rules.Order{}, nil)
+		require.Nil(t, err)
+		assert.Equal(t, Stacking{Exclusive: true, Group: "drinks"}, results[0].Stacking)
+
+		results, err = s.RedeemVouchers(ctx, "customer0@gmail.com", []string{"coffee", "tea"}, rules.Order{}, nil)
+		require.Nil(t, err)
+		if assert.Len(t, results, 2) {
+			assert.Equal(t, FixedDiscount(500, "EUR"), results[0].Discount)
+			assert.Equal(t, PercentageDiscount(1000), results[1].Discount)
+			assert.Equal(t, int64(2500), results[1].Stacking.MaxTotalDiscount)
+		}
+		_, err = s.RedeemVouchers(ctx, "customer0@gmail.com", []string{"coffee", "tea"}, rules.Order{}, nil)
+		assert.True(t, errors.Is(err, ErrVoucherRedeemed))
+		redemptions, err := s.GetRedemptions(ctx, "cake")
+		require.Nil(t, err)
+		assert.Len(t, redemptions, 0)
+	})
+
+	t.Run("generate and list vouchers", func(t *testing.T) {
+		s := newStore(t)
+		_, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		require.Nil(t, err)
+
+		assert.True(t, errors.Is(s.GenerateVoucher(ctx, "unknown@gmail.com", "abc", OfferRef{Name: "KOI", Discount: PercentageDiscount(2000)}, tomorrow, Limits{}), ErrCustomerNotFound))
+		assert.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "abc", OfferRef{Name: "KOI", Discount: PercentageDiscount(2000)}, tomorrow, Limits{}))
+		assert.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "def", OfferRef{Name: "apple_store", Discount: PercentageDiscount(3850)}, tomorrow, Limits{}))
+		assert.True(t, errors.Is(s.GenerateVoucher(ctx, "customer0@gmail.com", "abc", OfferRef{Name: "KOI", Discount: PercentageDiscount(2000)}, tomorrow, Limits{}), ErrCodeConflict))
+
+		codes, names, _, err := s.GetVouchers(ctx, "customer0@gmail.com")
+		assert.Nil(t, err)
+		assert.EqualValues(t, []string{"abc", "def"}, codes)
+		assert.EqualValues(t, []string{"KOI", "apple_store"}, names)
+
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "abc", rules.Order{})
+		require.Nil(t, err)
+		codes, names, _, err = s.GetVouchers(ctx, "customer0@gmail.com")
+		assert.Nil(t, err)
+		assert.EqualValues(t, []string{"def"}, codes)
+		assert.EqualValues(t, []string{"apple_store"}, names)
+
+		_, _, _, err = s.GetVouchers(ctx, "unknown@gmail.com")
+		assert.True(t, errors.Is(err, ErrCustomerNotFound))
+	})
+
+	t.Run("redeem voucher", func(t *testing.T) {
+		s := newStore(t)
+		_, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		require.Nil(t, err)
+		_, err = s.CreateCustomer(ctx, "customer 1", "customer1@gmail.com")
+		require.Nil(t, err)
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "abc", OfferRef{Name: "KOI", Discount: PercentageDiscount(3850)}, tomorrow, Limits{}))
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "expired", OfferRef{Name: "KOI", Discount: PercentageDiscount(3850)}, yesterday, Limits{}))
+
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "unknown", rules.Order{})
+		assert.True(t, errors.Is(err, ErrVoucherNotFound))
+		_, err = s.RedeemVoucher(ctx, "customer1@gmail.com", "abc", rules.Order{})
+		assert.True(t, errors.Is(err, ErrVoucherNotOwned))
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "expired", rules.Order{})
+		assert.True(t, errors.Is(err, ErrVoucherExpired))
+
+		result, err := s.RedeemVoucher(ctx, "customer0@gmail.com", "abc", rules.Order{})
+		assert.Nil(t, err)
+		assert.Equal(t, PercentageDiscount(3850), result.Discount)
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "abc", rules.Order{})
+		assert.True(t, errors.Is(err, ErrVoucherRedeemed))
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "fixed", OfferRef{Name: "ten_off", Discount: FixedDiscount(1000, "EUR")}, tomorrow, Limits{}))
+		result, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "fixed", rules.Order{})
+		assert.Nil(t, err)
+		assert.Equal(t, FixedDiscount(1000, "EUR"), result.Discount)
+	})
+
+	t.Run("quote voucher", func(t *testing.T) {
+		s := newStore(t)
+		_, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		require.Nil(t, err)
+		_, err = s.CreateCustomer(ctx, "customer 1", "customer1@gmail.com")
+		require.Nil(t, err)
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "abc", OfferRef{Name: "KOI", Discount: PercentageDiscount(3850)}, tomorrow, Limits{}))
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "expired", OfferRef{Name: "KOI", Discount: PercentageDiscount(3850)}, yesterday, Limits{}))
+
+		_, err = s.QuoteVoucher(ctx, "customer0@gmail.com", "unknown")
+		assert.True(t, errors.Is(err, ErrVoucherNotFound))
+		_, err = s.QuoteVoucher(ctx, "customer1@gmail.com", "abc")
+		assert.True(t, errors.Is(err, ErrVoucherNotOwned))
+		_, err = s.QuoteVoucher(ctx, "customer0@gmail.com", "expired")
+		assert.True(t, errors.Is(err, ErrVoucherExpired))
+
+		// quoting does not use the voucher
+		for i := 0; i < 2; i++ {
+			result, err := s.QuoteVoucher(ctx, "customer0@gmail.com", "abc")
+			assert.Nil(t, err)
+			assert.Equal(t, PercentageDiscount(3850), result.Discount)
+		}
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "abc", rules.Order{})
+		require.Nil(t, err)
+		_, err = s.QuoteVoucher(ctx, "customer0@gmail.com", "abc")
+		assert.True(t, errors.Is(err, ErrVoucherRedeemed))
+	})
+
+	t.Run("reserve voucher", func(t *testing.T) {
+		s := newStore(t)
+		_, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		require.Nil(t, err)
+		_, err = s.CreateCustomer(ctx, "customer 1", "customer1@gmail.com")
+		require.Nil(t, err)
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "abc", OfferRef{Name: "KOI", Discount: PercentageDiscount(3850)}, tomorrow, Limits{}))
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "def", OfferRef{Name: "KOI", Discount: PercentageDiscount(3850)}, tomorrow, Limits{}))
+		inAMinute := time.Now().Add(time.Minute)
+
+		_, err = s.ReserveVoucher(ctx, "customer0@gmail.com", "unknown", "r0", inAMinute, rules.Order{})
+		assert.True(t, errors.Is(err, ErrVoucherNotFound))
+		_, err = s.ReserveVoucher(ctx, "customer1@gmail.com", "abc", "r0", inAMinute, rules.Order{})
+		assert.True(t, errors.Is(err, ErrVoucherNotOwned))
+
+		// a reserved voucher can neither be redeemed nor reserved again until the reservation is released
+		result, err := s.ReserveVoucher(ctx, "customer0@gmail.com", "abc", "r1", inAMinute, rules.Order{})
+		require.Nil(t, err)
+		assert.Equal(t, PercentageDiscount(3850), result.Discount)
+		_, err = s.ReserveVoucher(ctx, "customer0@gmail.com", "abc", "r2", inAMinute, rules.Order{})
+		assert.True(t, errors.Is(err, ErrVoucherReserved))
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "abc", rules.Order{})
+		assert.True(t, errors.Is(err, ErrVoucherReserved))
+		require.Nil(t, s.ReleaseReservation(ctx, "r1"))
+		assert.True(t, errors.Is(s.ReleaseReservation(ctx, "r1"), ErrReservationNotFound))
+		_, err = s.ConfirmReservation(ctx, "r1")
+		assert.True(t, errors.Is(err, ErrReservationNotFound))
+
+		// confirm uses the voucher
+		_, err = s.ReserveVoucher(ctx, "customer0@gmail.com", "abc", "r3", inAMinute, rules.Order{})
+		require.Nil(t, err)
+		result, err = s.ConfirmReservation(ctx, "r3")
+		require.Nil(t, err)
+		assert.Equal(t, PercentageDiscount(3850), result.Discount)
+		_, err = s.ConfirmReservation(ctx, "r3")
+		assert.True(t, errors.Is(err, ErrReservationNotFound))
+		_, err = s.ReserveVoucher(ctx, "customer0@gmail.com", "abc", "r4", inAMinute, rules.Order{})
+		assert.True(t, errors.Is(err, ErrVoucherRedeemed))
+
+		// an expired reservation cannot be confirmed and no longer holds the voucher
+		_, err = s.ReserveVoucher(ctx, "customer0@gmail.com", "def", "r5", time.Now().Add(-time.Second), rules.Order{})
+		require.Nil(t, err)
+		_, err = s.ConfirmReservation(ctx, "r5")
+		assert.True(t, errors.Is(err, ErrReservationExpired))
+		_, err = s.ReserveVoucher(ctx, "customer0@gmail.com", "def", "r6", time.Now().Add(-time.Second), rules.Order{})
+		require.Nil(t, err)
+		released, err := s.ReleaseExpiredReservations(ctx, time.Now())
+		require.Nil(t, err)
+		assert.EqualValues(t, 1, released)
+		_, err = s.ConfirmReservation(ctx, "r6")
+		assert.True(t, errors.Is(err, ErrReservationNotFound))
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "def", rules.Order{})
+		assert.Nil(t, err)
+	})
+
+	t.Run("reverse redemption", func(t *testing.T) {
+		s := newStore(t)
+		_, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		require.Nil(t, err)
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "abc", OfferRef{Name: "KOI", Discount: PercentageDiscount(3850)}, tomorrow, Limits{}))
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "expired", OfferRef{Name: "KOI", Discount: PercentageDiscount(3850)}, time.Now().Add(time.Second), Limits{}))
+		reversal := Reversal{By: "support", Reason: "order refunded"}
+
+		_, err = s.ReverseRedemption(ctx, "unknown", reversal)
+		assert.True(t, errors.Is(err, ErrVoucherNotFound))
+		_, err = s.ReverseRedemption(ctx, "abc", reversal)
+		assert.True(t, errors.Is(err, ErrVoucherNotRedeemed))
+		_, err = s.GetRedemptions(ctx, "unknown")
+		assert.True(t, errors.Is(err, ErrVoucherNotFound))
+		redemptions, err := s.GetRedemptions(ctx, "abc")
+		assert.Nil(t, err)
+		assert.Empty(t, redemptions)
+
+		// the reversed voucher can be redeemed again, both redemptions are kept
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "abc", rules.Order{})
+		require.Nil(t, err)
+		reversed, err := s.ReverseRedemption(ctx, "abc", reversal)
+		require.Nil(t, err)
+		assert.Equal(t, "abc", reversed.Code)
+		assert.Equal(t, "customer0@gmail.com", reversed.Email)
+		assert.True(t, reversed.ReversedAt.Valid)
+		assert.Equal(t, "support", reversed.ReversedBy.String)
+		assert.Equal(t, "order refunded", reversed.ReversalReason.String)
+		_, err = s.ReverseRedemption(ctx, "abc", reversal)
+		assert.True(t, errors.Is(err, ErrVoucherNotRedeemed))
+		codes, _, _, err := s.GetVouchers(ctx, "customer0@gmail.com")
+		require.Nil(t, err)
+		assert.Contains(t, codes, "abc")
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "abc", rules.Order{})
+		require.Nil(t, err)
+		redemptions, err = s.GetRedemptions(ctx, "abc")
+		require.Nil(t, err)
+		require.Len(t, redemptions, 2)
+		assert.Equal(t, reversed.ID, redemptions[0].ID)
+		assert.True(t, redemptions[0].ReversedAt.Valid)
+		assert.False(t, redemptions[1].ReversedAt.Valid)
+		assert.False(t, redemptions[1].RedeemedAt.Before(redemptions[0].RedeemedAt))
+
+		// redemptions of expired vouchers are reversed unless UnexpiredOnly
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "expired", rules.Order{})
+		require.Nil(t, err)
+		time.Sleep(time.Second)
+		_, err = s.ReverseRedemption(ctx, "expired", Reversal{By: "support", UnexpiredOnly: true})
+		assert.True(t, errors.Is(err, ErrVoucherExpired))
+		_, err = s.ReverseRedemption(ctx, "expired", Reversal{By: "support"})
+		assert.Nil(t, err)
+	})
+
+	t.Run("multi-use vouchers", func(t *testing.T) {
+		s := newStore(t)
+		_, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		require.Nil(t, err)
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "SUMMER25", OfferRef{Name: "summer", Discount: PercentageDiscount(2500)}, tomorrow, Limits{MaxRedemptions: 3, MaxPerCustomer: 2}))
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "team", OfferRef{Name: "team", Discount: PercentageDiscount(1000)}, tomorrow, Limits{MaxRedemptions: 2}))
+		codes, _, remaining, err := s.GetVouchers(ctx, "customer0@gmail.com")
+		require.Nil(t, err)
+		assert.Equal(t, []string{"SUMMER25", "team"}, codes)
+		assert.Equal(t, []int{2, 2}, remaining)
+
+		result, err := s.RedeemVoucher(ctx, "customer0@gmail.com", "SUMMER25", rules.Order{})
+		require.Nil(t, err)
+		assert.Equal(t, RedeemResult{OfferID: 1, Discount: PercentageDiscount(2500), RemainingUses: 1}, result)
+		result, err = s.QuoteVoucher(ctx, "customer0@gmail.com", "SUMMER25")
+		require.Nil(t, err)
+		assert.Equal(t, 1, result.RemainingUses)
+
+		// a reservation holds the last use of the customer
+		result, err = s.ReserveVoucher(ctx, "customer0@gmail.com", "SUMMER25", "r1", time.Now().Add(time.Minute), rules.Order{})
+		require.Nil(t, err)
+		assert.Equal(t, 0, result.RemainingUses)
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "SUMMER25", rules.Order{})
+		assert.True(t, errors.Is(err, ErrVoucherReserved))
+		codes, _, _, err = s.GetVouchers(ctx, "customer0@gmail.com")
+		require.Nil(t, err)
+		assert.Equal(t, []string{"team"}, codes)
+		result, err = s.ConfirmReservation(ctx, "r1")
+		require.Nil(t, err)
+		assert.Equal(t, 0, result.RemainingUses)
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "SUMMER25", rules.Order{})
+		assert.True(t, errors.Is(err, ErrCustomerLimitReached))
+
+		// a reversal gives the use back
+		_, err = s.ReverseRedemption(ctx, "SUMMER25", Reversal{By: "support"})
+		require.Nil(t, err)
+		result, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "SUMMER25", rules.Order{})
+		require.Nil(t, err)
+		assert.Equal(t, 0, result.RemainingUses)
+
+		// used_at is set once all the uses are redeemed
+		for i := 1; i >= 0; i-- {
+			result, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "team", rules.Order{})
+			require.Nil(t, err)
+			assert.Equal(t, i, result.RemainingUses)
+		}
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "team", rules.Order{})
+		assert.True(t, errors.Is(err, ErrVoucherRedeemed))
+		codes, _, _, err = s.GetVouchers(ctx, "customer0@gmail.com")
+		require.Nil(t, err)
+		assert.Empty(t, codes)
+	})
+
+	t.Run("public and claim vouchers", func(t *testing.T) {
+		s := newStore(t)
+		for _, email := range []string{"customer0@gmail.com", "customer1@gmail.com"} {
+			_, err := s.CreateCustomer(ctx, email, email)
+			require.Nil(t, err)
+		}
+		assert.NotNil(t, s.GenerateUnassignedVoucher(ctx, AssignmentCustomer, "SUMMER", OfferRef{Name: "summer", Discount: PercentageDiscount(1000)}, tomorrow, Limits{}))
+		require.Nil(t, s.GenerateUnassignedVoucher(ctx, AssignmentPublic, "SUMMER", OfferRef{Name: "summer", Discount: PercentageDiscount(1000)}, tomorrow, Limits{MaxRedemptions: 10, MaxPerCustomer: 1}))
+		require.Nil(t, s.GenerateUnassignedVoucher(ctx, AssignmentClaim, "FIRST", OfferRef{Name: "summer", Discount: PercentageDiscount(1000)}, tomorrow, Limits{MaxRedemptions: 2}))
+
+		// any customer can redeem a public voucher, the redeemer is recorded in the redemption
+		for _, email := range []string{"customer0@gmail.com", "customer1@gmail.com"} {
+			result, err := s.RedeemVoucher(ctx, email, "SUMMER", rules.Order{})
+			require.Nil(t, err)
+			assert.Equal(t, 0, result.RemainingUses)
+		}
+		_, err := s.RedeemVoucher(ctx, "unknown@gmail.com", "SUMMER", rules.Order{})
+		assert.True(t, errors.Is(err, ErrCustomerNotFound))
+		redemptions, err := s.GetRedemptions(ctx, "SUMMER")
+		require.Nil(t, err)
+		if assert.Len(t, redemptions, 2) {
+			assert.Equal(t, "customer0@gmail.com", redemptions[0].Email)
+			assert.Equal(t, "customer1@gmail.com", redemptions[1].Email)
+		}
+		codes, _, _, err := s.GetVouchers(ctx, "customer0@gmail.com")
+		require.Nil(t, err)
+		assert.Empty(t, codes)
+
+		// a claim voucher belongs to the first customer who redeems it
+		result, err := s.RedeemVoucher(ctx, "customer0@gmail.com", "FIRST", rules.Order{})
+		require.Nil(t, err)
+		assert.Equal(t, 1, result.RemainingUses)
+		_, err = s.RedeemVoucher(ctx, "customer1@gmail.com", "FIRST", rules.Order{})
+		assert.True(t, errors.Is(err, ErrVoucherNotOwned))
+		_, err = s.QuoteVoucher(ctx, "customer1@gmail.com", "FIRST")
+		assert.True(t, errors.Is(err, ErrVoucherNotOwned))
+		codes, _, remaining, err := s.GetVouchers(ctx, "customer0@gmail.com")
+		require.Nil(t, err)
+		assert.Equal(t, []string{"FIRST"}, codes)
+		assert.Equal(t, []int{1}, remaining)
+
+		// the claim is given up with the reversal of the redemption
+		_, err = s.ReverseRedemption(ctx, "FIRST", Reversal{By: "support"})
+		require.Nil(t, err)
+		_, err = s.ReserveVoucher(ctx, "customer1@gmail.com", "FIRST", "r1", time.Now().Add(time.Minute), rules.Order{})
+		require.Nil(t, err)
+		_, err = s.RedeemVoucher(ctx, "customer0@gmail.com", "FIRST", rules.Order{})
+		assert.True(t, errors.Is(err, ErrVoucherNotOwned))
+	})
+
+	t.Run("redeem voucher concurrently", func(t *testing.T) {
+		s := newStore(t)
+		_, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		require.Nil(t, err)
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "abc", OfferRef{Name: "KOI", Discount: PercentageDiscount(3850)}, tomorrow, Limits{}))
+
+		const workers = 20
+		var wg sync.WaitGroup
+		errs := make(chan error, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := s.RedeemVoucher(ctx, "customer0@gmail.com", "abc", rules.Order{})
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		winners := 0
+		for err := range errs {
+			if err == nil {
+				winners++
+				continue
+			}
+			assert.True(t, errors.Is(err, ErrVoucherRedeemed))
+		}
+		assert.EqualValues(t, 1, winners)
+	})
+
+	t.Run("redeem multi-use voucher concurrently", func(t *testing.T) {
+		s := newStore(t)
+		_, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		require.Nil(t, err)
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "SUMMER25", OfferRef{Name: "summer", Discount: PercentageDiscount(2500)}, tomorrow, Limits{MaxRedemptions: 5}))
+
+		const workers = 20
+		var wg sync.WaitGroup
+		errs := make(chan error, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := s.RedeemVoucher(ctx, "customer0@gmail.com", "SUMMER25", rules.Order{})
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		winners := 0
+		for err := range errs {
+			if err == nil {
+				winners++
+				continue
+			}
+			assert.True(t, errors.Is(err, ErrVoucherRedeemed))
+		}
+		assert.EqualValues(t, 5, winners)
+		redemptions, err := s.GetRedemptions(ctx, "SUMMER25")
+		require.Nil(t, err)
+		assert.Len(t, redemptions, 5)
+	})
+
+	t.Run("bulk insert vouchers", func(t *testing.T) {
+		s := newStore(t)
+		id0, err := s.CreateCustomer(ctx, "customer 0", "customer0@gmail.com")
+		require.Nil(t, err)
+		id1, err := s.CreateCustomer(ctx, "customer 1", "customer1@yahoo.com")
+		require.Nil(t, err)
+		require.Nil(t, s.GenerateVoucher(ctx, "customer0@gmail.com", "abc", OfferRef{Name: "KOI", Discount: PercentageDiscount(2000)}, tomorrow, Limits{}))
+
+		ids, err := s.GetCustomerIDsByEmails(ctx, []string{"customer0@gmail.com", "customer1@yahoo.com", "unknown@gmail.com"})
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]uint64{"customer0@gmail.com": id0, "customer1@yahoo.com": id1}, ids)
+
+		emails, err := s.ListCustomerEmails(ctx, CustomerFilter{})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"customer0@gmail.com", "customer1@yahoo.com"}, emails)
+		emails, err = s.ListCustomerEmails(ctx, CustomerFilter{EmailDomain: "Yahoo.com"})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"customer1@yahoo.com"}, emails)
+
+		conflicts, err := s.InsertVouchers(ctx, OfferRef{Name: "summer", Discount: PercentageDiscount(1500)}, Limits{}, []DBModelVoucher{
+			{Code: "def", CustomerID: id0, ExpiryDate: tomorrow},
+			{Code: "abc", CustomerID: id1, ExpiryDate: tomorrow},
+			{Code: "ghi", CustomerID: id1, ExpiryDate: tomorrow},
+			{Code: "ghi", CustomerID: id0, ExpiryDate: tomorrow},
+		})
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []string{"abc", "ghi"}, conflicts)
+
+		codes, names, _, err := s.GetVouchers(ctx, "customer0@gmail.com")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"abc", "def"}, codes)
+		assert.Equal(t, []string{"KOI", "summer"}, names)
+		codes, _, _, err = s.GetVouchers(ctx, "customer1@yahoo.com")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"ghi"}, codes)
+
+		_, err = s.InsertVouchers(ctx, OfferRef{Name: "summer", Discount: PercentageDiscount(1500)}, Limits{}, []DBModelVoucher{{Code: "jkl", CustomerID: id1 + 100, ExpiryDate: tomorrow}})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("idempotency keys", func(t *testing.T) {
+		s := newStore(t)
+		now := time.Now()
+		// a claim is held for a minute, the time the request may run
+		gen, claimed, err := s.ClaimIdempotencyKey(ctx, "POST /vouchers/generate", "k1", "f1", now, now.Add(time.Minute))
+		require.Nil(t, err)
+		assert.True(t, claimed)
+		assert.False(t, gen.Status.Valid)
+
+		// the key is in progress until its response is saved, the same key of another scope is another key
+		k, claimed, err := s.ClaimIdempotencyKey(ctx, "POST /vouchers/generate", "k1", "f2", now, now.Add(time.Hour))
+		require.Nil(t, err)
+		assert.False(t, claimed)
+		assert.Equal(t, "f1", k.Fingerprint)
+		assert.False(t, k.Status.Valid)
+		stale, claimed, err := s.ClaimIdempotencyKey(ctx, "POST /vouchers/validate", "k1", "f2", now, now.Add(time.Hour))
+		require.Nil(t, err)
+		assert.True(t, claimed)
+
+		// a claim never saved is taken over once it expires, the request may have crashed
+		inAnHour := now.Add(time.Hour)
+		val, claimed, err := s.ClaimIdempotencyKey(ctx, "POST /vouchers/validate", "k1", "f2", inAnHour, inAnHour.Add(time.Minute))
+		require.Nil(t, err)
+		assert.True(t, claimed)
+
+		// the request which outlived its claim neither saves nor releases the claim of the retry
+		require.Nil(t, s.SaveIdempotentResponse(ctx, stale.Scope, stale.Key, stale.Fingerprint, stale.CreatedAt, 200, []byte(`{}`), now.Add(time.Hour+time.Minute)))
+		require.Nil(t, s.ReleaseIdempotencyKey(ctx, stale.Scope, stale.Key, stale.Fingerprint, stale.CreatedAt))
+		k, claimed, err = s.ClaimIdempotencyKey(ctx, "POST /vouchers/validate", "k1", "f2", inAnHour, inAnHour.Add(time.Minute))
+		require.Nil(t, err)
+		assert.False(t, claimed)
+		assert.True(t, k.CreatedAt.Equal(val.CreatedAt))
+		assert.False(t, k.Status.Valid)
+
+		// the saved response is kept until the expiry it is saved with
+		require.Nil(t, s.SaveIdempotentResponse(ctx, gen.Scope, gen.Key, gen.Fingerprint, gen.CreatedAt, 201, []byte(`{"code":"abc"}`), now.Add(time.Hour+time.Minute)))
+		k, claimed, err = s.ClaimIdempotencyKey(ctx, "POST /vouchers/generate", "k1", "f1", inAnHour, inAnHour.Add(time.Minute))
+		require.Nil(t, err)
+		assert.False(t, claimed)
+		assert.EqualValues(t, 201, k.Status.Int64)
+		assert.Equal(t, `{"code":"abc"}`, string(k.Body))
+
+		// a released key can be claimed again
+		require.Nil(t, s.ReleaseIdempotencyKey(ctx, val.Scope, val.Key, val.Fingerprint, val.CreatedAt))
+		_, claimed, err = s.ClaimIdempotencyKey(ctx, "POST /vouchers/validate", "k1", "f3", now, now.Add(time.Hour))
+		require.Nil(t, err)
+		assert.True(t, claimed)
+
+		// an expired key is taken over, the sweep deletes the expired keys
+		later := now.Add(2 * time.Hour)
+		k, claimed, err = s.ClaimIdempotencyKey(ctx, "POST /vouchers/generate", "k1", "f4", later, later.Add(time.Hour))
+		require.Nil(t, err)
+		assert.True(t, claimed)
+		assert.Equal(t, "f4", k.Fingerprint)
+		assert.False(t, k.Status.Valid)
+		deleted, err := s.DeleteExpiredIdempotencyKeys(ctx, later)
+		require.Nil(t, err)
+		assert.EqualValues(t, 1, deleted)
+		_, claimed, err = s.ClaimIdempotencyKey(ctx, "POST /vouchers/validate", "k1", "f5", later, later.Add(time.Hour))
+		require.Nil(t, err)
+		assert.True(t, claimed)
+	})
+}
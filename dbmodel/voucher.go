@@ -3,174 +3,428 @@ package dbmodel
 import (
 	"context"
 	"database/sql"
-	"fmt"
 	"time"
 
+	"github.com/ingemar0720/voucher-pool/rules"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 )
 
+// DBModelSpecialOffer is a version of a special offer, a row is never changed but SupersededAt
 type DBModelSpecialOffer struct {
-	Name     string  `json:"name" db:"name"`
-	Discount float32 `json:"discount" db:"discount"`
+	ID           uint64         `json:"id" db:"id"`
+	OfferID      uint64         `json:"offer_id" db:"offer_id"`
+	Name         string         `json:"name" db:"name"`
+	Version      int            `json:"version" db:"version"`
+	DiscountType string         `json:"discount_type" db:"discount_type"`
+	Discount     sql.NullString `json:"discount" db:"discount"`
+	AmountMinor  sql.NullInt64  `json:"amount_minor" db:"amount_minor"`
+	Currency     sql.NullString `json:"currency" db:"currency"`
+	CreatedAt    time.Time      `json:"created_at" db:"created_at"`
+	SupersededAt sql.NullTime   `json:"superseded_at" db:"superseded_at"`
 }
 
 type DBModelVoucher struct {
-	Code           string       `json:"code" db:"code"`
+	Code string `json:"code" db:"code"`
+	// CustomerID is 0 for vouchers not assigned to a customer
 	CustomerID     uint64       `json:"customer_id" db:"customer_id"`
 	SpecialOfferID uint64       `json:"special_offer_id" db:"special_offer_id"`
 	ExpiryDate     time.Time    `json:"expired_at" db:"expired_at"`
 	UsedDate       sql.NullTime `json:"used_at" db:"used_at"`
+	// used_at is set once RedemptionCount reaches MaxRedemptions
+	MaxRedemptions  int           `json:"max_redemptions" db:"max_redemptions"`
+	MaxPerCustomer  sql.NullInt64 `json:"max_per_customer" db:"max_per_customer"`
+	RedemptionCount int           `json:"redemption_count" db:"redemption_count"`
+	Assignment      Assignment    `json:"assignment" db:"assignment"`
 }
 
-func ValidateVoucher(ctx context.Context, email, code string, db *sqlx.DB) (sql.NullTime, error) {
-	rows, err := db.QueryContext(ctx, "SELECT vo.used_at, vo.expired_at FROM customers cus inner JOIN vouchers vo ON cus.id=vo.customer_id WHERE cus.email=$1 AND vo.code=$2", email, code)
+// RedeemVoucher checks owner, expiry and limits of the voucher and the rules of its offer against the order, and
+// records a redemption within one transaction. The voucher row is locked with SELECT ... FOR UPDATE, so concurrent
+// redemptions of the same code are serialized and never exceed the limits, the ones beyond get ErrVoucherRedeemed or
+// ErrCustomerLimitReached. A rule the order does not meet fails with a *rules.Failure. Vouchers of offers with a
+// stacking policy fail with ErrStackingPolicy, they are redeemed with RedeemVouchers.
+func RedeemVoucher(ctx context.Context, email, code string, order rules.Order, db *sqlx.DB) (RedeemResult, error) {
+	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
-		return sql.NullTime{}, errors.Wrapf(err, "fail to query used_at from table vouchers")
+		return RedeemResult{}, errors.Wrapf(err, "fail to begin redemption of voucher")
 	}
-	defer rows.Close()
-	usedAt := sql.NullTime{}
-	expiredAt := time.Time{}
-	if rows.Next() {
-		err := rows.Scan(&usedAt, &expiredAt)
-		if err != nil {
-			return sql.NullTime{}, errors.Wrapf(err, "fail to query used_at from vouchers table")
+	result, err := redeemVoucher(ctx, email, code, order, tx)
+	if err != nil {
+		if err1 := tx.Rollback(); err1 != nil {
+			return RedeemResult{}, errors.Wrapf(err1, "fail to rollback redemption of voucher, error %v", err)
 		}
+		return RedeemResult{}, err
 	}
-	if expiredAt.Before(time.Now()) {
-		return sql.NullTime{}, errors.New("voucher expired")
+	if err = tx.Commit(); err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "fail to commit redemption of voucher")
 	}
-	return usedAt, nil
+	return result, nil
 }
 
-func SetVoucherUsageAndGetDiscount(ctx context.Context, code string, db *sqlx.DB) (float32, error) {
-	rows, err := db.QueryContext(ctx, "SELECT so.discount FROM special_offers so INNER JOIN vouchers vo ON so.id=vo.special_offer_id WHERE vo.code=$1", code)
+func redeemVoucher(ctx context.Context, email, code string, order rules.Order, tx *sqlx.Tx) (RedeemResult, error) {
+	v, err := findVoucher(ctx, code, true, tx)
 	if err != nil {
-		return 0, errors.Wrapf(err, "fail to query discount from table special_offers")
+		return RedeemResult{}, err
 	}
-	var discount float32
-	if rows.Next() {
-		err := rows.Scan(&discount)
-		if err != nil {
-			return 0, errors.Wrapf(err, "fail to query discount from table special_offers")
-		}
+	if err := checkAlone(v.offer.stacking); err != nil {
+		return RedeemResult{}, errors.Wrapf(err, "voucher %v", code)
+	}
+	return redeemLocked(ctx, email, v, order, time.Now(), tx)
+}
+
+// RedeemVouchers redeems the vouchers of codes together for one order within one transaction, all of them or none.
+// The vouchers are locked in the order of their codes, every one is checked like by RedeemVoucher and the combination
+// shall satisfy the stacking policies of their offers or it fails with ErrStackingConflict. The results are in the
+// order of codes. check is called with the results before the commit, the redemptions are rolled back if it fails. It
+// may be nil.
+func RedeemVouchers(ctx context.Context, email string, codes []string, order rules.Order, check func([]RedeemResult) error, db *sqlx.DB) ([]RedeemResult, error) {
+	if err := checkCodes(codes); err != nil {
+		return nil, err
 	}
-	rows.Close()
 	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
-		return 0, errors.Wrapf(err, "fail to setup date of usage")
+		return nil, errors.Wrapf(err, "fail to begin redemption of vouchers")
+	}
+	results, err := redeemVouchers(ctx, email, codes, order, tx)
+	if err == nil && check != nil {
+		err = check(results)
 	}
-	_, err = tx.ExecContext(ctx, "UPDATE vouchers SET used_at=$1 WHERE code=$2", time.Now().Format(time.RFC3339), code)
 	if err != nil {
-		err = fmt.Errorf("fail to setup date of usage, error %v", err)
 		if err1 := tx.Rollback(); err1 != nil {
-			return 0, errors.Wrapf(err1, "fail to rollback date of usage, update error %v", err)
+			return nil, errors.Wrapf(err1, "fail to rollback redemption of vouchers, error %v", err)
+		}
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "fail to commit redemption of vouchers")
+	}
+	return results, nil
+}
+
+func redeemVouchers(ctx context.Context, email string, codes []string, order rules.Order, tx *sqlx.Tx) ([]RedeemResult, error) {
+	vouchers := make(map[string]voucherState, len(codes))
+	for _, code := range sortedCodes(codes) {
+		v, err := findVoucher(ctx, code, true, tx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "voucher %v", code)
 		}
-		return 0, err
+		vouchers[code] = v
+	}
+	policies := make([]Stacking, len(codes))
+	for i, code := range codes {
+		policies[i] = vouchers[code].offer.stacking
+	}
+	if err := checkStacking(codes, policies); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	results := make([]RedeemResult, len(codes))
+	for i, code := range codes {
+		result, err := redeemLocked(ctx, email, vouchers[code], order, now, tx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "voucher %v", code)
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
+// redeemLocked checks and redeems the voucher locked by findVoucher, the rules are evaluated while it is locked so
+// they cannot change in between
+func redeemLocked(ctx context.Context, email string, v voucherState, order rules.Order, now time.Time, tx *sqlx.Tx) (RedeemResult, error) {
+	if err := checkVoucher(email, v.owner, v.expiredAt, v.usedAt, v.offer, now); err != nil {
+		return RedeemResult{}, err
+	}
+	customerID, err := v.customerID(ctx, email, tx)
+	if err != nil {
+		return RedeemResult{}, err
+	}
+	usage, err := loadUsage(ctx, v, customerID, now, tx)
+	if err != nil {
+		return RedeemResult{}, err
+	}
+	if err := usage.check(); err != nil {
+		return RedeemResult{}, err
+	}
+	if err := v.offer.rules.Evaluate(order, now); err != nil {
+		return RedeemResult{}, err
+	}
+	if err := markRedeemed(ctx, v, customerID, now, tx); err != nil {
+		return RedeemResult{}, err
+	}
+	usage.redemptions++
+	usage.customerRedeemed++
+	return v.result(usage), nil
+}
+
+// markRedeemed counts a redemption of the voucher locked by findVoucher, sets used_at once the voucher is used up
+// and records the redemption of the customer
+func markRedeemed(ctx context.Context, v voucherState, customerID uint64, now time.Time, tx *sqlx.Tx) error {
+	res, err := tx.ExecContext(ctx, `UPDATE vouchers SET redemption_count=redemption_count+1,
+										used_at=CASE WHEN redemption_count+1>=max_redemptions THEN $1::timestamptz ELSE NULL END, updated_at=$1
+										WHERE id=$2 AND redemption_count<max_redemptions`, now, v.id)
+	if err != nil {
+		return errors.Wrapf(err, "fail to setup date of usage")
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "fail to setup date of usage")
+	}
+	if affected != 1 {
+		return ErrVoucherRedeemed
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO redemptions (voucher_id, customer_id, redeemed_at) VALUES ($1, $2, $3)", v.id, customerID, now)
+	if err != nil {
+		return errors.Wrapf(err, "fail to insert into table redemptions")
+	}
+	return nil
+}
+
+// loadUsage counts the redemptions and reservations of the voucher. It shall run after the voucher is locked,
+// so the redemptions and reservations committed meanwhile are seen.
+func loadUsage(ctx context.Context, v voucherState, customerID uint64, now time.Time, q sqlx.QueryerContext) (voucherUsage, error) {
+	u := voucherUsage{
+		maxRedemptions: v.maxRedemptions,
+		maxPerCustomer: v.maxPerCustomer,
+		claim:          v.assignment == AssignmentClaim,
+		redemptions:    v.redemptionCount,
+	}
+	err := q.QueryRowxContext(ctx, `SELECT (SELECT count(*) FROM redemptions WHERE voucher_id=$1 AND customer_id=$2 AND reversed_at IS NULL),
+										(SELECT count(*) FROM reservations WHERE voucher_id=$1 AND expires_at>$3),
+										(SELECT count(*) FROM reservations WHERE voucher_id=$1 AND customer_id=$2 AND expires_at>$3),
+										(SELECT count(*) FROM redemptions WHERE voucher_id=$1 AND customer_id<>$2 AND reversed_at IS NULL)
+											+ (SELECT count(*) FROM reservations WHERE voucher_id=$1 AND customer_id<>$2 AND expires_at>$3)`,
+		v.id, customerID, now).Scan(&u.customerRedeemed, &u.reserved, &u.customerReserved, &u.heldByOthers)
+	if err != nil {
+		return voucherUsage{}, errors.Wrapf(err, "fail to count redemptions of voucher")
+	}
+	return u, nil
+}
+
+// QuoteVoucher runs the same checks as RedeemVoucher and returns the discount of the voucher, without redeeming it.
+// Reservations are not checked, the customer may quote a voucher they reserved.
+func QuoteVoucher(ctx context.Context, email, code string, db *sqlx.DB) (RedeemResult, error) {
+	v, err := findVoucher(ctx, code, false, db)
+	if err != nil {
+		return RedeemResult{}, err
+	}
+	now := time.Now()
+	if err := checkVoucher(email, v.owner, v.expiredAt, v.usedAt, v.offer, now); err != nil {
+		return RedeemResult{}, err
 	}
-	err = tx.Commit()
+	customerID, err := v.customerID(ctx, email, db)
 	if err != nil {
-		return 0, errors.Wrapf(err, "fail to commit update of date of usage")
+		return RedeemResult{}, err
+	}
+	usage, err := loadUsage(ctx, v, customerID, now, db)
+	if err != nil {
+		return RedeemResult{}, err
+	}
+	usage.reserved, usage.customerReserved = 0, 0
+	if err := usage.check(); err != nil {
+		return RedeemResult{}, err
+	}
+	return v.result(usage), nil
+}
+
+// voucherState is what the redemption checks need to know of a voucher, the owner is not valid
+// for vouchers not assigned to a customer
+type voucherState struct {
+	id              uint64
+	ownerID         sql.NullInt64
+	owner           sql.NullString
+	assignment      Assignment
+	expiredAt       time.Time
+	usedAt          sql.NullTime
+	maxRedemptions  int
+	maxPerCustomer  sql.NullInt64
+	redemptionCount int
+	discount        Discount
+	offerID         uint64
+	offer           offerState
+}
+
+// result returns the terms of the voucher and the uses left to the customer after usage
+func (v voucherState) result(usage voucherUsage) RedeemResult {
+	return RedeemResult{OfferID: v.offerID, Discount: v.discount, RemainingUses: usage.remaining(), Rules: v.offer.rules, Stacking: v.offer.stacking}
+}
+
+// customerID returns the id of the customer of email who redeems the voucher, checkVoucher shall have
+// checked the owner of assigned vouchers
+func (v voucherState) customerID(ctx context.Context, email string, q sqlx.QueryerContext) (uint64, error) {
+	if v.ownerID.Valid {
+		return uint64(v.ownerID.Int64), nil
 	}
-	return discount, nil
+	return findCustomerID(ctx, email, q)
 }
 
-func GetCustomerIDByEmail(ctx context.Context, email string, db *sqlx.DB) (uint64, error) {
-	rows, err := db.QueryContext(ctx, "SELECT id FROM customers WHERE email=$1", email)
+// findVoucher returns the voucher with its owner, discount and the state of its offer, the voucher row is locked until the end of
+// the transaction if forUpdate is set
+func findVoucher(ctx context.Context, code string, forUpdate bool, q sqlx.QueryerContext) (voucherState, error) {
+	query := `SELECT vo.id, cus.id, cus.email, vo.assignment, vo.expired_at, vo.used_at, vo.max_redemptions, vo.max_per_customer, vo.redemption_count,
+										so.discount_type, so.discount, so.amount_minor, so.currency, o.active, o.archived_at, o.starts_at, o.ends_at, o.rules,
+										o.exclusive, o.stack_group, o.max_total_discount, o.id FROM vouchers vo
+										LEFT JOIN customers cus ON cus.id=vo.customer_id
+										INNER JOIN special_offers so ON so.id=vo.special_offer_id
+										INNER JOIN offers o ON o.id=so.offer_id
+										WHERE vo.code=$1`
+	if forUpdate {
+		query += " FOR UPDATE OF vo"
+	}
+	rows, err := q.QueryContext(ctx, query, code)
 	if err != nil {
-		return 0, errors.Wrapf(err, "fail to find customer with email %v", email)
+		return voucherState{}, errors.Wrapf(err, "fail to query voucher %v", code)
 	}
-	var customerID uint64
+	var (
+		v          voucherState
+		offer      DBModelSpecialOffer
+		exclusive  bool
+		stackGroup string
+		maxTotal   sql.NullString
+		found      bool
+	)
 	if rows.Next() {
-		err := rows.Scan(&customerID)
-		if err != nil {
-			return 0, errors.Wrapf(err, "fail to query discount from table special_offers")
-		}
+		found = true
+		err = rows.Scan(&v.id, &v.ownerID, &v.owner, &v.assignment, &v.expiredAt, &v.usedAt, &v.maxRedemptions, &v.maxPerCustomer, &v.redemptionCount,
+			&offer.DiscountType, &offer.Discount, &offer.AmountMinor, &offer.Currency, &v.offer.active, &v.offer.archivedAt, &v.offer.startsAt, &v.offer.endsAt, &v.offer.rules,
+			&exclusive, &stackGroup, &maxTotal, &v.offerID)
 	}
 	rows.Close()
-	if customerID == 0 {
-		return 0, errors.New("customerID shall not be 0")
+	if err != nil {
+		return voucherState{}, errors.Wrapf(err, "fail to query voucher %v", code)
+	}
+	if !found {
+		return voucherState{}, ErrVoucherNotFound
+	}
+	v.discount, err = offer.Terms()
+	if err != nil {
+		return voucherState{}, err
+	}
+	v.offer.stacking, err = parseStacking(exclusive, stackGroup, maxTotal)
+	if err != nil {
+		return voucherState{}, err
+	}
+	return v, nil
+}
+
+// checkVoucher returns the reason a voucher cannot be redeemed by email, or nil if it can.
+// owner is not valid for vouchers not assigned to a customer, usedAt is set once all the uses of the voucher are redeemed.
+func checkVoucher(email string, owner sql.NullString, expiredAt time.Time, usedAt sql.NullTime, offer offerState, now time.Time) error {
+	if owner.Valid && owner.String != NormalizeEmail(email) {
+		return ErrVoucherNotOwned
 	}
-	return customerID, nil
+	if usedAt.Valid {
+		return ErrVoucherRedeemed
+	}
+	if !expiredAt.After(now) {
+		return ErrVoucherExpired
+	}
+	return offer.check(now)
 }
 
-func GenerateVoucher(ctx context.Context, email, offerName, code string, expiry time.Time, discount float32, db *sqlx.DB) error {
+func GenerateVoucher(ctx context.Context, email, code string, offer OfferRef, expiry time.Time, limits Limits, db *sqlx.DB) error {
 	// query customer id
 	customerID, err := GetCustomerIDByEmail(ctx, email, db)
 	if err != nil {
 		return err
 	}
+	return insertVoucher(ctx, offer, DBModelVoucher{
+		Code:           code,
+		CustomerID:     customerID,
+		ExpiryDate:     expiry,
+		UsedDate:       sql.NullTime{Valid: false},
+		MaxRedemptions: limits.maxRedemptions(),
+		MaxPerCustomer: limits.maxPerCustomer(),
+		Assignment:     AssignmentCustomer,
+	}, db)
+}
+
+// GenerateUnassignedVoucher generates a public or claim voucher, it is not bound to any customer until it is redeemed
+func GenerateUnassignedVoucher(ctx context.Context, assignment Assignment, code string, offer OfferRef, expiry time.Time, limits Limits, db *sqlx.DB) error {
+	if !assignment.unassigned() {
+		return errors.Errorf("fail to generate voucher, %q is not an unassigned voucher", string(assignment))
+	}
+	return insertVoucher(ctx, offer, DBModelVoucher{
+		Code:           code,
+		ExpiryDate:     expiry,
+		UsedDate:       sql.NullTime{Valid: false},
+		MaxRedemptions: limits.maxRedemptions(),
+		MaxPerCustomer: limits.maxPerCustomer(),
+		Assignment:     assignment,
+	}, db)
+}
 
-	// upsert special_offer, so that we could update the discount of the special_offers
+// insertVoucher resolves the special offer and inserts the voucher of it in a transaction
+func insertVoucher(ctx context.Context, ref OfferRef, voucher DBModelVoucher, db *sqlx.DB) error {
+	// the voucher is issued with the current version of the offer
 	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
 		return errors.Wrapf(err, "fail to setup date of usage")
 	}
 
-	offer := DBModelSpecialOffer{
-		Name:     offerName,
-		Discount: discount,
-	}
-	var offerID uint64
-	offerRows, err := tx.NamedQuery(`INSERT INTO special_offers (name, discount) VALUES (:name, :discount)
-										ON CONFLICT (name) DO UPDATE SET discount=EXCLUDED.discount
-										RETURNING id`, offer)
+	offer, err := resolveOffer(ctx, ref, tx)
 	if err != nil {
 		if err1 := tx.Rollback(); err1 != nil {
 			return errors.Wrapf(err1, "fail to rollback insert to specail_offer table, insert error %v", err)
 		}
-		return errors.Wrapf(err, "fail to insert into table special_offers")
-	}
-	if offerRows.Next() {
-		offerRows.Scan(&offerID)
-	}
-	offerRows.Close()
-	if offerID == 0 {
-		return errors.New("offerID shall not be 0")
-	}
-	// insert voucher
-	voucher := DBModelVoucher{
-		Code:           code,
-		CustomerID:     customerID,
-		SpecialOfferID: offerID,
-		ExpiryDate:     expiry,
-		UsedDate:       sql.NullTime{Valid: false},
+		return err
 	}
-	_, err = tx.NamedExecContext(ctx, "INSERT INTO vouchers (code, customer_id, special_offer_id, expired_at, used_at) VALUES (:code, :customer_id, :special_offer_id, :expired_at, :used_at)", voucher)
+	// insert voucher, customer_id is NULL for unassigned vouchers
+	voucher.SpecialOfferID = offer.ID
+	_, err = tx.NamedExecContext(ctx, `INSERT INTO vouchers (code, customer_id, special_offer_id, expired_at, used_at, max_redemptions, max_per_customer, assignment)
+										VALUES (:code, NULLIF(:customer_id, 0), :special_offer_id, :expired_at, :used_at, :max_redemptions, :max_per_customer, :assignment)`, voucher)
 	if err != nil {
 		if err1 := tx.Rollback(); err1 != nil {
 			return errors.Wrapf(err1, "fail to rollback insert to voucher table, insert error %v", err)
 		}
+		if isViolation(err, pqUniqueViolation) {
+			return errors.Wrapf(ErrCodeConflict, "fail to insert to voucher table, %v", err)
+		}
 		return errors.Wrapf(err, "fail to insert to voucher table")
 	}
 	return tx.Commit()
 }
 
-// return map with offer name in key and voucher code in value
-func GetVouchers(ctx context.Context, email string, db *sqlx.DB) ([]string, []string, error) {
+// return voucher codes, offer names and how many more times the customer can redeem each voucher of the customer,
+// assigned to them or claimed by them. Vouchers the customer cannot redeem any more or whose offer is not running are left out
+func GetVouchers(ctx context.Context, email string, db *sqlx.DB) ([]string, []string, []int, error) {
 	var codes []string
 	var names []string
+	var remaining []int
 	// query customer id
 	customerID, err := GetCustomerIDByEmail(ctx, email, db)
 	if err != nil {
-		return []string{}, []string{}, err
+		return []string{}, []string{}, []int{}, err
 	}
 
-	// select vo.code from vouchers as vo inner join special_offers as so on vo.special_offer_id=so.id where vo.customer_id=1
-	rows, err := db.QueryContext(ctx, "SELECT vo.code, so.name FROM vouchers AS vo INNER JOIN special_offers AS so ON vo.special_offer_id=so.id WHERE vo.customer_id=$1 and vo.used_at is NULL", customerID)
+	rows, err := db.QueryContext(ctx, `SELECT vo.code, so.name, vo.max_redemptions, vo.max_per_customer, vo.redemption_count,
+										(SELECT count(*) FROM redemptions r WHERE r.voucher_id=vo.id AND r.customer_id=$1 AND r.reversed_at IS NULL),
+										(SELECT count(*) FROM reservations rs WHERE rs.voucher_id=vo.id AND rs.expires_at>$2),
+										(SELECT count(*) FROM reservations rs WHERE rs.voucher_id=vo.id AND rs.customer_id=$1 AND rs.expires_at>$2)
+										FROM vouchers AS vo INNER JOIN special_offers AS so ON vo.special_offer_id=so.id
+										INNER JOIN offers AS o ON o.id=so.offer_id
+										WHERE (vo.customer_id=$1 OR (vo.assignment='claim' AND EXISTS
+											(SELECT 1 FROM redemptions r WHERE r.voucher_id=vo.id AND r.customer_id=$1 AND r.reversed_at IS NULL)))
+										and vo.used_at is NULL AND o.active AND o.archived_at IS NULL
+										AND (o.starts_at IS NULL OR o.starts_at<=$2) AND (o.ends_at IS NULL OR o.ends_at>$2) ORDER BY vo.id`, customerID, time.Now())
 	if err != nil {
-		return []string{}, []string{}, errors.Wrapf(err, "fail to query discount from table special_offers")
+		return []string{}, []string{}, []int{}, errors.Wrapf(err, "fail to query discount from table special_offers")
 	}
+	defer rows.Close()
 	for rows.Next() {
 		var code string
 		var name string
-		err := rows.Scan(&code, &name)
+		var u voucherUsage
+		err := rows.Scan(&code, &name, &u.maxRedemptions, &u.maxPerCustomer, &u.redemptions, &u.customerRedeemed, &u.reserved, &u.customerReserved)
 		if err != nil {
-			return []string{}, []string{}, errors.Wrapf(err, "fail to query discount from table special_offers")
+			return []string{}, []string{}, []int{}, errors.Wrapf(err, "fail to query discount from table special_offers")
+		}
+		if u.remaining() == 0 {
+			continue
 		}
 		codes = append(codes, code)
 		names = append(names, name)
+		remaining = append(remaining, u.remaining())
 	}
-	rows.Close()
-	return codes, names, nil
+	return codes, names, remaining, rows.Err()
 }
@@ -8,11 +8,24 @@ import (
 	"time"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/ingemar0720/voucher-pool/rules"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
+// columns of the voucher queried by findVoucher
+var voucherColumns = []string{"id", "customer_id", "email", "assignment", "expired_at", "used_at", "max_redemptions", "max_per_customer", "redemption_count",
+	"discount_type", "discount", "amount_minor", "currency", "active", "archived_at", "starts_at", "ends_at", "rules",
+	"exclusive", "stack_group", "max_total_discount", "offer_id"}
+
+// the counts queried by loadUsage
+var (
+	usageQuery   = "SELECT \\(SELECT count\\(\\*\\) FROM redemptions (.+)"
+	usageColumns = []string{"customer_redeemed", "reserved", "customer_reserved", "held_by_others"}
+)
+
 func setupSQLMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -21,135 +34,307 @@ func setupSQLMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
 	return db, mock
 }
 
-func TestValidateVoucher(t *testing.T) {
+func TestRedeemVoucher(t *testing.T) {
 	db, mock := setupSQLMock(t)
 	defer db.Close()
 	fixtureEmail := "test@gmail.com"
 	fixtureCode := "code"
+	lockQuery := "SELECT (.+) FROM vouchers vo LEFT JOIN customers cus ON (.+) INNER JOIN special_offers so ON (.+) WHERE vo.code=(.+) FOR UPDATE OF vo"
 	tests := []struct {
-		name          string
-		givenEmail    string
-		givenCode     string
-		wantUsedAt    sql.NullTime
-		wantExpiredAt time.Time
-		wantErr       bool
+		name             string
+		givenEmail       string
+		givenOwner       string
+		givenExpiry      time.Time
+		givenUsedAt      sql.NullTime
+		givenMax         int
+		givenPerCustomer interface{}
+		givenCount       int
+		givenAssignment  Assignment
+		// redemptions by the customer, reservations, reservations by the customer and uses held by others
+		givenUsage   []int
+		notFound     bool
+		queryErr     bool
+		updateErr    bool
+		raceLost     bool
+		want         RedeemResult
+		wantErr      error
+		wantAnyErr   bool
+		wantNoUpdate bool
 	}{
 		{
-			name:          "used_at is null",
-			givenEmail:    fixtureEmail,
-			givenCode:     fixtureCode,
-			wantUsedAt:    sql.NullTime{Valid: false},
-			wantExpiredAt: time.Now().Add(25 * time.Hour),
-			wantErr:       false,
+			name:        "redeem voucher",
+			givenEmail:  fixtureEmail,
+			givenOwner:  fixtureEmail,
+			givenExpiry: time.Now().Add(24 * time.Hour),
+			want:        RedeemResult{OfferID: 3, Discount: PercentageDiscount(5010), Rules: rules.Set{}},
+		},
+		{
+			name:        "redeem multi-use voucher",
+			givenEmail:  fixtureEmail,
+			givenOwner:  fixtureEmail,
+			givenExpiry: time.Now().Add(24 * time.Hour),
+			givenMax:    5,
+			givenCount:  2,
+			givenUsage:  []int{0, 1, 0},
+			want:        RedeemResult{OfferID: 3, Discount: PercentageDiscount(5010), RemainingUses: 1, Rules: rules.Set{}},
+		},
+		{
+			name:            "redeem public voucher",
+			givenEmail:      fixtureEmail,
+			givenExpiry:     time.Now().Add(24 * time.Hour),
+			givenAssignment: AssignmentPublic,
+			givenMax:        10,
+			givenCount:      4,
+			givenUsage:      []int{0, 0, 0, 4},
+			want:            RedeemResult{OfferID: 3, Discount: PercentageDiscount(5010), RemainingUses: 5, Rules: rules.Set{}},
+		},
+		{
+			name:            "claim voucher held by another customer",
+			givenEmail:      fixtureEmail,
+			givenExpiry:     time.Now().Add(24 * time.Hour),
+			givenAssignment: AssignmentClaim,
+			givenMax:        3,
+			givenCount:      1,
+			givenUsage:      []int{0, 0, 0, 1},
+			wantErr:         ErrVoucherNotOwned,
+			wantNoUpdate:    true,
+		},
+		{
+			name:         "voucher not found",
+			givenEmail:   fixtureEmail,
+			notFound:     true,
+			wantErr:      ErrVoucherNotFound,
+			wantNoUpdate: true,
+		},
+		{
+			name:         "voucher of another customer",
+			givenEmail:   fixtureEmail,
+			givenOwner:   "other@gmail.com",
+			givenExpiry:  time.Now().Add(24 * time.Hour),
+			wantErr:      ErrVoucherNotOwned,
+			wantNoUpdate: true,
+		},
+		{
+			name:         "voucher expired",
+			givenEmail:   fixtureEmail,
+			givenOwner:   fixtureEmail,
+			givenExpiry:  time.Now().Add(-24 * time.Hour),
+			wantErr:      ErrVoucherExpired,
+			wantNoUpdate: true,
+		},
+		{
+			name:         "voucher redeemed",
+			givenEmail:   fixtureEmail,
+			givenOwner:   fixtureEmail,
+			givenExpiry:  time.Now().Add(24 * time.Hour),
+			givenUsedAt:  sql.NullTime{Valid: true, Time: time.Now()},
+			wantErr:      ErrVoucherRedeemed,
+			wantNoUpdate: true,
+		},
+		{
+			name:         "voucher reserved",
+			givenEmail:   fixtureEmail,
+			givenOwner:   fixtureEmail,
+			givenExpiry:  time.Now().Add(24 * time.Hour),
+			givenUsage:   []int{0, 1, 0},
+			wantErr:      ErrVoucherReserved,
+			wantNoUpdate: true,
+		},
+		{
+			name:             "customer limit reached",
+			givenEmail:       fixtureEmail,
+			givenOwner:       fixtureEmail,
+			givenExpiry:      time.Now().Add(24 * time.Hour),
+			givenMax:         5,
+			givenPerCustomer: 2,
+			givenCount:       2,
+			givenUsage:       []int{2, 0, 0},
+			wantErr:          ErrCustomerLimitReached,
+			wantNoUpdate:     true,
+		},
+		{
+			name:        "guarded update touches no row",
+			givenEmail:  fixtureEmail,
+			givenOwner:  fixtureEmail,
+			givenExpiry: time.Now().Add(24 * time.Hour),
+			raceLost:    true,
+			wantErr:     ErrVoucherRedeemed,
 		},
 		{
-			name:          "used_at is not null",
-			givenEmail:    fixtureEmail,
-			givenCode:     fixtureCode,
-			wantUsedAt:    sql.NullTime{Valid: true, Time: time.Date(2022, time.June, 1, 0, 0, 0, 0, time.Local)},
-			wantExpiredAt: time.Now().Add(25 * time.Hour),
-			wantErr:       false,
+			name:         "query error",
+			givenEmail:   fixtureEmail,
+			queryErr:     true,
+			wantAnyErr:   true,
+			wantNoUpdate: true,
 		},
 		{
-			name:          "db error",
-			givenEmail:    fixtureEmail,
-			givenCode:     fixtureCode,
-			wantUsedAt:    sql.NullTime{},
-			wantExpiredAt: time.Now().Add(25 * time.Hour),
-			wantErr:       true,
+			name:        "update error",
+			givenEmail:  fixtureEmail,
+			givenOwner:  fixtureEmail,
+			givenExpiry: time.Now().Add(24 * time.Hour),
+			updateErr:   true,
+			wantAnyErr:  true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if !tt.wantErr {
-				mock.ExpectQuery("SELECT (.+) FROM customers cus inner JOIN vouchers vo ON cus.id=vo.customer_id WHERE (.+)").WithArgs(fixtureEmail, fixtureCode).WillReturnRows(sqlmock.NewRows([]string{"used_at", "expired_at"}).AddRow(tt.wantUsedAt, tt.wantExpiredAt))
-			} else {
-				mock.ExpectQuery("SELECT (.+) FROM customers cus inner JOIN vouchers vo ON cus.id=vo.customer_id WHERE (.+)").WithArgs(fixtureEmail, fixtureCode).WillReturnError(errors.New("error"))
+			max := tt.givenMax
+			if max == 0 {
+				max = 1
+			}
+			mock.ExpectBegin()
+			switch {
+			case tt.queryErr:
+				mock.ExpectQuery(lockQuery).WithArgs(fixtureCode).WillReturnError(errors.New("error"))
+			case tt.notFound:
+				mock.ExpectQuery(lockQuery).WithArgs(fixtureCode).WillReturnRows(sqlmock.NewRows(voucherColumns))
+			case tt.givenAssignment.unassigned():
+				// the redeemer is looked up by email, the voucher has no customer
+				mock.ExpectQuery(lockQuery).WithArgs(fixtureCode).WillReturnRows(sqlmock.NewRows(voucherColumns).
+					AddRow(1, nil, nil, string(tt.givenAssignment), tt.givenExpiry, tt.givenUsedAt, max, tt.givenPerCustomer, tt.givenCount, "percentage", "50.10", nil, nil, true, nil, nil, nil, "[]", false, "", nil, 3))
+				mock.ExpectQuery("SELECT id FROM customers WHERE email=(.+)").WithArgs(tt.givenEmail).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+			default:
+				mock.ExpectQuery(lockQuery).WithArgs(fixtureCode).WillReturnRows(sqlmock.NewRows(voucherColumns).
+					AddRow(1, 2, tt.givenOwner, "customer", tt.givenExpiry, tt.givenUsedAt, max, tt.givenPerCustomer, tt.givenCount, "percentage", "50.10", nil, nil, true, nil, nil, nil, "[]", false, "", nil, 3))
 			}
-			got, err := ValidateVoucher(context.Background(), tt.givenEmail, tt.givenCode, sqlx.NewDb(db, "sqlmock"))
-			if (err != nil) != tt.wantErr {
-				t.Errorf("ValidateVoucher() error = %v, wantErr %v", err, tt.wantErr)
-				return
+			if !tt.wantNoUpdate || tt.givenUsage != nil {
+				usage := tt.givenUsage
+				if usage == nil {
+					usage = []int{0, 0, 0}
+				}
+				if len(usage) == 3 {
+					usage = append(usage, 0)
+				}
+				mock.ExpectQuery(usageQuery).WithArgs(1, 2, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows(usageColumns).AddRow(usage[0], usage[1], usage[2], usage[3]))
 			}
-			if !reflect.DeepEqual(got, tt.wantUsedAt) {
-				t.Errorf("ValidateVoucher() = %v, want %v", got, tt.wantUsedAt)
+			if !tt.wantNoUpdate {
+				update := mock.ExpectExec("UPDATE vouchers SET (.+) WHERE id=(.+) AND redemption_count<max_redemptions").WithArgs(sqlmock.AnyArg(), 1)
+				switch {
+				case tt.updateErr:
+					update.WillReturnError(errors.New("error"))
+				case tt.raceLost:
+					update.WillReturnResult(sqlmock.NewResult(0, 0))
+				default:
+					update.WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectExec("INSERT INTO redemptions (.+)").WithArgs(1, 2, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+				}
 			}
+			if tt.wantErr != nil || tt.wantAnyErr {
+				mock.ExpectRollback()
+			} else {
+				mock.ExpectCommit()
+			}
+
+			got, err := RedeemVoucher(context.Background(), tt.givenEmail, fixtureCode, rules.Order{}, sqlx.NewDb(db, "sqlmock"))
+			switch {
+			case tt.wantErr != nil:
+				assert.True(t, errors.Is(err, tt.wantErr))
+			case tt.wantAnyErr:
+				assert.NotNil(t, err)
+			default:
+				assert.Nil(t, err)
+			}
+			assert.EqualValues(t, tt.want, got)
+			assert.Nil(t, mock.ExpectationsWereMet())
 		})
 	}
 }
 
-func TestSetVoucherUsageAndGetDiscount(t *testing.T) {
+func TestQuoteVoucher(t *testing.T) {
 	db, mock := setupSQLMock(t)
 	defer db.Close()
-	fixtureCode := "code"
+	// the voucher is neither locked nor updated, reservations do not count
+	mock.ExpectQuery("SELECT (.+) FROM vouchers vo LEFT JOIN customers cus ON (.+) INNER JOIN special_offers so ON (.+) WHERE vo.code=\\$1$").WithArgs("code").
+		WillReturnRows(sqlmock.NewRows(voucherColumns).AddRow(1, 2, "test@gmail.com", "customer", time.Now().Add(24*time.Hour), nil, 3, nil, 1, "fixed", nil, 1050, "EUR", true, nil, nil, nil, `[{"type":"first_order"}]`, false, "", nil, 3))
+	mock.ExpectQuery(usageQuery).WithArgs(1, 2, sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows(usageColumns).AddRow(1, 2, 0, 0))
+	mock.ExpectQuery("SELECT (.+) FROM vouchers vo (.+) WHERE vo.code=\\$1$").WithArgs("code").
+		WillReturnRows(sqlmock.NewRows(voucherColumns).AddRow(1, 2, "test@gmail.com", "customer", time.Now().Add(24*time.Hour), time.Now(), 1, nil, 1, "fixed", nil, 1050, "EUR", true, nil, nil, nil, "[]", false, "", nil, 3))
+
+	got, err := QuoteVoucher(context.Background(), "test@gmail.com", "code", sqlx.NewDb(db, "sqlmock"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, RedeemResult{OfferID: 3, Discount: FixedDiscount(1050, "EUR"), RemainingUses: 2, Rules: rules.Set{{Type: rules.TypeFirstOrder}}}, got)
+	_, err = QuoteVoucher(context.Background(), "test@gmail.com", "code", sqlx.NewDb(db, "sqlmock"))
+	assert.True(t, errors.Is(err, ErrVoucherRedeemed))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+var errCheck = errors.New("check failed")
+
+func TestRedeemVouchers(t *testing.T) {
+	lockQuery := "SELECT (.+) FROM vouchers vo (.+) WHERE vo.code=(.+) FOR UPDATE OF vo"
+	expiry := time.Now().Add(24 * time.Hour)
 	tests := []struct {
-		name          string
-		givenCode     string
-		givenUsedDate sql.NullTime
-		want          float32
-		queryErr      bool
-		updateErr     bool
+		name           string
+		givenCodes     []string
+		givenExclusive bool
+		// error of the check of the results
+		givenCheckErr error
+		wantErr       error
 	}{
 		{
-			name:          "get discount value",
-			givenCode:     fixtureCode,
-			givenUsedDate: sql.NullTime{Valid: true, Time: time.Now()},
-			want:          50.1,
-			queryErr:      false,
-			updateErr:     false,
+			name:       "redeem together",
+			givenCodes: []string{"b", "a"},
+		},
+		{
+			name:           "exclusive voucher",
+			givenCodes:     []string{"b", "a"},
+			givenExclusive: true,
+			wantErr:        ErrStackingConflict,
 		},
 		{
-			name:          "query error",
-			givenCode:     fixtureCode,
-			givenUsedDate: sql.NullTime{Valid: true, Time: time.Now()},
-			want:          0,
-			queryErr:      true,
-			updateErr:     false,
+			name:       "code given twice",
+			givenCodes: []string{"a", "a"},
+			wantErr:    ErrStackingConflict,
 		},
 		{
-			name:          "update error",
-			givenCode:     fixtureCode,
-			givenUsedDate: sql.NullTime{Valid: true, Time: time.Now()},
-			want:          0,
-			queryErr:      false,
-			updateErr:     true,
+			name:          "check of the results fails",
+			givenCodes:    []string{"b", "a"},
+			givenCheckErr: errCheck,
+			wantErr:       errCheck,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if !tt.queryErr {
-				mock.ExpectQuery("SELECT (.+) FROM special_offers so INNER JOIN vouchers vo ON so.id=vo.special_offer_id WHERE (.+)").WithArgs(fixtureCode).WillReturnRows(sqlmock.NewRows([]string{"discount"}).AddRow(50.1))
-			} else {
-				mock.ExpectQuery("SELECT (.+) FROM special_offers so INNER JOIN vouchers vo ON so.id=vo.special_offer_id WHERE (.+)").WithArgs(fixtureCode).WillReturnError(errors.New("error"))
-			}
-			mock.ExpectBegin()
-			mock.ExpectExec("UPDATE vouchers SET (.+) WHERE (.+)").WithArgs(tt.givenUsedDate.Time.Format(time.RFC3339), tt.givenCode).WillReturnResult(sqlmock.NewResult(1, 1))
-			if !tt.updateErr {
-				mock.ExpectCommit()
-			} else {
-				mock.ExpectRollback()
-			}
-
-			got, err := SetVoucherUsageAndGetDiscount(context.Background(), tt.givenCode, sqlx.NewDb(db, "sqlmock"))
-			if tt.queryErr {
-				if err == nil {
-					t.Errorf("SetVoucherUsageAndGetDiscount() error = %v, queryErr %v", err, tt.queryErr)
-					return
+			db, mock := setupSQLMock(t)
+			defer db.Close()
+			if tt.givenCodes[0] != tt.givenCodes[1] {
+				mock.ExpectBegin()
+				// the vouchers are locked in the order of their codes
+				mock.ExpectQuery(lockQuery).WithArgs("a").WillReturnRows(sqlmock.NewRows(voucherColumns).
+					AddRow(1, 2, "test@gmail.com", "customer", expiry, nil, 1, nil, 0, "percentage", "10.00", nil, nil, true, nil, nil, nil, "[]", false, "tea", "30.00", 3))
+				mock.ExpectQuery(lockQuery).WithArgs("b").WillReturnRows(sqlmock.NewRows(voucherColumns).
+					AddRow(2, 2, "test@gmail.com", "customer", expiry, nil, 1, nil, 0, "fixed", nil, 500, "EUR", true, nil, nil, nil, "[]", tt.givenExclusive, "tea", nil, 4))
+				if tt.wantErr == nil || tt.givenCheckErr != nil {
+					for _, id := range []int{2, 1} {
+						mock.ExpectQuery(usageQuery).WithArgs(id, 2, sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows(usageColumns).AddRow(0, 0, 0, 0))
+						mock.ExpectExec("UPDATE vouchers SET (.+) WHERE id=(.+)").WithArgs(sqlmock.AnyArg(), id).WillReturnResult(sqlmock.NewResult(0, 1))
+						mock.ExpectExec("INSERT INTO redemptions (.+)").WithArgs(id, 2, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+					}
 				}
-			}
-			if tt.updateErr {
-				if err == nil {
-					t.Errorf("SetVoucherUsageAndGetDiscount() error = %v, updateErr %v", err, tt.updateErr)
-					return
+				// the redemptions are rolled back if the check fails
+				if tt.wantErr != nil {
+					mock.ExpectRollback()
+				} else {
+					mock.ExpectCommit()
 				}
 			}
-			if err == nil {
-				assert.EqualValues(t, tt.updateErr, false)
-				assert.EqualValues(t, tt.queryErr, false)
+
+			check := func(results []RedeemResult) error {
+				assert.Len(t, results, 2)
+				return tt.givenCheckErr
 			}
-			if got != tt.want {
-				t.Errorf("SetVoucherUsageAndGetDiscount() = %v, want %v", got, tt.want)
+			got, err := RedeemVouchers(context.Background(), "test@gmail.com", tt.givenCodes, rules.Order{}, check, sqlx.NewDb(db, "sqlmock"))
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr), err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, []RedeemResult{
+					{OfferID: 4, Discount: FixedDiscount(500, "EUR"), Rules: rules.Set{}, Stacking: Stacking{Group: "tea"}},
+					{OfferID: 3, Discount: PercentageDiscount(1000), Rules: rules.Set{}, Stacking: Stacking{Group: "tea", MaxTotalDiscount: 3000}},
+				}, got)
 			}
+			assert.Nil(t, mock.ExpectationsWereMet())
 		})
 	}
 }
@@ -161,7 +346,7 @@ func TestGenerateVoucher(t *testing.T) {
 	fixtureOfferName := "apple_store"
 	fixtureVoucherCode := "abcd"
 	fixtureExpiry := time.Date(2021, time.June, 1, 0, 0, 0, 0, time.Local)
-	fixtureDiscount := float32(88.8)
+	fixtureDiscount := PercentageDiscount(8880)
 
 	tests := []struct {
 		name                 string
@@ -169,7 +354,7 @@ func TestGenerateVoucher(t *testing.T) {
 		givenOfferName       string
 		givenVoucherCode     string
 		givenExpiry          time.Time
-		givenDiscount        float32
+		givenDiscount        Discount
 		wantQueryCustomerErr bool
 		wantUpsertOfferErr   bool
 		wantInsertVoucherErr bool
@@ -219,23 +404,23 @@ func TestGenerateVoucher(t *testing.T) {
 			}
 			mock.ExpectBegin()
 			if !tt.wantUpsertOfferErr {
-				mock.ExpectQuery("INSERT INTO special_offers (.+) VALUES (.+) ON CONFLICT (.+) DO UPDATE SET (.+) RETURNING id").WithArgs(tt.givenOfferName, tt.givenDiscount).WillReturnRows(sqlmock.NewRows([]string{"used_at"}).AddRow(1))
+				expectNewOffer(mock, tt.givenOfferName, "88.80", 1)
 			} else {
-				mock.ExpectQuery("INSERT INTO special_offers (.+) VALUES (.+) ON CONFLICT (.+) DO UPDATE SET (.+) RETURNING id").WithArgs(tt.givenOfferName, tt.givenDiscount).WillReturnError(errors.New("error"))
+				mock.ExpectExec(offerLockQuery).WithArgs(tt.givenOfferName).WillReturnError(errors.New("error"))
 				mock.ExpectRollback()
 			}
 
 			if !tt.wantInsertVoucherErr {
-				mock.ExpectExec("INSERT INTO vouchers (.+) VALUES (.+)").WithArgs(tt.givenVoucherCode, 1, 1, tt.givenExpiry, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO vouchers (.+) VALUES (.+)").WithArgs(tt.givenVoucherCode, 1, 1, tt.givenExpiry, sqlmock.AnyArg(), 1, nil, "customer").WillReturnResult(sqlmock.NewResult(1, 1))
 			} else {
-				mock.ExpectExec("INSERT INTO vouchers (.+) VALUES (.+)").WithArgs(tt.givenVoucherCode, 1, 1, tt.givenExpiry, sqlmock.AnyArg()).WillReturnError(errors.New("error"))
+				mock.ExpectExec("INSERT INTO vouchers (.+) VALUES (.+)").WithArgs(tt.givenVoucherCode, 1, 1, tt.givenExpiry, sqlmock.AnyArg(), 1, nil, "customer").WillReturnError(errors.New("error"))
 			}
 			if tt.wantUpsertOfferErr || tt.wantInsertVoucherErr {
 				mock.ExpectRollback()
 			} else {
 				mock.ExpectCommit()
 			}
-			err := GenerateVoucher(context.Background(), tt.givenEmail, tt.givenOfferName, tt.givenVoucherCode, tt.givenExpiry, tt.givenDiscount, sqlx.NewDb(db, "sqlmock"))
+			err := GenerateVoucher(context.Background(), tt.givenEmail, tt.givenVoucherCode, OfferRef{Name: tt.givenOfferName, Discount: tt.givenDiscount}, tt.givenExpiry, Limits{}, sqlx.NewDb(db, "sqlmock"))
 			if tt.wantQueryCustomerErr {
 				assert.NotNil(t, err)
 			}
@@ -252,6 +437,21 @@ func TestGenerateVoucher(t *testing.T) {
 	}
 }
 
+func TestGenerateVoucherCodeConflict(t *testing.T) {
+	db, mock := setupSQLMock(t)
+	defer db.Close()
+	expiry := time.Date(2021, time.June, 1, 0, 0, 0, 0, time.Local)
+	mock.ExpectQuery("SELECT (.+) FROM customers WHERE (.+)").WithArgs("test@gmail.com").WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow(1))
+	mock.ExpectBegin()
+	expectNewOffer(mock, "apple_store", "88.80", 1)
+	mock.ExpectExec("INSERT INTO vouchers (.+) VALUES (.+)").WithArgs("abcd", 1, 1, expiry, sqlmock.AnyArg(), 3, 1, "customer").WillReturnError(&pq.Error{Code: "23505", Constraint: "vouchers_code_key"})
+	mock.ExpectRollback()
+
+	err := GenerateVoucher(context.Background(), "test@gmail.com", "abcd", OfferRef{Name: "apple_store", Discount: PercentageDiscount(8880)}, expiry, Limits{MaxRedemptions: 3, MaxPerCustomer: 1}, sqlx.NewDb(db, "sqlmock"))
+	assert.True(t, errors.Is(err, ErrCodeConflict))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
 func TestGetVouchers(t *testing.T) {
 	db, mock := setupSQLMock(t)
 	defer db.Close()
@@ -263,6 +463,7 @@ func TestGetVouchers(t *testing.T) {
 		givenEmail           string
 		wantVoucerCodes      []string
 		wantOffNames         []string
+		wantRemaining        []int
 		wantQueryCustomerErr bool
 		wantQueryVoucherErr  bool
 	}{
@@ -271,6 +472,7 @@ func TestGetVouchers(t *testing.T) {
 			givenEmail:           fixtureEmail,
 			wantVoucerCodes:      fixtureCode,
 			wantOffNames:         fixtureOfferName,
+			wantRemaining:        []int{1, 2},
 			wantQueryCustomerErr: false,
 			wantQueryVoucherErr:  false,
 		},
@@ -279,6 +481,7 @@ func TestGetVouchers(t *testing.T) {
 			givenEmail:           fixtureEmail,
 			wantVoucerCodes:      []string{},
 			wantOffNames:         []string{},
+			wantRemaining:        []int{},
 			wantQueryCustomerErr: true,
 			wantQueryVoucherErr:  false,
 		},
@@ -287,6 +490,7 @@ func TestGetVouchers(t *testing.T) {
 			givenEmail:           fixtureEmail,
 			wantVoucerCodes:      []string{},
 			wantOffNames:         []string{},
+			wantRemaining:        []int{},
 			wantQueryCustomerErr: false,
 			wantQueryVoucherErr:  true,
 		},
@@ -300,12 +504,17 @@ func TestGetVouchers(t *testing.T) {
 			}
 
 			if !tt.wantQueryVoucherErr {
-				mock.ExpectQuery("SELECT (.+) FROM vouchers AS vo INNER JOIN special_offers AS so ON vo.special_offer_id=so.id WHERE (.+)").WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"code", "name"}).AddRow("abcd", "apple_store").AddRow("defg", "7-11"))
+				mock.ExpectQuery("SELECT (.+) FROM vouchers AS vo INNER JOIN special_offers AS so ON vo.special_offer_id=so.id INNER JOIN offers AS o ON (.+) WHERE (.+)").WithArgs(1, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows(append([]string{"code", "name", "max_redemptions", "max_per_customer", "redemption_count"}, usageColumns[:3]...)).
+						AddRow("abcd", "apple_store", 1, nil, 0, 0, 0, 0).
+						// used up by the customer, the voucher has uses left for others
+						AddRow("used", "7-11", 5, 2, 2, 2, 0, 0).
+						AddRow("defg", "7-11", 5, 3, 2, 1, 1, 0))
 			} else {
-				mock.ExpectQuery("SELECT (.+) FROM vouchers AS vo INNER JOIN special_offers AS so ON vo.special_offer_id=so.id WHERE (.+)").WithArgs(1).WillReturnError(errors.New("error"))
+				mock.ExpectQuery("SELECT (.+) FROM vouchers AS vo INNER JOIN special_offers AS so ON vo.special_offer_id=so.id INNER JOIN offers AS o ON (.+) WHERE (.+)").WithArgs(1, sqlmock.AnyArg()).WillReturnError(errors.New("error"))
 			}
 
-			got, got1, err := GetVouchers(context.Background(), tt.givenEmail, sqlx.NewDb(db, "sqlmock"))
+			got, got1, got2, err := GetVouchers(context.Background(), tt.givenEmail, sqlx.NewDb(db, "sqlmock"))
 
 			if !tt.wantQueryCustomerErr && !tt.wantQueryVoucherErr {
 				assert.Nil(t, err)
@@ -318,6 +527,9 @@ func TestGetVouchers(t *testing.T) {
 			if !reflect.DeepEqual(got1, tt.wantOffNames) {
 				t.Errorf("GetVouchers() got1 = %v, want %v", got1, tt.wantOffNames)
 			}
+			if !reflect.DeepEqual(got2, tt.wantRemaining) {
+				t.Errorf("GetVouchers() got2 = %v, want %v", got2, tt.wantRemaining)
+			}
 		})
 	}
 }
@@ -0,0 +1,287 @@
+// Package logging writes the logs of the voucher service as JSON lines. Every line of a request carries its chi
+// request id, and the hash of the customer email and the prefix of the voucher codes once the handler knows them, so
+// the lines of a request can be found without logging personal data.
+package logging
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// how many characters of a voucher code are logged when codes are redacted
+	codePrefixLength = 4
+	// how many hex characters of the email hash are logged
+	emailHashLength = 16
+)
+
+// Config of the logs
+type Config struct {
+	// Level is the lowest level logged: debug, info, warn or error
+	Level string `yaml:"level"`
+	// Redact logs the hash of emails and the prefix of voucher codes instead of the full values, and errors by their
+	// cause only, see Redact
+	Redact bool `yaml:"redact"`
+}
+
+// DefaultConfig logs from info with emails, codes and error messages redacted
+var DefaultConfig = Config{Level: "info", Redact: true}
+
+func (c Config) Validate() error {
+	_, err := parseLevel(c.Level)
+	return err
+}
+
+func parseLevel(level string) (zerolog.Level, error) {
+	switch level {
+	case "debug":
+		return zerolog.DebugLevel, nil
+	case "info":
+		return zerolog.InfoLevel, nil
+	case "warn":
+		return zerolog.WarnLevel, nil
+	case "error":
+		return zerolog.ErrorLevel, nil
+	}
+	return zerolog.NoLevel, errors.Errorf("log level shall be debug, info, warn or error, got %q", level)
+}
+
+// Logger writes JSON lines with a level and a time. The methods of a nil *Logger log nothing.
+type Logger struct {
+	log    zerolog.Logger
+	redact bool
+}
+
+func New(w io.Writer, cfg Config) (*Logger, error) {
+	level, err := parseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{
+		log:    zerolog.New(w).Level(level).With().Timestamp().Logger(),
+		redact: cfg.Redact,
+	}, nil
+}
+
+var nop = zerolog.Nop()
+
+// For returns the logger of the request of ctx with its fields, l if ctx is not the context of a request
+func (l *Logger) For(ctx context.Context) *zerolog.Logger {
+	if req, ok := ctx.Value(requestKey{}).(*request); ok {
+		return &req.log
+	}
+	if l == nil {
+		return &nop
+	}
+	return &l.log
+}
+
+type requestKey struct{}
+
+// request holds the logger of a request, the handler adds fields to it while it runs
+type request struct {
+	mu     sync.Mutex
+	log    zerolog.Logger
+	redact bool
+	// the last store operation of the request which failed
+	failedOp string
+}
+
+func (req *request) update(f func(c zerolog.Context) zerolog.Context) {
+	req.mu.Lock()
+	defer req.mu.Unlock()
+	req.log = f(req.log.With()).Logger()
+}
+
+func update(ctx context.Context, f func(c zerolog.Context, redact bool) zerolog.Context) {
+	if req, ok := ctx.Value(requestKey{}).(*request); ok {
+		req.update(func(c zerolog.Context) zerolog.Context { return f(c, req.redact) })
+	}
+}
+
+// Middleware puts the logger of the request into its context and logs the request once it is served, at error level
+// if it failed with a 5xx. It shall run after middleware.RequestID, and after the tracing middleware to log the
+// trace_id. The path is only logged if codes are not redacted, it may contain one.
+func (l *Logger) Middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &request{redact: l.redact}
+		c := l.log.With().Str("request_id", middleware.GetReqID(r.Context()))
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			c = c.Str("trace_id", sc.TraceID().String())
+		}
+		if !l.redact {
+			c = c.Str("path", r.URL.Path)
+		}
+		req.log = c.Logger()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), requestKey{}, req)))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := "not_found"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		req.mu.Lock()
+		defer req.mu.Unlock()
+		e := req.log.Info()
+		if status >= http.StatusInternalServerError {
+			e = req.log.Error()
+		}
+		if status >= http.StatusInternalServerError && req.failedOp != "" {
+			e = e.Str("failed_op", req.failedOp)
+		}
+		e.Str("method", r.Method).
+			Str("route", route).
+			Int("status", status).
+			Int("bytes", ww.BytesWritten()).
+			Dur("duration", time.Since(start)).
+			Msg("request")
+	})
+}
+
+// QueryHook logs the operations of dbmodel.PostgresStore at debug level with the fields of their request. The last
+// failing operation of a request is logged as failed_op with the request if it fails with a 5xx.
+func (l *Logger) QueryHook() func(ctx context.Context, op string) (context.Context, func(error)) {
+	return func(ctx context.Context, op string) (context.Context, func(error)) {
+		start := time.Now()
+		return ctx, func(err error) {
+			e := l.For(ctx).Debug().Str("op", op).Dur("duration", time.Since(start))
+			if err != nil {
+				e = e.Fields(l.ErrorFields(err))
+				if req, ok := ctx.Value(requestKey{}).(*request); ok {
+					req.mu.Lock()
+					req.failedOp = op
+					req.mu.Unlock()
+				}
+			}
+			e.Msg("query")
+		}
+	}
+}
+
+// SetCustomer adds the customer of the request of ctx to its lines, as email_hash and, if not redacted, email
+func SetCustomer(ctx context.Context, email string) {
+	update(ctx, func(c zerolog.Context, redact bool) zerolog.Context {
+		c = c.Str("email_hash", EmailHash(email))
+		if !redact {
+			c = c.Str("email", email)
+		}
+		return c
+	})
+}
+
+// SetVouchers adds the voucher codes of the request of ctx to its lines, as code_prefix for one code and
+// code_prefixes for several, and the full codes if not redacted
+func SetVouchers(ctx context.Context, codes ...string) {
+	if len(codes) == 0 {
+		return
+	}
+	update(ctx, func(c zerolog.Context, redact bool) zerolog.Context {
+		prefixes := make([]string, len(codes))
+		for i, code := range codes {
+			prefixes[i] = CodePrefix(code)
+		}
+		if len(codes) == 1 {
+			c = c.Str("code_prefix", prefixes[0])
+			if !redact {
+				c = c.Str("code", codes[0])
+			}
+			return c
+		}
+		c = c.Strs("code_prefixes", prefixes)
+		if !redact {
+			c = c.Strs("codes", codes)
+		}
+		return c
+	})
+}
+
+// SetError adds the error a request failed with to its lines, see ErrorFields
+func SetError(ctx context.Context, err error) {
+	update(ctx, func(c zerolog.Context, redact bool) zerolog.Context {
+		return c.Fields(errorFields(err, redact))
+	})
+}
+
+// ErrorFields are the fields logging err: error and cause, the error err wraps with pkg/errors. If errors are
+// redacted, the cause is logged as told by Redact, the messages of wrapped errors hold emails and codes. A postgres
+// error adds its sqlstate, constraint and table either way, they hold no customer data unlike its detail.
+func (l *Logger) ErrorFields(err error) map[string]interface{} {
+	return errorFields(err, l == nil || l.redact)
+}
+
+func errorFields(err error, redact bool) map[string]interface{} {
+	fields := map[string]interface{}{"cause": Redact(err)}
+	if !redact {
+		fields = map[string]interface{}{"error": err.Error(), "cause": errors.Cause(err).Error()}
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		fields["sqlstate"] = string(pqErr.Code)
+		if pqErr.Constraint != "" {
+			fields["constraint"] = pqErr.Constraint
+		}
+		if pqErr.Table != "" {
+			fields["table"] = pqErr.Table
+		}
+	}
+	return fields
+}
+
+// sentinels are the errors whose messages are logged when errors are redacted
+var sentinels = []error{context.Canceled, context.DeadlineExceeded, sql.ErrNoRows, sql.ErrConnDone, sql.ErrTxDone}
+
+// AddSentinels adds errors with a fixed message, like the errors of dbmodel, to the errors Redact tells by their
+// message. It shall be called before logging.
+func AddSentinels(errs ...error) {
+	sentinels = append(sentinels, errs...)
+}
+
+// Redact describes err without customer data: by the message of the sentinel error it wraps, else by the type of
+// its cause like *pq.Error
+func Redact(err error) string {
+	for _, sentinel := range sentinels {
+		if errors.Is(err, sentinel) {
+			return sentinel.Error()
+		}
+	}
+	return fmt.Sprintf("%T", errors.Cause(err))
+}
+
+// EmailHash identifies an email in the logs without revealing it, emails differing only in case hash the same
+func EmailHash(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(sum[:])[:emailHashLength]
+}
+
+// CodePrefix is the part of a voucher code which is logged, at most half of it so the code cannot be redeemed from
+// the logs
+func CodePrefix(code string) string {
+	n := codePrefixLength
+	if n > len(code)/2 {
+		n = len(code) / 2
+	}
+	return code[:n]
+}
@@ -0,0 +1,169 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs a request through a router logging with cfg and returns the lines written
+func serve(t *testing.T, cfg Config, handler http.HandlerFunc) []map[string]interface{} {
+	var buf bytes.Buffer
+	l, err := New(&buf, cfg)
+	require.Nil(t, err)
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(l.Middleware)
+	r.Post("/vouchers/{code}", handler)
+	req := httptest.NewRequest("POST", "http://vouchers/vouchers/ABCDEFGH", nil)
+	req.Header.Set(middleware.RequestIDHeader, "req-1")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	var lines []map[string]interface{}
+	s := bufio.NewScanner(&buf)
+	for s.Scan() {
+		line := map[string]interface{}{}
+		require.Nil(t, json.Unmarshal(s.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestMiddleware(t *testing.T) {
+	var queried error
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		SetCustomer(r.Context(), "Customer0@gmail.com")
+		SetVouchers(r.Context(), chi.URLParam(r, "code"))
+		_, done := (*Logger)(nil).QueryHook()(r.Context(), "RedeemVoucher")
+		done(queried)
+		w.WriteHeader(http.StatusCreated)
+	}
+
+	lines := serve(t, Config{Level: "debug", Redact: true}, handler)
+	require.Len(t, lines, 2)
+	// the query is logged with the fields of its request
+	assert.Equal(t, "query", lines[0]["message"])
+	assert.Equal(t, "debug", lines[0]["level"])
+	assert.Equal(t, "RedeemVoucher", lines[0]["op"])
+	assert.Equal(t, "req-1", lines[0]["request_id"])
+	assert.Equal(t, EmailHash("customer0@gmail.com"), lines[0]["email_hash"])
+
+	access := lines[1]
+	assert.Equal(t, "request", access["message"])
+	assert.Equal(t, "info", access["level"])
+	assert.Equal(t, "req-1", access["request_id"])
+	assert.Equal(t, "/vouchers/{code}", access["route"])
+	assert.EqualValues(t, http.StatusCreated, access["status"])
+	assert.Equal(t, "ABCD", access["code_prefix"])
+	assert.Len(t, access["email_hash"], emailHashLength)
+	for _, field := range []string{"email", "code", "path"} {
+		assert.NotContains(t, access, field)
+	}
+
+	lines = serve(t, Config{Level: "info", Redact: false}, handler)
+	require.Len(t, lines, 1)
+	assert.Equal(t, "Customer0@gmail.com", lines[0]["email"])
+	assert.Equal(t, "ABCDEFGH", lines[0]["code"])
+	assert.Equal(t, "/vouchers/ABCDEFGH", lines[0]["path"])
+}
+
+func TestMiddlewareServerError(t *testing.T) {
+	handler := func(err error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			SetVouchers(r.Context(), "ABCDEFGH", "IJKLMNOP")
+			SetError(r.Context(), err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+	lines := serve(t, Config{Level: "info", Redact: true}, handler(errors.Wrapf(context.DeadlineExceeded, "fail to redeem voucher ABCDEFGH")))
+	require.Len(t, lines, 1)
+	assert.Equal(t, "error", lines[0]["level"])
+	// the message of the error holds the code, only its cause is logged
+	assert.NotContains(t, lines[0], "error")
+	assert.Equal(t, "context deadline exceeded", lines[0]["cause"])
+	assert.Equal(t, []interface{}{"ABCD", "IJKL"}, lines[0]["code_prefixes"])
+
+	lines = serve(t, Config{Level: "info", Redact: true}, handler(errors.Wrapf(errors.Errorf("invalid code %q", "ABCDEFGH"), "fail to redeem voucher")))
+	require.Len(t, lines, 1)
+	assert.Equal(t, "*errors.fundamental", lines[0]["cause"])
+
+	lines = serve(t, Config{Level: "info", Redact: false}, handler(errors.Wrapf(context.DeadlineExceeded, "fail to redeem voucher ABCDEFGH")))
+	require.Len(t, lines, 1)
+	assert.Equal(t, "fail to redeem voucher ABCDEFGH: context deadline exceeded", lines[0]["error"])
+	assert.Equal(t, "context deadline exceeded", lines[0]["cause"])
+}
+
+func TestMiddlewareQueryError(t *testing.T) {
+	pqErr := &pq.Error{Code: "23505", Constraint: "vouchers_code_key", Table: "vouchers", Detail: "Key (code)=(ABCDEFGH) already exists."}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		SetCustomer(r.Context(), "customer0@gmail.com")
+		_, done := (*Logger)(nil).QueryHook()(r.Context(), "GenerateVoucher")
+		err := errors.Wrapf(pqErr, "fail to insert voucher ABCDEFGH of customer0@gmail.com")
+		done(err)
+		SetError(r.Context(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	lines := serve(t, Config{Level: "info", Redact: true}, handler)
+	require.Len(t, lines, 1)
+	// the redacted line tells the failing query and the postgres error, but no email or code
+	assert.Equal(t, "GenerateVoucher", lines[0]["failed_op"])
+	assert.Equal(t, "*pq.Error", lines[0]["cause"])
+	assert.Equal(t, "23505", lines[0]["sqlstate"])
+	assert.Equal(t, "vouchers_code_key", lines[0]["constraint"])
+	assert.Equal(t, "vouchers", lines[0]["table"])
+	line, err := json.Marshal(lines[0])
+	require.Nil(t, err)
+	assert.NotContains(t, string(line), "customer0@gmail.com")
+	assert.NotContains(t, string(line), "ABCDEFGH")
+}
+
+func TestWithoutRequest(t *testing.T) {
+	// the fields are dropped outside of a request and a nil logger logs nothing
+	ctx := context.Background()
+	SetCustomer(ctx, "customer0@gmail.com")
+	SetError(ctx, errors.New("fail"))
+	var l *Logger
+	l.For(ctx).Error().Msg("nothing")
+	assert.NotNil(t, l.Middleware(http.NotFoundHandler()))
+
+	var buf bytes.Buffer
+	l, err := New(&buf, DefaultConfig)
+	require.Nil(t, err)
+	l.For(ctx).Debug().Msg("below the level")
+	l.For(ctx).Info().Msg("sweep")
+	assert.Contains(t, buf.String(), `"message":"sweep"`)
+	assert.NotContains(t, buf.String(), "below the level")
+}
+
+func TestRedaction(t *testing.T) {
+	assert.Equal(t, EmailHash("customer0@gmail.com"), EmailHash(" Customer0@Gmail.com"))
+	assert.NotEqual(t, EmailHash("customer0@gmail.com"), EmailHash("customer1@gmail.com"))
+	assert.Equal(t, "KOI-", CodePrefix("KOI-ABCD-EFGH"))
+	assert.Equal(t, "abc", CodePrefix("abcdefg"))
+	assert.Equal(t, "", CodePrefix("a"))
+
+	sentinel := errors.New("voucher not found")
+	err := errors.Wrapf(sentinel, "fail to find voucher ABCDEFGH of customer0@gmail.com")
+	assert.Equal(t, "*errors.fundamental", Redact(err))
+	AddSentinels(sentinel)
+	assert.Equal(t, "voucher not found", Redact(err))
+	assert.Equal(t, map[string]interface{}{"cause": "voucher not found"}, (*Logger)(nil).ErrorFields(err))
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.Nil(t, DefaultConfig.Validate())
+	assert.NotNil(t, Config{Level: "verbose"}.Validate())
+	_, err := New(&bytes.Buffer{}, Config{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,167 @@
+// Package metrics exposes the prometheus metrics of the voucher service: the voucher lifecycle, the HTTP requests per
+// route, the queries of the store and the code pool.
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/ingemar0720/voucher-pool/codepool"
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// OutcomeRedeemed is the outcome of a successful redemption, failed ones are counted by their error code
+const OutcomeRedeemed = "redeemed"
+
+// Metrics are registered on their own registry, so every instance can be scraped on its own. The recording methods
+// do nothing on a nil *Metrics.
+type Metrics struct {
+	registry    *prometheus.Registry
+	generated   *prometheus.CounterVec
+	redemptions *prometheus.CounterVec
+	requests    *prometheus.HistogramVec
+	queries     *prometheus.HistogramVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		generated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "voucher_generated_total",
+			Help: "Vouchers generated, by assignment and by single or bulk generation.",
+		}, []string{"assignment", "mode"}),
+		redemptions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "voucher_redemptions_total",
+			Help: "Redemption attempts by endpoint and outcome, redeemed or the error code of the rejection.",
+		}, []string{"endpoint", "outcome"}),
+		requests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Duration of the HTTP requests by method, chi route pattern and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		queries: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "db_query_duration_seconds",
+			Help:    "Duration of the operations of the postgres store by dbmodel function and result.",
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"op", "result"}),
+	}
+	m.registry.MustRegister(
+		m.generated,
+		m.redemptions,
+		m.requests,
+		m.queries,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics to prometheus
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// RegisterDB exposes the sql.DBStats of the connection pool of db as go_sql_* metrics
+func (m *Metrics) RegisterDB(db *sql.DB, name string) {
+	m.registry.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// RegisterCodePool exposes the depth and the counters of the code pool as codepool_* metrics, stats is read once per
+// scrape
+func (m *Metrics) RegisterCodePool(stats func() codepool.Stats) {
+	m.registry.MustRegister(codePoolCollector{stats: stats})
+}
+
+var (
+	codePoolDepth = prometheus.NewDesc("codepool_depth", "Codes left in the code pool.", nil, nil)
+	codePoolSize  = prometheus.NewDesc("codepool_size", "Capacity of the code pool.", nil, nil)
+	codePoolLow   = prometheus.NewDesc("codepool_low_water", "Depth below which the code pool is refilled.", nil, nil)
+	// counters of codepool.Stats by name
+	codePoolCounters = map[string]*prometheus.Desc{
+		"served":     prometheus.NewDesc("codepool_served_total", "Codes handed out from the code pool.", nil, nil),
+		"misses":     prometheus.NewDesc("codepool_misses_total", "Codes generated on demand because the code pool was empty.", nil, nil),
+		"generated":  prometheus.NewDesc("codepool_refilled_total", "Codes generated by the refill of the code pool.", nil, nil),
+		"duplicates": prometheus.NewDesc("codepool_duplicates_total", "Generated codes dropped because they were in the code pool already.", nil, nil),
+	}
+)
+
+// codePoolCollector collects the codepool_* metrics from the stats of the pool
+type codePoolCollector struct {
+	stats func() codepool.Stats
+}
+
+func (c codePoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- codePoolDepth
+	ch <- codePoolSize
+	ch <- codePoolLow
+	for _, desc := range codePoolCounters {
+		ch <- desc
+	}
+}
+
+func (c codePoolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.stats()
+	ch <- prometheus.MustNewConstMetric(codePoolDepth, prometheus.GaugeValue, float64(s.Depth))
+	ch <- prometheus.MustNewConstMetric(codePoolSize, prometheus.GaugeValue, float64(s.Size))
+	ch <- prometheus.MustNewConstMetric(codePoolLow, prometheus.GaugeValue, float64(s.LowWater))
+	for name, value := range map[string]uint64{"served": s.Served, "misses": s.Misses, "generated": s.Generated, "duplicates": s.Duplicates} {
+		ch <- prometheus.MustNewConstMetric(codePoolCounters[name], prometheus.CounterValue, float64(value))
+	}
+}
+
+// Generated counts n vouchers generated with the assignment, mode is single or bulk
+func (m *Metrics) Generated(assignment, mode string, n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.generated.WithLabelValues(assignment, mode).Add(float64(n))
+}
+
+// Redemption counts a redemption attempt at the endpoint, outcome is OutcomeRedeemed or the error code
+func (m *Metrics) Redemption(endpoint, outcome string) {
+	if m == nil {
+		return
+	}
+	m.redemptions.WithLabelValues(endpoint, outcome).Inc()
+}
+
+// Middleware observes the duration of the requests by chi route pattern, so path parameters like codes do not blow
+// up the number of series. Requests matching no route are observed as not_found.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r)
+		route := "not_found"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		m.requests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// QueryHook observes the duration of the operations of dbmodel.PostgresStore
+func (m *Metrics) QueryHook() dbmodel.QueryHook {
+	return func(ctx context.Context, op string) (context.Context, func(error)) {
+		start := time.Now()
+		return ctx, func(err error) {
+			result := "ok"
+			if err != nil {
+				result = "error"
+			}
+			m.queries.WithLabelValues(op, result).Observe(time.Since(start).Seconds())
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi"
+	"github.com/ingemar0720/voucher-pool/codepool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scrape returns the metrics like prometheus scrapes them
+func scrape(t *testing.T, m *Metrics) string {
+	server := httptest.NewServer(m.Handler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	m.Generated("customer", "single", 1)
+	m.Generated("customer", "bulk", 3)
+	m.Generated("public", "bulk", 0)
+	m.Redemption("validate", OutcomeRedeemed)
+	m.Redemption("validate", "voucher_expired")
+	m.Redemption("validate", "voucher_expired")
+
+	r := chi.NewRouter()
+	r.Use(m.Middleware)
+	r.Get("/vouchers/{code}/redemptions", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	for _, url := range []string{"/vouchers/abc/redemptions", "/vouchers/def/redemptions", "/healthz", "/unknown"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+
+	hook := m.QueryHook()
+	_, done := hook(context.Background(), "RedeemVoucher")
+	done(nil)
+	_, done = hook(context.Background(), "RedeemVoucher")
+	done(errors.New("connection reset"))
+
+	db, _, err := sqlmock.New()
+	require.Nil(t, err)
+	defer db.Close()
+	m.RegisterDB(db, "voucher")
+	m.RegisterCodePool(func() codepool.Stats {
+		return codepool.Stats{Depth: 240, Size: 1000, LowWater: 250, Served: 760, Misses: 2, Generated: 1000, Duplicates: 1}
+	})
+
+	body := scrape(t, m)
+	for _, line := range []string{
+		`voucher_generated_total{assignment="customer",mode="single"} 1`,
+		`voucher_generated_total{assignment="customer",mode="bulk"} 3`,
+		`voucher_redemptions_total{endpoint="validate",outcome="redeemed"} 1`,
+		`voucher_redemptions_total{endpoint="validate",outcome="voucher_expired"} 2`,
+		`http_request_duration_seconds_count{method="GET",route="/vouchers/{code}/redemptions",status="404"} 2`,
+		`http_request_duration_seconds_count{method="GET",route="/healthz",status="200"} 1`,
+		`http_request_duration_seconds_count{method="GET",route="not_found",status="404"} 1`,
+		`db_query_duration_seconds_count{op="RedeemVoucher",result="ok"} 1`,
+		`db_query_duration_seconds_count{op="RedeemVoucher",result="error"} 1`,
+		`go_sql_open_connections{db_name="voucher"}`,
+		`go_sql_max_open_connections{db_name="voucher"} 0`,
+		"codepool_depth 240",
+		"codepool_size 1000",
+		"codepool_low_water 250",
+		"codepool_served_total 760",
+		"codepool_misses_total 2",
+		"codepool_refilled_total 1000",
+		"codepool_duplicates_total 1",
+	} {
+		assert.Contains(t, body, line)
+	}
+	assert.NotContains(t, body, `assignment="public"`)
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.Generated("customer", "single", 1)
+	m.Redemption("validate", OutcomeRedeemed)
+}
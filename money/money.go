@@ -0,0 +1,156 @@
+package money
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PercentScale is the number of fraction digits of percentages, they are kept in hundredths of a percent (basis points)
+const PercentScale = 2
+
+// Currency is an ISO 4217 currency, Exponent is the number of fraction digits of its minor unit
+type Currency struct {
+	Code     string
+	Exponent int
+}
+
+// currencies supported for fixed amount discounts, https://en.wikipedia.org/wiki/ISO_4217
+var currencies = map[string]int{
+	"AED": 2, "AUD": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2, "CLP": 0, "CNY": 2, "CZK": 2, "DKK": 2,
+	"EUR": 2, "GBP": 2, "HKD": 2, "HUF": 2, "IDR": 2, "INR": 2, "ISK": 0, "JOD": 3, "JPY": 0, "KRW": 0,
+	"KWD": 3, "MXN": 2, "MYR": 2, "NOK": 2, "NZD": 2, "OMR": 3, "PHP": 2, "PLN": 2, "SAR": 2, "SEK": 2,
+	"SGD": 2, "THB": 2, "TND": 3, "TWD": 2, "USD": 2, "VND": 0, "ZAR": 2,
+}
+
+// LookupCurrency returns the currency of the upper case ISO 4217 code
+func LookupCurrency(code string) (Currency, error) {
+	exp, ok := currencies[code]
+	if !ok {
+		return Currency{}, errors.Errorf("unsupported currency %q", code)
+	}
+	return Currency{Code: code, Exponent: exp}, nil
+}
+
+// ParseDecimal parses a decimal number like "10.5" into an integer of scale fraction digits, e.g. 1050 for scale 2.
+// Numbers with more fraction digits than scale are rejected instead of rounded.
+func ParseDecimal(s string, scale int) (int64, error) {
+	neg := strings.HasPrefix(s, "-")
+	unsigned := strings.TrimPrefix(s, "-")
+	parts := strings.SplitN(unsigned, ".", 2)
+	whole := parts[0]
+	frac := ""
+	if len(parts) == 2 {
+		frac = strings.TrimRight(parts[1], "0")
+		if parts[1] == "" {
+			return 0, errors.Errorf("invalid decimal %q", s)
+		}
+	}
+	if whole == "" || !isDigits(whole) || !isDigits(frac) {
+		return 0, errors.Errorf("invalid decimal %q", s)
+	}
+	if len(frac) > scale {
+		return 0, errors.Errorf("decimal %q has more than %v fraction digits", s, scale)
+	}
+	v, err := strconv.ParseInt(whole+frac+strings.Repeat("0", scale-len(frac)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid decimal %q", s)
+	}
+	if neg {
+		v = -v
+	}
+	return v, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatDecimal formats v of scale fraction digits, e.g. "10.50" for 1050 and scale 2
+func FormatDecimal(v int64, scale int) string {
+	sign := ""
+	u := uint64(v)
+	if v < 0 {
+		sign = "-"
+		u = uint64(-v)
+	}
+	digits := strconv.FormatUint(u, 10)
+	if scale <= 0 {
+		return sign + digits
+	}
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+// TrimDecimal removes trailing fraction zeros of a formatted decimal, e.g. "38.5" for "38.50" and "10" for "10.00"
+func TrimDecimal(s string) string {
+	if !strings.Contains(s, ".") {
+		return s
+	}
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+// Percent returns basisPoints hundredths of a percent of amount rounded half up to the unit of amount,
+// and the exact result in ten thousandths of the unit of amount
+func Percent(amount, basisPoints int64) (int64, int64, error) {
+	if amount < 0 || basisPoints < 0 {
+		return 0, 0, errors.Errorf("percent of negative numbers, amount %v basis points %v", amount, basisPoints)
+	}
+	if basisPoints > 0 && amount > math.MaxInt64/basisPoints {
+		return 0, 0, errors.Errorf("amount %v is too large", amount)
+	}
+	exact := amount * basisPoints
+	return exact/10000 + (exact%10000)/5000, exact, nil
+}
+
+// Allocate splits total into parts proportional to weights, the parts are rounded down and the units left are
+// given to the parts with the largest remainders, so they always add up to total. total shall not exceed the sum of weights.
+func Allocate(total int64, weights []int64) ([]int64, error) {
+	var sum uint64
+	for _, w := range weights {
+		if w < 0 {
+			return nil, errors.Errorf("negative weight %v", w)
+		}
+		var carry uint64
+		sum, carry = bits.Add64(sum, uint64(w), 0)
+		if carry != 0 || sum > math.MaxInt64 {
+			return nil, errors.New("sum of weights is too large")
+		}
+	}
+	if total < 0 || uint64(total) > sum {
+		return nil, errors.Errorf("total %v shall be in [0, %v]", total, sum)
+	}
+	parts := make([]int64, len(weights))
+	if total == 0 {
+		return parts, nil
+	}
+	remainders := make([]uint64, len(weights))
+	left := total
+	for i, w := range weights {
+		hi, lo := bits.Mul64(uint64(total), uint64(w))
+		quo, rem := bits.Div64(hi, lo, sum)
+		parts[i] = int64(quo)
+		remainders[i] = rem
+		left -= parts[i]
+	}
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return remainders[order[a]] > remainders[order[b]] })
+	for _, i := range order[:left] {
+		parts[i]++
+	}
+	return parts, nil
+}
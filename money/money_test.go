@@ -0,0 +1,118 @@
+package money
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDecimal(t *testing.T) {
+	tests := []struct {
+		given   string
+		scale   int
+		want    int64
+		wantErr bool
+	}{
+		{given: "22.1", scale: 2, want: 2210},
+		{given: "38.50", scale: 2, want: 3850},
+		{given: "100", scale: 2, want: 10000},
+		{given: "0.01", scale: 2, want: 1},
+		{given: "10.500", scale: 2, want: 1050},
+		{given: "-1.5", scale: 2, want: -150},
+		{given: "1000", scale: 0, want: 1000},
+		{given: "1.234", scale: 3, want: 1234},
+		{given: "0.001", scale: 2, wantErr: true},
+		{given: "1.5", scale: 0, wantErr: true},
+		{given: "", scale: 2, wantErr: true},
+		{given: ".5", scale: 2, wantErr: true},
+		{given: "5.", scale: 2, wantErr: true},
+		{given: "1e3", scale: 2, wantErr: true},
+		{given: "abc", scale: 2, wantErr: true},
+		{given: "99999999999999999999", scale: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.given, func(t *testing.T) {
+			got, err := ParseDecimal(tt.given, tt.scale)
+			assert.Equal(t, tt.wantErr, err != nil, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFormatDecimal(t *testing.T) {
+	assert.Equal(t, "38.50", FormatDecimal(3850, 2))
+	assert.Equal(t, "0.01", FormatDecimal(1, 2))
+	assert.Equal(t, "0.00", FormatDecimal(0, 2))
+	assert.Equal(t, "-1.50", FormatDecimal(-150, 2))
+	assert.Equal(t, "1000", FormatDecimal(1000, 0))
+	assert.Equal(t, "1.234", FormatDecimal(1234, 3))
+
+	assert.Equal(t, "38.5", TrimDecimal("38.50"))
+	assert.Equal(t, "10", TrimDecimal("10.00"))
+	assert.Equal(t, "1000", TrimDecimal("1000"))
+}
+
+func TestLookupCurrency(t *testing.T) {
+	c, err := LookupCurrency("EUR")
+	assert.Nil(t, err)
+	assert.Equal(t, Currency{Code: "EUR", Exponent: 2}, c)
+	c, err = LookupCurrency("JPY")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, c.Exponent)
+	_, err = LookupCurrency("eur")
+	assert.NotNil(t, err)
+	_, err = LookupCurrency("XXX")
+	assert.NotNil(t, err)
+}
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		amount, basisPoints int64
+		want, wantExact     int64
+		wantErr             bool
+	}{
+		{amount: 10000, basisPoints: 3850, want: 3850, wantExact: 38500000},
+		{amount: 1999, basisPoints: 1000, want: 200, wantExact: 1999000},
+		{amount: 1001, basisPoints: 5000, want: 501, wantExact: 5005000},
+		{amount: 1001, basisPoints: 4999, want: 500, wantExact: 5003999},
+		{amount: 123, basisPoints: 10000, want: 123, wantExact: 1230000},
+		{amount: 0, basisPoints: 3850},
+		{amount: math.MaxInt64, basisPoints: 2, wantErr: true},
+		{amount: -1, basisPoints: 100, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, exact, err := Percent(tt.amount, tt.basisPoints)
+		assert.Equal(t, tt.wantErr, err != nil, err)
+		assert.Equal(t, tt.want, got)
+		assert.Equal(t, tt.wantExact, exact)
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   int64
+		weights []int64
+		want    []int64
+		wantErr bool
+	}{
+		{name: "even", total: 300, weights: []int64{100, 200, 300}, want: []int64{50, 100, 150}},
+		{name: "largest remainder", total: 100, weights: []int64{100, 100, 100}, want: []int64{34, 33, 33}},
+		{name: "remainders by size", total: 10, weights: []int64{3, 5, 7}, want: []int64{2, 3, 5}},
+		{name: "zero weight", total: 5, weights: []int64{0, 10}, want: []int64{0, 5}},
+		{name: "all of the weights", total: 15, weights: []int64{3, 5, 7}, want: []int64{3, 5, 7}},
+		{name: "nothing", total: 0, weights: []int64{0, 0}, want: []int64{0, 0}},
+		{name: "large", total: math.MaxInt64 / 2, weights: []int64{math.MaxInt64 / 2, math.MaxInt64 / 2}, want: []int64{math.MaxInt64/4 + 1, math.MaxInt64 / 4}},
+		{name: "more than the weights", total: 16, weights: []int64{3, 5, 7}, wantErr: true},
+		{name: "negative weight", total: 1, weights: []int64{-1, 5}, wantErr: true},
+		{name: "weights overflow", total: 1, weights: []int64{math.MaxInt64, 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Allocate(tt.total, tt.weights)
+			assert.Equal(t, tt.wantErr, err != nil, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,332 @@
+// Package rules evaluates the eligibility rules of special offers against an order. Rules are data, they are kept as
+// JSON on the offer so they can be configured without deploys.
+package rules
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/money"
+	"github.com/pkg/errors"
+)
+
+type Type string
+
+const (
+	// the amount of the order shall be at least Amount of Currency
+	TypeMinAmount Type = "min_amount"
+	// the order shall contain an item of one of SKUs
+	TypeSKU Type = "sku"
+	// the order shall contain an item of one of Categories
+	TypeCategory Type = "category"
+	// the order shall be the first one of the customer
+	TypeFirstOrder Type = "first_order"
+	// the order shall be placed through one of Channels
+	TypeChannel Type = "channel"
+	// the order shall be placed on one of Days, between From and To, in TimeZone
+	TypeSchedule Type = "schedule"
+)
+
+// clock time of From and To of schedules
+const clockLayout = "15:04"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Rule is a condition the order shall meet, only the fields of its Type apply
+type Rule struct {
+	Type Type `json:"type"`
+	// min_amount, Amount is a decimal in major units of Currency
+	Amount   json.Number `json:"amount,omitempty"`
+	Currency string      `json:"currency,omitempty"`
+	// sku, category and channel, one of the values shall match
+	SKUs       []string `json:"skus,omitempty"`
+	Categories []string `json:"categories,omitempty"`
+	Channels   []string `json:"channels,omitempty"`
+	// schedule, Days are mon to sun and every day if empty. From and To are clock times like 09:00, To is excluded
+	// and before From if the window spans midnight. TimeZone is an IANA time zone, UTC if empty.
+	Days     []string `json:"days,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       string   `json:"to,omitempty"`
+	TimeZone string   `json:"time_zone,omitempty"`
+}
+
+// Set is the rules of an offer, an order is eligible if it meets all of them. It is stored as a JSON array.
+type Set []Rule
+
+// Item is a line of the order
+type Item struct {
+	SKU      string
+	Category string
+}
+
+// Order is what the rules are evaluated against, Amount is in minor units of Currency. Currency is empty if the
+// amount of the order is not known.
+type Order struct {
+	Currency string
+	Amount   int64
+	Items    []Item
+	Channel  string
+	// PreviousOrders is the number of orders the customer placed before, nil if not known
+	PreviousOrders *int
+}
+
+// Failure tells which rule the order does not meet, Index is the position of the rule in its Set
+type Failure struct {
+	Index   int
+	Type    Type
+	Message string
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("rule %v (%v) failed: %v", f.Index, f.Type, f.Message)
+}
+
+// Validate checks the rules can be evaluated, it is run before the rules are stored
+func (s Set) Validate() error {
+	for i, r := range s {
+		if err := r.validate(); err != nil {
+			return errors.Wrapf(err, "rule %v", i)
+		}
+	}
+	return nil
+}
+
+func (r Rule) validate() error {
+	switch r.Type {
+	case TypeMinAmount:
+		_, _, err := r.minAmount()
+		return err
+	case TypeSKU:
+		return nonEmpty("skus", r.SKUs)
+	case TypeCategory:
+		return nonEmpty("categories", r.Categories)
+	case TypeChannel:
+		return nonEmpty("channels", r.Channels)
+	case TypeFirstOrder:
+		return nil
+	case TypeSchedule:
+		_, err := r.schedule()
+		return err
+	default:
+		return errors.Errorf("unknown rule type %q", r.Type)
+	}
+}
+
+func nonEmpty(field string, values []string) error {
+	if len(values) == 0 {
+		return errors.Errorf("%v shall not be empty", field)
+	}
+	return nil
+}
+
+// minAmount returns the currency and the minimum amount in its minor units
+func (r Rule) minAmount() (money.Currency, int64, error) {
+	c, err := money.LookupCurrency(strings.ToUpper(r.Currency))
+	if err != nil {
+		return money.Currency{}, 0, errors.New("currency shall be a supported ISO 4217 code")
+	}
+	amount, err := money.ParseDecimal(r.Amount.String(), c.Exponent)
+	if err != nil || amount <= 0 {
+		return money.Currency{}, 0, errors.Errorf("amount shall be a positive amount of %v with at most %v decimal places", c.Code, c.Exponent)
+	}
+	return c, amount, nil
+}
+
+// window is a parsed schedule rule, from and to are minutes of the day
+type window struct {
+	days     map[time.Weekday]bool
+	from, to int
+	clock    bool
+	location *time.Location
+}
+
+func (r Rule) schedule() (window, error) {
+	w := window{location: time.UTC}
+	if len(r.Days) > 0 {
+		w.days = make(map[time.Weekday]bool, len(r.Days))
+		for _, d := range r.Days {
+			day, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return window{}, errors.Errorf("day %q shall be one of mon, tue, wed, thu, fri, sat, sun", d)
+			}
+			w.days[day] = true
+		}
+	}
+	if (r.From == "") != (r.To == "") {
+		return window{}, errors.New("from and to shall be given together")
+	}
+	if r.From != "" {
+		from, err := time.Parse(clockLayout, r.From)
+		if err != nil {
+			return window{}, errors.Errorf("from shall be a clock time like 09:00")
+		}
+		to, err := time.Parse(clockLayout, r.To)
+		if err != nil {
+			return window{}, errors.Errorf("to shall be a clock time like 17:00")
+		}
+		if from.Equal(to) {
+			return window{}, errors.New("from and to shall differ")
+		}
+		w.clock = true
+		w.from, w.to = from.Hour()*60+from.Minute(), to.Hour()*60+to.Minute()
+	}
+	if w.days == nil && !w.clock {
+		return window{}, errors.New("days or from and to shall be given")
+	}
+	if r.TimeZone != "" {
+		loc, err := time.LoadLocation(r.TimeZone)
+		if err != nil {
+			return window{}, errors.Errorf("time_zone %q is unknown", r.TimeZone)
+		}
+		w.location = loc
+	}
+	return w, nil
+}
+
+func (w window) contains(t time.Time) bool {
+	t = t.In(w.location)
+	if w.days != nil && !w.days[t.Weekday()] {
+		return false
+	}
+	if !w.clock {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	if w.from < w.to {
+		return m >= w.from && m < w.to
+	}
+	// the window spans midnight
+	return m >= w.from || m < w.to
+}
+
+// Evaluate returns a *Failure for the first rule the order placed at now does not meet, nil if it meets all of them
+func (s Set) Evaluate(o Order, now time.Time) error {
+	for i, r := range s {
+		if msg := r.evaluate(o, now); msg != "" {
+			return &Failure{Index: i, Type: r.Type, Message: msg}
+		}
+	}
+	return nil
+}
+
+// evaluate returns why the order does not meet the rule, empty if it does
+func (r Rule) evaluate(o Order, now time.Time) string {
+	switch r.Type {
+	case TypeMinAmount:
+		c, min, err := r.minAmount()
+		if err != nil {
+			return err.Error()
+		}
+		if o.Currency == "" {
+			return "the amount of the order shall be given"
+		}
+		if o.Currency != c.Code {
+			return fmt.Sprintf("the order shall be in %v", c.Code)
+		}
+		if o.Amount < min {
+			return fmt.Sprintf("the amount of the order shall be at least %v %v", money.FormatDecimal(min, c.Exponent), c.Code)
+		}
+	case TypeSKU:
+		for _, item := range o.Items {
+			if contains(r.SKUs, item.SKU) {
+				return ""
+			}
+		}
+		return fmt.Sprintf("the order shall contain an item of sku %v", strings.Join(r.SKUs, ", "))
+	case TypeCategory:
+		for _, item := range o.Items {
+			if contains(r.Categories, item.Category) {
+				return ""
+			}
+		}
+		return fmt.Sprintf("the order shall contain an item of category %v", strings.Join(r.Categories, ", "))
+	case TypeChannel:
+		if !contains(r.Channels, o.Channel) {
+			return fmt.Sprintf("the order shall be placed through %v", strings.Join(r.Channels, ", "))
+		}
+	case TypeFirstOrder:
+		if o.PreviousOrders == nil {
+			return "the number of previous orders of the customer shall be given"
+		}
+		if *o.PreviousOrders > 0 {
+			return "only the first order of a customer is eligible"
+		}
+	case TypeSchedule:
+		w, err := r.schedule()
+		if err != nil {
+			return err.Error()
+		}
+		if !w.contains(now) {
+			return "the order is placed outside of the schedule of the offer"
+		}
+	default:
+		return fmt.Sprintf("unknown rule type %q", r.Type)
+	}
+	return ""
+}
+
+// contains matches values case-insensitively, SKUs, categories and channels are names given by marketing
+func contains(values []string, v string) bool {
+	if v == "" {
+		return false
+	}
+	for _, value := range values {
+		if strings.EqualFold(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy returns a copy of the rules sharing no memory with s, empty rather than nil as they are read from the database
+func (s Set) Copy() Set {
+	c := make(Set, len(s))
+	for i, r := range s {
+		r.SKUs = append([]string(nil), r.SKUs...)
+		r.Categories = append([]string(nil), r.Categories...)
+		r.Channels = append([]string(nil), r.Channels...)
+		r.Days = append([]string(nil), r.Days...)
+		c[i] = r
+	}
+	return c
+}
+
+// Value stores the rules as a JSON array, nil as an empty one
+func (s Set) Value() (driver.Value, error) {
+	if s == nil {
+		return []byte("[]"), nil
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to marshal rules")
+	}
+	return b, nil
+}
+
+// Scan reads the rules from a JSON array
+func (s *Set) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	case nil:
+		*s = Set{}
+		return nil
+	default:
+		return errors.Errorf("fail to scan rules of type %T", src)
+	}
+	rules := Set{}
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return errors.Wrapf(err, "fail to unmarshal rules")
+	}
+	*s = rules
+	return nil
+}
@@ -0,0 +1,196 @@
+package rules
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		given   Set
+		wantErr bool
+	}{
+		{name: "no rules"},
+		{name: "all types", given: Set{
+			{Type: TypeMinAmount, Amount: "20", Currency: "eur"},
+			{Type: TypeSKU, SKUs: []string{"TEA-1"}},
+			{Type: TypeCategory, Categories: []string{"tea"}},
+			{Type: TypeFirstOrder},
+			{Type: TypeChannel, Channels: []string{"web"}},
+			{Type: TypeSchedule, Days: []string{"Mon"}, From: "22:00", To: "02:00", TimeZone: "Europe/Berlin"},
+		}},
+		{name: "unknown type", given: Set{{Type: "weather"}}, wantErr: true},
+		{name: "min amount without currency", given: Set{{Type: TypeMinAmount, Amount: "20"}}, wantErr: true},
+		{name: "min amount too precise", given: Set{{Type: TypeMinAmount, Amount: "20.001", Currency: "EUR"}}, wantErr: true},
+		{name: "min amount of yen", given: Set{{Type: TypeMinAmount, Amount: "1000", Currency: "JPY"}}},
+		{name: "sku without skus", given: Set{{Type: TypeSKU}}, wantErr: true},
+		{name: "empty schedule", given: Set{{Type: TypeSchedule}}, wantErr: true},
+		{name: "unknown day", given: Set{{Type: TypeSchedule, Days: []string{"someday"}}}, wantErr: true},
+		{name: "from without to", given: Set{{Type: TypeSchedule, From: "09:00"}}, wantErr: true},
+		{name: "invalid clock", given: Set{{Type: TypeSchedule, From: "9am", To: "17:00"}}, wantErr: true},
+		{name: "unknown time zone", given: Set{{Type: TypeSchedule, Days: []string{"mon"}, TimeZone: "Mars/Olympus"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.given.Validate()
+			assert.Equal(t, tt.wantErr, err != nil, err)
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	// a Monday
+	monday := time.Date(2021, time.August, 16, 10, 30, 0, 0, time.UTC)
+	one, none := 1, 0
+	order := Order{
+		Currency: "EUR",
+		Amount:   2500,
+		Items:    []Item{{SKU: "TEA-1", Category: "tea"}, {SKU: "CAKE-1", Category: "cake"}},
+		Channel:  "web",
+	}
+	tests := []struct {
+		name      string
+		given     Set
+		order     Order
+		now       time.Time
+		wantIndex int
+		wantType  Type
+		wantMsg   string
+	}{
+		{name: "no rules", order: order, now: monday, wantIndex: -1},
+		{name: "all met", given: Set{
+			{Type: TypeMinAmount, Amount: "25", Currency: "EUR"},
+			{Type: TypeSKU, SKUs: []string{"cake-1"}},
+			{Type: TypeCategory, Categories: []string{"coffee", "tea"}},
+			{Type: TypeChannel, Channels: []string{"app", "web"}},
+			{Type: TypeSchedule, Days: []string{"mon", "tue"}, From: "09:00", To: "17:00"},
+		}, order: order, now: monday, wantIndex: -1},
+		{
+			name:      "amount too low",
+			given:     Set{{Type: TypeMinAmount, Amount: "25.01", Currency: "EUR"}},
+			order:     order,
+			now:       monday,
+			wantIndex: 0,
+			wantType:  TypeMinAmount,
+			wantMsg:   "the amount of the order shall be at least 25.01 EUR",
+		},
+		{
+			name:      "other currency",
+			given:     Set{{Type: TypeMinAmount, Amount: "10", Currency: "USD"}},
+			order:     order,
+			now:       monday,
+			wantIndex: 0,
+			wantType:  TypeMinAmount,
+			wantMsg:   "the order shall be in USD",
+		},
+		{
+			name:      "amount not given",
+			given:     Set{{Type: TypeMinAmount, Amount: "10", Currency: "EUR"}},
+			now:       monday,
+			wantIndex: 0,
+			wantType:  TypeMinAmount,
+			wantMsg:   "the amount of the order shall be given",
+		},
+		{
+			name:      "second rule fails",
+			given:     Set{{Type: TypeChannel, Channels: []string{"web"}}, {Type: TypeCategory, Categories: []string{"coffee"}}},
+			order:     order,
+			now:       monday,
+			wantIndex: 1,
+			wantType:  TypeCategory,
+			wantMsg:   "the order shall contain an item of category coffee",
+		},
+		{
+			name:      "sku missing",
+			given:     Set{{Type: TypeSKU, SKUs: []string{"COFFEE-1"}}},
+			order:     order,
+			now:       monday,
+			wantIndex: 0,
+			wantType:  TypeSKU,
+			wantMsg:   "the order shall contain an item of sku COFFEE-1",
+		},
+		{
+			name:      "other channel",
+			given:     Set{{Type: TypeChannel, Channels: []string{"store"}}},
+			order:     order,
+			now:       monday,
+			wantIndex: 0,
+			wantType:  TypeChannel,
+			wantMsg:   "the order shall be placed through store",
+		},
+		{
+			name:      "first order unknown",
+			given:     Set{{Type: TypeFirstOrder}},
+			order:     order,
+			now:       monday,
+			wantIndex: 0,
+			wantType:  TypeFirstOrder,
+			wantMsg:   "the number of previous orders of the customer shall be given",
+		},
+		{
+			name:      "not the first order",
+			given:     Set{{Type: TypeFirstOrder}},
+			order:     Order{PreviousOrders: &one},
+			now:       monday,
+			wantIndex: 0,
+			wantType:  TypeFirstOrder,
+			wantMsg:   "only the first order of a customer is eligible",
+		},
+		{name: "first order", given: Set{{Type: TypeFirstOrder}}, order: Order{PreviousOrders: &none}, now: monday, wantIndex: -1},
+		{
+			name:      "other day",
+			given:     Set{{Type: TypeSchedule, Days: []string{"sat", "sun"}}},
+			now:       monday,
+			wantIndex: 0,
+			wantType:  TypeSchedule,
+			wantMsg:   "the order is placed outside of the schedule of the offer",
+		},
+		{
+			name:      "after hours",
+			given:     Set{{Type: TypeSchedule, From: "09:00", To: "10:30"}},
+			now:       monday,
+			wantIndex: 0,
+			wantType:  TypeSchedule,
+			wantMsg:   "the order is placed outside of the schedule of the offer",
+		},
+		// 10:30 UTC is 12:30 in Berlin in summer
+		{name: "in time zone", given: Set{{Type: TypeSchedule, From: "12:00", To: "13:00", TimeZone: "Europe/Berlin"}}, now: monday, wantIndex: -1},
+		{name: "over midnight", given: Set{{Type: TypeSchedule, From: "22:00", To: "02:00"}}, now: monday.Add(15 * time.Hour), wantIndex: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.given.Evaluate(tt.order, tt.now)
+			if tt.wantIndex < 0 {
+				assert.Nil(t, err)
+				return
+			}
+			f, ok := err.(*Failure)
+			require.True(t, ok, err)
+			assert.Equal(t, tt.wantIndex, f.Index)
+			assert.Equal(t, tt.wantType, f.Type)
+			assert.Equal(t, tt.wantMsg, f.Message)
+		})
+	}
+}
+
+func TestScanValue(t *testing.T) {
+	var s Set
+	v, err := s.Value()
+	require.Nil(t, err)
+	assert.Equal(t, []byte("[]"), v)
+
+	given := `[{"type":"min_amount","amount":20.00,"currency":"EUR"},{"type":"first_order"}]`
+	require.Nil(t, s.Scan([]byte(given)))
+	assert.Equal(t, Set{{Type: TypeMinAmount, Amount: json.Number("20.00"), Currency: "EUR"}, {Type: TypeFirstOrder}}, s)
+	v, err = s.Value()
+	require.Nil(t, err)
+	assert.JSONEq(t, given, string(v.([]byte)))
+
+	assert.NotNil(t, s.Scan(123))
+	assert.NotNil(t, s.Scan("{"))
+}
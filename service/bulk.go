@@ -0,0 +1,348 @@
+package voucher
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/pkg/errors"
+)
+
+const (
+	// number of vouchers inserted per transaction
+	defaultBulkBatchSize = 500
+	// finished bulk jobs are kept for polling this long
+	bulkJobRetention = 24 * time.Hour
+)
+
+// status of a recipient in BulkResult
+const (
+	BulkCreated         = "created"
+	BulkInvalidEmail    = "invalid_email"
+	BulkUnknownCustomer = "unknown_customer"
+	BulkDuplicateEmail  = "duplicate_email"
+	BulkFailed          = "failed"
+	// the batch of the recipient failed or was not reached, no voucher was generated for it
+	BulkNotProcessed = "not_processed"
+)
+
+// status of a BulkJob
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+type CustomerFilterRequest struct {
+	EmailDomain string `json:"email_domain"`
+}
+
+// BulkGenerateRequest generates a voucher of the offer for every email of Emails, or for every customer matching Filter
+type BulkGenerateRequest struct {
+	Emails []string               `json:"emails"`
+	Filter *CustomerFilterRequest `json:"filter"`
+	// OfferID, OfferName, Discount, DiscountType and Currency are the same as of GenerateRequest
+	OfferID      uint64      `json:"offer_id"`
+	OfferName    string      `json:"offer_name"`
+	Discount     json.Number `json:"discount"`
+	DiscountType string      `json:"discount_type"`
+	Currency     string      `json:"currency"`
+	Expiry       time.Time   `json:"expiry"`
+	// MaxRedemptions and MaxPerCustomer are the same as of GenerateRequest
+	MaxRedemptions int `json:"max_redemptions"`
+	MaxPerCustomer int `json:"max_per_customer"`
+	// return a job id to poll instead of waiting for the vouchers
+	Async bool `json:"async"`
+}
+
+type BulkResult struct {
+	Email  string `json:"email"`
+	Status string `json:"status"`
+	Code   string `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BulkGenerateResponse struct {
+	Created       int          `json:"created"`
+	UnknownEmails []string     `json:"unknown_emails"`
+	Results       []BulkResult `json:"results"`
+	// Error tells why the generation stopped, the vouchers of Results created before are kept
+	Error *ErrorResponse `json:"error,omitempty"`
+}
+
+type BulkJob struct {
+	ID        string `json:"job_id"`
+	Status    string `json:"status"`
+	Total     int    `json:"total"`
+	Processed int    `json:"processed"`
+	// Error tells why the job failed like the message of ErrorResponse, the log line of the job tells more
+	Error  string                `json:"error,omitempty"`
+	Result *BulkGenerateResponse `json:"result,omitempty"`
+
+	finishedAt time.Time
+}
+
+// bulkJobs keeps the async bulk jobs of this process
+type bulkJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*BulkJob
+}
+
+func (j *bulkJobs) add(total int) (*BulkJob, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to generate job id")
+	}
+	job := &BulkJob{ID: id, Status: JobRunning, Total: total}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.jobs == nil {
+		j.jobs = map[string]*BulkJob{}
+	}
+	for id, old := range j.jobs {
+		if old.Status != JobRunning && time.Since(old.finishedAt) > bulkJobRetention {
+			delete(j.jobs, id)
+		}
+	}
+	j.jobs[job.ID] = job
+	return job, nil
+}
+
+// get returns a copy of the job, so it can be encoded while the job is running
+func (j *bulkJobs) get(id string) (BulkJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	if !ok {
+		return BulkJob{}, false
+	}
+	return *job, true
+}
+
+func (j *bulkJobs) update(job *BulkJob, f func(job *BulkJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f(job)
+}
+
+// BulkGenerateHandler generates vouchers of one offer for many customers. Vouchers are inserted in batches,
+// one transaction per batch. In async mode it returns 202 with a job to poll at GET /vouchers/generate/bulk/{jobID}.
+func (srv *VoucherSrv) BulkGenerateHandler(w http.ResponseWriter, r *http.Request) {
+	br := BulkGenerateRequest{}
+	err := json.NewDecoder(r.Body).Decode(&br)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+
+	//validate input
+	if (br.Filter == nil) == (len(br.Emails) == 0) {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, "either emails or filter shall be given")
+		return
+	}
+	terms, msg := validateOffer(br.OfferID, br.OfferName, br.DiscountType, br.Discount, br.Currency, br.Expiry, br.MaxRedemptions, br.MaxPerCustomer)
+	if msg != "" {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, msg)
+		return
+	}
+
+	recipients := br.Emails
+	if br.Filter != nil {
+		recipients, err = srv.Store.ListCustomerEmails(r.Context(), dbmodel.CustomerFilter{EmailDomain: br.Filter.EmailDomain})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	if !br.Async {
+		resp, err := srv.bulkGenerate(r.Context(), terms, recipients, func(int) {})
+		status := http.StatusCreated
+		if err != nil {
+			// the recipients of the batches committed before keep their vouchers, they are told by the results
+			var failure ErrorResponse
+			status, failure = requestErrorResponse(r, err)
+			logFailure(r, status, err)
+			resp.Error = &failure
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	job, err := srv.jobs.add(len(recipients))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// the job outlives the request, it stops at the next batch once the service stops
+	log := srv.Log.For(r.Context()).With().Str("job_id", job.ID).Logger()
+	srv.jobsRunning.Add(1)
+	go func() {
+		defer srv.jobsRunning.Done()
+		resp, err := srv.bulkGenerate(srv.Ctx, terms, recipients, func(processed int) {
+			srv.jobs.update(job, func(job *BulkJob) { job.Processed = processed })
+		})
+		srv.jobs.update(job, func(job *BulkJob) {
+			job.finishedAt = time.Now()
+			job.Result = resp
+			if err != nil {
+				log.Error().Fields(srv.Log.ErrorFields(err)).Msg("bulk job failed")
+				job.Status = JobFailed
+				_, resp := errorResponse(err)
+				job.Error = resp.Message
+				return
+			}
+			job.Status = JobDone
+		})
+	}()
+	snapshot, _ := srv.jobs.get(job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// WaitBulkJobs waits for the async bulk jobs, they stop at their next batch once Ctx is cancelled
+func (srv *VoucherSrv) WaitBulkJobs() {
+	srv.jobsRunning.Wait()
+}
+
+// GetBulkJobHandler returns the progress of an async bulk job, and its results once done
+func (srv *VoucherSrv) GetBulkJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := srv.jobs.get(chi.URLParam(r, "jobID"))
+	if !ok {
+		writeErrorResponse(w, http.StatusNotFound, CodeJobNotFound, "bulk job not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job)
+}
+
+// bulkGenerate generates the vouchers batch by batch, progress is called with the number of recipients processed
+// after every batch. Errors of a batch abort the remaining batches, batches committed before are kept. The results are
+// returned with the error, the recipients of the failed and the remaining batches are BulkNotProcessed.
+func (srv *VoucherSrv) bulkGenerate(ctx context.Context, terms offerTerms, recipients []string, progress func(int)) (*BulkGenerateResponse, error) {
+	batchSize := srv.BulkBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBulkBatchSize
+	}
+	resp := &BulkGenerateResponse{UnknownEmails: []string{}, Results: make([]BulkResult, len(recipients))}
+	seen := make(map[string]bool, len(recipients))
+	var err error
+	for start := 0; start < len(recipients); start += batchSize {
+		if err = ctx.Err(); err != nil {
+			err = errors.Wrapf(err, "bulk generation stopped after %v recipients", start)
+			break
+		}
+		end := start + batchSize
+		if end > len(recipients) {
+			end = len(recipients)
+		}
+		var emails []string
+		for i := start; i < end; i++ {
+			email, err := parseEmail(recipients[i])
+			if err != nil {
+				resp.Results[i].Email = recipients[i]
+				resp.Results[i].Status = BulkInvalidEmail
+				resp.Results[i].Error = err.Error()
+				continue
+			}
+			resp.Results[i].Email = email
+			if seen[email] {
+				resp.Results[i].Status = BulkDuplicateEmail
+				continue
+			}
+			seen[email] = true
+			emails = append(emails, email)
+		}
+		if len(emails) > 0 {
+			if err = srv.generateBatch(ctx, terms, emails, resp.Results[start:end]); err != nil {
+				break
+			}
+		}
+		progress(end)
+	}
+	for i := range resp.Results {
+		result := &resp.Results[i]
+		switch result.Status {
+		case BulkCreated:
+			resp.Created++
+		case BulkUnknownCustomer:
+			resp.UnknownEmails = append(resp.UnknownEmails, result.Email)
+		case "":
+			if result.Email == "" {
+				result.Email = recipients[i]
+			}
+			result.Status = BulkNotProcessed
+		}
+	}
+	return resp, err
+}
+
+// generateBatch inserts the vouchers of emails in one transaction, results of the batch are filled by email
+func (srv *VoucherSrv) generateBatch(ctx context.Context, terms offerTerms, emails []string, results []BulkResult) error {
+	ids, err := srv.Store.GetCustomerIDsByEmails(ctx, emails)
+	if err != nil {
+		return err
+	}
+	pending := map[string]int{}
+	for i := range results {
+		if results[i].Status != "" {
+			continue
+		}
+		if _, ok := ids[results[i].Email]; !ok {
+			results[i].Status = BulkUnknownCustomer
+			continue
+		}
+		pending[results[i].Email] = i
+	}
+
+	gen := srv.codeGenerator()
+	for attempt := 0; attempt < srv.codeAttempts() && len(pending) > 0; attempt++ {
+		// index+1 of the result by code, 0 means the code is not in the batch
+		byCode := make(map[string]int, len(pending))
+		vouchers := make([]dbmodel.DBModelVoucher, 0, len(pending))
+		for email, i := range pending {
+			code, err := gen.Generate()
+			// codes shall be unique within the batch to tell which of them conflict
+			for err == nil && byCode[code] != 0 {
+				code, err = gen.Generate()
+			}
+			if err != nil {
+				return err
+			}
+			byCode[code] = i + 1
+			vouchers = append(vouchers, dbmodel.DBModelVoucher{Code: code, CustomerID: ids[email], ExpiryDate: terms.Expiry})
+		}
+		conflicts, err := srv.Store.InsertVouchers(ctx, terms.ref(), terms.Limits, vouchers)
+		if err != nil {
+			return err
+		}
+		conflicted := make(map[string]bool, len(conflicts))
+		for _, code := range conflicts {
+			conflicted[code] = true
+		}
+		pending = map[string]int{}
+		for _, v := range vouchers {
+			i := byCode[v.Code] - 1
+			if conflicted[v.Code] {
+				pending[results[i].Email] = i
+				continue
+			}
+			results[i].Status = BulkCreated
+			results[i].Code = v.Code
+		}
+		srv.Metrics.Generated(string(dbmodel.AssignmentCustomer), "bulk", len(vouchers)-len(conflicts))
+	}
+	for _, i := range pending {
+		results[i].Status = BulkFailed
+		results[i].Error = dbmodel.ErrCodeConflict.Error()
+	}
+	return nil
+}
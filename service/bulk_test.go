@@ -0,0 +1,151 @@
+package voucher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bulkRequestBody(fields string) []byte {
+	tomorrow := time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+	return []byte(`{"offer_name": "summer", "discount": 15, "expiry": "` + tomorrow + `", ` + fields + `}`)
+}
+
+func (suite *TestSuite) TestBulkGenerateHandler() {
+	resp, body := httpTestHelper("POST", "http://vouchers/generate/bulk", bytes.NewBuffer(bulkRequestBody(`"emails": []`)), suite.srv, suite.srv.BulkGenerateHandler)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"either emails or filter shall be given"}`+"\n", string(body))
+
+	suite.srv.BulkBatchSize = 2
+	resp, body = httpTestHelper("POST", "http://vouchers/generate/bulk", bytes.NewBuffer(bulkRequestBody(
+		`"emails": ["customer0@gmail.com", "unknown@gmail.com", "invalid_email", "customer0@gmail.com", "customer1@gmail.com"]`)), suite.srv, suite.srv.BulkGenerateHandler)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	br := BulkGenerateResponse{}
+	assert.Nil(suite.T(), json.Unmarshal(body, &br))
+	assert.EqualValues(suite.T(), 2, br.Created)
+	assert.EqualValues(suite.T(), []string{"unknown@gmail.com"}, br.UnknownEmails)
+	statuses := []string{}
+	for _, result := range br.Results {
+		statuses = append(statuses, result.Status)
+	}
+	assert.EqualValues(suite.T(), []string{BulkCreated, BulkUnknownCustomer, BulkInvalidEmail, BulkDuplicateEmail, BulkCreated}, statuses)
+
+	codes, names, _, err := suite.srv.Store.GetVouchers(suite.srv.Ctx, "customer0@gmail.com")
+	assert.Nil(suite.T(), err)
+	assert.EqualValues(suite.T(), []string{br.Results[0].Code}, codes)
+	assert.EqualValues(suite.T(), []string{"summer"}, names)
+}
+
+func (suite *TestSuite) TestBulkGenerateHandlerByFilter() {
+	// the first code collides with the voucher seeded below and is replaced
+	suite.seedVoucher("customer0@gmail.com", "KOI", dbmodel.PercentageDiscount(2000), "abc", time.Now().Add(24*time.Hour))
+	suite.srv.CodeGen = &sequenceCodeGen{codes: []string{"abc", "def", "ghi"}}
+	resp, body := httpTestHelper("POST", "http://vouchers/generate/bulk", bytes.NewBuffer(bulkRequestBody(`"filter": {"email_domain": "gmail.com"}`)), suite.srv, suite.srv.BulkGenerateHandler)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	br := BulkGenerateResponse{}
+	assert.Nil(suite.T(), json.Unmarshal(body, &br))
+	assert.EqualValues(suite.T(), 2, br.Created)
+	assert.Len(suite.T(), br.Results, 2)
+	created := []string{}
+	for _, result := range br.Results {
+		assert.EqualValues(suite.T(), BulkCreated, result.Status)
+		created = append(created, result.Code)
+	}
+	assert.ElementsMatch(suite.T(), []string{"def", "ghi"}, created)
+}
+
+func (suite *TestSuite) TestBulkGenerateHandlerAsync() {
+	resp, body := httpTestHelper("POST", "http://vouchers/generate/bulk", bytes.NewBuffer(bulkRequestBody(`"emails": ["customer0@gmail.com", "customer1@gmail.com"], "async": true`)), suite.srv, suite.srv.BulkGenerateHandler)
+	assert.EqualValues(suite.T(), http.StatusAccepted, resp.StatusCode)
+	job := BulkJob{}
+	assert.Nil(suite.T(), json.Unmarshal(body, &job))
+	assert.NotEmpty(suite.T(), job.ID)
+	assert.EqualValues(suite.T(), 2, job.Total)
+
+	poll := func(jobID string) (*http.Response, BulkJob) {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("jobID", jobID)
+		resp, body := httpTestHelper("GET", "http://vouchers/generate/bulk/"+jobID, nil, suite.srv, func(w http.ResponseWriter, r *http.Request) {
+			suite.srv.GetBulkJobHandler(w, r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx)))
+		})
+		polled := BulkJob{}
+		json.Unmarshal(body, &polled)
+		return resp, polled
+	}
+	assert.Eventually(suite.T(), func() bool {
+		_, polled := poll(job.ID)
+		return polled.Status == JobDone
+	}, 5*time.Second, 10*time.Millisecond)
+	resp, polled := poll(job.ID)
+	assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode)
+	assert.EqualValues(suite.T(), 2, polled.Processed)
+	assert.EqualValues(suite.T(), 2, polled.Result.Created)
+
+	resp, _ = poll("unknown")
+	assert.EqualValues(suite.T(), http.StatusNotFound, resp.StatusCode)
+}
+
+func (suite *TestSuite) TestBulkGenerateHandlerAsyncStopped() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	srv := &VoucherSrv{Store: suite.srv.Store, Ctx: ctx}
+	resp, body := httpTestHelper("POST", "http://vouchers/generate/bulk", bytes.NewBuffer(bulkRequestBody(`"emails": ["customer0@gmail.com"], "async": true`)), srv, srv.BulkGenerateHandler)
+	require.EqualValues(suite.T(), http.StatusAccepted, resp.StatusCode)
+	job := BulkJob{}
+	require.Nil(suite.T(), json.Unmarshal(body, &job))
+
+	// the job stops before its first batch once the service stops, nothing is generated
+	srv.WaitBulkJobs()
+	stopped, ok := srv.jobs.get(job.ID)
+	require.True(suite.T(), ok)
+	assert.EqualValues(suite.T(), JobFailed, stopped.Status)
+	assert.EqualValues(suite.T(), "internal error", stopped.Error)
+	assert.EqualValues(suite.T(), 0, stopped.Processed)
+	require.NotNil(suite.T(), stopped.Result)
+	assert.EqualValues(suite.T(), []BulkResult{{Email: "customer0@gmail.com", Status: BulkNotProcessed}}, stopped.Result.Results)
+	codes, _, _, err := suite.srv.Store.GetVouchers(suite.srv.Ctx, "customer0@gmail.com")
+	require.Nil(suite.T(), err)
+	assert.Empty(suite.T(), codes)
+}
+
+// failingInsertStore fails the inserts of vouchers after the first ones
+type failingInsertStore struct {
+	dbmodel.VoucherStore
+	inserts *int
+}
+
+func (s failingInsertStore) InsertVouchers(ctx context.Context, offer dbmodel.OfferRef, limits dbmodel.Limits, vouchers []dbmodel.DBModelVoucher) ([]string, error) {
+	*s.inserts++
+	if *s.inserts > 1 {
+		return nil, errors.New("connection reset")
+	}
+	return s.VoucherStore.InsertVouchers(ctx, offer, limits, vouchers)
+}
+
+func (suite *TestSuite) TestBulkGenerateHandlerPartial() {
+	srv := &VoucherSrv{Store: failingInsertStore{VoucherStore: suite.srv.Store, inserts: new(int)}, Ctx: context.Background(), BulkBatchSize: 1}
+	resp, body := httpTestHelper("POST", "http://vouchers/generate/bulk", bytes.NewBuffer(bulkRequestBody(
+		`"emails": ["customer0@gmail.com", "customer1@gmail.com", "unknown@gmail.com"]`)), srv, srv.BulkGenerateHandler)
+	assert.EqualValues(suite.T(), http.StatusInternalServerError, resp.StatusCode)
+
+	// the response tells who got a voucher before the second batch failed, a retry shall skip them
+	br := BulkGenerateResponse{}
+	require.Nil(suite.T(), json.Unmarshal(body, &br))
+	assert.EqualValues(suite.T(), &ErrorResponse{Code: CodeInternal, Message: "internal error"}, br.Error)
+	assert.EqualValues(suite.T(), 1, br.Created)
+	require.Len(suite.T(), br.Results, 3)
+	assert.EqualValues(suite.T(), BulkCreated, br.Results[0].Status)
+	assert.EqualValues(suite.T(), BulkResult{Email: "customer1@gmail.com", Status: BulkNotProcessed}, br.Results[1])
+	assert.EqualValues(suite.T(), BulkResult{Email: "unknown@gmail.com", Status: BulkNotProcessed}, br.Results[2])
+	codes, _, _, err := suite.srv.Store.GetVouchers(suite.srv.Ctx, "customer0@gmail.com")
+	require.Nil(suite.T(), err)
+	assert.EqualValues(suite.T(), []string{br.Results[0].Code}, codes)
+}
@@ -0,0 +1,318 @@
+package voucher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/ingemar0720/voucher-pool/logging"
+	"github.com/ingemar0720/voucher-pool/money"
+)
+
+const (
+	defaultCustomerPageSize = 50
+	maxCustomerPageSize     = 200
+)
+
+// CustomerRequest creates a customer or replaces all of it
+type CustomerRequest struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type CustomerResponse struct {
+	ID        uint64     `json:"id"`
+	Name      string     `json:"name"`
+	Email     string     `json:"email"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ErasedAt  *time.Time `json:"erased_at,omitempty"`
+}
+
+// CustomerVoucherResponse is a voucher of the customer with the terms of the offer version it was issued with
+type CustomerVoucherResponse struct {
+	Code         string `json:"code"`
+	OfferID      uint64 `json:"offer_id"`
+	OfferName    string `json:"offer_name"`
+	OfferVersion int    `json:"offer_version"`
+	// Discount is the percentage, or the amount in major units of Currency for fixed discounts
+	Discount        json.Number `json:"discount"`
+	DiscountType    string      `json:"discount_type"`
+	DiscountValue   string      `json:"discount_value"`
+	Currency        string      `json:"currency,omitempty"`
+	Assignment      string      `json:"assignment"`
+	ExpiredAt       time.Time   `json:"expired_at"`
+	UsedAt          *time.Time  `json:"used_at,omitempty"`
+	MaxRedemptions  int         `json:"max_redemptions"`
+	MaxPerCustomer  int64       `json:"max_per_customer,omitempty"`
+	RedemptionCount int         `json:"redemption_count"`
+}
+
+// CustomerExportResponse is everything held about a customer
+type CustomerExportResponse struct {
+	Customer    CustomerResponse          `json:"customer"`
+	Vouchers    []CustomerVoucherResponse `json:"vouchers"`
+	Redemptions []RedemptionResponse      `json:"redemptions"`
+}
+
+// ListCustomersResponse is a page of customers, NextAfterID is the after_id of the next page and not set on the last page
+type ListCustomersResponse struct {
+	Customers   []CustomerResponse `json:"customers"`
+	NextAfterID uint64             `json:"next_after_id,omitempty"`
+}
+
+// InvalidRequestError is returned for input failing validation, it is written as 422 invalid_request with its message
+type InvalidRequestError struct {
+	Message string
+}
+
+func (e *InvalidRequestError) Error() string {
+	return e.Message
+}
+
+func newCustomerResponse(c dbmodel.DBModelCustomer) CustomerResponse {
+	return CustomerResponse{ID: c.ID, Name: c.Name, Email: c.Email, CreatedAt: c.CreatedAt, UpdatedAt: c.UpdatedAt, ErasedAt: timePtr(c.ErasedAt)}
+}
+
+func newCustomerExportResponse(export dbmodel.CustomerExport) (CustomerExportResponse, error) {
+	resp := CustomerExportResponse{
+		Customer:    newCustomerResponse(export.Customer),
+		Vouchers:    make([]CustomerVoucherResponse, 0, len(export.Vouchers)),
+		Redemptions: make([]RedemptionResponse, 0, len(export.Redemptions)),
+	}
+	for _, v := range export.Vouchers {
+		d, err := v.Offer.Terms()
+		if err != nil {
+			return CustomerExportResponse{}, err
+		}
+		resp.Vouchers = append(resp.Vouchers, CustomerVoucherResponse{
+			Code:            v.Code,
+			OfferID:         v.Offer.OfferID,
+			OfferName:       v.Offer.Name,
+			OfferVersion:    v.Offer.Version,
+			Discount:        json.Number(money.TrimDecimal(d.Decimal())),
+			DiscountType:    string(d.Type),
+			DiscountValue:   d.Decimal(),
+			Currency:        d.Currency,
+			Assignment:      string(v.Assignment),
+			ExpiredAt:       v.ExpiryDate,
+			UsedAt:          timePtr(v.UsedDate),
+			MaxRedemptions:  v.MaxRedemptions,
+			MaxPerCustomer:  v.MaxPerCustomer.Int64,
+			RedemptionCount: v.RedemptionCount,
+		})
+	}
+	for _, r := range export.Redemptions {
+		resp.Redemptions = append(resp.Redemptions, newRedemptionResponse(r))
+	}
+	return resp, nil
+}
+
+// parseEmail validates the email with net/mail and returns its address normalized as the customers are looked up.
+// The domain of erased customers is refused, their emails shall not lead to them.
+func parseEmail(email string) (string, error) {
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return "", err
+	}
+	normalized := dbmodel.NormalizeEmail(addr.Address)
+	if strings.HasSuffix(normalized, "@"+dbmodel.ErasedEmailDomain) {
+		return "", fmt.Errorf("email domain %v is reserved", dbmodel.ErasedEmailDomain)
+	}
+	return normalized, nil
+}
+
+// validateCustomer returns the name and the normalized email of the customer, or an InvalidRequestError
+func validateCustomer(name, email string) (string, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", "", &InvalidRequestError{Message: "name shall not be empty"}
+	}
+	email, err := parseEmail(email)
+	if err != nil {
+		return "", "", &InvalidRequestError{Message: err.Error()}
+	}
+	return name, email, nil
+}
+
+// RegisterCustomer validates and creates a customer, it is shared by CreateCustomerHandler and the seed command
+func (srv *VoucherSrv) RegisterCustomer(ctx context.Context, name, email string) (dbmodel.DBModelCustomer, error) {
+	name, email, err := validateCustomer(name, email)
+	if err != nil {
+		return dbmodel.DBModelCustomer{}, err
+	}
+	id, err := srv.Store.CreateCustomer(ctx, name, email)
+	if err != nil {
+		return dbmodel.DBModelCustomer{}, err
+	}
+	return srv.Store.GetCustomer(ctx, id)
+}
+
+// customerID returns the id of the customer in the URL, false if it is not a valid id
+func customerID(r *http.Request) (uint64, bool) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	return id, err == nil && id > 0
+}
+
+func (srv *VoucherSrv) CreateCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	cr := CustomerRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	logging.SetCustomer(r.Context(), cr.Email)
+	c, err := srv.RegisterCustomer(r.Context(), cr.Name, cr.Email)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeCustomer(w, http.StatusCreated, c)
+}
+
+func (srv *VoucherSrv) GetCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := customerID(r)
+	if !ok {
+		writeErrorResponse(w, http.StatusNotFound, CodeCustomerNotFound, dbmodel.ErrCustomerNotFound.Error())
+		return
+	}
+	c, err := srv.Store.GetCustomer(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeCustomer(w, http.StatusOK, c)
+}
+
+// ListCustomersHandler returns a page of the customers in the order of their ids, optionally of the email_domain only.
+// The next page is asked for with after_id.
+func (srv *VoucherSrv) ListCustomersHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := defaultCustomerPageSize
+	if v := q.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 || l > maxCustomerPageSize {
+			writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, "limit shall be between 1 and "+strconv.Itoa(maxCustomerPageSize))
+			return
+		}
+		limit = l
+	}
+	var afterID uint64
+	if v := q.Get("after_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, "after_id shall be a customer id")
+			return
+		}
+		afterID = id
+	}
+	filter := dbmodel.CustomerFilter{EmailDomain: q.Get("email_domain")}
+
+	// one more customer tells if there is a next page
+	customers, err := srv.Store.ListCustomers(r.Context(), filter, afterID, limit+1)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	resp := ListCustomersResponse{Customers: make([]CustomerResponse, 0, len(customers))}
+	if len(customers) > limit {
+		customers = customers[:limit]
+		resp.NextAfterID = customers[limit-1].ID
+	}
+	for _, c := range customers {
+		resp.Customers = append(resp.Customers, newCustomerResponse(c))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// UpdateCustomerHandler replaces the name and the email of the customer, the vouchers of the customer follow the new email
+func (srv *VoucherSrv) UpdateCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := customerID(r)
+	if !ok {
+		writeErrorResponse(w, http.StatusNotFound, CodeCustomerNotFound, dbmodel.ErrCustomerNotFound.Error())
+		return
+	}
+	cr := CustomerRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	name, email, err := validateCustomer(cr.Name, cr.Email)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	logging.SetCustomer(r.Context(), email)
+	c, err := srv.Store.UpdateCustomer(r.Context(), id, name, email)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeCustomer(w, http.StatusOK, c)
+}
+
+// DeleteCustomerHandler deletes a customer without vouchers, redemptions or reservations
+func (srv *VoucherSrv) DeleteCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := customerID(r)
+	if !ok {
+		writeErrorResponse(w, http.StatusNotFound, CodeCustomerNotFound, dbmodel.ErrCustomerNotFound.Error())
+		return
+	}
+	if err := srv.Store.DeleteCustomer(r.Context(), id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ExportCustomerHandler returns everything held about the customer: profile, vouchers and redemptions
+func (srv *VoucherSrv) ExportCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := customerID(r)
+	if !ok {
+		writeErrorResponse(w, http.StatusNotFound, CodeCustomerNotFound, dbmodel.ErrCustomerNotFound.Error())
+		return
+	}
+	export, err := srv.Store.ExportCustomer(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	resp, err := newCustomerExportResponse(export)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// EraseCustomerHandler anonymizes the name and the email of the customer. Its vouchers and redemptions are kept
+// for financial reporting, its reservations are released.
+func (srv *VoucherSrv) EraseCustomerHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := customerID(r)
+	if !ok {
+		writeErrorResponse(w, http.StatusNotFound, CodeCustomerNotFound, dbmodel.ErrCustomerNotFound.Error())
+		return
+	}
+	c, err := srv.Store.EraseCustomer(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeCustomer(w, http.StatusOK, c)
+}
+
+func writeCustomer(w http.ResponseWriter, status int, c dbmodel.DBModelCustomer) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(newCustomerResponse(c))
+}
@@ -0,0 +1,141 @@
+package voucher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (suite *TestSuite) TestCustomerLifecycle() {
+	resp, body := httpTestHelper("POST", "http://customers", bytes.NewBuffer([]byte(`{"name": "new", "email": "invalid_email"}`)), suite.srv, suite.srv.CreateCustomerHandler)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"mail: missing '@' or angle-addr"}`+"\n", string(body))
+	resp, body = httpTestHelper("POST", "http://customers", bytes.NewBuffer([]byte(`{"name": " ", "email": "new@gmail.com"}`)), suite.srv, suite.srv.CreateCustomerHandler)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"name shall not be empty"}`+"\n", string(body))
+	resp, body = httpTestHelper("POST", "http://customers", bytes.NewBuffer([]byte(`{"name": "customer 0", "email": "Customer0@Gmail.com"}`)), suite.srv, suite.srv.CreateCustomerHandler)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"customer_conflict","message":"customer email already exists"}`+"\n", string(body))
+
+	resp, body = httpTestHelper("POST", "http://customers", bytes.NewBuffer([]byte(`{"name": "new", "email": "New <New@Gmail.com>"}`)), suite.srv, suite.srv.CreateCustomerHandler)
+	require.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode, string(body))
+	created := CustomerResponse{}
+	require.Nil(suite.T(), json.Unmarshal(body, &created))
+	assert.Equal(suite.T(), "new@gmail.com", created.Email)
+	id := fmt.Sprint(created.ID)
+
+	resp, body = suite.idRequest("GET", "http://customers/"+id, id, nil, suite.srv.GetCustomerHandler)
+	assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode)
+	got := CustomerResponse{}
+	assert.Nil(suite.T(), json.Unmarshal(body, &got))
+	assert.Equal(suite.T(), "new", got.Name)
+	resp, _ = suite.idRequest("GET", "http://customers/abc", "abc", nil, suite.srv.GetCustomerHandler)
+	assert.EqualValues(suite.T(), http.StatusNotFound, resp.StatusCode)
+
+	// vouchers are generated and validated with the email in any case
+	suite.seedVoucher("NEW@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
+	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "New@Gmail.com", "code": "abc"}`)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode, string(body))
+
+	resp, body = suite.idRequest("PUT", "http://customers/"+id, id, bytes.NewBuffer([]byte(`{"name": "renamed", "email": "customer1@gmail.com"}`)), suite.srv.UpdateCustomerHandler)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"customer_conflict","message":"customer email already exists"}`+"\n", string(body))
+	resp, body = suite.idRequest("PUT", "http://customers/"+id, id, bytes.NewBuffer([]byte(`{"name": "renamed", "email": "Renamed@gmail.com"}`)), suite.srv.UpdateCustomerHandler)
+	assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode, string(body))
+	assert.Nil(suite.T(), json.Unmarshal(body, &got))
+	assert.Equal(suite.T(), "renamed@gmail.com", got.Email)
+
+	resp, body = suite.idRequest("DELETE", "http://customers/"+id, id, nil, suite.srv.DeleteCustomerHandler)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"customer_in_use","message":"customer has vouchers or redemptions"}`+"\n", string(body))
+	resp, _ = suite.idRequest("DELETE", "http://customers/1", "1", nil, suite.srv.DeleteCustomerHandler)
+	assert.EqualValues(suite.T(), http.StatusNoContent, resp.StatusCode)
+	resp, _ = suite.idRequest("GET", "http://customers/1", "1", nil, suite.srv.GetCustomerHandler)
+	assert.EqualValues(suite.T(), http.StatusNotFound, resp.StatusCode)
+}
+
+func (suite *TestSuite) TestListCustomers() {
+	resp, _ := httpTestHelper("GET", "http://customers?limit=0", nil, suite.srv, suite.srv.ListCustomersHandler)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+
+	for i := 2; i < 10; i++ {
+		_, err := suite.srv.RegisterCustomer(suite.srv.Ctx, fmt.Sprintf("customer %v", i), fmt.Sprintf("customer%v@gmail.com", i))
+		require.Nil(suite.T(), err)
+	}
+	var ids []uint64
+	afterID := ""
+	for {
+		resp, body := httpTestHelper("GET", "http://customers?limit=4&after_id="+afterID, nil, suite.srv, suite.srv.ListCustomersHandler)
+		require.EqualValues(suite.T(), http.StatusOK, resp.StatusCode, string(body))
+		page := ListCustomersResponse{}
+		require.Nil(suite.T(), json.Unmarshal(body, &page))
+		for _, c := range page.Customers {
+			ids = append(ids, c.ID)
+		}
+		if page.NextAfterID == 0 {
+			break
+		}
+		afterID = fmt.Sprint(page.NextAfterID)
+	}
+	assert.Len(suite.T(), ids, 10)
+
+	_, err := suite.srv.RegisterCustomer(suite.srv.Ctx, "yahoo", "someone@yahoo.com")
+	require.Nil(suite.T(), err)
+	resp, body := httpTestHelper("GET", "http://customers?email_domain=yahoo.com", nil, suite.srv, suite.srv.ListCustomersHandler)
+	require.EqualValues(suite.T(), http.StatusOK, resp.StatusCode)
+	page := ListCustomersResponse{}
+	require.Nil(suite.T(), json.Unmarshal(body, &page))
+	require.Len(suite.T(), page.Customers, 1)
+	assert.Equal(suite.T(), "someone@yahoo.com", page.Customers[0].Email)
+}
+
+func (suite *TestSuite) TestExportAndEraseCustomer() {
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
+	suite.seedVoucher("customer0@gmail.com", "ten_off", dbmodel.FixedDiscount(1000, "EUR"), "def", time.Now().Add(24*time.Hour))
+	resp, body := httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "abc"}`)), suite.srv, suite.srv.ValidateHanlder)
+	require.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode, string(body))
+
+	resp, body = suite.idRequest("GET", "http://customers/1/export", "1", nil, suite.srv.ExportCustomerHandler)
+	require.EqualValues(suite.T(), http.StatusOK, resp.StatusCode, string(body))
+	export := CustomerExportResponse{}
+	require.Nil(suite.T(), json.Unmarshal(body, &export))
+	assert.Equal(suite.T(), "customer0@gmail.com", export.Customer.Email)
+	require.Len(suite.T(), export.Vouchers, 2)
+	assert.Equal(suite.T(), "apple_store", export.Vouchers[0].OfferName)
+	assert.Equal(suite.T(), "38.50", export.Vouchers[0].DiscountValue)
+	assert.NotNil(suite.T(), export.Vouchers[0].UsedAt)
+	assert.Equal(suite.T(), "EUR", export.Vouchers[1].Currency)
+	require.Len(suite.T(), export.Redemptions, 1)
+	assert.Equal(suite.T(), "abc", export.Redemptions[0].Code)
+	resp, _ = suite.idRequest("GET", "http://customers/99/export", "99", nil, suite.srv.ExportCustomerHandler)
+	assert.EqualValues(suite.T(), http.StatusNotFound, resp.StatusCode)
+
+	// erasure is safe with outstanding vouchers, they are kept but the email does not lead to them any more
+	resp, body = suite.idRequest("POST", "http://customers/1/erase", "1", nil, suite.srv.EraseCustomerHandler)
+	require.EqualValues(suite.T(), http.StatusOK, resp.StatusCode, string(body))
+	erased := CustomerResponse{}
+	require.Nil(suite.T(), json.Unmarshal(body, &erased))
+	assert.Empty(suite.T(), erased.Name)
+	assert.NotNil(suite.T(), erased.ErasedAt)
+	assert.Equal(suite.T(), "erased-1@"+dbmodel.ErasedEmailDomain, erased.Email)
+
+	resp, body = suite.idRequest("GET", "http://customers/1/export", "1", nil, suite.srv.ExportCustomerHandler)
+	require.EqualValues(suite.T(), http.StatusOK, resp.StatusCode, string(body))
+	require.Nil(suite.T(), json.Unmarshal(body, &export))
+	assert.Len(suite.T(), export.Vouchers, 2)
+	require.Len(suite.T(), export.Redemptions, 1)
+	assert.Equal(suite.T(), erased.Email, export.Redemptions[0].Email)
+
+	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "`+erased.Email+`", "code": "def"}`)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"email domain erased.invalid is reserved"}`+"\n", string(body))
+	resp, body = suite.idRequest("PUT", "http://customers/1", "1", bytes.NewBuffer([]byte(`{"name": "customer 0", "email": "customer0@gmail.com"}`)), suite.srv.UpdateCustomerHandler)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"customer_erased","message":"customer is erased"}`+"\n", string(body))
+}
@@ -0,0 +1,185 @@
+package voucher
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/ingemar0720/voucher-pool/logging"
+	"github.com/ingemar0720/voucher-pool/metrics"
+	"github.com/ingemar0720/voucher-pool/rules"
+	"github.com/ingemar0720/voucher-pool/tracing"
+	"github.com/pkg/errors"
+)
+
+// machine readable error codes returned in ErrorResponse
+const (
+	CodeBadRequest               = "bad_request"
+	CodeInvalidRequest           = "invalid_request"
+	CodeVoucherNotFound          = "voucher_not_found"
+	CodeVoucherNotOwned          = "voucher_not_owned"
+	CodeVoucherExpired           = "voucher_expired"
+	CodeVoucherRedeemed          = "voucher_redeemed"
+	CodeCustomerNotFound         = "customer_not_found"
+	CodeCustomerConflict         = "customer_conflict"
+	CodeCustomerInUse            = "customer_in_use"
+	CodeCustomerErased           = "customer_erased"
+	CodeOfferConflict            = "offer_conflict"
+	CodeOfferNotFound            = "offer_not_found"
+	CodeOfferInactive            = "offer_inactive"
+	CodeOfferNotStarted          = "offer_not_started"
+	CodeOfferEnded               = "offer_ended"
+	CodeOfferArchived            = "offer_archived"
+	CodeCodeConflict             = "code_conflict"
+	CodeJobNotFound              = "job_not_found"
+	CodeCurrencyMismatch         = "currency_mismatch"
+	CodeVoucherReserved          = "voucher_reserved"
+	CodeReservationNotFound      = "reservation_not_found"
+	CodeReservationExpired       = "reservation_expired"
+	CodeVoucherNotRedeemed       = "voucher_not_redeemed"
+	CodeCustomerLimit            = "customer_limit_reached"
+	CodeRuleFailed               = "rule_failed"
+	CodeStackingConflict         = "stacking_conflict"
+	CodeIdempotencyKeyReused     = "idempotency_key_reused"
+	CodeIdempotencyKeyInProgress = "idempotency_key_in_progress"
+	CodeInternal                 = "internal_error"
+)
+
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Rule is the rule of the offer the order does not meet, set with CodeRuleFailed
+	Rule *RuleFailure `json:"rule,omitempty"`
+	// RequestID is set with CodeInternal, the error is told by the log line of the request only
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// RuleFailure tells which rule failed, Index is its position in the rules of the offer
+type RuleFailure struct {
+	Index int        `json:"index"`
+	Type  rules.Type `json:"type"`
+}
+
+// domain errors of dbmodel and their status and code, checked in order with errors.Is
+var errorMappings = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{dbmodel.ErrVoucherNotFound, http.StatusNotFound, CodeVoucherNotFound},
+	{dbmodel.ErrCustomerNotFound, http.StatusNotFound, CodeCustomerNotFound},
+	{dbmodel.ErrCustomerConflict, http.StatusConflict, CodeCustomerConflict},
+	{dbmodel.ErrCustomerInUse, http.StatusConflict, CodeCustomerInUse},
+	{dbmodel.ErrCustomerErased, http.StatusConflict, CodeCustomerErased},
+	{dbmodel.ErrVoucherNotOwned, http.StatusUnprocessableEntity, CodeVoucherNotOwned},
+	{dbmodel.ErrVoucherExpired, http.StatusGone, CodeVoucherExpired},
+	{dbmodel.ErrVoucherRedeemed, http.StatusConflict, CodeVoucherRedeemed},
+	{dbmodel.ErrOfferConflict, http.StatusConflict, CodeOfferConflict},
+	{dbmodel.ErrInvalidOffer, http.StatusUnprocessableEntity, CodeInvalidRequest},
+	{dbmodel.ErrOfferNotFound, http.StatusNotFound, CodeOfferNotFound},
+	{dbmodel.ErrOfferInactive, http.StatusConflict, CodeOfferInactive},
+	{dbmodel.ErrOfferNotStarted, http.StatusConflict, CodeOfferNotStarted},
+	{dbmodel.ErrOfferEnded, http.StatusGone, CodeOfferEnded},
+	{dbmodel.ErrOfferArchived, http.StatusConflict, CodeOfferArchived},
+	{dbmodel.ErrCodeConflict, http.StatusConflict, CodeCodeConflict},
+	{dbmodel.ErrVoucherReserved, http.StatusConflict, CodeVoucherReserved},
+	{dbmodel.ErrReservationNotFound, http.StatusNotFound, CodeReservationNotFound},
+	{dbmodel.ErrReservationExpired, http.StatusGone, CodeReservationExpired},
+	{dbmodel.ErrVoucherNotRedeemed, http.StatusConflict, CodeVoucherNotRedeemed},
+	{dbmodel.ErrCustomerLimitReached, http.StatusConflict, CodeCustomerLimit},
+	{dbmodel.ErrStackingConflict, http.StatusUnprocessableEntity, CodeStackingConflict},
+	{dbmodel.ErrStackingPolicy, http.StatusUnprocessableEntity, CodeStackingConflict},
+}
+
+func init() {
+	// the domain errors hold no customer data, they are logged by their message when errors are redacted
+	for _, m := range errorMappings {
+		logging.AddSentinels(m.err)
+	}
+}
+
+// writeError writes a JSON ErrorResponse, the status and code are looked up from the domain error err wraps
+// and fall back to 500. The error of a 500 is logged with the request r.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, resp := requestErrorResponse(r, err)
+	logFailure(r, status, err)
+	writeErrorBody(w, status, resp)
+}
+
+// logFailure adds err to the log line and the span of the request r if it failed with a 5xx, the client errors are
+// told by status
+func logFailure(r *http.Request, status int, err error) {
+	if status >= http.StatusInternalServerError {
+		logging.SetError(r.Context(), err)
+		tracing.RecordError(r.Context(), err)
+	}
+}
+
+// requestErrorResponse returns the status and the ErrorResponse of err for the request r, a 500 refers to the
+// request ID
+func requestErrorResponse(r *http.Request, err error) (int, ErrorResponse) {
+	status, resp := errorResponse(err)
+	if status >= http.StatusInternalServerError {
+		resp.RequestID = middleware.GetReqID(r.Context())
+	}
+	return status, resp
+}
+
+// errorResponse returns the status and the ErrorResponse of err, the message of an unexpected error is not sent as it
+// may hold customer data
+func errorResponse(err error) (int, ErrorResponse) {
+	var invalid *InvalidRequestError
+	if errors.As(err, &invalid) {
+		return http.StatusUnprocessableEntity, ErrorResponse{Code: CodeInvalidRequest, Message: invalid.Message}
+	}
+	var failure *rules.Failure
+	if errors.As(err, &failure) {
+		return http.StatusUnprocessableEntity, ErrorResponse{
+			Code:    CodeRuleFailed,
+			Message: failure.Message,
+			Rule:    &RuleFailure{Index: failure.Index, Type: failure.Type},
+		}
+	}
+	for _, m := range errorMappings {
+		if errors.Is(err, m.err) {
+			return m.status, ErrorResponse{Code: m.code, Message: m.err.Error()}
+		}
+	}
+	return http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Message: "internal error"}
+}
+
+func writeErrorResponse(w http.ResponseWriter, status int, code, message string) {
+	writeErrorBody(w, status, ErrorResponse{Code: code, Message: message})
+}
+
+func writeErrorBody(w http.ResponseWriter, status int, resp ErrorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// redemptionFailed writes the error of a redemption at endpoint and counts the rejection by its code
+func (srv *VoucherSrv) redemptionFailed(w http.ResponseWriter, r *http.Request, endpoint string, err error) {
+	status, resp := requestErrorResponse(r, err)
+	logFailure(r, status, err)
+	srv.redemptionRejected(r, endpoint, resp.Code)
+	writeErrorBody(w, status, resp)
+}
+
+// redemptionRejected counts a redemption at endpoint rejected with the error code and records it on the span
+func (srv *VoucherSrv) redemptionRejected(r *http.Request, endpoint, code string) {
+	srv.Metrics.Redemption(endpoint, code)
+	tracing.SetOutcome(r.Context(), code)
+}
+
+// redeemed counts a successful redemption at endpoint and records the offers of the vouchers on the span
+func (srv *VoucherSrv) redeemed(r *http.Request, endpoint string, results ...dbmodel.RedeemResult) {
+	srv.Metrics.Redemption(endpoint, metrics.OutcomeRedeemed)
+	tracing.SetOutcome(r.Context(), metrics.OutcomeRedeemed)
+	ids := make([]uint64, len(results))
+	for i, result := range results {
+		ids[i] = result.OfferID
+	}
+	tracing.SetOffers(r.Context(), ids...)
+}
@@ -0,0 +1,127 @@
+package voucher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/codepool"
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+)
+
+// status of a check and of the service
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// how long the readiness checks may take if VoucherSrv.ReadinessTimeout is 0
+const defaultReadinessTimeout = 2 * time.Second
+
+// CheckResult is the outcome of one readiness check, Detail tells what was checked and Error why it failed
+type CheckResult struct {
+	Status string      `json:"status"`
+	Detail interface{} `json:"detail,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// HealthResponse is ok if every check is, Checks is empty for liveness
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// DBPoolDetail is the connection pool of the database
+type DBPoolDetail struct {
+	OpenConnections int `json:"open_connections"`
+	InUse           int `json:"in_use"`
+	Idle            int `json:"idle"`
+	MaxOpen         int `json:"max_open"`
+	// WaitCount is how many times a query waited for a connection
+	WaitCount int64 `json:"wait_count"`
+}
+
+// MigrationDetail compares the migration applied to the database with the one the service expects
+type MigrationDetail struct {
+	Version  string `json:"version"`
+	Expected string `json:"expected"`
+}
+
+// HealthzHandler tells the process is alive, it does not check dependencies so a slow database does not get the
+// service restarted
+func (srv *VoucherSrv) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, HealthResponse{Status: StatusOK})
+}
+
+// ReadyzHandler tells whether the service can serve requests: the database answers a ping in time and its migrations
+// are at SchemaVersion. The code pool is reported but never fails readiness, codes are generated on demand when it
+// is drained. It returns 503 if a check fails.
+func (srv *VoucherSrv) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), srv.readinessTimeout())
+	defer cancel()
+	resp := HealthResponse{Status: StatusOK, Checks: map[string]CheckResult{}}
+	if hc, ok := srv.Store.(dbmodel.HealthChecker); ok {
+		resp.Checks["db"] = checkDB(ctx, hc)
+		resp.Checks["migrations"] = checkMigrations(ctx, hc)
+	} else {
+		resp.Checks["store"] = CheckResult{Status: StatusOK, Detail: "in memory"}
+	}
+	if pool, ok := srv.codeGenerator().(interface{ Stats() codepool.Stats }); ok {
+		resp.Checks["codepool"] = CheckResult{Status: StatusOK, Detail: pool.Stats()}
+	}
+	for _, c := range resp.Checks {
+		if c.Status != StatusOK {
+			resp.Status = StatusFail
+		}
+	}
+	writeHealth(w, resp)
+}
+
+func checkDB(ctx context.Context, hc dbmodel.HealthChecker) CheckResult {
+	stats := hc.Stats()
+	result := CheckResult{Status: StatusOK, Detail: DBPoolDetail{
+		OpenConnections: stats.OpenConnections,
+		InUse:           stats.InUse,
+		Idle:            stats.Idle,
+		MaxOpen:         stats.MaxOpenConnections,
+		WaitCount:       stats.WaitCount,
+	}}
+	if err := hc.Ping(ctx); err != nil {
+		result.Status = StatusFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// checkMigrations fails if the database is behind SchemaVersion, a newer database is fine as migrations are applied
+// before the service is rolled out
+func checkMigrations(ctx context.Context, hc dbmodel.HealthChecker) CheckResult {
+	version, err := hc.MigrationVersion(ctx)
+	if err != nil {
+		return CheckResult{Status: StatusFail, Error: err.Error()}
+	}
+	result := CheckResult{Status: StatusOK, Detail: MigrationDetail{Version: version, Expected: dbmodel.SchemaVersion}}
+	if version < dbmodel.SchemaVersion {
+		result.Status = StatusFail
+		result.Error = fmt.Sprintf("database is at migration %q, %v is expected", version, dbmodel.SchemaVersion)
+	}
+	return result
+}
+
+func writeHealth(w http.ResponseWriter, resp HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if resp.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (srv *VoucherSrv) readinessTimeout() time.Duration {
+	if srv.ReadinessTimeout <= 0 {
+		return defaultReadinessTimeout
+	}
+	return srv.ReadinessTimeout
+}
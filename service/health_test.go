@@ -0,0 +1,88 @@
+package voucher
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/ingemar0720/voucher-pool/codegen"
+	"github.com/ingemar0720/voucher-pool/codepool"
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checkedStore reports the health of a database in front of the store
+type checkedStore struct {
+	dbmodel.VoucherStore
+	pingErr error
+	version string
+}
+
+func (s checkedStore) Ping(ctx context.Context) error {
+	return s.pingErr
+}
+
+func (s checkedStore) MigrationVersion(ctx context.Context) (string, error) {
+	return s.version, nil
+}
+
+func (s checkedStore) Stats() sql.DBStats {
+	return sql.DBStats{MaxOpenConnections: 20, OpenConnections: 3, InUse: 1, Idle: 2}
+}
+
+func (suite *TestSuite) TestHealthzHandler() {
+	resp, body := httpTestHelper("GET", "http://healthz", nil, suite.srv, suite.srv.HealthzHandler)
+	assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"status":"ok"}`+"\n", string(body))
+}
+
+func (suite *TestSuite) TestReadyzHandler() {
+	pool, err := codepool.New(codegen.MustNew(codegen.DefaultConfig), codepool.Config{Size: 10, LowWater: 5})
+	require.Nil(suite.T(), err)
+	for _, tc := range []struct {
+		name       string
+		store      dbmodel.VoucherStore
+		wantStatus int
+		want       string
+	}{
+		{
+			name:       "ready",
+			store:      checkedStore{VoucherStore: suite.srv.Store, version: dbmodel.SchemaVersion},
+			wantStatus: http.StatusOK,
+			want: `{"status":"ok","checks":{` +
+				`"codepool":{"status":"ok","detail":{"depth":0,"size":10,"low_water":5,"served":0,"misses":0,"generated":0,"duplicates":0}},` +
+				`"db":{"status":"ok","detail":{"open_connections":3,"in_use":1,"idle":2,"max_open":20,"wait_count":0}},` +
+				`"migrations":{"status":"ok","detail":{"version":"` + dbmodel.SchemaVersion + `","expected":"` + dbmodel.SchemaVersion + `"}}}}`,
+		},
+		{
+			name:       "db down",
+			store:      checkedStore{VoucherStore: suite.srv.Store, pingErr: errors.New("connection refused"), version: dbmodel.SchemaVersion},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "migrations behind",
+			store:      checkedStore{VoucherStore: suite.srv.Store, version: "20210101000000"},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	} {
+		srv := &VoucherSrv{Store: tc.store, Ctx: context.Background(), CodeGen: pool}
+		resp, body := httpTestHelper("GET", "http://readyz", nil, srv, srv.ReadyzHandler)
+		assert.EqualValues(suite.T(), tc.wantStatus, resp.StatusCode, tc.name)
+		if tc.want != "" {
+			assert.EqualValues(suite.T(), tc.want+"\n", string(body), tc.name)
+		}
+	}
+
+	resp, body := httpTestHelper("GET", "http://readyz", nil, suite.srv, suite.srv.ReadyzHandler)
+	if _, ok := suite.srv.Store.(dbmodel.HealthChecker); ok {
+		assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode, string(body))
+		return
+	}
+	assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode)
+	got := HealthResponse{}
+	require.Nil(suite.T(), json.Unmarshal(body, &got))
+	assert.Equal(suite.T(), HealthResponse{Status: StatusOK, Checks: map[string]CheckResult{"store": {Status: StatusOK, Detail: "in memory"}}}, got)
+}
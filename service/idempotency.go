@@ -0,0 +1,149 @@
+package voucher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+)
+
+const (
+	// IdempotencyKeyHeader is the header a client sends to make a POST safe to retry
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on responses replayed for an idempotency key
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	// how long a response is kept for its key if VoucherSrv.IdempotencyTTL is 0
+	defaultIdempotencyTTL = 24 * time.Hour
+	// how long a request holds its key if VoucherSrv.IdempotencyLease is 0, longer than the default request timeout
+	defaultIdempotencyLease = 2 * time.Minute
+	maxIdempotencyKeyLength = 255
+)
+
+// Idempotent is a middleware which replays the response of the first request sent with an Idempotency-Key header to
+// the retries with the same key and body, so they do not generate or redeem a voucher twice. A key reused with another
+// body, or sent again while the first request is in progress, gets a conflict. Requests without the header run as
+// usual. A 5xx response or a panic is not kept, the request runs again on retry. The first request holds the key for
+// VoucherSrv.IdempotencyLease only, so a key is not stuck in progress if the service stops before the response is
+// saved.
+func (srv *VoucherSrv) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest,
+				fmt.Sprintf("%v shall be at most %v characters", IdempotencyKeyHeader, maxIdempotencyKeyLength))
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		scope := r.Method + " " + r.URL.Path
+		fingerprint := requestFingerprint(scope, body)
+		now := time.Now()
+		k, claimed, err := srv.Store.ClaimIdempotencyKey(r.Context(), scope, key, fingerprint, now, now.Add(srv.idempotencyLease()))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if !claimed {
+			switch {
+			case k.Fingerprint != fingerprint:
+				writeErrorResponse(w, http.StatusConflict, CodeIdempotencyKeyReused,
+					fmt.Sprintf("%v was used with another request", IdempotencyKeyHeader))
+			case !k.Status.Valid:
+				writeErrorResponse(w, http.StatusConflict, CodeIdempotencyKeyInProgress,
+					fmt.Sprintf("the request with the %v is in progress", IdempotencyKeyHeader))
+			default:
+				if len(k.Body) > 0 {
+					w.Header().Set("Content-Type", "application/json")
+				}
+				w.Header().Set(IdempotentReplayedHeader, "true")
+				w.WriteHeader(int(k.Status.Int64))
+				w.Write(k.Body)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			if p := recover(); p != nil {
+				srv.releaseIdempotencyKey(r, k, http.StatusInternalServerError)
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+		// the outcome is recorded even if the request was cancelled meanwhile, the key is in progress until then. A retry
+		// which took over the key once the claim expired keeps it, k tells the claim of this request.
+		if rec.status >= http.StatusInternalServerError {
+			srv.releaseIdempotencyKey(r, k, rec.status)
+			return
+		}
+		if err := srv.Store.SaveIdempotentResponse(srv.Ctx, scope, key, k.Fingerprint, k.CreatedAt, rec.status, rec.body.Bytes(), time.Now().Add(srv.idempotencyTTL())); err != nil {
+			srv.Log.For(r.Context()).Error().Fields(srv.Log.ErrorFields(err)).Msg("fail to save idempotent response")
+		}
+	})
+}
+
+// releaseIdempotencyKey frees the key claimed by k of a request which failed with status, so a retry runs again
+func (srv *VoucherSrv) releaseIdempotencyKey(r *http.Request, k dbmodel.DBModelIdempotencyKey, status int) {
+	if err := srv.Store.ReleaseIdempotencyKey(srv.Ctx, k.Scope, k.Key, k.Fingerprint, k.CreatedAt); err != nil {
+		srv.Log.For(r.Context()).Error().Fields(srv.Log.ErrorFields(err)).Int("status", status).Msg("fail to release idempotency key")
+	}
+}
+
+// requestFingerprint tells apart the requests sent with the same key
+func requestFingerprint(scope string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(scope))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (srv *VoucherSrv) idempotencyTTL() time.Duration {
+	if srv.IdempotencyTTL <= 0 {
+		return defaultIdempotencyTTL
+	}
+	return srv.IdempotencyTTL
+}
+
+func (srv *VoucherSrv) idempotencyLease() time.Duration {
+	if srv.IdempotencyLease <= 0 {
+		return defaultIdempotencyLease
+	}
+	return srv.IdempotencyLease
+}
+
+// responseRecorder writes the response through and keeps its status and body
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,97 @@
+package voucher
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// idempotentRequest sends the request through the Idempotent middleware with the key
+func (suite *TestSuite) idempotentRequest(url, key, body string, f func(http.ResponseWriter, *http.Request)) (*http.Response, []byte) {
+	req := httptest.NewRequest("POST", url, strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	suite.srv.Idempotent(http.HandlerFunc(f)).ServeHTTP(w, req)
+	resp := w.Result()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	return resp, respBody
+}
+
+func (suite *TestSuite) TestIdempotent() {
+	expiry := time.Now().Add(time.Hour).Format(time.RFC3339)
+	reqBody := `{"email": "customer0@gmail.com", "offer_name": "tea", "discount": 10, "expiry": "` + expiry + `"}`
+	resp, body := suite.idempotentRequest("http://vouchers/generate", "k1", reqBody, suite.srv.GenerateHanlder)
+	require.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode, string(body))
+	assert.Empty(suite.T(), resp.Header.Get(IdempotentReplayedHeader))
+	generated := GenerateResponse{}
+	require.Nil(suite.T(), json.Unmarshal(body, &generated))
+
+	// the retry gets the same code instead of a second voucher
+	resp, replayed := suite.idempotentRequest("http://vouchers/generate", "k1", reqBody, suite.srv.GenerateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	assert.EqualValues(suite.T(), "true", resp.Header.Get(IdempotentReplayedHeader))
+	assert.EqualValues(suite.T(), "application/json", resp.Header.Get("Content-Type"))
+	assert.EqualValues(suite.T(), string(body), string(replayed))
+	codes, _, _, err := suite.srv.Store.GetVouchers(suite.srv.Ctx, "customer0@gmail.com")
+	require.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{generated.Code}, codes)
+
+	// the key cannot be reused with another body, but can on another endpoint
+	resp, body = suite.idempotentRequest("http://vouchers/generate", "k1", strings.Replace(reqBody, "customer0", "customer1", 1), suite.srv.GenerateHanlder)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"idempotency_key_reused","message":"Idempotency-Key was used with another request"}`+"\n", string(body))
+	validateBody := `{"email": "customer0@gmail.com", "code": "` + generated.Code + `"}`
+	resp, body = suite.idempotentRequest("http://vouchers/validate", "k1", validateBody, suite.srv.ValidateHanlder)
+	require.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode, string(body))
+
+	// the voucher is redeemed once, the retry gets the first response rather than voucher_redeemed
+	resp, replayed = suite.idempotentRequest("http://vouchers/validate", "k1", validateBody, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	assert.EqualValues(suite.T(), string(body), string(replayed))
+	resp, body = suite.idempotentRequest("http://vouchers/validate", "k2", validateBody, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"voucher_redeemed","message":"this voucher has been redeemed"}`+"\n", string(body))
+	resp, _ = suite.idempotentRequest("http://vouchers/validate", "", validateBody, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+
+	// a key in progress gets a conflict, a 5xx response is not kept. The scope is the path of the test URL.
+	scope := "POST /validate"
+	_, _, err = suite.srv.Store.ClaimIdempotencyKey(suite.srv.Ctx, scope, "k3", requestFingerprint(scope, []byte(validateBody)), time.Now(), time.Now().Add(time.Hour))
+	require.Nil(suite.T(), err)
+	resp, body = suite.idempotentRequest("http://vouchers/validate", "k3", validateBody, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"idempotency_key_in_progress","message":"the request with the Idempotency-Key is in progress"}`+"\n", string(body))
+	failing := func(w http.ResponseWriter, r *http.Request) {
+		writeErrorResponse(w, http.StatusInternalServerError, CodeInternal, "internal error")
+	}
+	resp, _ = suite.idempotentRequest("http://vouchers/validate", "k4", validateBody, failing)
+	assert.EqualValues(suite.T(), http.StatusInternalServerError, resp.StatusCode)
+	resp, _ = suite.idempotentRequest("http://vouchers/validate", "k4", validateBody, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.Empty(suite.T(), resp.Header.Get(IdempotentReplayedHeader))
+
+	// a panic releases the key before it goes on
+	panicking := func(w http.ResponseWriter, r *http.Request) { panic("boom") }
+	assert.PanicsWithValue(suite.T(), "boom", func() {
+		suite.idempotentRequest("http://vouchers/validate", "k5", validateBody, panicking)
+	})
+	resp, _ = suite.idempotentRequest("http://vouchers/validate", "k5", validateBody, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.Empty(suite.T(), resp.Header.Get(IdempotentReplayedHeader))
+
+	// a key whose request never saved a response is free again once its lease expires
+	now := time.Now()
+	_, _, err = suite.srv.Store.ClaimIdempotencyKey(suite.srv.Ctx, scope, "k6", requestFingerprint(scope, []byte(validateBody)), now.Add(-time.Hour), now.Add(-time.Hour).Add(defaultIdempotencyLease))
+	require.Nil(suite.T(), err)
+	resp, body = suite.idempotentRequest("http://vouchers/validate", "k6", validateBody, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.Contains(suite.T(), string(body), "voucher_redeemed")
+}
@@ -0,0 +1,88 @@
+package voucher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/ingemar0720/voucher-pool/logging"
+	"github.com/ingemar0720/voucher-pool/rules"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (suite *TestSuite) TestServerErrorLogged() {
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abcdefgh", time.Now().Add(24*time.Hour))
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, logging.DefaultConfig)
+	require.Nil(suite.T(), err)
+	srv := &VoucherSrv{Store: cancelledStore{suite.srv.Store}, Ctx: context.Background(), Log: logger}
+	handler := middleware.RequestID(logger.Middleware(http.HandlerFunc(srv.ValidateHanlder)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("POST", "http://vouchers/validate", strings.NewReader(`{"email": "customer0@gmail.com", "code": "abcdefgh"}`)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.EqualValues(suite.T(), http.StatusInternalServerError, w.Code)
+
+	line := map[string]interface{}{}
+	require.Nil(suite.T(), json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(suite.T(), "error", line["level"])
+	assert.Equal(suite.T(), "context canceled", line["cause"])
+	assert.NotEmpty(suite.T(), line["request_id"])
+	assert.Equal(suite.T(), logging.EmailHash("customer0@gmail.com"), line["email_hash"])
+	assert.Equal(suite.T(), "abcd", line["code_prefix"])
+	// emails and codes are redacted by default
+	assert.NotContains(suite.T(), buf.String(), "customer0@gmail.com")
+	assert.NotContains(suite.T(), buf.String(), "abcdefgh")
+
+	// client errors are logged without an error
+	buf.Reset()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://vouchers/validate", strings.NewReader(`{"email": "customer1@gmail.com", "code": "abcdefgh"}`)))
+	line = map[string]interface{}{}
+	require.Nil(suite.T(), json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(suite.T(), "info", line["level"])
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, line["status"])
+	assert.NotContains(suite.T(), line, "error")
+}
+
+// failingStore fails redemptions with an error holding the email and the code, like the errors of postgres wrapped
+// by dbmodel
+type failingStore struct {
+	dbmodel.VoucherStore
+}
+
+func (s failingStore) RedeemVoucher(ctx context.Context, email, code string, order rules.Order) (dbmodel.RedeemResult, error) {
+	return dbmodel.RedeemResult{}, errors.Wrapf(errors.Errorf("invalid input %q", code), "fail to redeem voucher %v of %v", code, email)
+}
+
+func (suite *TestSuite) TestServerErrorRedacted() {
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abcdefgh", time.Now().Add(24*time.Hour))
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, logging.DefaultConfig)
+	require.Nil(suite.T(), err)
+	srv := &VoucherSrv{Store: failingStore{suite.srv.Store}, Ctx: context.Background(), Log: logger}
+	handler := middleware.RequestID(logger.Middleware(http.HandlerFunc(srv.ValidateHanlder)))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "http://vouchers/validate", strings.NewReader(`{"email": "customer0@gmail.com", "code": "abcdefgh"}`)))
+	assert.EqualValues(suite.T(), http.StatusInternalServerError, w.Code)
+	line := map[string]interface{}{}
+	require.Nil(suite.T(), json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(suite.T(), "*errors.fundamental", line["cause"])
+	assert.NotContains(suite.T(), buf.String(), "customer0@gmail.com")
+	assert.NotContains(suite.T(), buf.String(), "abcdefgh")
+
+	// the response refers to the log line rather than telling the error
+	requestID, _ := line["request_id"].(string)
+	require.NotEmpty(suite.T(), requestID)
+	assert.EqualValues(suite.T(), `{"code":"internal_error","message":"internal error","request_id":"`+requestID+`"}`+"\n", w.Body.String())
+}
@@ -0,0 +1,45 @@
+package voucher
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/ingemar0720/voucher-pool/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func (suite *TestSuite) TestMetrics() {
+	suite.srv.Metrics = metrics.New()
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
+
+	for i := 0; i < 2; i++ {
+		httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "abc"}`)), suite.srv, suite.srv.ValidateHanlder)
+	}
+	httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "unknown"}`)), suite.srv, suite.srv.ValidateHanlder)
+	tomorrow := time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+	reqBody := `{"email": "customer1@gmail.com", "offer_name": "apple_store", "discount": 54.30, "expiry": "` + tomorrow + `"}`
+	resp, _ := httpTestHelper("POST", "http://vouchers/generate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.GenerateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+
+	resp, body := httpTestHelper("GET", "http://vouchers/metrics", nil, suite.srv, suite.srv.Metrics.Handler().ServeHTTP)
+	assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode)
+	for _, line := range []string{
+		`voucher_redemptions_total{endpoint="validate",outcome="redeemed"} 1`,
+		`voucher_redemptions_total{endpoint="validate",outcome="voucher_redeemed"} 1`,
+		`voucher_redemptions_total{endpoint="validate",outcome="voucher_not_found"} 1`,
+		`voucher_generated_total{assignment="customer",mode="single"} 1`,
+	} {
+		assert.Contains(suite.T(), string(body), line)
+	}
+}
+
+func (suite *TestSuite) TestMetricsDisabled() {
+	// a service without metrics records nothing and does not fail
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
+	w := httptest.NewRecorder()
+	suite.srv.ValidateHanlder(w, httptest.NewRequest("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "abc"}`))))
+	assert.EqualValues(suite.T(), http.StatusCreated, w.Code)
+}
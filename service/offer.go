@@ -0,0 +1,368 @@
+package voucher
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/ingemar0720/voucher-pool/money"
+	"github.com/ingemar0720/voucher-pool/rules"
+	"github.com/ingemar0720/voucher-pool/tracing"
+)
+
+const (
+	defaultOfferPageSize = 50
+	maxOfferPageSize     = 200
+)
+
+// OfferRequest creates an offer or replaces all of it, the discount fields are the same as of GenerateRequest
+type OfferRequest struct {
+	Name         string      `json:"name"`
+	Description  string      `json:"description"`
+	Discount     json.Number `json:"discount"`
+	DiscountType string      `json:"discount_type"`
+	Currency     string      `json:"currency"`
+	// StartsAt and EndsAt are the window the vouchers of the offer can be redeemed in, open if not given
+	StartsAt *time.Time `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at"`
+	// Active is true if not given
+	Active *bool `json:"active"`
+	// Rules are the eligibility rules an order shall meet, see package rules
+	Rules rules.Set `json:"rules"`
+	// Exclusive vouchers are redeemed alone, the others only together with codes of offers of the same StackGroup.
+	// MaxTotalDiscount caps the total discount of such a combination, a percentage of the order.
+	Exclusive        bool        `json:"exclusive"`
+	StackGroup       string      `json:"stack_group"`
+	MaxTotalDiscount json.Number `json:"max_total_discount"`
+}
+
+// OfferResponse is a special offer with the terms of its current version
+type OfferResponse struct {
+	ID          uint64 `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Version     int    `json:"version"`
+	// Discount is the percentage, or the amount in major units of Currency for fixed discounts
+	Discount      json.Number `json:"discount"`
+	DiscountType  string      `json:"discount_type"`
+	DiscountValue string      `json:"discount_value"`
+	Currency      string      `json:"currency,omitempty"`
+	StartsAt      *time.Time  `json:"starts_at,omitempty"`
+	EndsAt        *time.Time  `json:"ends_at,omitempty"`
+	Active        bool        `json:"active"`
+	ArchivedAt    *time.Time  `json:"archived_at,omitempty"`
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+	Rules         rules.Set   `json:"rules"`
+	Exclusive     bool        `json:"exclusive"`
+	StackGroup    string      `json:"stack_group,omitempty"`
+	// MaxTotalDiscount is an exact decimal percentage, not set if there is no cap
+	MaxTotalDiscount string `json:"max_total_discount,omitempty"`
+}
+
+// ListOffersResponse is a page of offers, NextAfterID is the after_id of the next page and not set on the last page
+type ListOffersResponse struct {
+	Offers      []OfferResponse `json:"offers"`
+	NextAfterID uint64          `json:"next_after_id,omitempty"`
+}
+
+// OfferVersionResponse is a version of a special offer, SupersededAt is set once a newer version is made
+type OfferVersionResponse struct {
+	ID      uint64 `json:"id"`
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+	// Discount is the percentage, or the amount in major units of Currency for fixed discounts
+	Discount      json.Number `json:"discount"`
+	DiscountType  string      `json:"discount_type"`
+	DiscountValue string      `json:"discount_value"`
+	Currency      string      `json:"currency,omitempty"`
+	CreatedAt     time.Time   `json:"created_at"`
+	SupersededAt  *time.Time  `json:"superseded_at,omitempty"`
+}
+
+func newOfferResponse(o dbmodel.DBModelOffer) (OfferResponse, error) {
+	d, err := o.Current.Terms()
+	if err != nil {
+		return OfferResponse{}, err
+	}
+	stacking, err := o.Stacking()
+	if err != nil {
+		return OfferResponse{}, err
+	}
+	resp := OfferResponse{
+		ID:            o.ID,
+		Name:          o.Current.Name,
+		Description:   o.Description,
+		Version:       o.Current.Version,
+		Discount:      json.Number(money.TrimDecimal(d.Decimal())),
+		DiscountType:  string(d.Type),
+		DiscountValue: d.Decimal(),
+		Currency:      d.Currency,
+		StartsAt:      timePtr(o.StartsAt),
+		EndsAt:        timePtr(o.EndsAt),
+		Active:        o.Active,
+		ArchivedAt:    timePtr(o.ArchivedAt),
+		CreatedAt:     o.CreatedAt,
+		UpdatedAt:     o.UpdatedAt,
+		Rules:         o.Rules.Copy(),
+		Exclusive:     stacking.Exclusive,
+		StackGroup:    stacking.Group,
+	}
+	if stacking.MaxTotalDiscount > 0 {
+		resp.MaxTotalDiscount = money.FormatDecimal(stacking.MaxTotalDiscount, money.PercentScale)
+	}
+	return resp, nil
+}
+
+func newOfferVersionResponse(o dbmodel.DBModelSpecialOffer) (OfferVersionResponse, error) {
+	d, err := o.Terms()
+	if err != nil {
+		return OfferVersionResponse{}, err
+	}
+	return OfferVersionResponse{
+		ID:            o.ID,
+		Name:          o.Name,
+		Version:       o.Version,
+		Discount:      json.Number(money.TrimDecimal(d.Decimal())),
+		DiscountType:  string(d.Type),
+		DiscountValue: d.Decimal(),
+		Currency:      d.Currency,
+		CreatedAt:     o.CreatedAt,
+		SupersededAt:  timePtr(o.SupersededAt),
+	}, nil
+}
+
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
+
+// parseOfferRequest decodes the body into the spec of the offer, the status and message are set if it is invalid
+func parseOfferRequest(r *http.Request) (dbmodel.OfferSpec, int, string) {
+	or := OfferRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&or); err != nil {
+		return dbmodel.OfferSpec{}, http.StatusBadRequest, err.Error()
+	}
+	if strings.TrimSpace(or.Name) == "" {
+		return dbmodel.OfferSpec{}, http.StatusUnprocessableEntity, "name shall not be empty"
+	}
+	d, msg := parseDiscount(or.DiscountType, or.Discount, or.Currency)
+	if msg != "" {
+		return dbmodel.OfferSpec{}, http.StatusUnprocessableEntity, msg
+	}
+	if or.StartsAt != nil && or.EndsAt != nil && !or.StartsAt.Before(*or.EndsAt) {
+		return dbmodel.OfferSpec{}, http.StatusUnprocessableEntity, "starts_at shall be before ends_at"
+	}
+	if err := or.Rules.Validate(); err != nil {
+		return dbmodel.OfferSpec{}, http.StatusUnprocessableEntity, err.Error()
+	}
+	stacking := dbmodel.Stacking{Exclusive: or.Exclusive, Group: strings.TrimSpace(or.StackGroup)}
+	if or.MaxTotalDiscount != "" {
+		max, err := money.ParseDecimal(or.MaxTotalDiscount.String(), money.PercentScale)
+		if err != nil || max <= 0 || max > 100*100 {
+			return dbmodel.OfferSpec{}, http.StatusUnprocessableEntity, "max_total_discount shall bigger than 0 or less than 100.00"
+		}
+		stacking.MaxTotalDiscount = max
+	}
+	spec := dbmodel.OfferSpec{
+		Name:        or.Name,
+		Description: or.Description,
+		Discount:    d,
+		StartsAt:    nullTime(or.StartsAt),
+		EndsAt:      nullTime(or.EndsAt),
+		Active:      or.Active == nil || *or.Active,
+		Rules:       or.Rules,
+		Stacking:    stacking,
+	}
+	return spec, 0, ""
+}
+
+// offerID returns the id of the offer in the URL, false if it is not a valid id
+func offerID(r *http.Request) (uint64, bool) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id == 0 {
+		return 0, false
+	}
+	tracing.SetOffers(r.Context(), id)
+	return id, true
+}
+
+// CreateOfferHandler creates an offer, vouchers can then be generated for it by its id
+func (srv *VoucherSrv) CreateOfferHandler(w http.ResponseWriter, r *http.Request) {
+	spec, status, msg := parseOfferRequest(r)
+	if status == http.StatusBadRequest {
+		writeErrorResponse(w, status, CodeBadRequest, msg)
+		return
+	}
+	if msg != "" {
+		writeErrorResponse(w, status, CodeInvalidRequest, msg)
+		return
+	}
+	offer, err := srv.Store.CreateOffer(r.Context(), spec)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeOffer(w, r, http.StatusCreated, offer)
+}
+
+func (srv *VoucherSrv) GetOfferHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := offerID(r)
+	if !ok {
+		writeErrorResponse(w, http.StatusNotFound, CodeOfferNotFound, dbmodel.ErrOfferNotFound.Error())
+		return
+	}
+	offer, err := srv.Store.GetOffer(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeOffer(w, r, http.StatusOK, offer)
+}
+
+// ListOffersHandler returns a page of the offers in the order of their ids, archived offers are left out unless
+// archived=true. The next page is asked for with after_id.
+func (srv *VoucherSrv) ListOffersHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := dbmodel.OfferFilter{Limit: defaultOfferPageSize}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxOfferPageSize {
+			writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, "limit shall be between 1 and "+strconv.Itoa(maxOfferPageSize))
+			return
+		}
+		filter.Limit = limit
+	}
+	if v := q.Get("after_id"); v != "" {
+		afterID, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, "after_id shall be an offer id")
+			return
+		}
+		filter.AfterID = afterID
+	}
+	if v := q.Get("archived"); v != "" {
+		archived, err := strconv.ParseBool(v)
+		if err != nil {
+			writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, "archived shall be true or false")
+			return
+		}
+		filter.Archived = archived
+	}
+
+	// one more offer tells if there is a next page
+	pageSize := filter.Limit
+	filter.Limit++
+	offers, err := srv.Store.ListOffers(r.Context(), filter)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	resp := ListOffersResponse{Offers: make([]OfferResponse, 0, len(offers))}
+	if len(offers) > pageSize {
+		offers = offers[:pageSize]
+		resp.NextAfterID = offers[pageSize-1].ID
+	}
+	for _, o := range offers {
+		offer, err := newOfferResponse(o)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		resp.Offers = append(resp.Offers, offer)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// UpdateOfferHandler replaces the offer. A change of the name or the discount makes a new version of the offer,
+// the vouchers issued before keep the discount they were issued with.
+func (srv *VoucherSrv) UpdateOfferHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := offerID(r)
+	if !ok {
+		writeErrorResponse(w, http.StatusNotFound, CodeOfferNotFound, dbmodel.ErrOfferNotFound.Error())
+		return
+	}
+	spec, status, msg := parseOfferRequest(r)
+	if status == http.StatusBadRequest {
+		writeErrorResponse(w, status, CodeBadRequest, msg)
+		return
+	}
+	if msg != "" {
+		writeErrorResponse(w, status, CodeInvalidRequest, msg)
+		return
+	}
+	offer, err := srv.Store.UpdateOffer(r.Context(), id, spec)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeOffer(w, r, http.StatusOK, offer)
+}
+
+// ArchiveOfferHandler archives the offer, its vouchers cannot be generated or redeemed any more
+func (srv *VoucherSrv) ArchiveOfferHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := offerID(r)
+	if !ok {
+		writeErrorResponse(w, http.StatusNotFound, CodeOfferNotFound, dbmodel.ErrOfferNotFound.Error())
+		return
+	}
+	offer, err := srv.Store.ArchiveOffer(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeOffer(w, r, http.StatusOK, offer)
+}
+
+// GetOfferHistoryHandler returns the versions of the offer, the oldest first
+func (srv *VoucherSrv) GetOfferHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := offerID(r)
+	if !ok {
+		writeErrorResponse(w, http.StatusNotFound, CodeOfferNotFound, dbmodel.ErrOfferNotFound.Error())
+		return
+	}
+	offers, err := srv.Store.GetOfferHistory(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	resp := make([]OfferVersionResponse, 0, len(offers))
+	for _, o := range offers {
+		offer, err := newOfferVersionResponse(o)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		resp = append(resp, offer)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeOffer(w http.ResponseWriter, r *http.Request, status int, o dbmodel.DBModelOffer) {
+	resp, err := newOfferResponse(o)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
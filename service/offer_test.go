@@ -0,0 +1,172 @@
+package voucher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// idRequest calls handler with the id of the offer or the customer as URL parameter
+func (suite *TestSuite) idRequest(method, url, id string, body io.Reader, handler http.HandlerFunc) (*http.Response, []byte) {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id)
+	return httpTestHelper(method, url, body, suite.srv, func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx)))
+	})
+}
+
+// createOffer creates the offer of reqBody and returns it
+func (suite *TestSuite) createOffer(reqBody string) OfferResponse {
+	resp, body := httpTestHelper("POST", "http://offers", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.CreateOfferHandler)
+	require.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode, string(body))
+	offer := OfferResponse{}
+	require.Nil(suite.T(), json.Unmarshal(body, &offer))
+	return offer
+}
+
+func (suite *TestSuite) TestOfferLifecycle() {
+	resp, body := httpTestHelper("POST", "http://offers", bytes.NewBuffer([]byte(`{"name": "summer", "discount": 101}`)), suite.srv, suite.srv.CreateOfferHandler)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"discount shall bigger than 0 or less than 100.00"}`+"\n", string(body))
+	resp, body = httpTestHelper("POST", "http://offers", bytes.NewBuffer([]byte(`{"name": "summer", "discount": 10, "starts_at": "2021-09-01T00:00:00Z", "ends_at": "2021-08-01T00:00:00Z"}`)), suite.srv, suite.srv.CreateOfferHandler)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"starts_at shall be before ends_at"}`+"\n", string(body))
+
+	offer := suite.createOffer(`{"name": "summer", "description": "summer sale", "discount": 10}`)
+	assert.EqualValues(suite.T(), "10.00", offer.DiscountValue)
+	assert.EqualValues(suite.T(), 1, offer.Version)
+	assert.True(suite.T(), offer.Active)
+	id := fmt.Sprint(offer.ID)
+	resp, body = httpTestHelper("POST", "http://offers", bytes.NewBuffer([]byte(`{"name": "summer", "discount": 20}`)), suite.srv, suite.srv.CreateOfferHandler)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"offer_conflict","message":"special offer conflicts with its constraints"}`+"\n", string(body))
+
+	resp, body = suite.idRequest("GET", "http://offers/"+id, id, nil, suite.srv.GetOfferHandler)
+	assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode)
+	got := OfferResponse{}
+	assert.Nil(suite.T(), json.Unmarshal(body, &got))
+	assert.EqualValues(suite.T(), "summer sale", got.Description)
+	resp, _ = suite.idRequest("GET", "http://offers/abc", "abc", nil, suite.srv.GetOfferHandler)
+	assert.EqualValues(suite.T(), http.StatusNotFound, resp.StatusCode)
+
+	// vouchers are generated for the offer by its id
+	expiry := time.Now().Add(time.Hour).Format(time.RFC3339)
+	reqBody := `{"email": "customer0@gmail.com", "offer_id": ` + id + `, "offer_name": "summer", "expiry": "` + expiry + `"}`
+	resp, body = httpTestHelper("POST", "http://vouchers/generate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.GenerateHanlder)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"offer_id shall not be given with offer_name or discount"}`+"\n", string(body))
+	reqBody = `{"email": "customer0@gmail.com", "offer_id": ` + id + `, "expiry": "` + expiry + `"}`
+	resp, body = httpTestHelper("POST", "http://vouchers/generate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.GenerateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	generated := GenerateResponse{}
+	assert.Nil(suite.T(), json.Unmarshal(body, &generated))
+
+	// a new discount makes a new version, the voucher keeps the discount it was issued with
+	resp, body = suite.idRequest("PUT", "http://offers/"+id, id, bytes.NewBuffer([]byte(`{"name": "summer", "discount": 5, "discount_type": "fixed", "currency": "EUR"}`)), suite.srv.UpdateOfferHandler)
+	assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode)
+	updated := OfferResponse{}
+	assert.Nil(suite.T(), json.Unmarshal(body, &updated))
+	assert.EqualValues(suite.T(), 2, updated.Version)
+	assert.EqualValues(suite.T(), "5.00", updated.DiscountValue)
+	assert.EqualValues(suite.T(), "", updated.Description)
+	quoted, err := suite.srv.Store.QuoteVoucher(suite.srv.Ctx, "customer0@gmail.com", generated.Code)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), dbmodel.PercentageDiscount(1000), quoted.Discount)
+
+	// the vouchers of a deactivated offer fail validation
+	resp, _ = suite.idRequest("PUT", "http://offers/"+id, id, bytes.NewBuffer([]byte(`{"name": "summer", "discount": 5, "discount_type": "fixed", "currency": "EUR", "active": false}`)), suite.srv.UpdateOfferHandler)
+	assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode)
+	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "`+generated.Code+`"}`)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"offer_inactive","message":"special offer is deactivated"}`+"\n", string(body))
+
+	// archived offers cannot be changed or issued any more
+	resp, body = suite.idRequest("DELETE", "http://offers/"+id, id, nil, suite.srv.ArchiveOfferHandler)
+	assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode)
+	archived := OfferResponse{}
+	assert.Nil(suite.T(), json.Unmarshal(body, &archived))
+	assert.NotNil(suite.T(), archived.ArchivedAt)
+	resp, body = suite.idRequest("PUT", "http://offers/"+id, id, bytes.NewBuffer([]byte(`{"name": "summer", "discount": 10}`)), suite.srv.UpdateOfferHandler)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"offer_archived","message":"special offer is archived"}`+"\n", string(body))
+	resp, body = httpTestHelper("POST", "http://vouchers/generate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.GenerateHanlder)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"offer_inactive","message":"special offer is deactivated"}`+"\n", string(body))
+
+	resp, body = suite.idRequest("GET", "http://offers/"+id+"/versions", id, nil, suite.srv.GetOfferHistoryHandler)
+	assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode)
+	history := []OfferVersionResponse{}
+	assert.Nil(suite.T(), json.Unmarshal(body, &history))
+	if assert.Len(suite.T(), history, 2) {
+		assert.EqualValues(suite.T(), "10.00", history[0].DiscountValue)
+		assert.NotNil(suite.T(), history[0].SupersededAt)
+		assert.EqualValues(suite.T(), "EUR", history[1].Currency)
+		assert.Nil(suite.T(), history[1].SupersededAt)
+	}
+	resp, _ = suite.idRequest("GET", "http://offers/100/versions", "100", nil, suite.srv.GetOfferHistoryHandler)
+	assert.EqualValues(suite.T(), http.StatusNotFound, resp.StatusCode)
+}
+
+func (suite *TestSuite) TestOfferWindow() {
+	// the vouchers of an offer are not issued after it ends
+	ended := suite.createOffer(`{"name": "spring", "discount": 10, "starts_at": "2021-03-01T00:00:00Z", "ends_at": "2021-06-01T00:00:00Z"}`)
+	reqBody := fmt.Sprintf(`{"email": "customer0@gmail.com", "offer_id": %v, "expiry": "%v"}`, ended.ID, time.Now().Add(time.Hour).Format(time.RFC3339))
+	resp, body := httpTestHelper("POST", "http://vouchers/generate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.GenerateHanlder)
+	assert.EqualValues(suite.T(), http.StatusGone, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"offer_ended","message":"special offer has ended"}`+"\n", string(body))
+
+	// and not redeemed before it starts
+	startsAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	upcoming := suite.createOffer(`{"name": "autumn", "discount": 10, "starts_at": "` + startsAt + `"}`)
+	reqBody = fmt.Sprintf(`{"email": "customer0@gmail.com", "offer_id": %v, "expiry": "%v"}`, upcoming.ID, time.Now().Add(2*time.Hour).Format(time.RFC3339))
+	resp, body = httpTestHelper("POST", "http://vouchers/generate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.GenerateHanlder)
+	require.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	generated := GenerateResponse{}
+	assert.Nil(suite.T(), json.Unmarshal(body, &generated))
+	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "`+generated.Code+`"}`)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"offer_not_started","message":"special offer has not started yet"}`+"\n", string(body))
+}
+
+func (suite *TestSuite) TestListOffers() {
+	for _, name := range []string{"spring", "summer", "autumn"} {
+		suite.createOffer(`{"name": "` + name + `", "discount": 10}`)
+	}
+	list := func(query string) ListOffersResponse {
+		resp, body := httpTestHelper("GET", "http://offers"+query, nil, suite.srv, suite.srv.ListOffersHandler)
+		require.EqualValues(suite.T(), http.StatusOK, resp.StatusCode, string(body))
+		page := ListOffersResponse{}
+		require.Nil(suite.T(), json.Unmarshal(body, &page))
+		return page
+	}
+
+	page := list("?limit=2")
+	if assert.Len(suite.T(), page.Offers, 2) {
+		assert.EqualValues(suite.T(), "spring", page.Offers[0].Name)
+		assert.EqualValues(suite.T(), page.Offers[1].ID, page.NextAfterID)
+	}
+	page = list(fmt.Sprintf("?limit=2&after_id=%v", page.NextAfterID))
+	if assert.Len(suite.T(), page.Offers, 1) {
+		assert.EqualValues(suite.T(), "autumn", page.Offers[0].Name)
+		assert.Zero(suite.T(), page.NextAfterID)
+	}
+
+	id := fmt.Sprint(page.Offers[0].ID)
+	resp, _ := suite.idRequest("DELETE", "http://offers/"+id, id, nil, suite.srv.ArchiveOfferHandler)
+	assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode)
+	assert.Len(suite.T(), list("").Offers, 2)
+	assert.Len(suite.T(), list("?archived=true").Offers, 3)
+
+	resp, body := httpTestHelper("GET", "http://offers?limit=0", nil, suite.srv, suite.srv.ListOffersHandler)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"limit shall be between 1 and 200"}`+"\n", string(body))
+}
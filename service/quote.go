@@ -0,0 +1,250 @@
+package voucher
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/ingemar0720/voucher-pool/logging"
+	"github.com/ingemar0720/voucher-pool/money"
+	"github.com/pkg/errors"
+)
+
+const (
+	// rounding of percentage discounts to the minor unit of the currency
+	roundingHalfUp = "half_up"
+	// largest amount of an order in minor units, so a discount of 100% in basis points cannot overflow
+	maxOrderAmount = math.MaxInt64 / 10000
+)
+
+type QuoteItem struct {
+	Name      string      `json:"name"`
+	Quantity  int64       `json:"quantity"`
+	UnitPrice json.Number `json:"unit_price"`
+	// SKU and Category are matched by the sku and category rules of the offer
+	SKU      string `json:"sku"`
+	Category string `json:"category"`
+}
+
+// OrderRequest is the order a voucher is applied to, of Amount or of the sum of Items in Currency
+type OrderRequest struct {
+	Amount   json.Number `json:"amount"`
+	Currency string      `json:"currency"`
+	Items    []QuoteItem `json:"items"`
+	// Channel is the sales channel the order is placed through, like web or app
+	Channel string `json:"channel"`
+	// PreviousOrders is how many orders the customer placed before, first_order rules need it
+	PreviousOrders *int `json:"previous_orders"`
+}
+
+// QuoteRequest prices the order with the voucher of Code
+type QuoteRequest struct {
+	Code  string `json:"code"`
+	Email string `json:"email"`
+	OrderRequest
+}
+
+type QuoteLine struct {
+	Name           string `json:"name"`
+	Quantity       int64  `json:"quantity"`
+	UnitPrice      string `json:"unit_price"`
+	OriginalAmount string `json:"original_amount"`
+	DiscountAmount string `json:"discount_amount"`
+	FinalAmount    string `json:"final_amount"`
+}
+
+// QuoteRounding tells how the discount was rounded to the minor unit of the currency, Adjustment is DiscountAmount minus ExactDiscount
+type QuoteRounding struct {
+	Mode          string `json:"mode"`
+	ExactDiscount string `json:"exact_discount"`
+	Adjustment    string `json:"adjustment"`
+}
+
+// QuoteResponse amounts are exact decimals in Currency, the discount of Items adds up to DiscountAmount
+type QuoteResponse struct {
+	Code           string        `json:"code"`
+	Currency       string        `json:"currency"`
+	DiscountType   string        `json:"discount_type"`
+	DiscountValue  string        `json:"discount_value"`
+	OriginalAmount string        `json:"original_amount"`
+	DiscountAmount string        `json:"discount_amount"`
+	FinalAmount    string        `json:"final_amount"`
+	Rounding       QuoteRounding `json:"rounding"`
+	Items          []QuoteLine   `json:"items,omitempty"`
+	// RemainingUses is how many more times the customer can redeem the voucher
+	RemainingUses int `json:"remaining_uses"`
+}
+
+// order is a validated OrderRequest, amounts are in minor units of currency
+type order struct {
+	currency money.Currency
+	amount   int64
+	items    []QuoteItem
+	// amount of every item, quantity times unit price
+	lines      []int64
+	unitPrices []int64
+}
+
+// QuoteHandler previews the price of an order with the voucher. It runs the same checks as ValidateHanlder
+// but does not mark the voucher as used.
+func (srv *VoucherSrv) QuoteHandler(w http.ResponseWriter, r *http.Request) {
+	qr := QuoteRequest{}
+	err := json.NewDecoder(r.Body).Decode(&qr)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+
+	//validate input
+	qr.Email, err = parseEmail(qr.Email)
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, err.Error())
+		return
+	}
+	logging.SetCustomer(r.Context(), qr.Email)
+	logging.SetVouchers(r.Context(), qr.Code)
+	o, msg := parseOrder(qr.OrderRequest)
+	if msg != "" {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, msg)
+		return
+	}
+	eligible, msg := eligibilityOrder(qr.OrderRequest, o)
+	if msg != "" {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, msg)
+		return
+	}
+
+	result, err := srv.Store.QuoteVoucher(r.Context(), qr.Email, qr.Code)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := result.Rules.Evaluate(eligible, time.Now()); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	discount := result.Discount
+	if discount.Type == dbmodel.DiscountFixed && discount.Currency != o.currency.Code {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeCurrencyMismatch,
+			fmt.Sprintf("voucher is a discount of %v, the order is in %v", discount.Currency, o.currency.Code))
+		return
+	}
+	resp, err := quote(qr.Code, discount, o)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	resp.RemainingUses = result.RemainingUses
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseOrder returns the priced order of the request, or why it is invalid
+func parseOrder(qr OrderRequest) (order, string) {
+	c, err := money.LookupCurrency(strings.ToUpper(qr.Currency))
+	if err != nil {
+		return order{}, "currency shall be a supported ISO 4217 code"
+	}
+	o := order{currency: c, items: qr.Items}
+	for _, item := range qr.Items {
+		unitPrice, err := money.ParseDecimal(item.UnitPrice.String(), c.Exponent)
+		if err != nil || unitPrice < 0 {
+			return order{}, fmt.Sprintf("unit_price of %q shall be an amount of %v with at most %v decimal places", item.Name, c.Code, c.Exponent)
+		}
+		if item.Quantity <= 0 {
+			return order{}, fmt.Sprintf("quantity of %q shall be positive", item.Name)
+		}
+		if unitPrice > 0 && item.Quantity > math.MaxInt64/unitPrice || item.Quantity*unitPrice > math.MaxInt64-o.amount {
+			return order{}, "amount of the order is too large"
+		}
+		line := item.Quantity * unitPrice
+		o.unitPrices = append(o.unitPrices, unitPrice)
+		o.lines = append(o.lines, line)
+		o.amount += line
+	}
+	if qr.Amount == "" && len(qr.Items) == 0 {
+		return order{}, "either amount or items shall be given"
+	}
+	if qr.Amount != "" {
+		amount, err := money.ParseDecimal(qr.Amount.String(), c.Exponent)
+		if err != nil || amount < 0 {
+			return order{}, fmt.Sprintf("amount shall be an amount of %v with at most %v decimal places", c.Code, c.Exponent)
+		}
+		if len(qr.Items) > 0 && amount != o.amount {
+			return order{}, fmt.Sprintf("amount shall equal the sum of the items %v", money.FormatDecimal(o.amount, c.Exponent))
+		}
+		o.amount = amount
+	}
+	if o.amount > maxOrderAmount {
+		return order{}, fmt.Sprintf("amount of the order shall be at most %v", money.FormatDecimal(maxOrderAmount, c.Exponent))
+	}
+	return o, ""
+}
+
+// quote applies the discount to the order. Percentage discounts are rounded half up to the minor unit, fixed discounts
+// are capped at the amount of the order. The discount is split over the items in proportion to their amount.
+func quote(code string, discount dbmodel.Discount, o order) (QuoteResponse, error) {
+	exp := o.currency.Exponent
+	var off, exact int64
+	var exactScale int
+	switch discount.Type {
+	case dbmodel.DiscountFixed:
+		off = discount.Value
+		if off > o.amount {
+			off = o.amount
+		}
+		exact, exactScale = off, exp
+	default:
+		var err error
+		off, exact, err = money.Percent(o.amount, discount.Value)
+		if err != nil {
+			return QuoteResponse{}, errors.Wrapf(err, "fail to apply discount %v", discount)
+		}
+		exactScale = exp + 2*money.PercentScale
+	}
+	resp := QuoteResponse{
+		Code:           code,
+		Currency:       o.currency.Code,
+		DiscountType:   string(discount.Type),
+		DiscountValue:  discount.Decimal(),
+		OriginalAmount: money.FormatDecimal(o.amount, exp),
+		DiscountAmount: money.FormatDecimal(off, exp),
+		FinalAmount:    money.FormatDecimal(o.amount-off, exp),
+		Rounding: QuoteRounding{
+			Mode:          roundingHalfUp,
+			ExactDiscount: money.TrimDecimal(money.FormatDecimal(exact, exactScale)),
+			Adjustment:    money.TrimDecimal(money.FormatDecimal(off*pow10(exactScale-exp)-exact, exactScale)),
+		},
+	}
+	if len(o.items) == 0 {
+		return resp, nil
+	}
+	parts, err := money.Allocate(off, o.lines)
+	if err != nil {
+		return QuoteResponse{}, errors.Wrapf(err, "fail to split discount over the items")
+	}
+	for i, item := range o.items {
+		resp.Items = append(resp.Items, QuoteLine{
+			Name:           item.Name,
+			Quantity:       item.Quantity,
+			UnitPrice:      money.FormatDecimal(o.unitPrices[i], exp),
+			OriginalAmount: money.FormatDecimal(o.lines[i], exp),
+			DiscountAmount: money.FormatDecimal(parts[i], exp),
+			FinalAmount:    money.FormatDecimal(o.lines[i]-parts[i], exp),
+		})
+	}
+	return resp, nil
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
@@ -0,0 +1,112 @@
+package voucher
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/stretchr/testify/assert"
+)
+
+func (suite *TestSuite) TestQuoteHandler() {
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
+	suite.seedVoucher("customer0@gmail.com", "ten_off", dbmodel.FixedDiscount(1000, "EUR"), "fixed", time.Now().Add(24*time.Hour))
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "expired", time.Now().Add(-24*time.Hour))
+
+	for _, tc := range []struct {
+		name       string
+		reqBody    string
+		wantStatus int
+		want       string
+	}{
+		{
+			name:       "invalid email",
+			reqBody:    `{"email": "invalid_email", "code": "abc", "amount": 10, "currency": "EUR"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"invalid_request","message":"mail: missing '@' or angle-addr"}`,
+		},
+		{
+			name:       "unknown currency",
+			reqBody:    `{"email": "customer0@gmail.com", "code": "abc", "amount": 10}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"invalid_request","message":"currency shall be a supported ISO 4217 code"}`,
+		},
+		{
+			name:       "neither amount nor items",
+			reqBody:    `{"email": "customer0@gmail.com", "code": "abc", "currency": "EUR"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"invalid_request","message":"either amount or items shall be given"}`,
+		},
+		{
+			name:       "amount finer than the minor unit",
+			reqBody:    `{"email": "customer0@gmail.com", "code": "abc", "amount": 10.001, "currency": "EUR"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"invalid_request","message":"amount shall be an amount of EUR with at most 2 decimal places"}`,
+		},
+		{
+			name:       "amount not matching the items",
+			reqBody:    `{"email": "customer0@gmail.com", "code": "abc", "amount": 10, "currency": "EUR", "items": [{"name": "tea", "quantity": 2, "unit_price": 4.5}]}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"invalid_request","message":"amount shall equal the sum of the items 9.00"}`,
+		},
+		{
+			name:       "item without quantity",
+			reqBody:    `{"email": "customer0@gmail.com", "code": "abc", "currency": "EUR", "items": [{"name": "tea", "unit_price": 4.5}]}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"invalid_request","message":"quantity of \"tea\" shall be positive"}`,
+		},
+		{
+			name:       "voucher of another customer",
+			reqBody:    `{"email": "customer1@gmail.com", "code": "abc", "amount": 10, "currency": "EUR"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"voucher_not_owned","message":"voucher belongs to another customer"}`,
+		},
+		{
+			name:       "voucher expired",
+			reqBody:    `{"email": "customer0@gmail.com", "code": "expired", "amount": 10, "currency": "EUR"}`,
+			wantStatus: http.StatusGone,
+			want:       `{"code":"voucher_expired","message":"voucher expired"}`,
+		},
+		{
+			name:       "fixed discount in another currency",
+			reqBody:    `{"email": "customer0@gmail.com", "code": "fixed", "amount": 10, "currency": "USD"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"currency_mismatch","message":"voucher is a discount of EUR, the order is in USD"}`,
+		},
+		{
+			name:       "percentage rounded half up",
+			reqBody:    `{"email": "customer0@gmail.com", "code": "abc", "amount": 10.01, "currency": "EUR"}`,
+			wantStatus: http.StatusOK,
+			want: `{"code":"abc","currency":"EUR","discount_type":"percentage","discount_value":"38.50","original_amount":"10.01","discount_amount":"3.85","final_amount":"6.16",` +
+				`"rounding":{"mode":"half_up","exact_discount":"3.85385","adjustment":"-0.00385"},"remaining_uses":1}`,
+		},
+		{
+			name:       "percentage split over the items",
+			reqBody:    `{"email": "customer0@gmail.com", "code": "abc", "currency": "eur", "items": [{"name": "tea", "quantity": 3, "unit_price": 1}, {"name": "cake", "quantity": 1, "unit_price": 2}]}`,
+			wantStatus: http.StatusOK,
+			want: `{"code":"abc","currency":"EUR","discount_type":"percentage","discount_value":"38.50","original_amount":"5.00","discount_amount":"1.93","final_amount":"3.07",` +
+				`"rounding":{"mode":"half_up","exact_discount":"1.925","adjustment":"0.005"},"items":[` +
+				`{"name":"tea","quantity":3,"unit_price":"1.00","original_amount":"3.00","discount_amount":"1.16","final_amount":"1.84"},` +
+				`{"name":"cake","quantity":1,"unit_price":"2.00","original_amount":"2.00","discount_amount":"0.77","final_amount":"1.23"}],"remaining_uses":1}`,
+		},
+		{
+			name:       "fixed discount capped at the amount",
+			reqBody:    `{"email": "customer0@gmail.com", "code": "fixed", "amount": 7.5, "currency": "EUR"}`,
+			wantStatus: http.StatusOK,
+			want: `{"code":"fixed","currency":"EUR","discount_type":"fixed","discount_value":"10.00","original_amount":"7.50","discount_amount":"7.50","final_amount":"0.00",` +
+				`"rounding":{"mode":"half_up","exact_discount":"7.5","adjustment":"0"},"remaining_uses":1}`,
+		},
+	} {
+		resp, body := httpTestHelper("POST", "http://vouchers/quote", bytes.NewBuffer([]byte(tc.reqBody)), suite.srv, suite.srv.QuoteHandler)
+		assert.EqualValues(suite.T(), tc.wantStatus, resp.StatusCode, tc.name)
+		assert.EqualValues(suite.T(), tc.want+"\n", string(body), tc.name)
+	}
+
+	// quoting does not use the voucher
+	resp, _ := httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "abc"}`)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	resp, body := httpTestHelper("POST", "http://vouchers/quote", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "abc", "amount": 10, "currency": "EUR"}`)), suite.srv, suite.srv.QuoteHandler)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"voucher_redeemed","message":"this voucher has been redeemed"}`+"\n", string(body))
+}
@@ -0,0 +1,99 @@
+package voucher
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/ingemar0720/voucher-pool/logging"
+)
+
+// ReverseRequest reverses a redemption of the voucher of Code, ReversedBy tells who reverses it, e.g. an operator or a system
+type ReverseRequest struct {
+	Code       string `json:"code"`
+	ReversedBy string `json:"reversed_by"`
+	Reason     string `json:"reason"`
+	// refuse to reverse the redemption if the voucher has expired
+	UnexpiredOnly bool `json:"unexpired_only"`
+	// the redemption to reverse, the latest one not reversed yet if 0
+	RedemptionID uint64 `json:"redemption_id"`
+}
+
+type RedemptionResponse struct {
+	ID             uint64     `json:"id"`
+	Code           string     `json:"code"`
+	Email          string     `json:"email"`
+	RedeemedAt     time.Time  `json:"redeemed_at"`
+	ReversedAt     *time.Time `json:"reversed_at,omitempty"`
+	ReversedBy     string     `json:"reversed_by,omitempty"`
+	ReversalReason string     `json:"reversal_reason,omitempty"`
+}
+
+func newRedemptionResponse(r dbmodel.DBModelRedemption) RedemptionResponse {
+	resp := RedemptionResponse{
+		ID:             r.ID,
+		Code:           r.Code,
+		Email:          r.Email,
+		RedeemedAt:     r.RedeemedAt,
+		ReversedBy:     r.ReversedBy.String,
+		ReversalReason: r.ReversalReason.String,
+	}
+	if r.ReversedAt.Valid {
+		resp.ReversedAt = &r.ReversedAt.Time
+	}
+	return resp
+}
+
+// ReverseHandler un-redeems a voucher, e.g. when the order is refunded, so it can be redeemed again.
+// The redemption is kept with who reversed it, when and why.
+func (srv *VoucherSrv) ReverseHandler(w http.ResponseWriter, r *http.Request) {
+	rr := ReverseRequest{}
+	err := json.NewDecoder(r.Body).Decode(&rr)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+
+	logging.SetVouchers(r.Context(), rr.Code)
+
+	//validate input
+	if strings.TrimSpace(rr.ReversedBy) == "" {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, "reversed_by shall be given")
+		return
+	}
+
+	redemption, err := srv.Store.ReverseRedemption(r.Context(), rr.Code, dbmodel.Reversal{
+		By:            rr.ReversedBy,
+		Reason:        rr.Reason,
+		UnexpiredOnly: rr.UnexpiredOnly,
+		RedemptionID:  rr.RedemptionID,
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(newRedemptionResponse(redemption))
+}
+
+// GetRedemptionsHandler returns the audit trail of a voucher, its redemptions and their reversals in the order they happened
+func (srv *VoucherSrv) GetRedemptionsHandler(w http.ResponseWriter, r *http.Request) {
+	code := chi.URLParam(r, "code")
+	logging.SetVouchers(r.Context(), code)
+	redemptions, err := srv.Store.GetRedemptions(r.Context(), code)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	resp := make([]RedemptionResponse, 0, len(redemptions))
+	for _, redemption := range redemptions {
+		resp = append(resp, newRedemptionResponse(redemption))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
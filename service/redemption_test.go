@@ -0,0 +1,64 @@
+package voucher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/stretchr/testify/assert"
+)
+
+func (suite *TestSuite) getRedemptions(code string) (*http.Response, []byte) {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("code", code)
+	return httpTestHelper("GET", "http://vouchers/"+code+"/redemptions", nil, suite.srv, func(w http.ResponseWriter, r *http.Request) {
+		suite.srv.GetRedemptionsHandler(w, r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx)))
+	})
+}
+
+func (suite *TestSuite) TestReverseHandler() {
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
+	reverse := func(reqBody string) (*http.Response, []byte) {
+		return httpTestHelper("POST", "http://vouchers/reverse", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.ReverseHandler)
+	}
+
+	resp, body := reverse(`{"code": "abc"}`)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"reversed_by shall be given"}`+"\n", string(body))
+	resp, body = reverse(`{"code": "unknown", "reversed_by": "support"}`)
+	assert.EqualValues(suite.T(), http.StatusNotFound, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"voucher_not_found","message":"voucher not found"}`+"\n", string(body))
+	resp, body = reverse(`{"code": "abc", "reversed_by": "support"}`)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"voucher_not_redeemed","message":"voucher has not been redeemed"}`+"\n", string(body))
+
+	resp, _ = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "abc"}`)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	resp, body = reverse(`{"code": "abc", "reversed_by": "support", "reason": "order refunded", "unexpired_only": true}`)
+	assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode)
+	reversed := RedemptionResponse{}
+	assert.Nil(suite.T(), json.Unmarshal(body, &reversed))
+	assert.EqualValues(suite.T(), "customer0@gmail.com", reversed.Email)
+	assert.NotNil(suite.T(), reversed.ReversedAt)
+	assert.EqualValues(suite.T(), "support", reversed.ReversedBy)
+	assert.EqualValues(suite.T(), "order refunded", reversed.ReversalReason)
+
+	// the voucher is valid again and the audit trail keeps both redemptions
+	resp, _ = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "abc"}`)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	resp, body = suite.getRedemptions("abc")
+	assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode)
+	redemptions := []RedemptionResponse{}
+	assert.Nil(suite.T(), json.Unmarshal(body, &redemptions))
+	if assert.Len(suite.T(), redemptions, 2) {
+		assert.EqualValues(suite.T(), reversed.ID, redemptions[0].ID)
+		assert.NotNil(suite.T(), redemptions[0].ReversedAt)
+		assert.Nil(suite.T(), redemptions[1].ReversedAt)
+	}
+	resp, _ = suite.getRedemptions("unknown")
+	assert.EqualValues(suite.T(), http.StatusNotFound, resp.StatusCode)
+}
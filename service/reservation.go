@@ -0,0 +1,156 @@
+package voucher
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultReservationTTL = 15 * time.Minute
+	// upper bound of ttl_seconds of ReserveRequest
+	maxReservationTTL = time.Hour
+	// DefaultSweepInterval is how often RunReservationSweeper releases expired reservations and idempotency keys
+	DefaultSweepInterval = time.Minute
+)
+
+type ReserveRequest struct {
+	Code  string `json:"code"`
+	Email string `json:"email"`
+	// TTLSeconds is how long the voucher is held, VoucherSrv.ReservationTTL if 0
+	TTLSeconds int `json:"ttl_seconds"`
+	// Order is evaluated against the rules of the offer like by ValidateHanlder, confirming does not evaluate them again
+	Order *OrderRequest `json:"order"`
+}
+
+type ReserveResponse struct {
+	ReservationID string    `json:"reservation_id"`
+	Code          string    `json:"code"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	ValidateResponse
+}
+
+type ReservationRequest struct {
+	ReservationID string `json:"reservation_id"`
+}
+
+// ReserveHandler runs the checks of ValidateHanlder and holds the voucher until the reservation is confirmed,
+// released or expires. The voucher cannot be validated or reserved again meanwhile.
+func (srv *VoucherSrv) ReserveHandler(w http.ResponseWriter, r *http.Request) {
+	rr := ReserveRequest{}
+	err := json.NewDecoder(r.Body).Decode(&rr)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+
+	//validate input
+	rr.Email, err = parseEmail(rr.Email)
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, err.Error())
+		return
+	}
+	logging.SetCustomer(r.Context(), rr.Email)
+	logging.SetVouchers(r.Context(), rr.Code)
+	ttl := time.Duration(rr.TTLSeconds) * time.Second
+	if rr.TTLSeconds < 0 || ttl > maxReservationTTL {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, "ttl_seconds shall be in [0, 3600]")
+		return
+	}
+	if ttl == 0 {
+		ttl = srv.reservationTTL()
+	}
+	order, msg := parseValidateOrder(rr.Order)
+	if msg != "" {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, msg)
+		return
+	}
+
+	id, err := newRandomID()
+	if err != nil {
+		writeError(w, r, errors.Wrapf(err, "fail to generate reservation id"))
+		return
+	}
+	expiresAt := time.Now().Add(ttl)
+	result, err := srv.Store.ReserveVoucher(r.Context(), rr.Email, rr.Code, id, expiresAt, order)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ReserveResponse{ReservationID: id, Code: rr.Code, ExpiresAt: expiresAt, ValidateResponse: newValidateResponse(result)})
+}
+
+// ConfirmHandler redeems the use of the voucher held by the reservation, it responds like ValidateHanlder
+func (srv *VoucherSrv) ConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	rr := ReservationRequest{}
+	err := json.NewDecoder(r.Body).Decode(&rr)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	result, err := srv.Store.ConfirmReservation(r.Context(), rr.ReservationID)
+	if err != nil {
+		srv.redemptionFailed(w, r, "confirm", err)
+		return
+	}
+	srv.redeemed(r, "confirm", result)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newValidateResponse(result))
+}
+
+// ReleaseHandler cancels the reservation, so the use of the voucher it held is available again
+func (srv *VoucherSrv) ReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	rr := ReservationRequest{}
+	err := json.NewDecoder(r.Body).Decode(&rr)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	if err := srv.Store.ReleaseReservation(r.Context(), rr.ReservationID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RunReservationSweeper releases expired reservations and deletes expired idempotency keys every interval until ctx is
+// cancelled, it returns ctx.Err(). Expired reservations and keys have no effect anyway, the sweeper keeps their tables
+// small.
+func (srv *VoucherSrv) RunReservationSweeper(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			log := srv.Log.For(ctx)
+			released, err := srv.Store.ReleaseExpiredReservations(ctx, now)
+			if err != nil {
+				log.Error().Fields(srv.Log.ErrorFields(err)).Msg("fail to sweep reservations")
+			} else if released > 0 {
+				log.Info().Int64("released", released).Msg("released expired reservations")
+			}
+			deleted, err := srv.Store.DeleteExpiredIdempotencyKeys(ctx, now)
+			if err != nil {
+				log.Error().Fields(srv.Log.ErrorFields(err)).Msg("fail to sweep idempotency keys")
+			} else if deleted > 0 {
+				log.Info().Int64("deleted", deleted).Msg("deleted expired idempotency keys")
+			}
+		}
+	}
+}
+
+func (srv *VoucherSrv) reservationTTL() time.Duration {
+	if srv.ReservationTTL <= 0 {
+		return defaultReservationTTL
+	}
+	return srv.ReservationTTL
+}
@@ -0,0 +1,94 @@
+package voucher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/ingemar0720/voucher-pool/rules"
+	"github.com/stretchr/testify/assert"
+)
+
+func (suite *TestSuite) reserve(reqBody string) (*http.Response, ReserveResponse, []byte) {
+	resp, body := httpTestHelper("POST", "http://vouchers/reserve", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.ReserveHandler)
+	rr := ReserveResponse{}
+	json.Unmarshal(body, &rr)
+	return resp, rr, body
+}
+
+func reservationBody(id string) *bytes.Buffer {
+	return bytes.NewBuffer([]byte(`{"reservation_id": "` + id + `"}`))
+}
+
+func (suite *TestSuite) TestReserveHandler() {
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
+
+	resp, _, body := suite.reserve(`{"email": "invalid_email", "code": "abc"}`)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"mail: missing '@' or angle-addr"}`+"\n", string(body))
+	resp, _, body = suite.reserve(`{"email": "customer0@gmail.com", "code": "abc", "ttl_seconds": 3601}`)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"ttl_seconds shall be in [0, 3600]"}`+"\n", string(body))
+	resp, _, body = suite.reserve(`{"email": "customer1@gmail.com", "code": "abc"}`)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"voucher_not_owned","message":"voucher belongs to another customer"}`+"\n", string(body))
+
+	// the reserved voucher is held until it is released
+	resp, rr, _ := suite.reserve(`{"email": "customer0@gmail.com", "code": "abc"}`)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	assert.NotEmpty(suite.T(), rr.ReservationID)
+	assert.EqualValues(suite.T(), "abc", rr.Code)
+	assert.EqualValues(suite.T(), "38.50", rr.DiscountValue)
+	assert.WithinDuration(suite.T(), time.Now().Add(defaultReservationTTL), rr.ExpiresAt, time.Minute)
+	resp, _, body = suite.reserve(`{"email": "customer0@gmail.com", "code": "abc"}`)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"voucher_reserved","message":"voucher is reserved"}`+"\n", string(body))
+	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "abc"}`)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"voucher_reserved","message":"voucher is reserved"}`+"\n", string(body))
+
+	resp, _ = httpTestHelper("POST", "http://vouchers/release", reservationBody(rr.ReservationID), suite.srv, suite.srv.ReleaseHandler)
+	assert.EqualValues(suite.T(), http.StatusNoContent, resp.StatusCode)
+	resp, body = httpTestHelper("POST", "http://vouchers/release", reservationBody(rr.ReservationID), suite.srv, suite.srv.ReleaseHandler)
+	assert.EqualValues(suite.T(), http.StatusNotFound, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"reservation_not_found","message":"reservation not found"}`+"\n", string(body))
+
+	// confirm uses the voucher
+	resp, rr, _ = suite.reserve(`{"email": "customer0@gmail.com", "code": "abc", "ttl_seconds": 60}`)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	assert.WithinDuration(suite.T(), time.Now().Add(time.Minute), rr.ExpiresAt, 10*time.Second)
+	resp, body = httpTestHelper("POST", "http://vouchers/confirm", reservationBody(rr.ReservationID), suite.srv, suite.srv.ConfirmHandler)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"discount":38.5,"discount_type":"percentage","discount_value":"38.50","remaining_uses":0}`+"\n", string(body))
+	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "abc"}`)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"voucher_redeemed","message":"this voucher has been redeemed"}`+"\n", string(body))
+}
+
+func (suite *TestSuite) TestReservationSweeper() {
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
+	_, err := suite.srv.Store.ReserveVoucher(suite.srv.Ctx, "customer0@gmail.com", "abc", "expiring", time.Now().Add(50*time.Millisecond), rules.Order{})
+	assert.Nil(suite.T(), err)
+
+	time.Sleep(50 * time.Millisecond)
+	resp, _ := httpTestHelper("POST", "http://vouchers/confirm", reservationBody("expiring"), suite.srv, suite.srv.ConfirmHandler)
+	assert.EqualValues(suite.T(), http.StatusGone, resp.StatusCode)
+
+	// expired reservations are deleted by the sweeper
+	ctx, cancel := context.WithCancel(suite.srv.Ctx)
+	done := make(chan error)
+	go func() { done <- suite.srv.RunReservationSweeper(ctx, 10*time.Millisecond) }()
+	assert.Eventually(suite.T(), func() bool {
+		resp, _ := httpTestHelper("POST", "http://vouchers/confirm", reservationBody("expiring"), suite.srv, suite.srv.ConfirmHandler)
+		return resp.StatusCode == http.StatusNotFound
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	assert.Equal(suite.T(), context.Canceled, <-done)
+
+	// the voucher is available again
+	resp, _ = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "abc"}`)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+}
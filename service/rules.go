@@ -0,0 +1,34 @@
+package voucher
+
+import "github.com/ingemar0720/voucher-pool/rules"
+
+// eligibilityOrder returns the order the rules of the offer are evaluated against, o is the priced order of req and
+// its zero value if the order is not priced
+func eligibilityOrder(req OrderRequest, o order) (rules.Order, string) {
+	if req.PreviousOrders != nil && *req.PreviousOrders < 0 {
+		return rules.Order{}, "previous_orders shall not be negative"
+	}
+	eligible := rules.Order{Currency: o.currency.Code, Amount: o.amount, Channel: req.Channel, PreviousOrders: req.PreviousOrders}
+	for _, item := range req.Items {
+		eligible.Items = append(eligible.Items, rules.Item{SKU: item.SKU, Category: item.Category})
+	}
+	return eligible, ""
+}
+
+// parseValidateOrder returns the order of a validate request, which is optional. The order is priced like a quote
+// only if its currency is given, the rules on the amount fail otherwise.
+func parseValidateOrder(req *OrderRequest) (rules.Order, string) {
+	if req == nil {
+		return rules.Order{}, ""
+	}
+	var o order
+	if req.Currency != "" {
+		var msg string
+		if o, msg = parseOrder(*req); msg != "" {
+			return rules.Order{}, msg
+		}
+	} else if req.Amount != "" {
+		return rules.Order{}, "currency shall be given with amount"
+	}
+	return eligibilityOrder(*req, o)
+}
@@ -0,0 +1,103 @@
+package voucher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/rules"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (suite *TestSuite) TestOfferRules() {
+	resp, body := httpTestHelper("POST", "http://offers", bytes.NewBuffer([]byte(`{"name": "tea", "discount": 10, "rules": [{"type": "weather"}]}`)), suite.srv, suite.srv.CreateOfferHandler)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"rule 0: unknown rule type \"weather\""}`+"\n", string(body))
+
+	offer := suite.createOffer(`{"name": "tea", "discount": 10, "rules": [
+		{"type": "min_amount", "amount": 20, "currency": "EUR"},
+		{"type": "category", "categories": ["tea"]},
+		{"type": "channel", "channels": ["web", "app"]},
+		{"type": "first_order"}]}`)
+	require.Len(suite.T(), offer.Rules, 4)
+	assert.EqualValues(suite.T(), rules.TypeFirstOrder, offer.Rules[3].Type)
+	id := fmt.Sprint(offer.ID)
+
+	expiry := time.Now().Add(time.Hour).Format(time.RFC3339)
+	reqBody := `{"email": "customer0@gmail.com", "offer_id": ` + id + `, "expiry": "` + expiry + `"}`
+	resp, body = httpTestHelper("POST", "http://vouchers/generate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.GenerateHanlder)
+	require.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode, string(body))
+	generated := GenerateResponse{}
+	require.Nil(suite.T(), json.Unmarshal(body, &generated))
+
+	for _, tc := range []struct {
+		name       string
+		order      string
+		wantStatus int
+		want       string
+	}{
+		{
+			name:       "amount too low",
+			order:      `"amount": 19.99, "currency": "EUR"`,
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"rule_failed","message":"the amount of the order shall be at least 20.00 EUR","rule":{"index":0,"type":"min_amount"}}`,
+		},
+		{
+			name:       "no item of the category",
+			order:      `"currency": "EUR", "items": [{"name": "cake", "quantity": 1, "unit_price": 25, "category": "cake"}]`,
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"rule_failed","message":"the order shall contain an item of category tea","rule":{"index":1,"type":"category"}}`,
+		},
+		{
+			name:       "not the first order",
+			order:      `"currency": "EUR", "items": [{"name": "tea", "quantity": 2, "unit_price": 12.5, "category": "tea"}], "channel": "web", "previous_orders": 3`,
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"rule_failed","message":"only the first order of a customer is eligible","rule":{"index":3,"type":"first_order"}}`,
+		},
+		{
+			name:       "negative previous orders",
+			order:      `"amount": 25, "currency": "EUR", "previous_orders": -1`,
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"invalid_request","message":"previous_orders shall not be negative"}`,
+		},
+	} {
+		suite.T().Run(tc.name, func(t *testing.T) {
+			quoteBody := `{"email": "customer0@gmail.com", "code": "` + generated.Code + `", ` + tc.order + `}`
+			resp, body := httpTestHelper("POST", "http://vouchers/quote", bytes.NewBuffer([]byte(quoteBody)), suite.srv, suite.srv.QuoteHandler)
+			assert.EqualValues(t, tc.wantStatus, resp.StatusCode)
+			assert.EqualValues(t, tc.want+"\n", string(body))
+
+			validateBody := `{"email": "customer0@gmail.com", "code": "` + generated.Code + `", "order": {` + tc.order + `}}`
+			resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(validateBody)), suite.srv, suite.srv.ValidateHanlder)
+			assert.EqualValues(t, tc.wantStatus, resp.StatusCode)
+			assert.EqualValues(t, tc.want+"\n", string(body))
+
+			// a reservation evaluates the rules like the validation, so confirming it cannot skip them
+			resp, body = httpTestHelper("POST", "http://vouchers/reserve", bytes.NewBuffer([]byte(validateBody)), suite.srv, suite.srv.ReserveHandler)
+			assert.EqualValues(t, tc.wantStatus, resp.StatusCode)
+			assert.EqualValues(t, tc.want+"\n", string(body))
+		})
+	}
+
+	// without an order the first rule fails, the voucher is not redeemed
+	reqBody = `{"email": "customer0@gmail.com", "code": "` + generated.Code + `"}`
+	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"rule_failed","message":"the amount of the order shall be given","rule":{"index":0,"type":"min_amount"}}`+"\n", string(body))
+	resp, _ = httpTestHelper("POST", "http://vouchers/reserve", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.ReserveHandler)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+
+	reqBody = `{"email": "customer0@gmail.com", "code": "` + generated.Code + `", "order": {"currency": "EUR",
+		"items": [{"name": "tea", "quantity": 2, "unit_price": 12.5, "sku": "TEA-1", "category": "Tea"}], "channel": "app", "previous_orders": 0}}`
+	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode, string(body))
+
+	// rules are replaced with the offer, no rules make every order eligible
+	resp, body = suite.idRequest("PUT", "http://offers/"+id, id, bytes.NewBuffer([]byte(`{"name": "tea", "discount": 10}`)), suite.srv.UpdateOfferHandler)
+	assert.EqualValues(suite.T(), http.StatusOK, resp.StatusCode)
+	assert.Contains(suite.T(), string(body), `"rules":[]`)
+}
@@ -0,0 +1,201 @@
+package voucher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/ingemar0720/voucher-pool/logging"
+	"github.com/ingemar0720/voucher-pool/money"
+	"github.com/ingemar0720/voucher-pool/rules"
+	"github.com/pkg/errors"
+)
+
+// most codes redeemed together for one order
+const maxCodesPerOrder = 10
+
+// RedeemCodesRequest redeems Codes together for the order, which is given like to the quote API
+type RedeemCodesRequest struct {
+	Codes []string `json:"codes"`
+	Email string   `json:"email"`
+	OrderRequest
+}
+
+// RedeemedCode is the discount a code takes off the order
+type RedeemedCode struct {
+	Code           string `json:"code"`
+	DiscountType   string `json:"discount_type"`
+	DiscountValue  string `json:"discount_value"`
+	DiscountAmount string `json:"discount_amount"`
+	// RemainingUses is how many more times the customer can redeem the voucher
+	RemainingUses int `json:"remaining_uses"`
+}
+
+// RedeemCodesResponse amounts are exact decimals in Currency, the discount of Vouchers adds up to DiscountAmount.
+// Capped is set if the total discount was cut to the max_total_discount of an offer.
+type RedeemCodesResponse struct {
+	Currency       string         `json:"currency"`
+	OriginalAmount string         `json:"original_amount"`
+	DiscountAmount string         `json:"discount_amount"`
+	FinalAmount    string         `json:"final_amount"`
+	Capped         bool           `json:"capped"`
+	Vouchers       []RedeemedCode `json:"vouchers"`
+}
+
+// RedeemCodesHandler redeems several codes for one order, all of them or none. Every code is checked like by
+// ValidateHanlder and QuoteHandler, and the combination against the stacking policies of their offers.
+func (srv *VoucherSrv) RedeemCodesHandler(w http.ResponseWriter, r *http.Request) {
+	rr := RedeemCodesRequest{}
+	err := json.NewDecoder(r.Body).Decode(&rr)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+
+	//validate input
+	rr.Email, err = parseEmail(rr.Email)
+	if err != nil {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, err.Error())
+		return
+	}
+	logging.SetCustomer(r.Context(), rr.Email)
+	logging.SetVouchers(r.Context(), rr.Codes...)
+	if msg := validateCodes(rr.Codes); msg != "" {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, msg)
+		return
+	}
+	o, msg := parseOrder(rr.OrderRequest)
+	if msg != "" {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, msg)
+		return
+	}
+	eligible, msg := eligibilityOrder(rr.OrderRequest, o)
+	if msg != "" {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, msg)
+		return
+	}
+
+	// the currency of every voucher is checked before any is redeemed
+	for _, code := range rr.Codes {
+		result, err := srv.Store.QuoteVoucher(r.Context(), rr.Email, code)
+		if err != nil {
+			srv.redemptionFailed(w, r, "redeem", err)
+			return
+		}
+		discount := result.Discount
+		if discount.Type == dbmodel.DiscountFixed && discount.Currency != o.currency.Code {
+			srv.redemptionRejected(r, "redeem", CodeCurrencyMismatch)
+			writeErrorResponse(w, http.StatusUnprocessableEntity, CodeCurrencyMismatch,
+				fmt.Sprintf("voucher %v is a discount of %v, the order is in %v", code, discount.Currency, o.currency.Code))
+			return
+		}
+	}
+	results, resp, err := srv.redeemCodes(r.Context(), rr.Email, rr.Codes, eligible, o)
+	if err != nil {
+		srv.redemptionFailed(w, r, "redeem", err)
+		return
+	}
+	srv.redeemed(r, "redeem", results...)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// redeemCodes redeems the codes together for the order o. The stacking policies, owners, expiry, limits and rules are
+// checked and the redemptions are counted atomically, the discounts are combined before the redemptions are committed
+// so none is redeemed if they cannot be.
+func (srv *VoucherSrv) redeemCodes(ctx context.Context, email string, codes []string, eligible rules.Order, o order) ([]dbmodel.RedeemResult, RedeemCodesResponse, error) {
+	var resp RedeemCodesResponse
+	results, err := srv.Store.RedeemVouchers(ctx, email, codes, eligible, func(results []dbmodel.RedeemResult) error {
+		var err error
+		resp, err = combine(codes, results, o)
+		return err
+	})
+	if err != nil {
+		return nil, RedeemCodesResponse{}, err
+	}
+	return results, resp, nil
+}
+
+// validateCodes returns why the codes cannot be redeemed together, empty if they can be tried
+func validateCodes(codes []string) string {
+	if len(codes) == 0 || len(codes) > maxCodesPerOrder {
+		return fmt.Sprintf("codes shall be 1 to %v codes", maxCodesPerOrder)
+	}
+	seen := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		if strings.TrimSpace(code) == "" {
+			return "codes shall not be empty"
+		}
+		if seen[code] {
+			return fmt.Sprintf("code %v is given twice", code)
+		}
+		seen[code] = true
+	}
+	return ""
+}
+
+// combine applies the discounts one after the other in the order of the codes, each to the amount the previous ones
+// left, so the order never gets negative. The total is capped at the smallest max_total_discount of the offers, the
+// cut is taken off the last codes first.
+func combine(codes []string, results []dbmodel.RedeemResult, o order) (RedeemCodesResponse, error) {
+	exp := o.currency.Exponent
+	offs := make([]int64, len(results))
+	left := o.amount
+	limit := int64(-1)
+	for i, result := range results {
+		discount := result.Discount
+		switch discount.Type {
+		case dbmodel.DiscountFixed:
+			offs[i] = discount.Value
+			if offs[i] > left {
+				offs[i] = left
+			}
+		default:
+			off, _, err := money.Percent(left, discount.Value)
+			if err != nil {
+				return RedeemCodesResponse{}, errors.Wrapf(err, "fail to apply discount %v", discount)
+			}
+			offs[i] = off
+		}
+		left -= offs[i]
+		if max := result.Stacking.MaxTotalDiscount; max > 0 {
+			capped, _, err := money.Percent(o.amount, max)
+			if err != nil {
+				return RedeemCodesResponse{}, errors.Wrapf(err, "fail to apply max total discount of voucher %v", codes[i])
+			}
+			if limit < 0 || capped < limit {
+				limit = capped
+			}
+		}
+	}
+	resp := RedeemCodesResponse{Currency: o.currency.Code, OriginalAmount: money.FormatDecimal(o.amount, exp)}
+	if total := o.amount - left; limit >= 0 && total > limit {
+		resp.Capped = true
+		cut := total - limit
+		for i := len(offs) - 1; i >= 0 && cut > 0; i-- {
+			c := offs[i]
+			if c > cut {
+				c = cut
+			}
+			offs[i] -= c
+			cut -= c
+			left += c
+		}
+	}
+	resp.DiscountAmount = money.FormatDecimal(o.amount-left, exp)
+	resp.FinalAmount = money.FormatDecimal(left, exp)
+	for i, result := range results {
+		resp.Vouchers = append(resp.Vouchers, RedeemedCode{
+			Code:           codes[i],
+			DiscountType:   string(result.Discount.Type),
+			DiscountValue:  result.Discount.Decimal(),
+			DiscountAmount: money.FormatDecimal(offs[i], exp),
+			RemainingUses:  result.RemainingUses,
+		})
+	}
+	return resp, nil
+}
@@ -0,0 +1,151 @@
+package voucher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/money"
+	"github.com/ingemar0720/voucher-pool/rules"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// generateForOffer generates a voucher of the offer for the customer and returns its code
+func (suite *TestSuite) generateForOffer(email string, offerID uint64) string {
+	expiry := time.Now().Add(time.Hour).Format(time.RFC3339)
+	reqBody := fmt.Sprintf(`{"email": %q, "offer_id": %v, "expiry": %q}`, email, offerID, expiry)
+	resp, body := httpTestHelper("POST", "http://vouchers/generate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.GenerateHanlder)
+	require.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode, string(body))
+	generated := GenerateResponse{}
+	require.Nil(suite.T(), json.Unmarshal(body, &generated))
+	return generated.Code
+}
+
+func (suite *TestSuite) TestRedeemCodesHandler() {
+	resp, body := httpTestHelper("POST", "http://offers", bytes.NewBuffer([]byte(`{"name": "tea", "discount": 10, "max_total_discount": 101}`)), suite.srv, suite.srv.CreateOfferHandler)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"max_total_discount shall bigger than 0 or less than 100.00"}`+"\n", string(body))
+
+	tea := suite.createOffer(`{"name": "tea", "discount": 10, "stack_group": "drinks", "max_total_discount": 20}`)
+	assert.EqualValues(suite.T(), "drinks", tea.StackGroup)
+	assert.EqualValues(suite.T(), "20.00", tea.MaxTotalDiscount)
+	coffee := suite.createOffer(`{"name": "coffee", "discount": 5, "discount_type": "fixed", "currency": "EUR", "stack_group": "drinks"}`)
+	cake := suite.createOffer(`{"name": "cake", "discount": 3, "discount_type": "fixed", "currency": "EUR"}`)
+	vip := suite.createOffer(`{"name": "vip", "discount": 50, "exclusive": true, "stack_group": "drinks"}`)
+	assert.True(suite.T(), vip.Exclusive)
+	teaCode := suite.generateForOffer("customer0@gmail.com", tea.ID)
+	coffeeCode := suite.generateForOffer("customer0@gmail.com", coffee.ID)
+	cakeCode := suite.generateForOffer("customer0@gmail.com", cake.ID)
+	vipCode := suite.generateForOffer("customer0@gmail.com", vip.ID)
+
+	// separate validations or reservations of the codes of an order would skip the stacking policies
+	for _, code := range []string{teaCode, vipCode} {
+		reqBody := fmt.Sprintf(`{"email": "customer0@gmail.com", "code": %q}`, code)
+		for _, handler := range []http.HandlerFunc{suite.srv.ValidateHanlder, suite.srv.ReserveHandler} {
+			resp, body := httpTestHelper("POST", "http://vouchers", bytes.NewBuffer([]byte(reqBody)), suite.srv, handler)
+			assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+			assert.EqualValues(suite.T(), `{"code":"stacking_conflict","message":"vouchers of offers with a stacking policy shall be redeemed with the redeem API"}`+"\n", string(body))
+		}
+	}
+
+	for _, tc := range []struct {
+		name       string
+		codes      []string
+		currency   string
+		wantStatus int
+		want       string
+	}{
+		{
+			name:       "no codes",
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"invalid_request","message":"codes shall be 1 to 10 codes"}`,
+		},
+		{
+			name:       "code given twice",
+			codes:      []string{teaCode, teaCode},
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"invalid_request","message":"code ` + teaCode + ` is given twice"}`,
+		},
+		{
+			name:       "other stack group",
+			codes:      []string{teaCode, cakeCode},
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"stacking_conflict","message":"vouchers cannot be combined"}`,
+		},
+		{
+			name:       "exclusive voucher",
+			codes:      []string{vipCode, teaCode},
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"stacking_conflict","message":"vouchers cannot be combined"}`,
+		},
+		{
+			name:       "fixed discount in another currency",
+			codes:      []string{teaCode, coffeeCode},
+			currency:   "USD",
+			wantStatus: http.StatusUnprocessableEntity,
+			want:       `{"code":"currency_mismatch","message":"voucher ` + coffeeCode + ` is a discount of EUR, the order is in USD"}`,
+		},
+		{
+			name:       "unknown code",
+			codes:      []string{teaCode, "unknown"},
+			wantStatus: http.StatusNotFound,
+			want:       `{"code":"voucher_not_found","message":"voucher not found"}`,
+		},
+	} {
+		currency := tc.currency
+		if currency == "" {
+			currency = "EUR"
+		}
+		codes, _ := json.Marshal(tc.codes)
+		reqBody := fmt.Sprintf(`{"email": "customer0@gmail.com", "codes": %s, "amount": 40, "currency": %q}`, codes, currency)
+		resp, body := httpTestHelper("POST", "http://vouchers/redeem", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.RedeemCodesHandler)
+		assert.EqualValues(suite.T(), tc.wantStatus, resp.StatusCode, tc.name)
+		assert.EqualValues(suite.T(), tc.want+"\n", string(body), tc.name)
+	}
+
+	// an order too large to apply a percentage to is rejected before any code is redeemed
+	reqBody := fmt.Sprintf(`{"email": "customer0@gmail.com", "codes": [%q, %q], "amount": "10000000000000", "currency": "EUR"}`, coffeeCode, teaCode)
+	resp, body = httpTestHelper("POST", "http://vouchers/redeem", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.RedeemCodesHandler)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"amount of the order shall be at most 9223372036854.77"}`+"\n", string(body))
+	// the redemptions are rolled back if the discounts cannot be combined
+	eur, err := money.LookupCurrency("EUR")
+	require.Nil(suite.T(), err)
+	_, _, err = suite.srv.redeemCodes(suite.srv.Ctx, "customer0@gmail.com", []string{coffeeCode, teaCode}, rules.Order{}, order{currency: eur, amount: math.MaxInt64})
+	assert.NotNil(suite.T(), err)
+	for _, code := range []string{coffeeCode, teaCode} {
+		redemptions, err := suite.srv.Store.GetRedemptions(suite.srv.Ctx, code)
+		require.Nil(suite.T(), err)
+		assert.Len(suite.T(), redemptions, 0)
+	}
+
+	// none of the codes was redeemed by the failed combinations. The coffee discount leaves 35.00, the tea discount
+	// takes 3.50 of it and the total is cut to 20% of the order.
+	reqBody = fmt.Sprintf(`{"email": "customer0@gmail.com", "codes": [%q, %q], "amount": 40, "currency": "EUR"}`, coffeeCode, teaCode)
+	resp, body = httpTestHelper("POST", "http://vouchers/redeem", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.RedeemCodesHandler)
+	require.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode, string(body))
+	got := RedeemCodesResponse{}
+	require.Nil(suite.T(), json.Unmarshal(body, &got))
+	assert.EqualValues(suite.T(), RedeemCodesResponse{
+		Currency:       "EUR",
+		OriginalAmount: "40.00",
+		DiscountAmount: "8.00",
+		FinalAmount:    "32.00",
+		Capped:         true,
+		Vouchers: []RedeemedCode{
+			{Code: coffeeCode, DiscountType: "fixed", DiscountValue: "5.00", DiscountAmount: "5.00"},
+			{Code: teaCode, DiscountType: "percentage", DiscountValue: "10.00", DiscountAmount: "3.00"},
+		},
+	}, got)
+	resp, _ = httpTestHelper("POST", "http://vouchers/redeem", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.RedeemCodesHandler)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+
+	// a single exclusive voucher is redeemed alone
+	reqBody = fmt.Sprintf(`{"email": "customer0@gmail.com", "codes": [%q], "amount": 40, "currency": "EUR"}`, vipCode)
+	resp, body = httpTestHelper("POST", "http://vouchers/redeem", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.RedeemCodesHandler)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode, string(body))
+}
@@ -0,0 +1,58 @@
+package voucher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/ingemar0720/voucher-pool/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func (suite *TestSuite) TestTracing() {
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
+	exp := tracetest.NewInMemoryExporter()
+	tracer := tracing.NewWithExporter(exp)
+	validate := func(srv *VoucherSrv, ctx context.Context) map[attribute.Key]attribute.Value {
+		exp.Reset()
+		req := httptest.NewRequest("POST", "http://vouchers/validate", strings.NewReader(`{"email": "customer0@gmail.com", "code": "abc"}`)).WithContext(ctx)
+		tracer.Middleware(http.HandlerFunc(srv.ValidateHanlder)).ServeHTTP(httptest.NewRecorder(), req)
+		spans := exp.GetSpans()
+		require.Len(suite.T(), spans, 1)
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, kv := range spans[0].Attributes {
+			attrs[kv.Key] = kv.Value
+		}
+		return attrs
+	}
+
+	// the error of a 5xx is recorded on the span, the voucher is not redeemed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	validate(&VoucherSrv{Store: cancelledStore{suite.srv.Store}, Ctx: context.Background()}, ctx)
+	span := exp.GetSpans()[0]
+	assert.Equal(suite.T(), codes.Error, span.Status.Code)
+	exception := span.Events[len(span.Events)-1]
+	assert.Equal(suite.T(), "exception", exception.Name)
+	assert.Contains(suite.T(), exception.Attributes, attribute.String("exception.message", "context canceled"))
+
+	quote, err := suite.srv.Store.QuoteVoucher(suite.srv.Ctx, "customer0@gmail.com", "abc")
+	require.Nil(suite.T(), err)
+	attrs := validate(suite.srv, context.Background())
+	assert.Equal(suite.T(), "redeemed", attrs[tracing.OutcomeKey].AsString())
+	assert.NotZero(suite.T(), quote.OfferID)
+	assert.EqualValues(suite.T(), quote.OfferID, attrs[tracing.OfferIDKey].AsInt64())
+	assert.Equal(suite.T(), "request decoded", exp.GetSpans()[0].Events[0].Name)
+
+	// a rejection is an outcome, not an error of the service
+	attrs = validate(suite.srv, context.Background())
+	assert.Equal(suite.T(), CodeVoucherRedeemed, attrs[tracing.OutcomeKey].AsString())
+	assert.Equal(suite.T(), codes.Unset, exp.GetSpans()[0].Status.Code)
+}
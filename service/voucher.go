@@ -2,28 +2,67 @@ package voucher
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net/http"
-	"net/mail"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/ingemar0720/voucher-pool/codegen"
+	"github.com/ingemar0720/voucher-pool/config"
 	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/ingemar0720/voucher-pool/logging"
+	"github.com/ingemar0720/voucher-pool/metrics"
+	"github.com/ingemar0720/voucher-pool/money"
+	"github.com/ingemar0720/voucher-pool/tracing"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
 )
 
-const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+// number of codes tried before giving up generating a voucher, when the codes collide with existing vouchers
+const defaultCodeAttempts = 5
+
+var defaultCodeGen = codegen.MustNew(codegen.DefaultConfig)
 
 type VoucherSrv struct {
-	DB  *sqlx.DB
+	Store dbmodel.VoucherStore
+	// Ctx lives as long as the service, it bounds the work outliving a request like async bulk jobs. Handlers query
+	// with the context of their request, so cancelled and timed out requests abort their statements.
 	Ctx context.Context
+	// CodeGen generates voucher codes, codegen.DefaultConfig is used if nil
+	CodeGen codegen.CodeGenerator
+	// CodeAttempts bounds the retries on code collisions, defaultCodeAttempts is used if 0
+	CodeAttempts int
+	// BulkBatchSize is the number of vouchers inserted per transaction by bulk generation, defaultBulkBatchSize is used if 0
+	BulkBatchSize int
+	// ReservationTTL is how long a reservation holds a voucher if the request does not tell, defaultReservationTTL is used if 0
+	ReservationTTL time.Duration
+	// IdempotencyTTL is how long the response to an Idempotency-Key is replayed, defaultIdempotencyTTL is used if 0
+	IdempotencyTTL time.Duration
+	// IdempotencyLease is how long a request holds its Idempotency-Key before its response is saved, it shall outlast
+	// the request. defaultIdempotencyLease is used if 0.
+	IdempotencyLease time.Duration
+	// ReadinessTimeout bounds the checks of ReadyzHandler, defaultReadinessTimeout is used if 0
+	ReadinessTimeout time.Duration
+	// Metrics records the voucher lifecycle, nothing is recorded if nil
+	Metrics *metrics.Metrics
+	// Log writes the lines outliving a request, the handlers log with the logger of their request. Nothing is logged if nil.
+	Log *logging.Logger
+
+	jobs bulkJobs
+	// jobsRunning tracks the goroutines of async bulk jobs
+	jobsRunning sync.WaitGroup
 }
 
 type ValidateRequest struct {
 	Code  string `json:"code"`
 	Email string `json:"email"`
+	// Order is evaluated against the rules of the offer, it is only needed for offers with rules
+	Order *OrderRequest `json:"order"`
 }
 
 type ListRequest struct {
@@ -31,14 +70,59 @@ type ListRequest struct {
 }
 
 type GenerateRequest struct {
-	Email     string    `json:"email"`
-	OfferName string    `json:"offer_name"`
-	Discount  float32   `json:"discount"`
-	Expiry    time.Time `json:"expiry"`
+	Email string `json:"email"`
+	// OfferID is the offer the voucher is issued for. Otherwise the voucher is issued for the offer of OfferName,
+	// created if it does not exist yet and revised if its discount differs from Discount.
+	OfferID   uint64 `json:"offer_id"`
+	OfferName string `json:"offer_name"`
+	// Discount is the percentage, or the amount in major units of Currency for fixed discounts
+	Discount json.Number `json:"discount"`
+	// DiscountType is percentage or fixed, percentage if empty
+	DiscountType string    `json:"discount_type"`
+	Currency     string    `json:"currency"`
+	Expiry       time.Time `json:"expiry"`
+	// MaxRedemptions is how many times the voucher can be redeemed, 1 if 0
+	MaxRedemptions int `json:"max_redemptions"`
+	// MaxPerCustomer is how many times one customer can redeem the voucher, no limit but MaxRedemptions if 0
+	MaxPerCustomer int `json:"max_per_customer"`
+	// Assignment is customer, public or claim, customer if empty. Email is only given for customer vouchers,
+	// public and claim vouchers are bound to the customer who redeems them
+	Assignment string `json:"assignment"`
 }
 
 type ValidateResponse struct {
-	Discount float32 `json:"discount"`
+	// Discount is the percentage, or the amount in major units of Currency for fixed discounts
+	Discount     json.Number `json:"discount"`
+	DiscountType string      `json:"discount_type"`
+	// DiscountValue is Discount as an exact decimal
+	DiscountValue string `json:"discount_value"`
+	Currency      string `json:"currency,omitempty"`
+	// RemainingUses is how many more times the customer can redeem the voucher
+	RemainingUses int `json:"remaining_uses"`
+}
+
+func newValidateResponse(r dbmodel.RedeemResult) ValidateResponse {
+	d := r.Discount
+	return ValidateResponse{
+		Discount:      json.Number(money.TrimDecimal(d.Decimal())),
+		DiscountType:  string(d.Type),
+		DiscountValue: d.Decimal(),
+		Currency:      d.Currency,
+		RemainingUses: r.RemainingUses,
+	}
+}
+
+// offerTerms are the validated terms of the vouchers to generate, Name and Discount are not set if OfferID is
+type offerTerms struct {
+	OfferID  uint64
+	Name     string
+	Discount dbmodel.Discount
+	Expiry   time.Time
+	Limits   dbmodel.Limits
+}
+
+func (t offerTerms) ref() dbmodel.OfferRef {
+	return dbmodel.OfferRef{ID: t.OfferID, Name: t.Name, Discount: t.Discount}
 }
 
 type GenerateResponse struct {
@@ -46,15 +130,20 @@ type GenerateResponse struct {
 }
 
 type GetResponse struct {
-	Code      string `json:"code"`
-	OfferName string `json:"offer_name"`
+	Code          string `json:"code"`
+	OfferName     string `json:"offer_name"`
+	RemainingUses int    `json:"remaining_uses"`
 }
 
-func New() (*sqlx.DB, error) {
-	db, err := sqlx.Connect("postgres", "postgres://user:mysecretpassword@db:5432/postgres?sslmode=disable")
+// New connects to the database of cfg and sizes its connection pool
+func New(cfg config.DB) (*sqlx.DB, error) {
+	db, err := sqlx.Connect("postgres", cfg.DSN)
 	if err != nil {
 		return &sqlx.DB{}, fmt.Errorf("fail to connect to db, error: %v", err)
 	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
 	return db, nil
 }
 
@@ -63,118 +152,227 @@ func (srv *VoucherSrv) ValidateHanlder(w http.ResponseWriter, r *http.Request) {
 	vr := ValidateRequest{}
 	err := json.NewDecoder(r.Body).Decode(&vr)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeErrorResponse(w, http.StatusBadRequest, CodeBadRequest, err.Error())
 		return
 	}
+	tracing.AddEvent(r.Context(), "request decoded")
 
-	_, err = mail.ParseAddress(vr.Email)
+	vr.Email, err = parseEmail(vr.Email)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, err.Error())
 		return
 	}
-	t, err := dbmodel.ValidateVoucher(srv.Ctx, vr.Email, vr.Code, srv.DB)
-	if err != nil {
-		if err.Error() == "voucher expired" {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	logging.SetCustomer(r.Context(), vr.Email)
+	logging.SetVouchers(r.Context(), vr.Code)
+	order, msg := parseValidateOrder(vr.Order)
+	if msg != "" {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, msg)
 		return
 	}
-	// column used_at not null, this voucher has been redeemed
-	if t.Valid {
-		http.Error(w, "this voucher has been redeemed", http.StatusBadRequest)
-		return
-	} else {
-		discount, err := dbmodel.SetVoucherUsageAndGetDiscount(srv.Ctx, vr.Code, srv.DB)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		validateResp := ValidateResponse{
-			Discount: discount,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(validateResp)
+	// owner, expiry, limits and the rules are checked and the redemption is counted atomically
+	result, err := srv.Store.RedeemVoucher(r.Context(), vr.Email, vr.Code, order)
+	if err != nil {
+		srv.redemptionFailed(w, r, "validate", err)
 		return
 	}
+	srv.redeemed(r, "validate", result)
+	validateResp := newValidateResponse(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(validateResp)
 }
 
 func (srv *VoucherSrv) GenerateHanlder(w http.ResponseWriter, r *http.Request) {
 	gr := GenerateRequest{}
 	err := json.NewDecoder(r.Body).Decode(&gr)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeErrorResponse(w, http.StatusBadRequest, CodeBadRequest, err.Error())
 		return
 	}
 
 	//validate input
-	_, err = mail.ParseAddress(gr.Email)
+	assignment := dbmodel.AssignmentCustomer
+	if gr.Assignment != "" {
+		assignment = dbmodel.Assignment(gr.Assignment)
+	}
+	err = assignment.Validate()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, err.Error())
 		return
 	}
-	if gr.Discount <= 0 || gr.Discount > 100.00 {
-		http.Error(w, "discount shall bigger than 0 or less than 100.00", http.StatusBadRequest)
+	if assignment == dbmodel.AssignmentCustomer {
+		gr.Email, err = parseEmail(gr.Email)
+		if err != nil {
+			writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, err.Error())
+			return
+		}
+		logging.SetCustomer(r.Context(), gr.Email)
+	} else if gr.Email != "" {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, "email shall only be given for vouchers assigned to a customer")
 		return
 	}
-	if gr.Expiry.Before(time.Now()) {
-		http.Error(w, "expiry date shall be in the future", http.StatusBadRequest)
+	terms, msg := validateOffer(gr.OfferID, gr.OfferName, gr.DiscountType, gr.Discount, gr.Currency, gr.Expiry, gr.MaxRedemptions, gr.MaxPerCustomer)
+	if msg != "" {
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, msg)
 		return
 	}
 
-	//generate code
-	code := RandStringBytes(8)
-	if err := dbmodel.GenerateVoucher(srv.Ctx, gr.Email, gr.OfferName, code, gr.Expiry, gr.Discount, srv.DB); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	code, err := srv.generateVoucher(r.Context(), gr.Email, assignment, terms)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
+	srv.Metrics.Generated(string(assignment), "single", 1)
+	logging.SetVouchers(r.Context(), code)
+	if terms.OfferID != 0 {
+		tracing.SetOffers(r.Context(), terms.OfferID)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(GenerateResponse{Code: code})
 }
 
-//https://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-go
-func RandStringBytes(n int) string {
-	rand.Seed(time.Now().UnixNano())
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+// validateOffer returns the terms of the offer, or why they are invalid. The offer is given either by offerID
+// or by name and discount.
+func validateOffer(offerID uint64, name, discountType string, discount json.Number, currency string, expiry time.Time, maxRedemptions, maxPerCustomer int) (offerTerms, string) {
+	var d dbmodel.Discount
+	if offerID != 0 {
+		if name != "" || discountType != "" || discount != "" || currency != "" {
+			return offerTerms{}, "offer_id shall not be given with offer_name or discount"
+		}
+	} else {
+		var msg string
+		d, msg = parseDiscount(discountType, discount, currency)
+		if msg != "" {
+			return offerTerms{}, msg
+		}
+	}
+	if expiry.Before(time.Now()) {
+		return offerTerms{}, "expiry date shall be in the future"
+	}
+	limits := dbmodel.Limits{MaxRedemptions: maxRedemptions, MaxPerCustomer: maxPerCustomer}
+	if msg := validateLimits(limits); msg != "" {
+		return offerTerms{}, msg
+	}
+	return offerTerms{OfferID: offerID, Name: name, Discount: d, Expiry: expiry, Limits: limits}, ""
+}
+
+// validateLimits returns why the redemption limits are invalid, 0 stands for the default of each limit
+func validateLimits(l dbmodel.Limits) string {
+	if l.MaxRedemptions < 0 || l.MaxPerCustomer < 0 {
+		return "max_redemptions and max_per_customer shall not be negative"
+	}
+	if l.MaxRedemptions > 0 && l.MaxPerCustomer > l.MaxRedemptions {
+		return "max_per_customer shall not be bigger than max_redemptions"
 	}
-	return string(b)
+	return ""
+}
+
+// parseDiscount parses the discount exactly, percentages have at most 2 decimal places
+// and fixed amounts at most the decimal places of the minor unit of the currency
+func parseDiscount(discountType string, discount json.Number, currency string) (dbmodel.Discount, string) {
+	switch dbmodel.DiscountType(discountType) {
+	case "", dbmodel.DiscountPercentage:
+		if currency != "" {
+			return dbmodel.Discount{}, "currency is only allowed for fixed discounts"
+		}
+		basisPoints, err := money.ParseDecimal(discount.String(), money.PercentScale)
+		if err != nil || basisPoints <= 0 || basisPoints > 100*100 {
+			return dbmodel.Discount{}, "discount shall bigger than 0 or less than 100.00"
+		}
+		return dbmodel.PercentageDiscount(basisPoints), ""
+	case dbmodel.DiscountFixed:
+		c, err := money.LookupCurrency(strings.ToUpper(currency))
+		if err != nil {
+			return dbmodel.Discount{}, "currency shall be a supported ISO 4217 code"
+		}
+		minor, err := money.ParseDecimal(discount.String(), c.Exponent)
+		if err != nil || minor <= 0 {
+			return dbmodel.Discount{}, fmt.Sprintf("discount shall be a positive amount of %v with at most %v decimal places", c.Code, c.Exponent)
+		}
+		return dbmodel.FixedDiscount(minor, c.Code), ""
+	default:
+		return dbmodel.Discount{}, "discount_type shall be percentage or fixed"
+	}
+}
+
+// newRandomID returns 128 random bits in hex, for ids handed out to clients
+func newRandomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (srv *VoucherSrv) codeGenerator() codegen.CodeGenerator {
+	if srv.CodeGen == nil {
+		return defaultCodeGen
+	}
+	return srv.CodeGen
+}
+
+func (srv *VoucherSrv) codeAttempts() int {
+	if srv.CodeAttempts <= 0 {
+		return defaultCodeAttempts
+	}
+	return srv.CodeAttempts
+}
+
+// generateVoucher stores the voucher with a fresh code, the code is regenerated if it collides with an existing one.
+// The voucher is bound to email for customer vouchers, email is ignored otherwise.
+func (srv *VoucherSrv) generateVoucher(ctx context.Context, email string, assignment dbmodel.Assignment, terms offerTerms) (string, error) {
+	gen := srv.codeGenerator()
+	attempts := srv.codeAttempts()
+	var err error
+	for i := 0; i < attempts; i++ {
+		var code string
+		code, err = gen.Generate()
+		if err != nil {
+			return "", err
+		}
+		if assignment == dbmodel.AssignmentCustomer {
+			err = srv.Store.GenerateVoucher(ctx, email, code, terms.ref(), terms.Expiry, terms.Limits)
+		} else {
+			err = srv.Store.GenerateUnassignedVoucher(ctx, assignment, code, terms.ref(), terms.Expiry, terms.Limits)
+		}
+		if !errors.Is(err, dbmodel.ErrCodeConflict) {
+			return code, err
+		}
+	}
+	return "", errors.Wrapf(err, "fail to generate a unique code in %v attempts", attempts)
 }
 
 func (srv *VoucherSrv) GetValidVouchers(w http.ResponseWriter, r *http.Request) {
 	lr := ListRequest{}
 	err := json.NewDecoder(r.Body).Decode(&lr)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeErrorResponse(w, http.StatusBadRequest, CodeBadRequest, err.Error())
 		return
 	}
 
 	//validate input
-	_, err = mail.ParseAddress(lr.Email)
+	lr.Email, err = parseEmail(lr.Email)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeErrorResponse(w, http.StatusUnprocessableEntity, CodeInvalidRequest, err.Error())
 		return
 	}
+	logging.SetCustomer(r.Context(), lr.Email)
 
-	codes, offerNames, err := dbmodel.GetVouchers(srv.Ctx, lr.Email, srv.DB)
+	codes, offerNames, remaining, err := srv.Store.GetVouchers(r.Context(), lr.Email)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	if len(codes) != len(offerNames) {
-		if err != nil {
-			http.Error(w, "number of column of voucher code not equal to number of columns of specail_offer name", http.StatusInternalServerError)
-			return
-		}
+	if len(codes) != len(offerNames) || len(codes) != len(remaining) {
+		writeErrorResponse(w, http.StatusInternalServerError, CodeInternal, "number of column of voucher code not equal to number of columns of specail_offer name")
+		return
 	}
 	var vouchers []GetResponse
 	l := len(codes)
 	for i := 0; i < l; i++ {
-		vouchers = append(vouchers, GetResponse{Code: codes[i], OfferName: offerNames[i]})
+		vouchers = append(vouchers, GetResponse{Code: codes[i], OfferName: offerNames[i], RemainingUses: remaining[i]})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -10,11 +10,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/ingemar0720/voucher-pool/config"
+	"github.com/ingemar0720/voucher-pool/dbmodel"
+	"github.com/ingemar0720/voucher-pool/rules"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
@@ -26,66 +30,51 @@ import (
 type TestSuite struct {
 	suite.Suite
 	srv *VoucherSrv
-}
-
-// setup test suite, prepare test db, db cleaner
-func (suite *TestSuite) SetupSuite() {
-	fmt.Println("setup suite")
-	db, err := sqlx.Connect("postgres", "postgres://user:mysecretpassword@db:5432/postgres_test?sslmode=disable")
-	if err != nil {
-		assert.Fail(suite.T(), "setup test DB fail", err)
-	}
-
-	suite.srv = &VoucherSrv{DB: db, Ctx: context.Background()}
-}
-
-func (suite *TestSuite) TearDownSuite() {
-	fmt.Println("teardown suite")
+	// newStore returns an empty store for every test
+	newStore func() dbmodel.VoucherStore
 }
 
 func (suite *TestSuite) BeforeTest(suiteName, testName string) {
 	fmt.Println("before test")
+	suite.srv = &VoucherSrv{Store: suite.newStore(), Ctx: context.Background()}
 	// seed 2 user
-	tx, err := suite.srv.DB.Beginx()
-	if err != nil {
-		log.Fatal(err)
-	}
 	for i := 0; i < 2; i++ {
-		_, err = tx.Exec("INSERT INTO customers (name, email) VALUES ($1, $2)", fmt.Sprintf("customer %v", i), fmt.Sprintf("customer%v@gmail.com", i))
+		_, err := suite.srv.Store.CreateCustomer(suite.srv.Ctx, fmt.Sprintf("customer %v", i), fmt.Sprintf("customer%v@gmail.com", i))
 		if err != nil {
-			tx.Rollback()
 			log.Fatal(err)
 		}
 	}
-	tx.Commit()
 }
 
-func (suite *TestSuite) AfterTest(suiteName, testName string) {
-	fmt.Println("after test")
-	tx, err := suite.srv.DB.Beginx()
+// seed a voucher of the offer for the customer
+func (suite *TestSuite) seedVoucher(email, offerName string, discount dbmodel.Discount, code string, expiry time.Time) {
+	err := suite.srv.Store.GenerateVoucher(suite.srv.Ctx, email, code, dbmodel.OfferRef{Name: offerName, Discount: discount}, expiry, dbmodel.Limits{})
 	if err != nil {
-		log.Fatal(err)
-	}
-	_, err = tx.Exec("TRUNCATE TABLE customers RESTART IDENTITY CASCADE")
-	if err != nil {
-		tx.Rollback()
-		log.Fatal(err)
-	}
-	_, err = tx.Exec("TRUNCATE TABLE special_offers RESTART IDENTITY CASCADE")
-	if err != nil {
-		tx.Rollback()
-		log.Fatal(err)
+		assert.FailNow(suite.T(), err.Error())
 	}
-	_, err = tx.Exec("TRUNCATE TABLE vouchers RESTART IDENTITY CASCADE")
+}
+
+// run the suite against the test database, skip when it is not reachable
+func TestTestSuite(t *testing.T) {
+	db, err := sqlx.Connect("postgres", config.TestDSN())
 	if err != nil {
-		tx.Rollback()
-		log.Fatal(err)
+		t.Skipf("setup test DB fail: %v", err)
 	}
-	tx.Commit()
+	defer db.Close()
+	suite.Run(t, &TestSuite{newStore: func() dbmodel.VoucherStore {
+		_, err := db.Exec("TRUNCATE TABLE customers, offers, special_offers, vouchers, idempotency_keys RESTART IDENTITY CASCADE")
+		if err != nil {
+			log.Fatal(err)
+		}
+		return dbmodel.NewPostgresStore(db)
+	}})
 }
 
-func TestTestSuite(t *testing.T) {
-	suite.Run(t, new(TestSuite))
+// run the suite fully in-process against the in-memory store
+func TestMemoryTestSuite(t *testing.T) {
+	suite.Run(t, &TestSuite{newStore: func() dbmodel.VoucherStore {
+		return dbmodel.NewMemoryStore()
+	}})
 }
 
 func httpTestHelper(method, url string, body io.Reader, srv *VoucherSrv, f func(http.ResponseWriter, *http.Request)) (*http.Response, []byte) {
@@ -100,79 +89,105 @@ func httpTestHelper(method, url string, body io.Reader, srv *VoucherSrv, f func(
 func (suite *TestSuite) TestValidateHanlder() {
 	resp, body := httpTestHelper("POST", "http://vouchers/validate", nil, suite.srv, suite.srv.ValidateHanlder)
 	assert.EqualValues(suite.T(), http.StatusBadRequest, resp.StatusCode)
-	assert.EqualValues(suite.T(), "EOF\n", string(body))
+	assert.EqualValues(suite.T(), `{"code":"bad_request","message":"EOF"}`+"\n", string(body))
 
 	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "invalid_email", "code": "abc"}`)), suite.srv, suite.srv.ValidateHanlder)
-	assert.EqualValues(suite.T(), http.StatusBadRequest, resp.StatusCode)
-	assert.EqualValues(suite.T(), "mail: missing '@' or angle-addr\n", string(body))
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"mail: missing '@' or angle-addr"}`+"\n", string(body))
 
 	// seed to prepare the db test
-	tx, err := suite.srv.DB.BeginTx(suite.srv.Ctx, nil)
-	if err != nil {
-		assert.FailNow(suite.T(), err.Error())
-	}
-	_, err = tx.Exec("INSERT INTO special_offers (name, discount) VALUES ($1, $2)", "apple_store", 38.5)
-	if err != nil {
-		assert.FailNow(suite.T(), err.Error())
-	}
-	_, err = tx.Exec("INSERT INTO vouchers (code, customer_id, special_offer_id, expired_at) VALUES ($1, $2, $3, $4)", "abc", 1, 1, time.Now().Add(24*time.Hour))
-	if err != nil {
-		assert.FailNow(suite.T(), err.Error())
-	}
-	err = tx.Commit()
-	if err != nil {
-		assert.FailNow(suite.T(), err.Error())
-	}
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
 
 	//test the happy case
 	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "abc"}`)), suite.srv, suite.srv.ValidateHanlder)
 	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
-	assert.EqualValues(suite.T(), "{\"discount\":38.5}\n", string(body))
+	assert.EqualValues(suite.T(), `{"discount":38.5,"discount_type":"percentage","discount_value":"38.50","remaining_uses":0}`+"\n", string(body))
 
 	//test again shall get redeemed error
 	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "abc"}`)), suite.srv, suite.srv.ValidateHanlder)
-	assert.EqualValues(suite.T(), http.StatusBadRequest, resp.StatusCode)
-	assert.EqualValues(suite.T(), "this voucher has been redeemed\n", string(body))
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"voucher_redeemed","message":"this voucher has been redeemed"}`+"\n", string(body))
+}
+
+func (suite *TestSuite) TestValidateHanlderOutcomes() {
+	// seed to prepare the db test
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "expired", time.Now().Add(-24*time.Hour))
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
+
+	resp, body := httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "unknown"}`)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusNotFound, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"voucher_not_found","message":"voucher not found"}`+"\n", string(body))
+
+	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer1@gmail.com", "code": "abc"}`)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"voucher_not_owned","message":"voucher belongs to another customer"}`+"\n", string(body))
+
+	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "expired"}`)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusGone, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"voucher_expired","message":"voucher expired"}`+"\n", string(body))
+}
+
+func (suite *TestSuite) TestValidateHanlderConcurrently() {
+	// seed to prepare the db test
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
+
+	// redeem the same voucher from many goroutines, exactly one of them shall win
+	const workers = 20
+	var wg sync.WaitGroup
+	statuses := make(chan int, workers)
+	start := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			resp, _ := httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "abc"}`)), suite.srv, suite.srv.ValidateHanlder)
+			statuses <- resp.StatusCode
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(statuses)
+
+	winners := 0
+	for status := range statuses {
+		if status == http.StatusCreated {
+			winners++
+			continue
+		}
+		assert.EqualValues(suite.T(), http.StatusConflict, status)
+	}
+	assert.EqualValues(suite.T(), 1, winners)
 }
 
 func (suite *TestSuite) TestGenerateHandler() {
 	resp, body := httpTestHelper("POST", "http://vouchers/validate", nil, suite.srv, suite.srv.GenerateHanlder)
 	assert.EqualValues(suite.T(), http.StatusBadRequest, resp.StatusCode)
-	assert.EqualValues(suite.T(), "EOF\n", string(body))
+	assert.EqualValues(suite.T(), `{"code":"bad_request","message":"EOF"}`+"\n", string(body))
 
 	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "invalid_email", "code": "abc"}`)), suite.srv, suite.srv.GenerateHanlder)
-	assert.EqualValues(suite.T(), http.StatusBadRequest, resp.StatusCode)
-	assert.EqualValues(suite.T(), "mail: missing '@' or angle-addr\n", string(body))
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"mail: missing '@' or angle-addr"}`+"\n", string(body))
 
 	tomorrow := time.Now().Add(24 * time.Hour).Format(time.RFC3339)
 	sqltext := `{"email": "test1@gmail.com", "offer_name": "apple_store", "discount": 101.0, "expiry": "` + tomorrow + `"}`
 	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(sqltext)), suite.srv, suite.srv.GenerateHanlder)
-	assert.EqualValues(suite.T(), http.StatusBadRequest, resp.StatusCode)
-	assert.EqualValues(suite.T(), "discount shall bigger than 0 or less than 100.00\n", string(body))
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"discount shall bigger than 0 or less than 100.00"}`+"\n", string(body))
 
 	yesterday := time.Now().Add(-24 * time.Hour).Format(time.RFC3339)
 	sqltext = `{"email": "test1@gmail.com", "offer_name": "apple_store", "discount": 54.30, "expiry": "` + yesterday + `"}`
 	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(sqltext)), suite.srv, suite.srv.GenerateHanlder)
-	assert.EqualValues(suite.T(), http.StatusBadRequest, resp.StatusCode)
-	assert.EqualValues(suite.T(), "expiry date shall be in the future\n", string(body))
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"expiry date shall be in the future"}`+"\n", string(body))
+
+	sqltext = `{"email": "test1@gmail.com", "offer_name": "apple_store", "discount": 54.30, "expiry": "` + tomorrow + `"}`
+	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(sqltext)), suite.srv, suite.srv.GenerateHanlder)
+	assert.EqualValues(suite.T(), http.StatusNotFound, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"customer_not_found","message":"customer not found"}`+"\n", string(body))
 
 	// seed to prepare the db test
-	tx, err := suite.srv.DB.BeginTx(suite.srv.Ctx, nil)
-	if err != nil {
-		assert.FailNow(suite.T(), err.Error())
-	}
-	_, err = tx.Exec("INSERT INTO special_offers (name, discount) VALUES ($1, $2)", "apple_store", 38.5)
-	if err != nil {
-		assert.FailNow(suite.T(), err.Error())
-	}
-	_, err = tx.Exec("INSERT INTO vouchers (code, customer_id, special_offer_id, expired_at) VALUES ($1, $2, $3, $4)", "abc", 1, 1, time.Now().Add(24*time.Hour))
-	if err != nil {
-		assert.FailNow(suite.T(), err.Error())
-	}
-	err = tx.Commit()
-	if err != nil {
-		assert.FailNow(suite.T(), err.Error())
-	}
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
 
 	sqltext = `{"email": "customer0@gmail.com", "offer_name": "apple_store", "discount": 54.30, "expiry": "` + tomorrow + `"}`
 	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(sqltext)), suite.srv, suite.srv.GenerateHanlder)
@@ -182,44 +197,213 @@ func (suite *TestSuite) TestGenerateHandler() {
 
 }
 
-func (suite *TestSuite) TestGetValidVouchers() {
-	resp, body := httpTestHelper("GET", "http://vouchers", nil, suite.srv, suite.srv.GetValidVouchers)
-	assert.EqualValues(suite.T(), http.StatusBadRequest, resp.StatusCode)
-	assert.EqualValues(suite.T(), "EOF\n", string(body))
+func (suite *TestSuite) TestGenerateHandlerFixedDiscount() {
+	tomorrow := time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+	for _, tc := range []struct {
+		name    string
+		reqBody string
+		want    string
+	}{
+		{
+			name:    "currency of percentage discount",
+			reqBody: `{"email": "customer0@gmail.com", "offer_name": "koi", "discount": 10, "currency": "EUR", "expiry": "` + tomorrow + `"}`,
+			want:    `{"code":"invalid_request","message":"currency is only allowed for fixed discounts"}`,
+		},
+		{
+			name:    "percentage with more than 2 decimal places",
+			reqBody: `{"email": "customer0@gmail.com", "offer_name": "koi", "discount": 10.005, "expiry": "` + tomorrow + `"}`,
+			want:    `{"code":"invalid_request","message":"discount shall bigger than 0 or less than 100.00"}`,
+		},
+		{
+			name:    "unknown discount type",
+			reqBody: `{"email": "customer0@gmail.com", "offer_name": "koi", "discount": 10, "discount_type": "bogo", "expiry": "` + tomorrow + `"}`,
+			want:    `{"code":"invalid_request","message":"discount_type shall be percentage or fixed"}`,
+		},
+		{
+			name:    "unknown currency",
+			reqBody: `{"email": "customer0@gmail.com", "offer_name": "koi", "discount": 10, "discount_type": "fixed", "currency": "XYZ", "expiry": "` + tomorrow + `"}`,
+			want:    `{"code":"invalid_request","message":"currency shall be a supported ISO 4217 code"}`,
+		},
+		{
+			name:    "amount finer than the minor unit",
+			reqBody: `{"email": "customer0@gmail.com", "offer_name": "koi", "discount": 10.5, "discount_type": "fixed", "currency": "JPY", "expiry": "` + tomorrow + `"}`,
+			want:    `{"code":"invalid_request","message":"discount shall be a positive amount of JPY with at most 0 decimal places"}`,
+		},
+		{
+			name:    "amount not positive",
+			reqBody: `{"email": "customer0@gmail.com", "offer_name": "koi", "discount": 0, "discount_type": "fixed", "currency": "EUR", "expiry": "` + tomorrow + `"}`,
+			want:    `{"code":"invalid_request","message":"discount shall be a positive amount of EUR with at most 2 decimal places"}`,
+		},
+	} {
+		resp, body := httpTestHelper("POST", "http://vouchers/generate", bytes.NewBuffer([]byte(tc.reqBody)), suite.srv, suite.srv.GenerateHanlder)
+		assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode, tc.name)
+		assert.EqualValues(suite.T(), tc.want+"\n", string(body), tc.name)
+	}
 
-	resp, body = httpTestHelper("GET", "http://vouchers", bytes.NewBuffer([]byte(`{"email": "invalid_email", "code": "abc"}`)), suite.srv, suite.srv.GetValidVouchers)
-	assert.EqualValues(suite.T(), http.StatusBadRequest, resp.StatusCode)
-	assert.EqualValues(suite.T(), "mail: missing '@' or angle-addr\n", string(body))
+	// the amount is kept exactly in minor units of the currency and returned on redemption
+	suite.srv.CodeGen = &sequenceCodeGen{codes: []string{"eur", "jpy"}}
+	reqBody := `{"email": "customer0@gmail.com", "offer_name": "koi", "discount": 10.99, "discount_type": "fixed", "currency": "eur", "expiry": "` + tomorrow + `"}`
+	resp, body := httpTestHelper("POST", "http://vouchers/generate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.GenerateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"eur"}`+"\n", string(body))
+	reqBody = `{"email": "customer0@gmail.com", "offer_name": "sushi", "discount": 500, "discount_type": "fixed", "currency": "JPY", "expiry": "` + tomorrow + `"}`
+	resp, _ = httpTestHelper("POST", "http://vouchers/generate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.GenerateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
 
-	// seed to prepare the db test
-	tx, err := suite.srv.DB.BeginTx(suite.srv.Ctx, nil)
-	if err != nil {
-		assert.FailNow(suite.T(), err.Error())
+	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "eur"}`)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"discount":10.99,"discount_type":"fixed","discount_value":"10.99","currency":"EUR","remaining_uses":0}`+"\n", string(body))
+	resp, body = httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "jpy"}`)), suite.srv, suite.srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"discount":500,"discount_type":"fixed","discount_value":"500","currency":"JPY","remaining_uses":0}`+"\n", string(body))
+}
+
+func (suite *TestSuite) TestGenerateHandlerMultiUse() {
+	tomorrow := time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+	generate := func(limits string) (*http.Response, []byte) {
+		reqBody := `{"email": "customer0@gmail.com", "offer_name": "summer", "discount": 25, ` + limits + `, "expiry": "` + tomorrow + `"}`
+		return httpTestHelper("POST", "http://vouchers/generate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.GenerateHanlder)
 	}
-	// insert 2 special_offer records
-	_, err = tx.Exec("INSERT INTO special_offers (name, discount) VALUES ($1, $2)", "apple_store", 38.5)
-	if err != nil {
-		assert.FailNow(suite.T(), err.Error())
+	resp, body := generate(`"max_redemptions": -1`)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"max_redemptions and max_per_customer shall not be negative"}`+"\n", string(body))
+	resp, body = generate(`"max_redemptions": 2, "max_per_customer": 3`)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"max_per_customer shall not be bigger than max_redemptions"}`+"\n", string(body))
+
+	suite.srv.CodeGen = &sequenceCodeGen{codes: []string{"SUMMER25"}}
+	resp, _ = generate(`"max_redemptions": 100, "max_per_customer": 2`)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	resp, body = httpTestHelper("GET", "http://vouchers", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com"}`)), suite.srv, suite.srv.GetValidVouchers)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	assert.EqualValues(suite.T(), `[{"code":"SUMMER25","offer_name":"summer","remaining_uses":2}]`+"\n", string(body))
+
+	validate := func() (*http.Response, []byte) {
+		return httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com", "code": "SUMMER25"}`)), suite.srv, suite.srv.ValidateHanlder)
 	}
-	_, err = tx.Exec("INSERT INTO special_offers (name, discount) VALUES ($1, $2)", "KOI", 76.5)
-	if err != nil {
-		assert.FailNow(suite.T(), err.Error())
+	for _, remaining := range []string{"1", "0"} {
+		resp, body = validate()
+		assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+		assert.EqualValues(suite.T(), `{"discount":25,"discount_type":"percentage","discount_value":"25.00","remaining_uses":`+remaining+`}`+"\n", string(body))
 	}
-	// insert 2 voucher records with same customer ID but different offer ID, only the second one is not redeemed
-	_, err = tx.Exec("INSERT INTO vouchers (code, customer_id, special_offer_id, used_at, expired_at) VALUES ($1, $2, $3, $4, $5)", "abc", 1, 1, time.Date(2021, time.May, 1, 0, 0, 0, 0, time.Local), time.Now().Add(24*time.Hour))
-	if err != nil {
-		assert.FailNow(suite.T(), err.Error())
+	resp, body = validate()
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"customer_limit_reached","message":"customer has reached the redemption limit of this voucher"}`+"\n", string(body))
+}
+
+func (suite *TestSuite) TestGenerateHandlerUnassigned() {
+	tomorrow := time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+	generate := func(fields string) (*http.Response, []byte) {
+		reqBody := `{"offer_name": "summer", "discount": 25, "max_redemptions": 10, ` + fields + `, "expiry": "` + tomorrow + `"}`
+		return httpTestHelper("POST", "http://vouchers/generate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.GenerateHanlder)
 	}
-	_, err = tx.Exec("INSERT INTO vouchers (code, customer_id, special_offer_id, expired_at) VALUES ($1, $2, $3, $4)", "def", 1, 2, time.Now().Add(24*time.Hour))
-	if err != nil {
-		assert.FailNow(suite.T(), err.Error())
+	resp, body := generate(`"assignment": "team"`)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"unknown assignment \"team\""}`+"\n", string(body))
+	resp, body = generate(`"assignment": "public", "email": "customer0@gmail.com"`)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"email shall only be given for vouchers assigned to a customer"}`+"\n", string(body))
+
+	suite.srv.CodeGen = &sequenceCodeGen{codes: []string{"PUBLIC", "CLAIM"}}
+	resp, _ = generate(`"assignment": "public"`)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	resp, _ = generate(`"assignment": "claim"`)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+
+	validate := func(email, code string) (*http.Response, []byte) {
+		reqBody := `{"email": "` + email + `", "code": "` + code + `"}`
+		return httpTestHelper("POST", "http://vouchers/validate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.ValidateHanlder)
 	}
-	err = tx.Commit()
-	if err != nil {
+	for _, email := range []string{"customer0@gmail.com", "customer1@gmail.com"} {
+		resp, _ = validate(email, "PUBLIC")
+		assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	}
+	resp, _ = validate("customer0@gmail.com", "CLAIM")
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	resp, body = validate("customer1@gmail.com", "CLAIM")
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Contains(suite.T(), string(body), `"code":"voucher_not_owned"`)
+}
+
+// sequenceCodeGen generates the given codes in order
+type sequenceCodeGen struct {
+	mu    sync.Mutex
+	codes []string
+}
+
+func (g *sequenceCodeGen) Generate() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	code := g.codes[0]
+	g.codes = g.codes[1:]
+	return code, nil
+}
+
+func (suite *TestSuite) TestGenerateHandlerCodeCollision() {
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
+	tomorrow := time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+	reqBody := `{"email": "customer0@gmail.com", "offer_name": "apple_store", "discount": 54.30, "expiry": "` + tomorrow + `"}`
+
+	// colliding codes are replaced by fresh ones
+	suite.srv.CodeGen = &sequenceCodeGen{codes: []string{"abc", "abc", "xyz"}}
+	resp, body := httpTestHelper("POST", "http://vouchers/generate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.GenerateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"xyz"}`+"\n", string(body))
+
+	// give up after CodeAttempts collisions
+	suite.srv.CodeGen = &sequenceCodeGen{codes: []string{"abc", "xyz", "abc", "xyz"}}
+	suite.srv.CodeAttempts = 3
+	resp, body = httpTestHelper("POST", "http://vouchers/generate", bytes.NewBuffer([]byte(reqBody)), suite.srv, suite.srv.GenerateHanlder)
+	assert.EqualValues(suite.T(), http.StatusConflict, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"code_conflict","message":"voucher code already exists"}`+"\n", string(body))
+}
+
+func (suite *TestSuite) TestGetValidVouchers() {
+	resp, body := httpTestHelper("GET", "http://vouchers", nil, suite.srv, suite.srv.GetValidVouchers)
+	assert.EqualValues(suite.T(), http.StatusBadRequest, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"bad_request","message":"EOF"}`+"\n", string(body))
+
+	resp, body = httpTestHelper("GET", "http://vouchers", bytes.NewBuffer([]byte(`{"email": "invalid_email", "code": "abc"}`)), suite.srv, suite.srv.GetValidVouchers)
+	assert.EqualValues(suite.T(), http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.EqualValues(suite.T(), `{"code":"invalid_request","message":"mail: missing '@' or angle-addr"}`+"\n", string(body))
+
+	// seed to prepare the db test
+	// insert 2 voucher records with same customer but different offer, only the second one is not redeemed
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
+	suite.seedVoucher("customer0@gmail.com", "KOI", dbmodel.PercentageDiscount(7650), "def", time.Now().Add(24*time.Hour))
+	if _, err := suite.srv.Store.RedeemVoucher(suite.srv.Ctx, "customer0@gmail.com", "abc", rules.Order{}); err != nil {
 		assert.FailNow(suite.T(), err.Error())
 	}
 	resp, body = httpTestHelper("GET", "http://vouchers", bytes.NewBuffer([]byte(`{"email": "customer0@gmail.com"}`)), suite.srv, suite.srv.GetValidVouchers)
 	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode)
 	// assert to get second voucher code and offer name
-	assert.EqualValues(suite.T(), `[{"code":"def","offer_name":"KOI"}]`+"\n", string(body))
+	assert.EqualValues(suite.T(), `[{"code":"def","offer_name":"KOI","remaining_uses":1}]`+"\n", string(body))
+}
+
+// cancelledStore fails redemptions with the error of their context, like postgres aborting the statement
+type cancelledStore struct {
+	dbmodel.VoucherStore
+}
+
+func (s cancelledStore) RedeemVoucher(ctx context.Context, email, code string, order rules.Order) (dbmodel.RedeemResult, error) {
+	if err := ctx.Err(); err != nil {
+		return dbmodel.RedeemResult{}, err
+	}
+	return s.VoucherStore.RedeemVoucher(ctx, email, code, order)
+}
+
+func (suite *TestSuite) TestValidateHanlderRequestContext() {
+	suite.seedVoucher("customer0@gmail.com", "apple_store", dbmodel.PercentageDiscount(3850), "abc", time.Now().Add(24*time.Hour))
+	srv := &VoucherSrv{Store: cancelledStore{suite.srv.Store}, Ctx: context.Background()}
+
+	// the request went away, the voucher is not redeemed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("POST", "http://vouchers/validate", strings.NewReader(`{"email": "customer0@gmail.com", "code": "abc"}`)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	srv.ValidateHanlder(w, req)
+	assert.EqualValues(suite.T(), http.StatusInternalServerError, w.Code)
+
+	resp, body := httpTestHelper("POST", "http://vouchers/validate", strings.NewReader(`{"email": "customer0@gmail.com", "code": "abc"}`), srv, srv.ValidateHanlder)
+	assert.EqualValues(suite.T(), http.StatusCreated, resp.StatusCode, string(body))
 }
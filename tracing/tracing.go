@@ -0,0 +1,227 @@
+// Package tracing traces the requests of the voucher service with OpenTelemetry: a span per HTTP request, continuing
+// the trace of the W3C traceparent header of the caller, with a child span per operation of the store.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/ingemar0720/voucher-pool/logging"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// exporters of Config
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+const (
+	serviceName = "voucher-pool"
+	tracerName  = "github.com/ingemar0720/voucher-pool/tracing"
+)
+
+// attributes of the spans of the voucher operations
+var (
+	// OfferIDKey is the offer of the voucher, OfferIDsKey the offers of the vouchers redeemed together
+	OfferIDKey  = attribute.Key("voucher.offer_id")
+	OfferIDsKey = attribute.Key("voucher.offer_ids")
+	// OutcomeKey is redeemed or the error code a redemption is rejected with
+	OutcomeKey   = attribute.Key("voucher.outcome")
+	RequestIDKey = attribute.Key("request_id")
+)
+
+// Config of the traces
+type Config struct {
+	// Exporter of the spans: none, stdout or otlp
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the host:port of the OTLP/HTTP collector, OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318 if empty
+	Endpoint string `yaml:"endpoint"`
+	// Insecure sends the spans to the collector without TLS
+	Insecure bool `yaml:"insecure"`
+	// SampleRatio of the traces started by the service, a trace continued from a caller is sampled like the caller did
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// DefaultConfig exports nothing
+var DefaultConfig = Config{Exporter: ExporterNone, SampleRatio: 1}
+
+func (c Config) Validate() error {
+	switch c.Exporter {
+	case ExporterNone, ExporterStdout, ExporterOTLP:
+	default:
+		return errors.Errorf("exporter shall be none, stdout or otlp, got %q", c.Exporter)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return errors.Errorf("sample ratio shall be in [0, 1], got %v", c.SampleRatio)
+	}
+	return nil
+}
+
+// Tracer starts the spans of the service. The methods of a nil *Tracer trace nothing.
+type Tracer struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// New returns the tracer exporting to the exporter of cfg in batches, nil if the exporter is none
+func New(ctx context.Context, cfg Config) (*Tracer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	var exp sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case ExporterNone:
+		return nil, nil
+	case ExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exp, err = otlptracehttp.New(ctx, opts...)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to create %v exporter", cfg.Exporter)
+	}
+	return newTracer(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio)), sdktrace.WithBatcher(exp)), nil
+}
+
+// NewWithExporter returns a tracer sampling every trace and exporting its spans to exp as soon as they end, like
+// tracetest.InMemoryExporter in tests
+func NewWithExporter(exp sdktrace.SpanExporter) *Tracer {
+	return newTracer(sdktrace.AlwaysSample(), sdktrace.WithSyncer(exp))
+}
+
+func newTracer(sampler sdktrace.Sampler, export sdktrace.TracerProviderOption) *Tracer {
+	provider := sdktrace.NewTracerProvider(
+		export,
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+	return &Tracer{
+		provider:   provider,
+		tracer:     provider.Tracer(tracerName),
+		propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+	}
+}
+
+// Shutdown exports the spans not exported yet, it shall be called once the server stopped
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
+
+// Middleware starts the span of a request, the child of the span of the traceparent header if the caller sent one.
+// The span is named by the chi route pattern once the request is routed, so codes in paths are not recorded. It
+// shall run after middleware.RequestID.
+func (t *Tracer) Middleware(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := t.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := t.tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPMethodKey.String(r.Method), RequestIDKey.String(middleware.GetReqID(ctx))))
+		defer span.End()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		route := "not_found"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(semconv.HTTPRouteKey.String(route), semconv.HTTPStatusCodeKey.Int(status))
+		// client errors are the outcome of the request, not a failure of the service
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// QueryHook starts a span for every operation of dbmodel.PostgresStore, named by the operation like RedeemVoucher
+func (t *Tracer) QueryHook() func(ctx context.Context, op string) (context.Context, func(error)) {
+	return func(ctx context.Context, op string) (context.Context, func(error)) {
+		if t == nil {
+			return ctx, func(error) {}
+		}
+		ctx, span := t.tracer.Start(ctx, op, trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBOperationKey.String(op)))
+		return ctx, func(err error) {
+			if err != nil {
+				recordError(span, err)
+			}
+			span.End()
+		}
+	}
+}
+
+// SetOutcome records the outcome of the voucher operation of the request of ctx on its span
+func SetOutcome(ctx context.Context, outcome string) {
+	trace.SpanFromContext(ctx).SetAttributes(OutcomeKey.String(outcome))
+}
+
+// SetOffers records the offers of the vouchers of the request of ctx on its span, as OfferIDKey for one offer and
+// OfferIDsKey for several
+func SetOffers(ctx context.Context, ids ...uint64) {
+	span := trace.SpanFromContext(ctx)
+	switch len(ids) {
+	case 0:
+	case 1:
+		span.SetAttributes(OfferIDKey.Int64(int64(ids[0])))
+	default:
+		values := make([]int64, len(ids))
+		for i, id := range ids {
+			values[i] = int64(id)
+		}
+		span.SetAttributes(OfferIDsKey.Int64Slice(values))
+	}
+}
+
+// AddEvent marks a step of the request of ctx on its span, to tell the time spent before and after it
+func AddEvent(ctx context.Context, name string) {
+	trace.SpanFromContext(ctx).AddEvent(name)
+}
+
+// RecordError records the error a request failed with on its span
+func RecordError(ctx context.Context, err error) {
+	recordError(trace.SpanFromContext(ctx), err)
+}
+
+// recordError records err like span.RecordError, but redacted like the logs: the messages of wrapped errors hold emails
+// and codes, so the exception and the status only tell the sentinel error or the type of the cause
+func recordError(span trace.Span, err error) {
+	message := logging.Redact(err)
+	span.AddEvent(semconv.ExceptionEventName, trace.WithAttributes(
+		semconv.ExceptionTypeKey.String(fmt.Sprintf("%T", errors.Cause(err))),
+		semconv.ExceptionMessageKey.String(message),
+	))
+	span.SetStatus(codes.Error, message)
+}
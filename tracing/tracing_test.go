@@ -0,0 +1,125 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// attrs returns the attributes of the span by key
+func attrs(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	m := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func serve(tracer *Tracer, req *http.Request, handler http.HandlerFunc) {
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(tracer.Middleware)
+	r.Post("/vouchers/{code}", handler)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestMiddleware(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tracer := NewWithExporter(exp)
+	req := httptest.NewRequest("POST", "http://vouchers/vouchers/ABCDEFGH", nil)
+	req.Header.Set("traceparent", traceparent)
+	req.Header.Set(middleware.RequestIDHeader, "req-1")
+	serve(tracer, req, func(w http.ResponseWriter, r *http.Request) {
+		_, done := tracer.QueryHook()(r.Context(), "RedeemVoucher")
+		done(nil)
+		_, done = tracer.QueryHook()(r.Context(), "QuoteVoucher")
+		done(errors.Wrapf(errors.Errorf("invalid input %q", "ABCDEFGH"), "fail to quote voucher ABCDEFGH"))
+		SetOutcome(r.Context(), "redeemed")
+		SetOffers(r.Context(), 7)
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 3)
+	redeem, quote, server := spans[0], spans[1], spans[2]
+	// the request continues the trace of the caller
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent.SpanID().String())
+	assert.Equal(t, "POST /vouchers/{code}", server.Name)
+	assert.Equal(t, trace.SpanKindServer, server.SpanKind)
+	assert.Equal(t, codes.Unset, server.Status.Code)
+	a := attrs(server)
+	assert.Equal(t, "/vouchers/{code}", a["http.route"].AsString())
+	assert.EqualValues(t, http.StatusCreated, a["http.status_code"].AsInt64())
+	assert.Equal(t, "req-1", a[RequestIDKey].AsString())
+	assert.Equal(t, "redeemed", a[OutcomeKey].AsString())
+	assert.EqualValues(t, 7, a[OfferIDKey].AsInt64())
+
+	// the operations of the store are children of the request
+	assert.Equal(t, "RedeemVoucher", redeem.Name)
+	assert.Equal(t, server.SpanContext.SpanID(), redeem.Parent.SpanID())
+	assert.Equal(t, "postgresql", attrs(redeem)["db.system"].AsString())
+	assert.Equal(t, codes.Unset, redeem.Status.Code)
+	assert.Equal(t, "QuoteVoucher", quote.Name)
+	assert.Equal(t, codes.Error, quote.Status.Code)
+	require.Len(t, quote.Events, 1)
+	// the message of the error holds the code, only the type of its cause is exported
+	assert.Equal(t, "*errors.fundamental", quote.Status.Description)
+	assert.Contains(t, quote.Events[0].Attributes, attribute.String("exception.message", "*errors.fundamental"))
+}
+
+func TestMiddlewareServerError(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tracer := NewWithExporter(exp)
+	serve(tracer, httptest.NewRequest("POST", "http://vouchers/vouchers/ABCDEFGH", nil), func(w http.ResponseWriter, r *http.Request) {
+		SetOffers(r.Context(), 7, 8)
+		RecordError(r.Context(), errors.Wrapf(context.Canceled, "fail to redeem voucher ABCDEFGH"))
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 1)
+	// a new trace is started without traceparent
+	assert.False(t, spans[0].Parent.IsValid())
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+	assert.Equal(t, "exception", spans[0].Events[0].Name)
+	assert.Contains(t, spans[0].Events[0].Attributes, attribute.String("exception.message", "context canceled"))
+	assert.Equal(t, []int64{7, 8}, attrs(spans[0])[OfferIDsKey].AsInt64Slice())
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	handler := http.NotFoundHandler()
+	assert.NotNil(t, tracer.Middleware(handler))
+	ctx, done := tracer.QueryHook()(context.Background(), "RedeemVoucher")
+	done(nil)
+	// nothing is recorded without a span
+	SetOutcome(ctx, "redeemed")
+	assert.False(t, trace.SpanContextFromContext(ctx).IsValid())
+	assert.Nil(t, tracer.Shutdown(ctx))
+}
+
+func TestNew(t *testing.T) {
+	tracer, err := New(context.Background(), DefaultConfig)
+	assert.Nil(t, err)
+	assert.Nil(t, tracer)
+	tracer, err = New(context.Background(), Config{Exporter: ExporterStdout, SampleRatio: 1})
+	require.Nil(t, err)
+	assert.Nil(t, tracer.Shutdown(context.Background()))
+	_, err = New(context.Background(), Config{Exporter: "jaeger"})
+	assert.NotNil(t, err)
+	assert.NotNil(t, Config{Exporter: ExporterOTLP, SampleRatio: -0.5}.Validate())
+}